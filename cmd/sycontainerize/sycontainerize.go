@@ -12,10 +12,13 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gvallee/go_util/pkg/util"
 	"github.com/gvallee/kv/pkg/kv"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/pkg/checker"
+	"github.com/sylabs/singularity-mpi/pkg/container"
 	"github.com/sylabs/singularity-mpi/pkg/containerizer"
 	"github.com/sylabs/singularity-mpi/pkg/launcher"
 	"github.com/sylabs/singularity-mpi/pkg/sy"
@@ -23,12 +26,22 @@ import (
 )
 
 func main() {
+	defer sylog.Flush()
 
 	/* Argument parsing */
 	verbose := flag.Bool("v", false, "Enable verbose mode")
 	debug := flag.Bool("d", false, "Enable debug mode")
 	appContainizer := flag.String("conf", "", "Path to the configuration file for automatically containerization an application")
 	upload := flag.Bool("upload", false, "Upload generated images (appropriate configuration files need to specify the registry's URL")
+	prepareOnly := flag.Bool("prepare-only", false, "Generate the definition file and a build bundle for review, without building the image")
+	executePrepared := flag.String("execute-prepared", "", "Build the image from a bundle previously created with -prepare-only")
+	bundleDigest := flag.String("bundle-digest", "", "Digest of the bundle reported by -prepare-only, required with -execute-prepared")
+	minimalBase := flag.Bool("minimal-base", false, "Base the images on a minimal Linux distribution, without compilers, when nothing is compiled in the image (e.g., with the bind model)")
+	singularityFlags := flag.String("singularity-flags", "", "Global flags passed to singularity before every command, e.g., \"--debug\" or \"-c /etc/singularity/site.conf\"")
+	strictPortability := flag.Bool("strict-portability", false, "Fail when the generated definition file relies on directories of the host, which makes it not portable")
+	repoSnapshot := flag.String("repo-snapshot", "", "Pin the packages of the Linux distribution to a snapshot of its repositories: a point in time, e.g., 20240101T000000Z, or the URL of a snapshot mirror")
+	retryTransient := flag.Int("retry-transient", 0, "Number of times a build is automatically retried when it fails because of a network failure")
+	stateFile := flag.String("state-file", "", "Build the configuration files specified with -conf and as arguments, recording completed builds in the state file so that they are skipped when the command is executed again")
 	noinstall := flag.Bool("noinstall", false, "Keep the MPI installations on the host and the container images in the specified directory (instead of deleting everything once an experiment terminates). Default is '~/.sympi', set SYMPI_INSTALL_DIR to overwrite")
 
 	flag.Parse()
@@ -44,9 +57,18 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	if *executePrepared != "" {
+		log.Println("* Creating container image from build bundle...")
+		err := container.ExecutePrepared(*executePrepared, *bundleDigest)
+		if err != nil {
+			sylog.Fatalf("failed to create container from bundle %s: %s", *executePrepared, err)
+		}
+		return
+	}
+
 	sysCfg, _, _, err := launcher.Load()
 	if err != nil {
-		log.Fatalf("unable to load configuration: %s", err)
+		sylog.Fatalf("unable to load configuration: %s", err)
 
 	}
 
@@ -55,16 +77,26 @@ func main() {
 		sysCfg.Verbose = true
 		err = checker.CheckSystemConfig()
 		if err != nil {
-			log.Fatalf("the system is not correctly setup: %s", err)
+			sylog.Fatalf("the system is not correctly setup: %s", err)
 		}
 	}
 
 	sysCfg.AppContainizer = *appContainizer
 	sysCfg.Upload = *upload
+	sysCfg.PrepareOnly = *prepareOnly
+	sysCfg.MinimalBase = *minimalBase
+	sysCfg.StrictPortability = *strictPortability
+	sysCfg.GlobalSingularityFlags = strings.Fields(*singularityFlags)
+	sysCfg.RetryTransient = *retryTransient
+	sysCfg.RepoSnapshot = *repoSnapshot
 	sysCfg.Verbose = *verbose
 	sysCfg.Debug = *debug
 	if !*noinstall {
 		sysCfg.Persistent = sys.GetSympiDir()
+		err = sys.InitWorkspace(sysCfg.Persistent)
+		if err != nil {
+			sylog.Fatalf("failed to initialize %s: %s", sysCfg.Persistent, err)
+		}
 	}
 
 	// Check if we can figure out any detail about the installation of Singularity
@@ -72,28 +104,41 @@ func main() {
 	// sudo or fakeroot to create an image?
 	sysCfg, err = sy.LookupConfig(&sysCfg)
 	if err != nil {
-		log.Fatalf("failed to get the Singularity configuration: %s", err)
+		sylog.Fatalf("failed to get the Singularity configuration: %s", err)
 	}
 
 	// Make sure the tool's configuration file is set and load its data
 	log.Println("* Loading the tool's configuration...")
 	toolConfigFile, err := sy.CreateMPIConfigFile()
 	if err != nil {
-		log.Fatalf("cannot setup configuration file: %s", err)
+		sylog.Fatalf("cannot setup configuration file: %s", err)
 	}
 	kvs, err := kv.LoadKeyValueConfig(toolConfigFile)
 	if err != nil {
-		log.Fatalf("cannot load the tool's configuration file (%s): %s", toolConfigFile, err)
+		sylog.Fatalf("cannot load the tool's configuration file (%s): %s", toolConfigFile, err)
 	}
 	var syConfig sy.MPIToolConfig
 	syConfig.BuildPrivilege, err = strconv.ParseBool(kv.GetValue(kvs, sy.BuildPrivilegeKey))
 	if err != nil {
-		log.Fatalf("failed to load the tool's configuration: %s", err)
+		sylog.Fatalf("failed to load the tool's configuration: %s", err)
+	}
+
+	if *stateFile != "" {
+		log.Println("* Creating containers...")
+		configs := flag.Args()
+		if *appContainizer != "" {
+			configs = append([]string{*appContainizer}, configs...)
+		}
+		err = containerizer.BuildAllResumable(configs, *stateFile, &sysCfg)
+		if err != nil {
+			sylog.Fatalf("failed to create containers: %s", err)
+		}
+		return
 	}
 
 	log.Println("* Creating container for your application...")
 	_, err = containerizer.ContainerizeApp(&sysCfg)
 	if err != nil {
-		log.Fatalf("failed to create container for app: %s", err)
+		sylog.Fatalf("failed to create container for app: %s", err)
 	}
 }
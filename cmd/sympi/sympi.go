@@ -18,6 +18,7 @@ import (
 
 	"github.com/gvallee/go_util/pkg/util"
 	"github.com/gvallee/kv/pkg/kv"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/internal/pkg/sympierr"
 	"github.com/sylabs/singularity-mpi/pkg/buildenv"
 	"github.com/sylabs/singularity-mpi/pkg/builder"
@@ -123,7 +124,13 @@ func displayInstalled(dir string, filter string) error {
 	}
 
 	if filter == "all" || strings.Contains(filter, "container") {
-		containers, err := getContainerInstalls(entries)
+		// Containers may still be stored at the root of the SyMPI directory by previous versions
+		imagesDir := sys.GetWorkspaceDir(dir, sys.WorkspaceImagesDir)
+		imageEntries, err := ioutil.ReadDir(imagesDir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read %s: %s", imagesDir, err)
+		}
+		containers, err := getContainerInstalls(append(imageEntries, entries...))
 		if err != nil {
 			return fmt.Errorf("unable to get the list of containers stored on the host: %s", err)
 		}
@@ -139,6 +146,20 @@ func displayInstalled(dir string, filter string) error {
 	return nil
 }
 
+func displayWorkspaceInfo(dir string) error {
+	usage, err := sys.WorkspaceInfo(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Disk usage of %s:\n", dir)
+	for _, u := range usage {
+		fmt.Printf("\t%s: %d bytes\n", u.Dir, u.Size)
+	}
+
+	return nil
+}
+
 func getSyDetails(desc string) string {
 	tokens := strings.Split(desc, ":")
 	if len(tokens) != 2 {
@@ -402,17 +423,18 @@ func listAvail(sysCfg *sys.Config) error {
 func importContainerImg(imgPath string, sysCfg *sys.Config) error {
 	// Check the architecture of the container, if does not match, error out
 	arch, err := sy.GetSIFArchs(imgPath, sysCfg)
-	if err != nil {
+	if _, ok := err.(*sympierr.ErrFeatureUnavailable); ok {
+		// Not a fatal error, the image can still be imported
+		fmt.Printf("[WARNING] Unable to check the architecture of %s: %s\n", imgPath, err)
+	} else if err != nil {
 		return fmt.Errorf("failed to extract architecture from %s: %s", imgPath, err)
-	}
-
-	if !sys.CompatibleArch(arch) {
+	} else if !sys.CompatibleArch(arch) {
 		return fmt.Errorf("%s's architecture is incompatible with host", imgPath)
 	}
 
 	// Copy the image in the proper directory under SyMPI
 	imgName := filepath.Base(imgPath)
-	targetDir := filepath.Join(sys.GetSympiDir(), sys.ContainerInstallDirPrefix+strings.Replace(imgName, ".sif", "", -1))
+	targetDir := sys.GetWorkspacePath(sys.GetSympiDir(), sys.WorkspaceImagesDir, sys.ContainerInstallDirPrefix+strings.Replace(imgName, ".sif", "", -1))
 	err = os.MkdirAll(targetDir, 0755)
 	if err != nil {
 		return fmt.Errorf("unable to create %s: %s", targetDir, err)
@@ -428,7 +450,7 @@ func importContainerImg(imgPath string, sysCfg *sys.Config) error {
 
 func exportContainerImg(containerID string) string {
 	// Figure out the path to the image
-	imgStoredPath := filepath.Join(getSyMPIBaseDir(), sys.ContainerInstallDirPrefix+containerID, containerID+".sif")
+	imgStoredPath := filepath.Join(sys.GetWorkspacePath(getSyMPIBaseDir(), sys.WorkspaceImagesDir, sys.ContainerInstallDirPrefix+containerID), containerID+".sif")
 	if !util.FileExists(imgStoredPath) {
 		log.Printf("%s does not exist", imgStoredPath)
 		return ""
@@ -447,6 +469,8 @@ func exportContainerImg(containerID string) string {
 }
 
 func main() {
+	defer sylog.Flush()
+
 	verbose := flag.Bool("v", false, "Enable verbose mode")
 	debug := flag.Bool("d", false, "Enable debug mode")
 	list := flag.Bool("list", false, "List all MPIs and Singularity versions on the host, and all MPI containers. 'singularity', 'mpi' and 'container' can be used as filters.")
@@ -460,6 +484,9 @@ func main() {
 	config := flag.Bool("config", false, "Check and configure the system for SyMPI")
 	importCmd := flag.String("import", "", "Import an existing image into SyMPI, e.g., -import <path/to/image>")
 	export := flag.String("export", "", "Export a container image")
+	cleanBuilds := flag.Bool("clean-builds", false, "Remove the stale build directories left behind by failed builds")
+	migrate := flag.Bool("migrate", false, "Move the images, definition files, manifests and logs stored by previous versions into the layout of the SyMPI directory")
+	workspaceInfo := flag.Bool("workspace-info", false, "Display the disk usage of the SyMPI directory")
 
 	flag.Parse()
 
@@ -507,20 +534,46 @@ func main() {
 				"\t\tgcc gcc-gfortran gcc-c++ make \\ \n")
 			fmt.Printf("On RPM systems, you may also want to run the following commands as root to enable fakeroot:\n\tgrubby --args=\"user_namespace.enable=1\" --update-kernel=\"$(grubby --default-kernel)\" \\ \n" +
 				"\tsudo echo \"user.max_user_namespaces=15000\" >> /etc/sysctl.conf\n")
-			log.Fatalf("System not setup properly: %s", err)
+			sylog.Fatalf("System not setup properly: %s", err)
 		}
 	}
 
 	envFile, err := sympi.GetEnvFile()
 	if err != nil || !util.FileExists(envFile) {
 		fmt.Println("SyMPI is not initialize, please run the 'sympi_init' command first")
-		os.Exit(1)
+		sylog.Exit(1)
 	}
 
 	sympiDir := sys.GetSympiDir()
+	err = sys.InitWorkspace(sympiDir)
+	if err != nil {
+		sylog.Fatalf("failed to initialize %s: %s", sympiDir, err)
+	}
 
 	if *config {
-		os.Exit(0)
+		sylog.Exit(0)
+	}
+
+	if *migrate {
+		err := sys.Migrate(sympiDir)
+		if err != nil {
+			sylog.Fatalf("failed to migrate %s: %s", sympiDir, err)
+		}
+	}
+
+	if *workspaceInfo {
+		err := displayWorkspaceInfo(sympiDir)
+		if err != nil {
+			sylog.Fatalf("failed to get the disk usage of %s: %s", sympiDir, err)
+		}
+	}
+
+	if *cleanBuilds {
+		sysCfg.Persistent = sympiDir
+		err := buildenv.CleanBuildArtifacts(&sysCfg)
+		if err != nil {
+			sylog.Fatalf("failed to clean up build directories: %s", err)
+		}
 	}
 
 	if *list {
@@ -536,12 +589,12 @@ func main() {
 		if re.Match([]byte(*load)) {
 			err := loadSingularity(*load)
 			if err != nil {
-				log.Fatalf("impossible to load Singularity: %s", err)
+				sylog.Fatalf("impossible to load Singularity: %s", err)
 			}
 		} else {
 			err := sympi.LoadMPI(*load)
 			if err != nil {
-				log.Fatalf("impossible to load MPI: %s", err)
+				sylog.Fatalf("impossible to load MPI: %s", err)
 			}
 		}
 	}
@@ -551,15 +604,15 @@ func main() {
 		case "mpi":
 			err := unloadMPI()
 			if err != nil {
-				log.Fatalf("impossible to unload MPI: %s", err)
+				sylog.Fatalf("impossible to unload MPI: %s", err)
 			}
 		case "singularity":
 			err := unloadSingularity()
 			if err != nil {
-				log.Fatalf("impossible to unload Singularity: %s", err)
+				sylog.Fatalf("impossible to unload Singularity: %s", err)
 			}
 		default:
-			log.Fatalf("unload only access the following arguments: mpi, singularity")
+			sylog.Fatalf("unload only access the following arguments: mpi, singularity")
 		}
 	}
 
@@ -574,12 +627,12 @@ func main() {
 			}
 			err := installSingularity(*install, singularityParameters, &sysCfg)
 			if err != nil {
-				log.Fatalf("failed to install Singularity %s: %s", *install, err)
+				sylog.Fatalf("failed to install Singularity %s: %s", *install, err)
 			}
 		} else {
 			err := sympi.InstallMPIonHost(*install, &sysCfg)
 			if err != nil {
-				log.Fatalf("failed to install MPI %s: %s", *install, err)
+				sylog.Fatalf("failed to install MPI %s: %s", *install, err)
 			}
 		}
 	}
@@ -587,7 +640,7 @@ func main() {
 	if *uninstall != "" {
 		err := uninstallMPIfromHost(*uninstall, &sysCfg)
 		if err != nil {
-			log.Fatalf("impossible to uninstall %s: %s", *uninstall, err)
+			sylog.Fatalf("impossible to uninstall %s: %s", *uninstall, err)
 		}
 	}
 
@@ -595,7 +648,7 @@ func main() {
 		err := sympi.RunContainer(*run, nil, &sysCfg)
 		if err != nil {
 			fmt.Printf("Impossible to run container %s: %s\n", *run, err)
-			os.Exit(1)
+			sylog.Exit(1)
 		}
 
 	}
@@ -603,21 +656,21 @@ func main() {
 	if *avail {
 		err := listAvail(&sysCfg)
 		if err != nil {
-			log.Fatalf("impossible to list available software that can be installed")
+			sylog.Fatalf("impossible to list available software that can be installed")
 		}
 	}
 
 	if *importCmd != "" {
 		err := importContainerImg(*importCmd, &sysCfg)
 		if err != nil {
-			log.Fatalf("failed to import container: %s", err)
+			sylog.Fatalf("failed to import container: %s", err)
 		}
 	}
 
 	if *export != "" {
 		imgPath := exportContainerImg(*export)
 		if imgPath == "" {
-			log.Fatalf("failed to export container %s", *export)
+			sylog.Fatalf("failed to export container %s", *export)
 		}
 		fmt.Printf("Container successfully exported: %s\n", imgPath)
 	}
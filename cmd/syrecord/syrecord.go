@@ -0,0 +1,65 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// syrecord runs the integration pipeline against the installed version of Singularity and records
+// the Singularity commands and their output in the transcript replayed by the integration tests.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/integration"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
+	"github.com/sylabs/singularity-mpi/pkg/sympi"
+)
+
+func main() {
+	defer sylog.Flush()
+
+	output := flag.String("output", filepath.Join("internal", "pkg", "integration", "testdata", integration.PipelineTranscript), "Path to the transcript to write")
+	registry := flag.String("registry", "", "Registry where the image is uploaded, e.g., library://user/collection/helloworld:latest (required)")
+	flag.Parse()
+
+	if *registry == "" {
+		sylog.Fatalf("the registry must be specified with -registry")
+	}
+
+	sysCfg := sympi.GetDefaultSysConfig()
+	sysCfg.Registry = *registry
+	if sysCfg.SingularityBin == "" {
+		var err error
+		sysCfg.SingularityBin, err = exec.LookPath("singularity")
+		if err != nil {
+			sylog.Fatalf("singularity is not available: %s", err)
+		}
+	}
+
+	workDir, err := ioutil.TempDir("", "syrecord")
+	if err != nil {
+		sylog.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	recorder := &syexec.RecordingRunner{Runner: &syexec.DefaultRunner{}}
+	container.SetRunner(recorder)
+	_, err = integration.RunPipeline(workDir, &sysCfg)
+	if err != nil {
+		sylog.Fatalf("pipeline failed: %s", err)
+	}
+
+	integration.Anonymize(&recorder.Transcript, workDir, &sysCfg)
+	err = recorder.Transcript.Save(*output)
+	if err != nil {
+		sylog.Fatalf("failed to save transcript: %s", err)
+	}
+	log.Printf("Transcript of %d command(s) saved in %s", len(recorder.Transcript.Steps), *output)
+}
@@ -11,12 +11,15 @@ import (
 	"os"
 
 	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/pkg/sympi"
 )
 
 func main() {
+	defer sylog.Flush()
+
 	if len(os.Args) < 2 {
-		log.Fatalf("%s requires at least one argument, a container name reported by the 'sympi -list' command.", os.Args[0])
+		sylog.Fatalf("%s requires at least one argument, a container name reported by the 'sympi -list' command.", os.Args[0])
 	}
 
 	logFile := util.OpenLogFile("syryun")
@@ -32,6 +35,6 @@ func main() {
 
 	err := sympi.RunContainer(os.Args[len(os.Args)-1], args, &sysCfg)
 	if err != nil {
-		log.Fatalf("impossible to run container %s: %s", os.Args[1], err)
+		sylog.Fatalf("impossible to run container %s: %s", os.Args[1], err)
 	}
 }
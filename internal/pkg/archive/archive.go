@@ -0,0 +1,52 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package archive
+
+import (
+	"path"
+	"strings"
+
+	"github.com/gvallee/go_util/pkg/util"
+)
+
+const (
+	// FormatXZ represents a xz file, e.g., .tar.xz or .txz
+	FormatXZ = "xz"
+)
+
+// extensions are the extensions of the tarballs, longest first so that .tar.gz is removed before .gz
+var extensions = []string{".tar.bz2", ".tar.gz", ".tar.xz", ".tbz2", ".tgz", ".txz", ".tar", ".bz2", ".gz", ".xz"}
+
+// DetectTarballFormat detects the format of a tarball so we can know how to untar it. It extends
+// util.DetectTarballFormat with the formats it does not know about, so the formats of
+// util (util.FormatBZ2, util.FormatGZ, util.FormatTAR and util.UnknownFormat) are also returned.
+func DetectTarballFormat(filepath string) string {
+	switch path.Ext(filepath) {
+	case ".xz", ".txz":
+		return FormatXZ
+	}
+	return util.DetectTarballFormat(filepath)
+}
+
+// TrimExtension returns the name of a tarball without its extension, e.g., NetPIPE-5.1.4 for
+// NetPIPE-5.1.4.tar.gz, which is usually the name of the top directory of the tarball
+func TrimExtension(filename string) string {
+	for _, ext := range extensions {
+		if strings.HasSuffix(filename, ext) {
+			return strings.TrimSuffix(filename, ext)
+		}
+	}
+	return filename
+}
+
+// GetTarArgs returns the arguments of tar to extract a tarball of a given format, an empty
+// string if the format is not supported
+func GetTarArgs(format string) string {
+	if format == FormatXZ {
+		return "-xJf"
+	}
+	return util.GetTarArgs(format)
+}
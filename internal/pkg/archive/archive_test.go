@@ -0,0 +1,43 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package archive
+
+import (
+	"path"
+	"testing"
+
+	"github.com/gvallee/go_util/pkg/util"
+)
+
+func TestDetectTarballFormat(t *testing.T) {
+	tests := []struct {
+		path    string
+		format  string
+		tarArgs string
+		name    string
+	}{
+		{path: "https://download.open-mpi.org/release/open-mpi/v4.1/openmpi-4.1.5.tar.xz", format: FormatXZ, tarArgs: "-xJf", name: "openmpi-4.1.5"},
+		{path: "/tmp/mpich-4.1.txz", format: FormatXZ, tarArgs: "-xJf", name: "mpich-4.1"},
+		{path: "openmpi-4.0.2.tar.bz2", format: util.FormatBZ2, tarArgs: "-xjf", name: "openmpi-4.0.2"},
+		{path: "NetPIPE-5.1.4.tar.gz", format: util.FormatGZ, tarArgs: "-xzf", name: "NetPIPE-5.1.4"},
+		{path: "app.tar", format: util.FormatTAR, tarArgs: "-xf", name: "app"},
+		{path: "/scratch/helloworld", format: util.UnknownFormat, tarArgs: "", name: "helloworld"},
+	}
+	for _, tt := range tests {
+		format := DetectTarballFormat(tt.path)
+		if format != tt.format {
+			t.Fatalf("format of %s is %q instead of %q", tt.path, format, tt.format)
+		}
+		tarArgs := GetTarArgs(format)
+		if tarArgs != tt.tarArgs {
+			t.Fatalf("arguments to extract %s are %q instead of %q", tt.path, tarArgs, tt.tarArgs)
+		}
+		name := TrimExtension(path.Base(tt.path))
+		if name != tt.name {
+			t.Fatalf("name of %s without extension is %q instead of %q", tt.path, name, tt.name)
+		}
+	}
+}
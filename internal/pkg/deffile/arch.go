@@ -0,0 +1,71 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const (
+	// ArchX86_64 is the identifier of the x86_64 architecture
+	ArchX86_64 = "x86_64"
+
+	// ArchAarch64 is the identifier of the aarch64 (arm64) architecture
+	ArchAarch64 = "aarch64"
+
+	// ArchPPC64LE is the identifier of the little-endian ppc64 architecture
+	ArchPPC64LE = "ppc64le"
+)
+
+// goArchs maps the architectures as named by Go to the identifiers of the target architectures of the images
+var goArchs = map[string]string{
+	"amd64":   ArchX86_64,
+	"arm64":   ArchAarch64,
+	"ppc64le": ArchPPC64LE,
+}
+
+// multiarchTriplets are the multiarch triplets of Debian-based distros, i.e., the name of the directory of the
+// libraries in /usr/lib, for each target architecture
+var multiarchTriplets = map[string]string{
+	ArchX86_64:  "x86_64-linux-gnu",
+	ArchAarch64: "aarch64-linux-gnu",
+	ArchPPC64LE: "powerpc64le-linux-gnu",
+}
+
+// getHostArch returns the identifier of the architecture of the host, the name used by Go if not supported
+func getHostArch() string {
+	if arch, ok := goArchs[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+// GetArch returns the target architecture of the image, the architecture of the host by default
+func (d *DefFileData) GetArch() string {
+	if d.Arch != "" {
+		return d.Arch
+	}
+	return getHostArch()
+}
+
+// checkArch checks that images can be generated for an architecture
+func checkArch(arch string) error {
+	if _, ok := multiarchTriplets[arch]; !ok {
+		return fmt.Errorf("unsupported architecture: %s", arch)
+	}
+	return nil
+}
+
+// getMultiarchLibDir returns the directory of the libraries of an architecture on Debian-based distros, an
+// empty string if the architecture is unknown
+func getMultiarchLibDir(arch string) string {
+	triplet, ok := multiarchTriplets[arch]
+	if !ok {
+		return ""
+	}
+	return "/usr/lib/" + triplet
+}
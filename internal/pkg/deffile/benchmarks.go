@@ -0,0 +1,66 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+const (
+	// OSUBenchmarksVersion is the version of the OSU micro-benchmarks installed in images
+	OSUBenchmarksVersion = "5.6.2"
+
+	// OSUBenchmarksURL is the URL of the tarball of the OSU micro-benchmarks installed in images
+	OSUBenchmarksURL = "http://mvapich.cse.ohio-state.edu/download/mvapich/osu-micro-benchmarks-" + OSUBenchmarksVersion + ".tar.gz"
+
+	// osuBenchmarksDirName is the name of the directory where the OSU micro-benchmarks are installed, in the
+	// directory of additional software
+	osuBenchmarksDirName = "osu-micro-benchmarks"
+)
+
+// installBenchmarks checks whether the MPI benchmarks must be installed in the image. Benchmarks are compiled
+// against the MPI of the image so they are only available with the hybrid model.
+func installBenchmarks(deffile *DefFileData) bool {
+	return deffile.InternalEnv != nil && deffile.InternalEnv.InstallBenchmarks && deffile.MpiImplm != nil && deffile.Model != container.BindModel
+}
+
+// getBenchmarksPrefix returns the directory where the OSU micro-benchmarks are installed in the image
+func getBenchmarksPrefix(deffile *DefFileData) string {
+	return deffile.layout().ExtrasRoot + "/" + osuBenchmarksDirName
+}
+
+// GetBenchmarksDir returns the directory of the image where the binaries of the MPI benchmarks are, as
+// recorded in the OSU_Benchmarks label
+func GetBenchmarksDir(deffile *DefFileData) string {
+	return getBenchmarksPrefix(deffile) + "/libexec/osu-micro-benchmarks/mpi"
+}
+
+// addBenchmarksInstall adds to the post section the download and compilation of the OSU micro-benchmarks
+// against the MPI of the image. It must be called after the installation of MPI, the benchmarks are built
+// in the build directory of MPI which is removed at the end of the build.
+func addBenchmarksInstall(f io.Writer, deffile *DefFileData) error {
+	if !installBenchmarks(deffile) {
+		return nil
+	}
+
+	tarball := path.Base(OSUBenchmarksURL)
+	srcDir := "osu-micro-benchmarks-" + OSUBenchmarksVersion
+	content := "\texport OSU_DIR=" + getBenchmarksPrefix(deffile) + "\n" +
+		"\tcd $MPI_BUILDDIR\n" +
+		"\t" + getDownloadCmd(OSUBenchmarksURL, deffile) + "\n" +
+		"\ttar -xzf " + tarball + "\n" +
+		"\tcd $MPI_BUILDDIR/" + srcDir + " && ./configure CC=$MPI_DIR/bin/mpicc CXX=$MPI_DIR/bin/mpicxx --prefix=$OSU_DIR && " + getMakeInstallCmd(deffile) + "\n\n"
+	_, err := io.WriteString(f, content)
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestBenchmarksInstall(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	data.InternalEnv.InstallBenchmarks = true
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+
+	content := readDefFile(t, data.Path)
+	expected := []string{
+		"\t" + container.BenchmarksLabel + " " + DefaultExtrasRoot + "/osu-micro-benchmarks/libexec/osu-micro-benchmarks/mpi\n",
+		"wget -c " + OSUBenchmarksURL + ";",
+		"./configure CC=$MPI_DIR/bin/mpicc CXX=$MPI_DIR/bin/mpicxx --prefix=$OSU_DIR && make -j8 install\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(content, e) {
+			t.Fatalf("definition file does not include %q:\n%s", e, content)
+		}
+	}
+	if strings.Index(content, "--prefix=$OSU_DIR") < strings.Index(content, "--prefix=$MPI_DIR") {
+		t.Fatalf("benchmarks are built before MPI:\n%s", content)
+	}
+
+	// Benchmarks are not installed by default
+	data = getTestDefFileData(tempDir, helloworld.Name)
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if strings.Contains(content, "OSU") {
+		t.Fatalf("benchmarks installed while not requested:\n%s", content)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/checker"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+const (
+	// BuildArgsMinVersion is the first version of Singularity supporting build arguments
+	BuildArgsMinVersion = "4.0"
+
+	// MPIVersionArg is the build argument specifying the version of MPI
+	MPIVersionArg = "MPI_VERSION"
+
+	// MPIURLArg is the build argument specifying the URL to download MPI
+	MPIURLArg = "MPI_URL"
+
+	// MPIChecksumArg is the build argument specifying the checksum of the MPI tarball
+	MPIChecksumArg = "MPI_CHECKSUM"
+
+	// MPITarballSizeArg is the build argument specifying the expected size in bytes of the MPI tarball
+	MPITarballSizeArg = "MPI_TARBALL_SIZE"
+
+	// AppSourceArg is the build argument specifying the URL to download the application
+	AppSourceArg = "APP_SOURCE"
+
+	// AppChecksumArg is the build argument specifying the checksum of the tarball of the application
+	AppChecksumArg = "APP_CHECKSUM"
+)
+
+// useBuildArgs checks whether the definition file uses build arguments instead of literal values.
+// Only the hybrid model downloads MPI and the application in the image so it is the only model using them.
+func (d *DefFileData) useBuildArgs() bool {
+	if !d.BuildArgs || d.Model == container.BindModel {
+		return false
+	}
+	return d.TargetSingularityVersion != "" && checker.CompareVersions(d.TargetSingularityVersion, BuildArgsMinVersion) >= 0
+}
+
+// getValue returns the reference to a build argument when the definition file uses build arguments, the literal value otherwise
+func getValue(d *DefFileData, arg string, literal string) string {
+	if d.useBuildArgs() {
+		return "{{ " + arg + " }}"
+	}
+	return literal
+}
+
+// getTarball returns the name of the tarball downloaded from a URL
+func getTarball(d *DefFileData, arg string, url string) string {
+	if d.useBuildArgs() {
+		return "$(basename " + getValue(d, arg, url) + ")"
+	}
+	return path.Base(url)
+}
+
+// isAppDownloaded checks whether the application is downloaded during the build
+func isAppDownloaded(a *app.Info) bool {
+	urlType := util.DetectURLType(a.Source)
+	return urlType == util.GitURL || urlType == util.HttpURL
+}
+
+// BuildArgs returns the default values of the build arguments of a definition file, nil if the definition file does not use build arguments
+func BuildArgs(a *app.Info, d *DefFileData) map[string]string {
+	if !d.useBuildArgs() {
+		return nil
+	}
+
+	args := make(map[string]string)
+	if d.MpiImplm != nil {
+		args[MPIVersionArg] = d.MpiImplm.Version
+		args[MPIURLArg] = d.MpiImplm.URL
+		if d.MpiImplm.Checksum != "" {
+			args[MPIChecksumArg] = d.MpiImplm.Checksum
+		}
+		if d.MpiImplm.TarballSize > 0 {
+			args[MPITarballSizeArg] = strconv.FormatInt(d.MpiImplm.TarballSize, 10)
+		}
+	}
+	if a != nil && isAppDownloaded(a) {
+		args[AppSourceArg] = a.Source
+		if hasSourceChecksum(a) {
+			args[AppChecksumArg] = a.SourceChecksum
+		}
+	}
+	return args
+}
+
+// addArguments adds the section specifying the default values of the build arguments
+func addArguments(f io.Writer, a *app.Info, d *DefFileData) error {
+	args := BuildArgs(a, d)
+	if len(args) == 0 {
+		return nil
+	}
+
+	var names []string
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	_, err := io.WriteString(f, "%arguments\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	for _, name := range names {
+		_, err = io.WriteString(f, "\t"+name+"="+args[name]+"\n")
+		if err != nil {
+			return fmt.Errorf("failed to write to definition file: %s", err)
+		}
+	}
+	_, err = io.WriteString(f, "\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	return nil
+}
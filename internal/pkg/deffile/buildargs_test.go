@@ -0,0 +1,59 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+)
+
+func TestBuildArgs(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		buildArgs  bool
+		version    string
+		expected   []string
+		unexpected []string
+	}{
+		{buildArgs: false, version: "4.0", expected: []string{"export MPI_VERSION=3.1.4", "tar -xjf openmpi-3.1.4.tar.bz2"}, unexpected: []string{"%arguments", "{{"}},
+		{buildArgs: true, version: "3.5.3", expected: []string{"export MPI_VERSION=3.1.4", "tar -xjf openmpi-3.1.4.tar.bz2"}, unexpected: []string{"%arguments", "{{"}},
+		{buildArgs: true, version: "4.0", expected: []string{"%arguments\n", "MPI_URL=https://download.open-mpi.org/release/open-mpi/v3.1/openmpi-3.1.4.tar.bz2", "MPI_VERSION=3.1.4", "export MPI_VERSION={{ MPI_VERSION }}", "tar -xjf $(basename {{ MPI_URL }})"}},
+	}
+
+	for _, tt := range tests {
+		data := getTestDefFileData(tempDir, "helloworld")
+		data.BuildArgs = tt.buildArgs
+		data.TargetSingularityVersion = tt.version
+
+		err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to create definition file: %s", err)
+		}
+		content := readDefFile(t, data.Path)
+		for _, expected := range tt.expected {
+			if !strings.Contains(content, expected) {
+				t.Fatalf("definition file for Singularity %s does not include %s:\n%s", tt.version, expected, content)
+			}
+		}
+		for _, unexpected := range tt.unexpected {
+			if strings.Contains(content, unexpected) {
+				t.Fatalf("definition file for Singularity %s includes %s:\n%s", tt.version, unexpected, content)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/pkgmap"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+// cmakeBuildDir is the name of the directory, in the application's source directory, where CMake builds the application
+const cmakeBuildDir = "build"
+
+// usesCMake checks whether the application is built with CMake in the image. The build system cannot be
+// detected from the sources when the definition file is created so CMake must be explicitly requested.
+func usesCMake(a *app.Info) bool {
+	return a.InstallCmd == "" && a.BuildSystem == app.BuildSystemCMake
+}
+
+// getCMakePrefix returns the directory where an application built with CMake is installed in the image
+func getCMakePrefix(a *app.Info, data *DefFileData) string {
+	return data.layout().AppRoot + "/" + a.Name
+}
+
+// getCMakeCompilerArgs returns the arguments of cmake selecting the MPI compiler wrappers, nil without MPI
+func getCMakeCompilerArgs(data *DefFileData) []string {
+	if data.MpiImplm == nil {
+		return nil
+	}
+
+	mpiID := data.MpiImplm.ID
+	if mpiID == "" {
+		mpiID = implem.OMPI
+	}
+	var args []string
+	for _, c := range []struct {
+		lang     string
+		variable string
+	}{
+		{app.CompilerC, "CMAKE_C_COMPILER"},
+		{app.CompilerCXX, "CMAKE_CXX_COMPILER"},
+		{app.CompilerFortran, "CMAKE_Fortran_COMPILER"},
+	} {
+		wrapper, err := app.GetCompilerWrapper(mpiID, c.lang)
+		if err != nil {
+			continue
+		}
+		args = append(args, "-D"+c.variable+"="+wrapper)
+	}
+	return args
+}
+
+// getCMakeInstallCmd returns the command building an application with CMake, in a build directory of its
+// sources, and installing it in getCMakePrefix. The arguments of the application are appended to the ones
+// we generate so they can override them.
+func getCMakeInstallCmd(a *app.Info, data *DefFileData) string {
+	args := []string{"-DCMAKE_INSTALL_PREFIX=" + getCMakePrefix(a, data)}
+	args = append(args, getCMakeCompilerArgs(data)...)
+	args = append(args, a.CMakeArgs...)
+	return "mkdir -p " + cmakeBuildDir + " && cd " + cmakeBuildDir + " && cmake " + strings.Join(args, " ") + " .. && " + getMakeInstallCmd(data)
+}
+
+// getAppBuildPackages returns the packages required to build the application in the image
+func getAppBuildPackages(a *app.Info, data *DefFileData) []string {
+	if !usesCMake(a) {
+		return nil
+	}
+	d := getDistroSupport(data.DistroID.Name)
+	if d == nil {
+		return nil
+	}
+	return pkgmap.Resolve(d.packageFormat, []string{pkgmap.CMake})
+}
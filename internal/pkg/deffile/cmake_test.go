@@ -0,0 +1,87 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestCMakeApp(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	netpipe := app.GetNetpipe(&sysCfg)
+	data := getTestDefFileData(tempDir, netpipe.Name)
+	data.Model = container.HybridModel
+	var buf bytes.Buffer
+	err = data.Render(&buf, &netpipe, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to render definition file: %s", err)
+	}
+	if strings.Contains(buf.String(), "cmake") {
+		t.Fatalf("definition file uses cmake while not requested:\n%s", buf.String())
+	}
+
+	tests := []struct {
+		distro   string
+		expected []string
+	}{
+		{
+			distro: "ubuntu:disco",
+			expected: []string{
+				"\tapt install -y cmake\n",
+				"\tcd /opt/$APPDIR && mkdir -p build && cd build && cmake -DCMAKE_INSTALL_PREFIX=/opt/" + netpipe.Name +
+					" -DCMAKE_C_COMPILER=mpicc -DCMAKE_CXX_COMPILER=mpicxx -DCMAKE_Fortran_COMPILER=mpifort -DBUILD_SHARED_LIBS=ON -DCMAKE_BUILD_TYPE=Release .. && make -j" + strconv.Itoa(DefaultBuildJobs) + " install\n",
+				"\tif [ ! -e /opt/" + netpipe.Name + "/bin/NPmpi ]; then",
+				"\tln -sf /opt/" + netpipe.Name + "/bin/NPmpi NPmpi\n",
+			},
+		},
+		{
+			distro:   "centos:8",
+			expected: []string{"\tyum install -y cmake\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		netpipe := app.GetNetpipe(&sysCfg)
+		netpipe.InstallCmd = ""
+		netpipe.BinPath = ""
+		netpipe.BinName = "NPmpi"
+		netpipe.BuildSystem = app.BuildSystemCMake
+		netpipe.CMakeArgs = []string{"-DBUILD_SHARED_LIBS=ON", "-DCMAKE_BUILD_TYPE=Release"}
+		data := getTestDefFileData(tempDir, netpipe.Name)
+		data.Model = container.HybridModel
+		data.DistroID = distro.ParseDescr(tt.distro)
+		buf.Reset()
+		err = data.Render(&buf, &netpipe, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to render definition file: %s", tt.distro, err)
+		}
+		content := buf.String()
+		for _, e := range tt.expected {
+			if !strings.Contains(content, e) {
+				t.Fatalf("%s: definition file does not include %q:\n%s", tt.distro, e, content)
+			}
+		}
+		if strings.Index(content, "install -y cmake") > strings.Index(content, "cmake -D") {
+			t.Fatalf("%s: cmake is installed after being used:\n%s", tt.distro, content)
+		}
+	}
+}
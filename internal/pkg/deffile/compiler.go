@@ -0,0 +1,126 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+// compilerPackages are the packages providing compilers when the package has not the same name than the compiler, per package format
+var compilerPackages = map[string]map[string]string{
+	"clang++":  {debPackageFormat: "clang", rpmPackageFormat: "clang", apkPackageFormat: "clang"},
+	"g++":      {debPackageFormat: "g++", rpmPackageFormat: "gcc-c++", apkPackageFormat: "g++"},
+	"gfortran": {debPackageFormat: "gfortran", rpmPackageFormat: "gcc-gfortran", apkPackageFormat: "gfortran"},
+}
+
+// compilerRegexp is the format of the compilers we accept, i.e., a command name or path without shell metacharacters
+var compilerRegexp = regexp.MustCompile(`^[A-Za-z0-9_./+-]+$`)
+
+// envVarRegexp is the format of the names of environment variables
+var envVarRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// getCompilerWrapper returns the MPI compiler wrapper to use to compile an application
+func getCompilerWrapper(a *app.Info, data *DefFileData) (string, error) {
+	lang, err := app.GetCompilerLanguage(a)
+	if err != nil {
+		return "", err
+	}
+
+	mpiID := implem.OMPI
+	if data.MpiImplm != nil && data.MpiImplm.ID != "" {
+		mpiID = data.MpiImplm.ID
+	}
+	return app.GetCompilerWrapper(mpiID, lang)
+}
+
+// quoteEnvValue quotes the value of an environment variable for a POSIX shell
+func quoteEnvValue(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// addBuildEnv adds the export of the application's build environment, sorted by name
+func addBuildEnv(f io.Writer, a *app.Info) error {
+	var names []string
+	for name := range a.BuildEnv {
+		if !envVarRegexp.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name: %s", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, err := io.WriteString(f, "\texport "+name+"="+quoteEnvValue(a.BuildEnv[name])+"\n")
+		if err != nil {
+			return fmt.Errorf("failed to write to definition file: %s", err)
+		}
+	}
+	return nil
+}
+
+// getCompilers returns the compilers to use to configure MPI, nil if the default compilers must be used
+func getCompilers(deffile *DefFileData) (*buildenv.Compilers, error) {
+	if deffile.InternalEnv == nil {
+		return nil, nil
+	}
+	compilers := &deffile.InternalEnv.Compilers
+	for _, compiler := range []string{compilers.CC, compilers.CXX, compilers.FC} {
+		if compiler != "" && !compilerRegexp.MatchString(compiler) {
+			return nil, fmt.Errorf("invalid compiler: %s", compiler)
+		}
+	}
+	return compilers, nil
+}
+
+// getCompilerPackages returns the packages to install to get the compilers used to configure MPI
+func getCompilerPackages(deffile *DefFileData) ([]string, error) {
+	compilers, err := getCompilers(deffile)
+	if err != nil || compilers == nil {
+		return nil, err
+	}
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d == nil {
+		return nil, fmt.Errorf("unsupported distro: %s", deffile.DistroID.Name)
+	}
+
+	var pkgs []string
+	seen := make(map[string]bool)
+	for _, compiler := range []string{compilers.CC, compilers.CXX, compilers.FC} {
+		if compiler == "" {
+			continue
+		}
+		pkg := filepath.Base(compiler)
+		if p, ok := compilerPackages[pkg]; ok {
+			pkg = p[d.packageFormat]
+		}
+		if !seen[pkg] {
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs, nil
+}
+
+// getConfigureCmd returns the configure command for MPI, setting the compilers when specified
+func getConfigureCmd(deffile *DefFileData) (string, error) {
+	compilers, err := getCompilers(deffile)
+	if err != nil {
+		return "", err
+	}
+	if compilers == nil {
+		return "./configure", nil
+	}
+	return strings.Join(append(compilers.GetEnv(), "./configure"), " "), nil
+}
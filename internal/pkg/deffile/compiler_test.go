@@ -0,0 +1,84 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+func TestAppCompiler(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Single-file Fortran application, the wrapper is selected from the file extension
+	var fortranApp app.Info
+	fortranApp.Name = "fortran"
+	fortranApp.BinPath = "/opt/hello"
+	fortranApp.Source = "file://" + filepath.Join(tempDir, "hello.f90")
+	data := getTestDefFileData(tempDir, "fortran")
+	err = CreateHybridDefFile(&fortranApp, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if !strings.Contains(content, "\tcd /opt/$APPDIR && mpifort -o /opt/hello "+filepath.Join(data.InternalEnv.SrcDir, "hello.f90")+"\n") {
+		t.Fatalf("mpifort is not used to compile a Fortran application:\n%s", content)
+	}
+
+	data.MpiImplm.ID = implem.IMPI
+	if wrapper, _ := getCompilerWrapper(&fortranApp, &data); wrapper != "mpiifort" {
+		t.Fatalf("invalid wrapper for Intel MPI: %s", wrapper)
+	}
+	fortranApp.Compiler = "cobol"
+	_, err = getCompilerWrapper(&fortranApp, &data)
+	if err == nil {
+		t.Fatalf("unsupported compiler was accepted")
+	}
+
+	// Make-based application with a build environment
+	var makeApp app.Info
+	makeApp.Name = "netpipe"
+	makeApp.BinName = "NPmpi"
+	makeApp.Source = "http://netpipe.cs.ksu.edu/download/NetPIPE-5.1.4.tar.gz"
+	makeApp.InstallCmd = "make mpi"
+	makeApp.BuildEnv = map[string]string{
+		"PETSC_DIR": "/opt/petsc",
+		"CFLAGS":    "-O2 -g",
+		"LDFLAGS":   "-L/opt/it's",
+	}
+	data = getTestDefFileData(tempDir, "netpipe")
+	err = CreateHybridDefFile(&makeApp, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	exports := "\texport CFLAGS='-O2 -g'\n\texport LDFLAGS='-L/opt/it'\\''s'\n\texport PETSC_DIR='/opt/petsc'\n"
+	idx := strings.Index(content, exports)
+	if idx == -1 {
+		t.Fatalf("build environment is not correctly exported:\n%s", content)
+	}
+	if idx > strings.Index(content, "&& make mpi") {
+		t.Fatalf("build environment is exported after the compilation:\n%s", content)
+	}
+
+	makeApp.BuildEnv = map[string]string{"BAD NAME": "value"}
+	err = CreateHybridDefFile(&makeApp, &data, &sysCfg)
+	if err == nil {
+		t.Fatalf("invalid environment variable name was accepted")
+	}
+}
@@ -6,17 +6,24 @@
 package deffile
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/internal/pkg/archive"
 	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
 	"github.com/sylabs/singularity-mpi/internal/pkg/ldd"
+	"github.com/sylabs/singularity-mpi/internal/pkg/pkgmap"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/pkg/app"
 	"github.com/sylabs/singularity-mpi/pkg/buildenv"
 	"github.com/sylabs/singularity-mpi/pkg/container"
@@ -26,8 +33,63 @@ import (
 
 const (
 	distroCodenameTag = "DISTROCODENAME"
+
+	// XPMEMTransport is the identifier of the xpmem shared-memory transport
+	XPMEMTransport = "xpmem"
+
+	// KNEMTransport is the identifier of the knem shared-memory transport
+	KNEMTransport = "knem"
+
+	// LicenseLabel is the label recording the path to the license of the application in the image
+	LicenseLabel = "License"
+
+	// ReadmeLabel is the label recording the path to the README of the application in the image
+	ReadmeLabel = "Readme"
+
+	// DefaultDownloadRetries is the default number of attempts to download a file during the build
+	DefaultDownloadRetries = 3
+
+	// DefaultDownloadRetryDelay is the default delay in seconds between two download attempts
+	DefaultDownloadRetryDelay = 10
+
+	// DefaultBuildJobs is the default number of parallel jobs used to compile MPI in the image
+	DefaultBuildJobs = 8
+
+	// BuildJobsAuto is the number of parallel jobs specifying that the number of CPUs of the machine
+	// building the image is used
+	BuildJobsAuto = -1
+
+	// rocmRepoURL is the URL of AMD's repository for ROCm packages
+	rocmRepoURL = "https://repo.radeon.com/rocm"
+
+	// rocmKeyring is the keyring that only holds the key of AMD's repository, referenced by the APT source of ROCm
+	rocmKeyring = "/etc/apt/keyrings/rocm.gpg"
+
+	// sharedMemPrefix is the prefix where the userspace shared-memory packages install their files
+	sharedMemPrefix = "/usr"
 )
 
+// sharedMemDebianPackages are the userspace packages required by the shared-memory transports on Debian-based distros
+var sharedMemDebianPackages = map[string][]string{
+	XPMEMTransport: {"libxpmem-dev"},
+	KNEMTransport:  {"knem"},
+}
+
+// sharedMemRPMPackages are the userspace packages required by the shared-memory transports on RPM-based distros
+var sharedMemRPMPackages = map[string][]string{
+	XPMEMTransport: {"xpmem-devel"},
+	KNEMTransport:  {"knem"},
+}
+
+// gitRefRegexp is the format of the branches, tags and commits of Git repositories
+var gitRefRegexp = regexp.MustCompile(`^[A-Za-z0-9_./+-]+$`)
+
+// gitCommitRegexp is the format of the (abbreviated) hashes of Git commits
+var gitCommitRegexp = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// appDirRegexp is the format of the names of the directories of the applications' sources
+var appDirRegexp = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+
 // TemplateTags gathers all the data related to a given template
 type TemplateTags struct {
 	// Verion is the version of the MPI implementation tag
@@ -51,6 +113,10 @@ type DefFileData struct {
 	// Path is the path to the definition file
 	Path string
 
+	// DestPath is the path where the definition file generated from the template at Path is written, so that
+	// several definition files can be generated from the same template; the template is updated in place if not set
+	DestPath string
+
 	// DistroID is the linux distribution identifier to be used in the definition file
 	DistroID distro.ID
 
@@ -65,78 +131,376 @@ type DefFileData struct {
 
 	// Model specifies the model to follow for MPI inside the container
 	Model string
+
+	// SharedMemTransports is the list of shared-memory transports (xpmem, knem) to setup in the image
+	SharedMemTransports []string
+
+	// ExtraTags are site-specific tags (e.g., internal repository hostname) substituted in templates after the built-in tags
+	ExtraTags map[string]string
+
+	// RedactExtraTags specifies whether the values of the extra tags are hidden in the definition file's header
+	RedactExtraTags bool
+
+	// DownloadRetries is the number of attempts to download a file during the build (DefaultDownloadRetries if not set)
+	DownloadRetries int
+
+	// BuildArgs specifies whether the definition file uses build arguments for the versions and URLs of MPI and the application,
+	// so that the same definition file can be used for different versions. Ignored when TargetSingularityVersion does not support them.
+	BuildArgs bool
+
+	// TargetSingularityVersion is the version of Singularity that will be used to build the image
+	TargetSingularityVersion string
+
+	// DownloadRetryDelay is the delay in seconds between two download attempts (DefaultDownloadRetryDelay if not set)
+	DownloadRetryDelay int
+
+	// User is the default user of the container, created during the build and used by the runscript when the container is started as root (optional)
+	User string
+
+	// Group is the group of the default user of the container; a group with the same name than the user is used if not set
+	Group string
+
+	// BaseImage is the path to a local image the new image is layered onto (localimage bootstrap); the distro's bootstrap is used if not set
+	BaseImage string
+
+	// OldMPIDir is the directory of a MPI installation present in BaseImage, removed before installing MPI (optional)
+	OldMPIDir string
+
+	// Layout is the set of well-known paths used in the image; default paths are used for the fields that are not set
+	Layout ImageLayout
+
+	// HealthCheck is the command checking that the container is ready, recorded in the HealthCheck label (optional)
+	HealthCheck string
+
+	// Interconnect is the interconnect the image is tuned for, recorded in the Interconnect label (optional)
+	Interconnect string
+
+	// MPIWrapper specifies whether a wrapper setting up the MPI environment and starting the application is
+	// generated in the application directory and used as the application's executable
+	MPIWrapper bool
+
+	// StageLargeFiles specifies whether the directories larger than StageThreshold are bound at build time and
+	// copied in the post section instead of being staged by %files. Ignored when TargetSingularityVersion does not
+	// support binds at build time; the binds to use are returned by BuildBinds.
+	StageLargeFiles bool
+
+	// StageThreshold is the size in bytes above which a directory is staged (DefaultStageThreshold if not set)
+	StageThreshold int64
+
+	// StageInclude are the patterns, relative to the staged directories, of the files to copy into the image;
+	// the whole directories are copied if empty
+	StageInclude []string
+
+	// EnvVars are the environment variables set in the image, overriding the defaults of the MPI implementation
+	EnvVars map[string]string
+
+	// BuildJobs is the number of parallel jobs used to compile MPI in the image (DefaultBuildJobs if not set),
+	// BuildJobsAuto uses the number of CPUs of the machine building the image
+	BuildJobs int
+
+	// Mirrors are the URLs of the mirrors of the Linux distribution, in order of preference (optional). The first
+	// one is used to bootstrap the image; when several are set, the first available one is used to setup the
+	// packages in the post section.
+	Mirrors []string
+
+	// Runscript is the body of the runscript section, replacing the default one starting the application (optional)
+	Runscript string
+
+	// Provenance specifies whether the host where the image is built and the versions of the compilers
+	// installed in the image are recorded in the labels of the image
+	Provenance bool
+
+	// EnableTest specifies whether the %test section checks the installation of MPI (hybrid model) and the
+	// application's executable, so that broken images are detected at build time
+	EnableTest bool
+
+	// AppTest specifies whether the %test section runs the test suite of the application (TestCmd of the
+	// application), so that the build fails when the tests of the application fail
+	AppTest bool
+
+	// LaunchInfo specifies whether the recommended command to launch MPI images is recorded in the
+	// Launch_command label and in the launch-info file of the application root
+	LaunchInfo bool
+
+	// ExtraPkgs are site-specific packages of the Linux distribution installed in the image, e.g., numactl (optional)
+	ExtraPkgs []string
+
+	// MPIMountPoint specifies whether the directory of MPI is created before installing MPI in hybrid images, so
+	// that the images can later be executed with the MPI of the host bound over the MPI of the image
+	MPIMountPoint bool
+
+	// NoAppSymlink specifies whether the symlink to the application's binary is not created in the application
+	// root, e.g., for applications with several binaries. The path to the binary of the application must then be
+	// specified for its executable to be known.
+	NoAppSymlink bool
+
+	// Arch is the target architecture of the image, e.g., ArchX86_64 or ArchAarch64; the architecture of the host
+	// if not set. The binaries copied into the image with the bind model are the ones of the host so both must match.
+	Arch string
+
+	// packages are the packages installed in the image, recorded while generating the definition file
+	packages []string
 }
 
 func setMPIInstallDir(mpiImplm string, mpiVersion string) string {
 	return mpiImplm + "-" + mpiVersion
 }
 
+// label is a label of the image
+type label struct {
+	name  string
+	value string
+}
+
+// getLabels returns the labels of the image, in the order they appear in the definition file
+func getLabels(app *app.Info, deffile *DefFileData) []label {
+	labels := []label{
+		{container.MetadataFormatLabel, strconv.Itoa(container.MetadataFormat)},
+		{"Linux_distribution", deffile.DistroID.Name},
+		{"Linux_version", deffile.DistroID.Version},
+	}
+
+	if deffile.MpiImplm != nil {
+		labels = append(labels, label{"MPI_Implementation", deffile.MpiImplm.ID})
+		labels = append(labels, label{"MPI_Version", getValue(deffile, MPIVersionArg, deffile.MpiImplm.Version)})
+		if deffile.MpiImplm.WithROCm {
+			labels = append(labels, label{"ROCm", "true"})
+		}
+		if deffile.MpiImplm.Device != "" {
+			labels = append(labels, label{container.MPIDeviceLabel, deffile.MpiImplm.Device})
+		}
+	}
+
+	if deffile.layout().MPIPrefix != "" {
+		labels = append(labels, label{"MPI_Directory", deffile.layout().MPIPrefix})
+	}
+
+	if deffile.Model != "" {
+		labels = append(labels, label{"Model", deffile.Model})
+	}
+
+	labels = append(labels, label{"Application", app.Name})
+
+	// When dealing with the bind model, we explicitly copy the binary in the application directory.
+	// When dealing with the hybrid model, we do not really know the path to the executable
+	// so we rely on the data in the app.Config structure (from user input)
+	if deffile.Model != container.BindModel && app.BinPath == "" {
+		app.BinPath = deffile.layout().AppRoot + "/" + app.BinName
+	}
+	labels = append(labels, label{"App_exe", getAppExe(app, deffile)})
+
+	if hasLaunchInfo(deffile) {
+		labels = append(labels, label{container.LaunchCommandLabel, getLaunchCommand(app, deffile)})
+	}
+
+	if deffile.HealthCheck != "" {
+		labels = append(labels, label{container.HealthCheckLabel, deffile.HealthCheck})
+	}
+
+	if deffile.Interconnect != "" {
+		labels = append(labels, label{container.InterconnectLabel, deffile.Interconnect})
+	}
+
+	if installBenchmarks(deffile) {
+		labels = append(labels, label{container.BenchmarksLabel, GetBenchmarksDir(deffile)})
+	}
+
+	for _, doc := range getDocFiles(app) {
+		labels = append(labels, label{doc.label, getDocFilePath(doc.path, deffile)})
+	}
+
+	if deffile.Provenance {
+		labels = append(labels, getHostProvenanceLabels()...)
+	}
+
+	return labels
+}
+
 // addLabels adds a set of labels to the definition file.
-func addLabels(f *os.File, app *app.Info, deffile *DefFileData) error {
-	_, err := f.WriteString("%labels\n")
+func addLabels(f io.Writer, app *app.Info, deffile *DefFileData) error {
+	content := "%labels\n"
+	for _, l := range getLabels(app, deffile) {
+		content += "\t" + l.name + " " + l.value + "\n"
+	}
+
+	_, err := io.WriteString(f, content+"\n")
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteString("\tLinux_distribution " + deffile.DistroID.Name + "\n")
+	return nil
+}
+
+// GetImageContent returns the labels, the environment and the packages of the image described by a definition
+// file created with Create, so that they can be reviewed without parsing the definition file. The labels
+// recording the versions of the compilers are only known once the image is built and are not included.
+func GetImageContent(app *app.Info, deffile *DefFileData) container.ImageContent {
+	var content container.ImageContent
+
+	content.Labels = make(map[string]string)
+	for _, l := range getLabels(app, deffile) {
+		content.Labels[l.name] = l.value
+	}
+	// Basic images do not set the environment of MPI
+	if deffile.Model != "" {
+		content.Environment = getImageEnv(deffile)
+	}
+	content.Dependencies = deffile.packages
+
+	return content
+}
+
+func addDockerBootstrap(f io.Writer, deffile *DefFileData) error {
+	_, err := io.WriteString(f, "Bootstrap: docker\nFrom: "+deffile.DistroID.Name+"\n\n")
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
 	}
 
-	_, err = f.WriteString("\tLinux_version " + deffile.DistroID.Version + "\n")
+	return nil
+}
+
+func addYumBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	mirror, err := getBootstrapMirror(deffile, sysCfg, getDefaultCentosMirror(deffile), nil)
 	if err != nil {
 		return err
 	}
+	_, err = io.WriteString(f, "Bootstrap: yum\nOSVersion: "+deffile.DistroID.Version+"\nMirrorURL: "+mirror+"\nInclude: yum\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
+	}
 
-	if deffile.MpiImplm != nil {
-		_, err = f.WriteString("\tMPI_Implementation " + deffile.MpiImplm.ID + "\n")
-		if err != nil {
-			return err
-		}
-		_, err = f.WriteString("\tMPI_Version " + deffile.MpiImplm.Version + "\n")
-		if err != nil {
-			return err
-		}
+	return nil
+}
+
+func addDebootstrapBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	mirror, err := getBootstrapMirror(deffile, sysCfg, getDefaultUbuntuMirror(deffile), getUbuntuSnapshotMirror)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "Bootstrap: debootstrap\nOSVersion: "+deffile.DistroID.Codename+"\nMirrorURL: "+mirror+"\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
 	}
 
-	if deffile.InternalEnv != nil && deffile.InternalEnv.InstallDir != "" {
-		_, err = f.WriteString("\tMPI_Directory " + deffile.InternalEnv.InstallDir + "\n")
-		if err != nil {
-			return err
-		}
+	return nil
+}
+
+// addUbuntuBootstrap adds the bootstrap section for Ubuntu
+func addUbuntuBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	return addDebootstrapBootstrap(f, deffile, sysCfg)
+}
+
+// addCentosBootstrap adds the bootstrap section for CentOS
+func addCentosBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	if !sysCfg.Nopriv {
+		return addYumBootstrap(f, deffile, sysCfg)
 	}
+	return addDockerBootstrap(f, deffile)
+}
 
-	if deffile.Model != "" {
-		_, err = f.WriteString("\tModel " + deffile.Model + "\n")
-		if err != nil {
-			return err
-		}
+// addDockerImageBootstrap adds the bootstrap section based on an official Docker image of a Linux distribution
+func addDockerImageBootstrap(f io.Writer, image string, deffile *DefFileData) error {
+	_, err := io.WriteString(f, "Bootstrap: docker\nFrom: "+image+":"+deffile.DistroID.Version+"\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
 	}
 
-	_, err = f.WriteString("\tApplication " + app.Name + "\n")
+	return nil
+}
+
+// addFedoraBootstrap adds the bootstrap section for Fedora, based on the official Docker images
+func addFedoraBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	return addDockerImageBootstrap(f, "fedora", deffile)
+}
+
+// addRockyBootstrap adds the bootstrap section for Rocky Linux, based on the official Docker images
+func addRockyBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	return addDockerImageBootstrap(f, "rockylinux", deffile)
+}
+
+// addAlmaLinuxBootstrap adds the bootstrap section for AlmaLinux, based on the official Docker images
+func addAlmaLinuxBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	return addDockerImageBootstrap(f, "almalinux", deffile)
+}
+
+// addAlpineBootstrap adds the bootstrap section for Alpine Linux, based on the official Docker images
+func addAlpineBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	return addDockerImageBootstrap(f, "alpine", deffile)
+}
+
+// addOpenSUSEBootstrap adds the bootstrap section for openSUSE Leap, based on the official Docker images
+func addOpenSUSEBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	return addDockerImageBootstrap(f, "opensuse/leap", deffile)
+}
+
+// addUbuntuInit adds the code initializing Ubuntu
+func addUbuntuInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tapt-get update && apt-get install -y dash wget git bash gcc gfortran g++ make file software-properties-common\n\n")
 	if err != nil {
 		return err
 	}
 
-	if deffile.Model == container.BindModel {
-		// When dealing with the bind model, we explicitly copy the binary in /opt
-		_, err = f.WriteString("\tApp_exe /opt/" + app.BinName + "\n")
-		if err != nil {
-			return err
-		}
-	} else {
-		// When dealing with the hybrid model, we do not really know the path to the executable
-		// so we rely on the data in the app.Config structure (from user input)
-		if app.BinPath == "" {
-			app.BinPath = "/opt/" + app.BinName
-		}
-		_, err = f.WriteString("\tApp_exe " + app.BinPath + "\n")
+	_, err = io.WriteString(f, "\tadd-apt-repository universe\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ubuntu initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\tadd-apt-repository multiverse\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ubuntu initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\tapt-get update\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ubuntu initialization code to definition file: %s", err)
+	}
+
+	return nil
+}
+
+// addUbuntuMinimalInit adds the code initializing a minimal Ubuntu, with only the runtime dependencies
+func addUbuntuMinimalInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tapt-get update && apt-get install -y --no-install-recommends dash bash wget ca-certificates file\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ubuntu initialization code to definition file: %s", err)
+	}
+	return nil
+}
+
+// addCentosInit adds the code initializing CentOS
+func addCentosInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	// We use yum only if we are not in the fakeroot case, i.e., nopriv case
+	if !sysCfg.Nopriv {
+		_, err := io.WriteString(f, "\trpm --rebuilddb\n")
 		if err != nil {
 			return err
 		}
 	}
+	_, err := io.WriteString(f, "\tyum -y update\n")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "\tyum -y install bash wget tar bzip2 git make gcc gcc-c++ gcc-gfortran\n")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "\tyum clean all\n\n")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
 
-	_, err = f.WriteString("\n")
+// addDnfInit adds the code initializing the distros based on dnf: Fedora, Rocky Linux and AlmaLinux
+func addDnfInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tdnf -y update\n")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "\tdnf -y install bash wget tar bzip2 file git make gcc gcc-c++ gcc-gfortran\n")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "\tdnf clean all\n\n")
 	if err != nil {
 		return err
 	}
@@ -144,140 +508,261 @@ func addLabels(f *os.File, app *app.Info, deffile *DefFileData) error {
 	return nil
 }
 
-func addDockerBootstrap(f *os.File, deffile *DefFileData) error {
-	_, err := f.WriteString("Bootstrap: docker\nFrom: " + deffile.DistroID.Name + "\n\n")
+// addAlpineInit adds the code initializing Alpine Linux. Alpine is based on musl and busybox so bash and GNU tar
+// are installed in addition to the toolchain.
+func addAlpineInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tapk update\n\tapk add --no-cache bash tar file build-base wget git gfortran linux-headers\n\n")
 	if err != nil {
-		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
+		return fmt.Errorf("failed to add alpine initialization code to definition file: %s", err)
 	}
 
 	return nil
 }
 
-func addYumBootstrap(f *os.File, deffile *DefFileData) error {
-	_, err := f.WriteString("Bootstrap: yum\nOSVersion: " + deffile.DistroID.Version + "\nMirrorURL: http://mirror.centos.org/centos-%{OSVERSION}/%{OSVERSION}/os/$basearch/\nInclude: yum\n\n")
+// addZypperInit adds the code initializing openSUSE
+func addZypperInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tzypper --non-interactive refresh\n")
 	if err != nil {
-		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
+		return fmt.Errorf("failed to add opensuse initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\tzypper --non-interactive install bash wget tar gzip bzip2 file git make gcc gcc-c++ gcc-fortran\n")
+	if err != nil {
+		return fmt.Errorf("failed to add opensuse initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\tzypper clean --all\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add opensuse initialization code to definition file: %s", err)
 	}
 
 	return nil
 }
 
-func addDebootstrapBootstrap(f *os.File, deffile *DefFileData) error {
-	// todo: do not hardcode the mirror URL
-	_, err := f.WriteString("Bootstrap: debootstrap\nOSVersion: " + deffile.DistroID.Codename + "\nMirrorURL: http://us.archive.ubuntu.com/ubuntu/\n\n")
+// addUbuntuROCmInit adds the code installing ROCm on Ubuntu. The key of the repository is stored in its own keyring
+// and only trusted for the ROCm repository, instead of being added to the global keyring with the deprecated apt-key.
+func addUbuntuROCmInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tapt-get install -y gnupg\n\tmkdir -p "+filepath.Dir(rocmKeyring)+"\n\twget -q -O - "+rocmRepoURL+"/rocm.gpg.key | gpg --dearmor > "+rocmKeyring+"\n")
 	if err != nil {
-		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
+		return fmt.Errorf("failed to add ROCm initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\techo 'deb [arch=amd64 signed-by="+rocmKeyring+"] "+rocmRepoURL+"/apt/debian/ "+deffile.DistroID.Codename+" main' > /etc/apt/sources.list.d/rocm.list\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ROCm initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\tapt-get update && apt-get install -y rocm-dev\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ROCm initialization code to definition file: %s", err)
+	}
+
+	return nil
+}
+
+// addCentosROCmInit adds the code installing ROCm on CentOS
+func addCentosROCmInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tprintf '[ROCm]\\nname=ROCm\\nbaseurl="+rocmRepoURL+"/yum/rpm\\nenabled=1\\ngpgcheck=1\\ngpgkey="+rocmRepoURL+"/rocm.gpg.key\\n' > /etc/yum.repos.d/rocm.repo\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ROCm initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\tyum install -y rocm-dev\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ROCm initialization code to definition file: %s", err)
+	}
+
+	return nil
+}
+
+// addDnfROCmInit adds the code installing ROCm on the distros based on dnf
+func addDnfROCmInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "\tprintf '[ROCm]\\nname=ROCm\\nbaseurl="+rocmRepoURL+"/yum/rpm\\nenabled=1\\ngpgcheck=1\\ngpgkey="+rocmRepoURL+"/rocm.gpg.key\\n' > /etc/yum.repos.d/rocm.repo\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ROCm initialization code to definition file: %s", err)
+	}
+	_, err = io.WriteString(f, "\tdnf install -y rocm-dev\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add ROCm initialization code to definition file: %s", err)
 	}
 
 	return nil
 }
 
-func addDistroInit(f *os.File, deffile *DefFileData, sysCfg *sys.Config) error {
-	_, err := f.WriteString("%post\n")
+func addDistroInit(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "%post\n")
 	if err != nil {
 		return err
 	}
 
-	switch deffile.DistroID.Name {
-	case "ubuntu":
-		_, err := f.WriteString("\tapt-get update && apt-get install -y dash wget git bash gcc gfortran g++ make file software-properties-common\n\n")
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d == nil {
+		return nil
+	}
+	err = addMirrorFailover(f, deffile, d, sysCfg)
+	if err != nil {
+		return err
+	}
+	if sysCfg.MinimalBase && d.minimalInit != nil {
+		// Nothing is compiled in the image so the compilers are not installed
+		err = d.minimalInit(f, deffile, sysCfg)
 		if err != nil {
 			return err
 		}
-
-		_, err = f.WriteString("\tadd-apt-repository universe\n")
-		if err != nil {
-			return fmt.Errorf("failed to add ubuntu initialization code to definition file: %s", err)
-		}
-		_, err = f.WriteString("\tadd-apt-repository multiverse\n")
-		if err != nil {
-			return fmt.Errorf("failed to add ubuntu initialization code to definition file: %s", err)
-		}
-		_, err = f.WriteString("\tapt-get update\n\n")
-		if err != nil {
-			return fmt.Errorf("failed to add ubuntu initialization code to definition file: %s", err)
-		}
-	case "centos":
-		// We use yum only if we are not in the fakeroot case, i.e., nopriv case
-		if !sysCfg.Nopriv {
-			_, err := f.WriteString("\trpm --rebuilddb\n")
-			if err != nil {
-				return err
-			}
+	} else {
+		if sysCfg.MinimalBase {
+			sylog.Warn("no minimal base is available for %s, using the default one", deffile.DistroID.Name)
 		}
-		_, err = f.WriteString("\tyum -y update\n")
+		err = d.init(f, deffile, sysCfg)
 		if err != nil {
 			return err
 		}
-		_, err = f.WriteString("\tyum -y install bash wget tar bzip2 git make gcc gcc-c++ gcc-gfortran\n")
+
+		pkgs, err := getCompilerPackages(deffile)
 		if err != nil {
 			return err
 		}
-		_, err = f.WriteString("\tyum clean all\n\n")
+		err = addPackages(f, deffile, pkgs)
 		if err != nil {
 			return err
 		}
 	}
 
+	if deffile.MpiImplm != nil && deffile.MpiImplm.WithROCm {
+		if d.rocmInit == nil {
+			return fmt.Errorf("ROCm is not supported on %s", deffile.DistroID.Name)
+		}
+		return d.rocmInit(f, deffile, sysCfg)
+	}
+
 	return nil
 }
 
 // AddBoostrap adds all the data to the definition file related to bootstrapping
-func AddBootstrap(f *os.File, deffile *DefFileData, sysCfg *sys.Config) error {
-	libraryURL := distro.GetBaseImageLibraryURL(deffile.DistroID, sysCfg)
-	if libraryURL != "" {
-		_, err := f.WriteString("Bootstrap: library\nFrom: " + libraryURL + "\n\n")
+func AddBootstrap(f io.Writer, deffile *DefFileData, sysCfg *sys.Config) error {
+	if deffile.BaseImage != "" {
+		_, err := io.WriteString(f, "Bootstrap: localimage\nFrom: "+deffile.BaseImage+"\n\n")
 		if err != nil {
 			return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
 		}
 		return nil
-	} else {
-		switch deffile.DistroID.Name {
-		case "ubuntu":
-			return addDebootstrapBootstrap(f, deffile)
-		case "centos":
-			if !sysCfg.Nopriv {
-				return addYumBootstrap(f, deffile)
-			} else {
-				return addDockerBootstrap(f, deffile)
-			}
-		default:
-			return fmt.Errorf("unsupported distro: %s", deffile.DistroID.Name)
+	}
+
+	libraryURL := distro.GetBaseImageLibraryURL(deffile.DistroID, deffile.GetArch(), sysCfg)
+	if libraryURL != "" {
+		_, err := io.WriteString(f, "Bootstrap: library\nFrom: "+libraryURL+"\n\n")
+		if err != nil {
+			return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
 		}
+		return nil
+	}
+
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d == nil {
+		return fmt.Errorf("unsupported distro: %s", deffile.DistroID.Name)
+	}
+	return d.bootstrap(f, deffile, sysCfg)
+}
+
+// addOldMPIRemoval adds the removal of the MPI installation of the base image when layering onto a local image
+func addOldMPIRemoval(f io.Writer, deffile *DefFileData) error {
+	if deffile.BaseImage == "" || deffile.OldMPIDir == "" {
+		return nil
+	}
+
+	// Be conservative since the directory is recursively removed
+	dir := path.Clean(deffile.OldMPIDir)
+	if !path.IsAbs(dir) || dir == "/" {
+		return fmt.Errorf("invalid directory of the previous MPI installation: %s", deffile.OldMPIDir)
 	}
+
+	_, err := io.WriteString(f, "\texport OLD_MPI_DIR="+dir+"\n\trm -rf $OLD_MPI_DIR\n")
+	return err
 }
 
 // AddMPIInstall adds all the data to the definition file related to the installation of MPI
-func AddMPIInstall(f *os.File, deffile *DefFileData) error {
-	_, err := f.WriteString("\texport MPI_VERSION=" + deffile.MpiImplm.Version + "\n\texport MPI_URL=\"" + deffile.MpiImplm.URL + "\"\n")
+func AddMPIInstall(f io.Writer, deffile *DefFileData) error {
+	_, err := io.WriteString(f, "\texport MPI_VERSION="+getValue(deffile, MPIVersionArg, deffile.MpiImplm.Version)+"\n\texport MPI_URL=\""+getValue(deffile, MPIURLArg, deffile.MpiImplm.URL)+"\"\n")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, "\texport MPI_DIR="+deffile.layout().MPIPrefix+"\n")
+	if err != nil {
+		return err
+	}
+
+	if deffile.MPIMountPoint {
+		_, err = io.WriteString(f, "\tmkdir -p $MPI_DIR\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = addOldMPIRemoval(f, deffile)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, "\texport MPI_BUILDDIR="+deffile.layout().MPIBuildDir+"\n\tmkdir -p $MPI_BUILDDIR\n\n")
+	if err != nil {
+		return err
+	}
+
+	mpitarball := getTarball(deffile, MPIURLArg, deffile.MpiImplm.URL)
+	tarballFormat := archive.DetectTarballFormat(path.Base(deffile.MpiImplm.URL))
+	tarArgs := archive.GetTarArgs(tarballFormat)
+	_, err = io.WriteString(f, "\tcd $MPI_BUILDDIR\n\t"+getDownloadCmd("$MPI_URL", deffile)+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Checking the size is cheap and catches truncated downloads before the checksum, if any, is computed
+	if deffile.MpiImplm.TarballSize > 0 {
+		size := getValue(deffile, MPITarballSizeArg, strconv.FormatInt(deffile.MpiImplm.TarballSize, 10))
+		_, err = io.WriteString(f, "\ttest $(stat -c%s "+mpitarball+") -eq "+size+" || { echo \""+mpitarball+" does not have the expected size ("+size+" bytes)\"; exit 1; }\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	if deffile.MpiImplm.Checksum != "" {
+		_, err = io.WriteString(f, "\t"+getChecksumCmd(getValue(deffile, MPIChecksumArg, deffile.MpiImplm.Checksum), mpitarball)+"\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(f, "\trm -rf $MPI_BUILDDIR/"+deffile.MpiImplm.ID+"-$MPI_VERSION\n\ttar "+tarArgs+" "+mpitarball+"\n")
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteString("\texport MPI_DIR=" + deffile.InternalEnv.InstallDir + "\n")
+	_, err = io.WriteString(f, "\techo \""+container.CompilationStartMarker+"\"\n")
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteString("\texport MPI_BUILDDIR=/opt/build-mpi\n\tmkdir -p $MPI_BUILDDIR\n\n")
+	err = addSharedMemPackages(f, deffile)
 	if err != nil {
 		return err
 	}
 
-	mpitarball := path.Base(deffile.MpiImplm.URL)
-	tarballFormat := util.DetectTarballFormat(mpitarball)
-	tarArgs := util.GetTarArgs(tarballFormat)
-	_, err = f.WriteString("\tcd $MPI_BUILDDIR && wget $MPI_URL && tar " + tarArgs + " " + mpitarball + "\n")
+	mpiArgs, mpiPkgs, err := getMPIConfigureArgs(deffile)
+	if err != nil {
+		return err
+	}
+	err = addPackages(f, deffile, mpiPkgs)
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteString("\tcd $MPI_BUILDDIR/" + deffile.MpiImplm.ID + "-$MPI_VERSION && ./configure --prefix=$MPI_DIR && make -j8 install\n")
+	configureArgs := append([]string{"--prefix=$MPI_DIR"}, mpiArgs...)
+	configureCmd, err := getConfigureCmd(deffile)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "\tcd $MPI_BUILDDIR/"+deffile.MpiImplm.ID+"-$MPI_VERSION && "+configureCmd+" "+strings.Join(configureArgs, " ")+" && "+getMakeInstallCmd(deffile)+"\n")
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteString("\texport PATH=$MPI_DIR/bin:$PATH\n\texport LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH\n\texport MANPATH=$MPI_DIR/share/man:$MANPATH\n\n")
+	_, err = io.WriteString(f, "\texport PATH=$MPI_DIR/bin:$PATH\n\texport LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH\n\texport MANPATH=$MPI_DIR/share/man:$MANPATH\n\n")
 	if err != nil {
 		return err
 	}
@@ -285,14 +770,178 @@ func AddMPIInstall(f *os.File, deffile *DefFileData) error {
 	return nil
 }
 
+// checkBuildJobs checks the number of parallel jobs used to compile software in the image
+func checkBuildJobs(jobs int) error {
+	if jobs < 0 && jobs != BuildJobsAuto {
+		return fmt.Errorf("invalid number of build jobs: %d, must be positive or %d to use the number of CPUs", jobs, BuildJobsAuto)
+	}
+	return nil
+}
+
+// getBuildJobs returns the number of parallel jobs used to compile software in the image. The number of CPUs
+// is evaluated in the image at build time since the image may not be built on the machine generating the
+// definition file.
+func getBuildJobs(deffile *DefFileData) string {
+	switch deffile.BuildJobs {
+	case 0:
+		return strconv.Itoa(DefaultBuildJobs)
+	case BuildJobsAuto:
+		return "$(nproc)"
+	}
+	return strconv.Itoa(deffile.BuildJobs)
+}
+
+// getMakeInstallCmd returns the command compiling and installing software in the image
+func getMakeInstallCmd(deffile *DefFileData) string {
+	return "make -j" + getBuildJobs(deffile) + " install"
+}
+
+// getDownloadCmd returns the shell code to download a file, resuming and retrying the download on failure
+func getDownloadCmd(url string, deffile *DefFileData) string {
+	retries := deffile.DownloadRetries
+	if retries <= 0 {
+		retries = DefaultDownloadRetries
+	}
+	delay := deffile.DownloadRetryDelay
+	if delay <= 0 {
+		delay = DefaultDownloadRetryDelay
+	}
+
+	return "n=0; until wget -c " + url + "; do n=$((n+1)); if [ $n -ge " + strconv.Itoa(retries) + " ]; then echo \"failed to download " + url + "\"; exit 1; fi; sleep " + strconv.Itoa(delay) + "; done"
+}
+
+// checkGitRef checks the branch, tag or commit of a Git repository, which is used in the post section
+func checkGitRef(ref string) error {
+	if !gitRefRegexp.MatchString(ref) || strings.HasPrefix(ref, "-") || strings.Contains(ref, "..") {
+		return fmt.Errorf("invalid Git reference: %s", ref)
+	}
+	return nil
+}
+
+// getGitCloneCmd returns the shell code to clone the Git repository of an application in the current
+// directory, at the reference of the application if any. The %post section may be executed again in a
+// sandbox (build --update), in which case the repository is updated.
+func getGitCloneCmd(a *app.Info, deffile *DefFileData) (string, error) {
+	dir, err := getAppDir(a, deffile)
+	if err != nil {
+		return "", err
+	}
+	// The repository is cloned in the requested directory instead of the name of the repository
+	repo := getValue(deffile, AppSourceArg, a.Source)
+	if a.SourceDir != "" {
+		repo += " " + dir
+	}
+
+	if a.Depth < 0 {
+		return "", fmt.Errorf("invalid depth of the Git clone: %d", a.Depth)
+	}
+	depth := ""
+	if a.Depth > 0 {
+		depth = " --depth " + strconv.Itoa(a.Depth)
+	}
+
+	if a.Ref == "" {
+		return "(git clone" + depth + " " + repo + " || (cd " + dir + " && git pull))", nil
+	}
+
+	err = checkGitRef(a.Ref)
+	if err != nil {
+		return "", err
+	}
+
+	// A commit may not be part of a shallow clone so the whole history is cloned
+	if gitCommitRegexp.MatchString(a.Ref) {
+		return "(git clone " + repo + " || (cd " + dir + " && git fetch)) && (cd " + dir + " && git checkout " + a.Ref + ")", nil
+	}
+
+	if depth == "" {
+		depth = " --depth 1"
+	}
+	return "(git clone --branch " + a.Ref + depth + " " + repo + " || (cd " + dir + " && git fetch" + depth + " origin " + a.Ref + " && git checkout FETCH_HEAD))", nil
+}
+
+// getChecksumCmd returns the shell code checking the SHA-256 checksum of a tarball, which makes the build fail
+// when the tarball is corrupted or was tampered with
+func getChecksumCmd(checksum string, tarball string) string {
+	return "echo \"" + checksum + "  " + tarball + "\" | sha256sum -c -"
+}
+
+// hasSourceChecksum checks whether the checksum of the tarball of an application is verified after its download
+func hasSourceChecksum(a *app.Info) bool {
+	return a.SourceChecksum != "" && util.DetectURLType(a.Source) == util.HttpURL
+}
+
+// getAppDownloadCmd returns the shell code downloading the tarball of an application, checking its checksum
+// when available, and extracting it in the current directory
+func getAppDownloadCmd(a *app.Info, d *DefFileData) string {
+	tarball := getTarball(d, AppSourceArg, a.Source)
+	tarArgs := archive.GetTarArgs(archive.DetectTarballFormat(a.Source))
+	content := getDownloadCmd(getValue(d, AppSourceArg, a.Source), d) + "\n\t"
+	if hasSourceChecksum(a) {
+		content += getChecksumCmd(getValue(d, AppChecksumArg, a.SourceChecksum), tarball) + "\n\t"
+	}
+	return content + getExtractCmd(tarball, tarArgs)
+}
+
+// getExtractCmd returns the shell code to extract a tarball in the current directory, removing the
+// top directory of the tarball first in case the %post section is executed again in a sandbox
+func getExtractCmd(tarball string, tarArgs string) string {
+	return "TOPDIR=`tar -tf " + tarball + " | head -1 | cut -d/ -f1`\n" +
+		"\tif [ -n \"$TOPDIR\" ] && [ \"$TOPDIR\" != \".\" ]; then rm -rf \"$TOPDIR\"; fi\n" +
+		"\ttar " + tarArgs + " " + tarball
+}
+
+// getSharedMemPackages returns the list of userspace packages required by the requested shared-memory transports
+func getSharedMemPackages(deffile *DefFileData) ([]string, error) {
+	var pkgs []string
+	for _, transport := range deffile.SharedMemTransports {
+		d := getDistroSupport(deffile.DistroID.Name)
+		if d == nil {
+			return nil, fmt.Errorf("shared-memory transports are not supported on %s", deffile.DistroID.Name)
+		}
+		var transportPkgs []string
+		var ok bool
+		switch d.packageFormat {
+		case rpmPackageFormat:
+			transportPkgs, ok = sharedMemRPMPackages[transport]
+		case debPackageFormat:
+			transportPkgs, ok = sharedMemDebianPackages[transport]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unsupported shared-memory transport: %s", transport)
+		}
+		pkgs = append(pkgs, transportPkgs...)
+	}
+	return pkgs, nil
+}
+
+// addSharedMemPackages adds the installation of the userspace packages required by the requested shared-memory transports
+func addSharedMemPackages(f io.Writer, deffile *DefFileData) error {
+	pkgs, err := getSharedMemPackages(deffile)
+	if err != nil {
+		return err
+	}
+	return addPackages(f, deffile, pkgs)
+}
+
 // addMPIEnv adds all the data to the definition file to specify the environment of the MPI installation in the container
-func addMPIEnv(f *os.File, deffile *DefFileData) error {
-	_, err := f.WriteString("%environment\n\tMPI_DIR=" + deffile.InternalEnv.InstallDir + "\n")
+func addMPIEnv(f io.Writer, deffile *DefFileData) error {
+	_, err := io.WriteString(f, "%environment\n\tMPI_DIR="+deffile.layout().MPIPrefix+"\n")
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteString("\texport MPI_DIR\n\texport PATH=$MPI_DIR/bin:$PATH\n\texport LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH\n\n")
+	_, err = io.WriteString(f, "\texport MPI_DIR\n\texport PATH=$MPI_DIR/bin:$PATH\n\texport LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH\n")
+	if err != nil {
+		return err
+	}
+
+	env := getMPIEnv(deffile)
+	err = checkEnvVars(env)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, getEnvContent(env)+"\n")
 	if err != nil {
 		return err
 	}
@@ -305,86 +954,161 @@ func UpdateDistroCodename(data, distro string) string {
 	return strings.Replace(data, distroCodenameTag, distro, -1)
 }
 
-// UpdateDeffileTemplate update a template file and create a usable definition file
+// UpdateDeffileTemplate update a template file and create a usable definition file, at data.DestPath if set
 func UpdateDeffileTemplate(data DefFileData, sysCfg *sys.Config) error {
-	// Sanity checks
-	if data.MpiImplm.Version == "" || data.MpiImplm.URL == "" ||
-		data.Path == "" || data.Tags.Version == "" ||
-		data.Tags.URL == "" || data.Tags.Tarball == "" ||
-		data.DistroID.Name == "" {
-		return fmt.Errorf("invalid parameter(s)")
-	}
+	return updateDeffileTemplate(data, sysCfg, nil)
+}
 
-	tarball := path.Base(data.MpiImplm.URL)
-	d, err := ioutil.ReadFile(data.Path)
+// UpdateDeffileTemplateWithTrace updates a template file like UpdateDeffileTemplate and returns the trace of the
+// substitutions: the occurrences of each tag and the diff between the template and the definition file.
+func UpdateDeffileTemplateWithTrace(data DefFileData, sysCfg *sys.Config) (*Trace, error) {
+	trace := &Trace{Template: data.Path}
+	err := updateDeffileTemplate(data, sysCfg, trace)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %s", data.Path, err)
+		return nil, err
 	}
+	return trace, nil
+}
 
-	var tarArgs string
-	format := util.DetectTarballFormat(tarball)
-	switch format {
-	case util.FormatBZ2:
-		tarArgs = "-xjf"
-	case util.FormatGZ:
-		tarArgs = "-xzf"
-	case util.FormatTAR:
-		tarArgs = "-xf"
-	default:
-		return fmt.Errorf("un-supported tarball format for %s", tarball)
+// updateDeffileTemplate updates a template file and records the substitutions in trace, if not nil
+func updateDeffileTemplate(data DefFileData, sysCfg *sys.Config, trace *Trace) error {
+	// Sanity checks
+	if data.MpiImplm == nil || data.Path == "" {
+		return fmt.Errorf("invalid parameter(s)")
 	}
 
 	if sysCfg.Debug {
+		tarball := path.Base(data.MpiImplm.URL)
 		log.Printf("--> Replacing %s with %s", data.Tags.Version, data.MpiImplm.Version)
 		log.Printf("--> Replacing %s with %s", data.Tags.URL, data.MpiImplm.URL)
 		log.Printf("--> Replacing %s with %s", data.Tags.Tarball, tarball)
+		tarArgs, _ := getTarArgs(tarball)
 		log.Printf("--> Replacing TARARGS with %s", tarArgs)
+		for tag, value := range data.ExtraTags {
+			if data.RedactExtraTags {
+				value = redactedValue
+			}
+			log.Printf("--> Replacing %s with %s", tag, value)
+		}
 	}
 
-	content := string(d)
-	content = strings.Replace(content, data.Tags.Version, data.MpiImplm.Version, -1)
-	content = strings.Replace(content, data.Tags.URL, data.MpiImplm.URL, -1)
-	content = strings.Replace(content, data.Tags.Tarball, tarball, -1)
-	content = strings.Replace(content, "TARARGS", tarArgs, -1)
-	content = UpdateDistroCodename(content, data.DistroID.Codename)
+	content, appliedTags, err := renderTemplate(data.Path, &data, trace)
+	if err != nil {
+		return err
+	}
+
+	dest := data.Path
+	tmplName := data.Path + ".tmpl"
+	if data.DestPath != "" {
+		dest = data.DestPath
+		tmplName = data.Path
+	}
 
-	err = ioutil.WriteFile(data.Path, []byte(content), 0)
+	if trace != nil {
+		d, err := ioutil.ReadFile(data.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", data.Path, err)
+		}
+		trace.Diff = unifiedDiff(string(d), content, tmplName, dest)
+		if data.RedactExtraTags {
+			for _, t := range appliedTags {
+				if data.ExtraTags[t] != "" {
+					trace.Diff = strings.Replace(trace.Diff, data.ExtraTags[t], redactedValue, -1)
+				}
+			}
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
 	if err != nil {
-		return fmt.Errorf("failed to write file %s: %s", data.Path, err)
+		return fmt.Errorf("failed to create the directory of %s: %s", dest, err)
+	}
+	err = ioutil.WriteFile(dest, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write file %s: %s", dest, err)
 	}
 
 	return nil
 }
 
-func createFilesSection(f *os.File, app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
-	_, err := f.WriteString("%files\n")
-	if err != nil {
-		return fmt.Errorf("failed to write to definition file: %s", err)
+// docFile is a documentation file of the application copied into the image and recorded in its labels
+type docFile struct {
+	label string
+	path  string
+}
+
+// getDocFiles returns the license and README of the application to copy into the image
+func getDocFiles(app *app.Info) []docFile {
+	var docs []docFile
+	if app.LicenseFile != "" {
+		docs = append(docs, docFile{label: LicenseLabel, path: app.LicenseFile})
+	}
+	if app.ReadmeFile != "" {
+		docs = append(docs, docFile{label: ReadmeLabel, path: app.ReadmeFile})
 	}
+	return docs
+}
+
+// getDocFilePath returns the path in the image of a documentation file of the application
+func getDocFilePath(file string, data *DefFileData) string {
+	return data.layout().AppRoot + "/" + path.Base(file)
+}
 
+// getAppFiles returns the files and directories of the application, on the host, to copy into the image
+func getAppFiles(app *app.Info, data *DefFileData) []fileEntry {
+	var files []fileEntry
 	switch data.Model {
 	case container.BindModel:
 		// In the context of the bind model, we compile the application on the host and copy it over
 		// This means this is most certainly a file
-		_, err = f.WriteString("\t" + app.BinPath + " /opt\n\n")
-		if err != nil {
-			return fmt.Errorf("failed to write to definition file: %s", err)
-		}
+		files = append(files, fileEntry{src: app.BinPath, dst: data.layout().AppRoot})
 	case container.HybridModel:
 		// If the application is a file that we compiled, we copy it into the container
-		if util.DetectTarballFormat(app.Source) == util.UnknownFormat {
+		if util.DetectURLType(app.Source) == util.FileURL && archive.DetectTarballFormat(app.Source) == util.UnknownFormat {
 			// This means this is most certainly a file
 			src := strings.Replace(app.Source, "file://", "", 1)
-			_, err = f.WriteString("\t" + src + " /opt\n\n")
-			if err != nil {
-				return fmt.Errorf("failed to write to definition file: %s", err)
-			}
+			files = append(files, fileEntry{src: src, dst: data.layout().AppRoot})
 		}
 	default:
 		log.Println("It does not seem to be a MPI application, simply copying files...")
 		// This means this is most certainly a file
 		src := strings.Replace(app.Source, "file://", "", 1)
-		_, err = f.WriteString("\t" + src + " /opt\n\n")
+		files = append(files, fileEntry{src: src, dst: data.layout().AppRoot})
+	}
+	return files
+}
+
+func createFilesSection(f io.Writer, app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "%files\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	// Large directories may be bound at build time and copied in the post section instead
+	staged := make(map[fileEntry]bool)
+	for _, entry := range getStagedFiles(app, data) {
+		staged[entry] = true
+	}
+
+	var files []string
+	for _, entry := range getAppFiles(app, data) {
+		if !staged[entry] {
+			files = append(files, entry.src+" "+entry.dst)
+		}
+	}
+
+	for _, doc := range getDocFiles(app) {
+		files = append(files, doc.path+" "+getDocFilePath(doc.path, data))
+	}
+
+	for _, file := range files {
+		_, err = io.WriteString(f, "\t"+file+"\n")
+		if err != nil {
+			return fmt.Errorf("failed to write to definition file: %s", err)
+		}
+	}
+	if len(files) > 0 {
+		_, err = io.WriteString(f, "\n")
 		if err != nil {
 			return fmt.Errorf("failed to write to definition file: %s", err)
 		}
@@ -393,13 +1117,13 @@ func createFilesSection(f *os.File, app *app.Info, data *DefFileData, sysCfg *sy
 	return nil
 }
 
-func createUbuntuDockerBootstrapSection(f *os.File, data *DefFileData, sysCfg *sys.Config) error {
-	_, err := f.WriteString("Bootstrap: docker\n")
+func createUbuntuDockerBootstrapSection(f io.Writer, data *DefFileData, sysCfg *sys.Config) error {
+	_, err := io.WriteString(f, "Bootstrap: docker\n")
 	if err != nil {
 		return fmt.Errorf("failed to write to definition file: %s", err)
 	}
 
-	_, err = f.WriteString("From: ubuntu:DISTROCODENAME\n\n")
+	_, err = io.WriteString(f, "From: ubuntu:DISTROCODENAME\n\n")
 	if err != nil {
 		return fmt.Errorf("failed to write to definition file: %s", err)
 	}
@@ -407,30 +1131,73 @@ func createUbuntuDockerBootstrapSection(f *os.File, data *DefFileData, sysCfg *s
 	return nil
 }
 
-func addAppInstall(f *os.File, app *app.Info, data *DefFileData) error {
+// addAppSymlink adds the creation of the symlink to the application's binary in the application root, e.g.,
+// /opt/NPmpi, which is the executable of the application when its path is not specified. The build fails if
+// the binary does not exist instead of creating a dangling symlink.
+func addAppSymlink(f io.Writer, app *app.Info, data *DefFileData) error {
+	if data.NoAppSymlink || app.BinName == "" {
+		return nil
+	}
+
+	appRoot := data.layout().AppRoot
+	target := app.BinPath
+	if target == "" || target == appRoot+"/"+app.BinName {
+		target = "$APPDIR/" + app.BinName
+		if usesCMake(app) {
+			target = getCMakePrefix(app, data) + "/bin/" + app.BinName
+		}
+	}
+	content := "\tcd " + appRoot + "\n" +
+		"\tif [ ! -e " + target + " ]; then echo \"cannot find the binary of the application: " + target + "\" >&2; exit 1; fi\n" +
+		"\tln -sf " + target + " " + app.BinName + "\n\n"
+	_, err := io.WriteString(f, content)
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	return nil
+}
+
+func addAppInstall(f io.Writer, app *app.Info, data *DefFileData) error {
 	installCmd := "make install"
 	if app.InstallCmd != "" {
 		installCmd = app.InstallCmd
+	} else if usesCMake(app) {
+		installCmd = getCMakeInstallCmd(app, data)
+	}
+
+	_, err := io.WriteString(f, "\techo \""+container.CompilationStartMarker+"\"\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
 	}
 
+	err = addBuildEnv(f, app)
+	if err != nil {
+		return err
+	}
+
+	appRoot := data.layout().AppRoot
 	urlType := util.DetectURLType(app.Source)
 	switch urlType {
 	case util.GitURL:
 		srcDir := path.Base(app.Source)
 		srcDir = strings.Replace(srcDir, ".git", "", -1)
-		_, err := f.WriteString("\tcd /opt/$APPDIR" + " && " + installCmd + "\n")
+		_, err := io.WriteString(f, "\tcd "+appRoot+"/$APPDIR"+" && "+installCmd+"\n")
 		if err != nil {
 			return fmt.Errorf("failed to write to definition file: %s", err)
 		}
 	case util.FileURL:
 		containerSrcPath := filepath.Join(data.InternalEnv.SrcDir, filepath.Base(app.Source))
 		if app.BinPath != "" {
-			_, err := f.WriteString("\tcd /opt/$APPDIR && mpicc -o " + app.BinPath + " " + containerSrcPath + "\n")
+			compiler, err := getCompilerWrapper(app, data)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(f, "\tcd "+appRoot+"/$APPDIR && "+compiler+" -o "+app.BinPath+" "+containerSrcPath+"\n")
 			if err != nil {
 				return fmt.Errorf("failed to write to definition file: %s", err)
 			}
 		} else if app.InstallCmd != "" {
-			_, err := f.WriteString("\tcd /opt/$APPDIR && " + app.InstallCmd + "\n")
+			_, err := io.WriteString(f, "\tcd "+appRoot+"/$APPDIR && "+app.InstallCmd+"\n")
 			if err != nil {
 				return fmt.Errorf("failed to write to definition file: %s", err)
 			}
@@ -438,21 +1205,25 @@ func addAppInstall(f *os.File, app *app.Info, data *DefFileData) error {
 			return fmt.Errorf("unable to figure out how to compile source file")
 		}
 	case util.HttpURL:
-		_, err := f.WriteString("\tcd /opt/$APPDIR && " + installCmd + "\n")
+		_, err := io.WriteString(f, "\tcd "+appRoot+"/$APPDIR && "+installCmd+"\n")
 		if err != nil {
 			return fmt.Errorf("failed to write to definition file: %s", err)
 		}
 	}
 
-	// A little magic to know exactly where the binary is
-	_, err := f.WriteString("\tcd /opt && ln -s $APPDIR/" + app.BinName + " " + app.BinName + " 2> /dev/null || true\n\n")
+	_, err = io.WriteString(f, "\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	err = addAppSymlink(f, app, data)
 	if err != nil {
-		return fmt.Errorf("failed to write to definition file: %s", err)
+		return err
 	}
 
 	// todo: Clean up
 	/*
-		_, err := f.WriteString("\trm -rf /opt/" + app.tarball + "\n")
+		_, err := io.WriteString(f, "\trm -rf /opt/" + app.tarball + "\n")
 		if err != nil {
 			return fmt.Errorf("failed to add cleanup section: %s", err)
 		}
@@ -461,18 +1232,43 @@ func addAppInstall(f *os.File, app *app.Info, data *DefFileData) error {
 	return nil
 }
 
-func addMPICleanup(f *os.File, app *app.Info, data *DefFileData) error {
-	if data.Model == container.HybridModel {
-		_, err := f.WriteString("\n\trm -rf $MPI_BUILDDIR\n\n")
-		if err != nil {
-			return fmt.Errorf("failed to add MPI cleanup section: %s", err)
+// getAppDir returns the name of the directory of the application's sources in the application root: the
+// SourceDir of the application when set, the name of the Git repository or the name of the tarball without
+// its extension otherwise. When the URL of the application is a build argument, the name is computed during
+// the build.
+func getAppDir(a *app.Info, data *DefFileData) (string, error) {
+	if a.SourceDir != "" {
+		if !appDirRegexp.MatchString(a.SourceDir) || a.SourceDir == "." || a.SourceDir == ".." {
+			return "", fmt.Errorf("invalid directory of the application's sources: %s", a.SourceDir)
 		}
+		return a.SourceDir, nil
 	}
-	return nil
+
+	if util.DetectURLType(a.Source) == util.GitURL {
+		if data.useBuildArgs() {
+			return "\"$(basename " + getValue(data, AppSourceArg, a.Source) + " .git)\"", nil
+		}
+		return strings.TrimSuffix(path.Base(a.Source), ".git"), nil
+	}
+
+	if data.useBuildArgs() {
+		// Top directory of the tarball, set by the extraction code
+		return "\"$TOPDIR\"", nil
+	}
+	return archive.TrimExtension(path.Base(a.Source)), nil
 }
 
-func addDetectAppDir(f *os.File, app *app.Info, data *DefFileData) error {
-	_, err := f.WriteString("\tAPPDIR=`ls -l /opt | egrep '^d' | head -1 | awk '{print $9}'`\n\n")
+// addAppDir adds the code setting APPDIR to the directory of the application's sources, which makes the
+// build fail if the directory does not exist after the download
+func addAppDir(f io.Writer, app *app.Info, data *DefFileData) error {
+	dir, err := getAppDir(app, data)
+	if err != nil {
+		return err
+	}
+
+	target := data.layout().AppRoot + "/$APPDIR"
+	_, err = io.WriteString(f, "\tAPPDIR="+dir+"\n"+
+		"\tif [ ! -d "+target+" ]; then echo \"cannot find the directory of the application: "+target+"\" >&2; exit 1; fi\n\n")
 	if err != nil {
 		return fmt.Errorf("failed to add app env info: %s", err)
 	}
@@ -480,34 +1276,33 @@ func addDetectAppDir(f *os.File, app *app.Info, data *DefFileData) error {
 	return nil
 }
 
-// addAppDownload adds the code to the definition file to download an application
-//
-// Note that the function assumes that /opt is empty when called so it needs to be
-// called before downloading/installing anything else.
-func addAppDownload(f *os.File, app *app.Info, data *DefFileData) error {
+// addAppDownload adds the code to the definition file to download an application and to set APPDIR to
+// the directory of its sources
+func addAppDownload(f io.Writer, app *app.Info, data *DefFileData) error {
+	appRoot := data.layout().AppRoot
 	urlType := util.DetectURLType(app.Source)
 	switch urlType {
 	case util.GitURL:
-		srcDir := path.Base(app.Source)
-		srcDir = strings.Replace(srcDir, ".git", "", -1)
-		_, err := f.WriteString("\tcd /opt && git clone " + app.Source + "\n")
+		cloneCmd, err := getGitCloneCmd(app, data)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, "\tcd "+appRoot+" && "+cloneCmd+"\n")
 		if err != nil {
 			return fmt.Errorf("failed to write to definition file: %s", err)
 		}
 
-		err = addDetectAppDir(f, app, data)
+		err = addAppDir(f, app, data)
 		if err != nil {
 			return fmt.Errorf("failed to add code to get the directory of the app to the definition file: %s", err)
 		}
 	case util.HttpURL:
-		format := util.DetectTarballFormat(app.Source)
-		tarArgs := util.GetTarArgs(format)
-		_, err := f.WriteString("\tcd /opt && wget " + app.Source + " && tar " + tarArgs + " " + path.Base(app.Source) + "\n")
+		_, err := io.WriteString(f, "\tcd "+appRoot+"\n\t"+getAppDownloadCmd(app, data)+"\n")
 		if err != nil {
 			return fmt.Errorf("failed to write to definition file: %s", err)
 		}
 
-		err = addDetectAppDir(f, app, data)
+		err = addAppDir(f, app, data)
 		if err != nil {
 			return fmt.Errorf("failed to add code to get the directory of the app to the definition file: %s", err)
 		}
@@ -516,21 +1311,41 @@ func addAppDownload(f *os.File, app *app.Info, data *DefFileData) error {
 	return nil
 }
 
-func addDebianDependencies(f *os.File, list []string) error {
+// osmcompPackagePrefix is the prefix of the name of the packages providing libosmcomp on Debian-based distros
+const osmcompPackagePrefix = "libosmcomp"
+
+// dependsOnOsmcomp checks whether libosmcomp is in a list of packages
+func dependsOnOsmcomp(list []string) bool {
+	for _, pkg := range list {
+		if strings.HasPrefix(pkg, osmcompPackagePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func addDebianDependencies(f io.Writer, deffile *DefFileData, list []string) error {
 	if len(list) > 0 {
-		_, err := f.WriteString("\tapt install -y " + strings.Join(list, " ") + "\n")
+		_, err := io.WriteString(f, "\tapt install -y "+strings.Join(list, " ")+"\n")
 		if err != nil {
 			return fmt.Errorf("failed to section to install dependencies: %s", err)
 		}
 	}
 
 	// todo: find a better way to deal with symlinks that are necessary for cross-distro compatility
-	_, err := f.WriteString("\tln -s /usr/lib/x86_64-linux-gnu/libosmcomp.so /usr/lib/x86_64-linux-gnu/libosmcomp.so.3\n")
-	if err != nil {
-		return fmt.Errorf("failed to add cleanup section: %s", err)
+	if dependsOnOsmcomp(list) {
+		libDir := getMultiarchLibDir(deffile.GetArch())
+		if libDir == "" {
+			sylog.Warn("unknown architecture %s, libosmcomp.so.3 is not created", deffile.GetArch())
+		} else {
+			_, err := io.WriteString(f, "\tln -sf "+libDir+"/libosmcomp.so "+libDir+"/libosmcomp.so.3\n")
+			if err != nil {
+				return fmt.Errorf("failed to add cleanup section: %s", err)
+			}
+		}
 	}
 
-	_, err = f.WriteString("\tldconfig\n")
+	_, err := io.WriteString(f, "\tldconfig\n")
 	if err != nil {
 		return fmt.Errorf("failed to add cleanup section: %s", err)
 	}
@@ -538,9 +1353,9 @@ func addDebianDependencies(f *os.File, list []string) error {
 	return nil
 }
 
-func addRPMDependencies(f *os.File, list []string) error {
+func addRPMDependencies(f io.Writer, packageManager string, list []string) error {
 	if len(list) > 0 {
-		_, err := f.WriteString("\tyum install -y " + strings.Join(list, " ") + "\n")
+		_, err := io.WriteString(f, "\t"+packageManager+" install -y "+strings.Join(list, " ")+"\n")
 		if err != nil {
 			return fmt.Errorf("failed to section to install dependencies: %s", err)
 		}
@@ -549,44 +1364,220 @@ func addRPMDependencies(f *os.File, list []string) error {
 	return nil
 }
 
-func addDependencies(f *os.File, deffile *DefFileData, list []string) error {
-	switch deffile.DistroID.Name {
-	case "centos":
-		return addRPMDependencies(f, list)
-	case "ubuntu":
-		return addDebianDependencies(f, list)
+// getApkPackages returns the packages to install on Alpine Linux. The dependencies detected with ldd are named
+// after the packages of the host, which is not based on musl; they are translated to Alpine packages and the ones
+// without a known Alpine package are skipped instead of breaking the build. The extra packages are Alpine
+// packages and are installed as is.
+func getApkPackages(list []string, extraPkgs []string) []string {
+	var pkgs []string
+	for _, pkg := range list {
+		name, ok := pkgmap.Translate(apkPackageFormat, pkg)
+		if !ok {
+			sylog.Warn("no apk package known for %s, skipping", pkg)
+			continue
+		}
+		pkgs = append(pkgs, name)
+	}
+	return mergePackages(pkgs, extraPkgs)
+}
+
+// addApkDependencies adds the installation of a list of Alpine packages
+func addApkDependencies(f io.Writer, pkgs []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(f, "\tapk add --no-cache "+strings.Join(pkgs, " ")+"\n")
+	if err != nil {
+		return fmt.Errorf("failed to section to install dependencies: %s", err)
+	}
+
+	return nil
+}
+
+// addZypperDependencies adds the installation of a list of openSUSE packages
+func addZypperDependencies(f io.Writer, d *distroSupport, pkgs []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(f, "\t"+d.getInstallCmd()+" "+strings.Join(pkgs, " ")+"\n")
+	if err != nil {
+		return fmt.Errorf("failed to section to install dependencies: %s", err)
 	}
+
 	return nil
 }
 
-func addCleanUp(f *os.File, deffile *DefFileData) error {
-	switch deffile.DistroID.Name {
-	case "centos":
-		_, err := f.WriteString("\tapt-get clean\n")
-		if err != nil {
-			return fmt.Errorf("failed to add cleanup section: %s", err)
-		}
-	case "ubuntu":
-		_, err := f.WriteString("\tyum clean all\n")
+// getDependencies returns the packages installed from a list of packages and the extra packages, named after
+// the packages of the Linux distribution. On openSUSE, the dependencies are named after the RPM packages of the
+// RHEL-based distributions and are renamed when openSUSE uses other names.
+func getDependencies(d *distroSupport, deffile *DefFileData, list []string) []string {
+	if d.packageFormat == apkPackageFormat {
+		return getApkPackages(list, deffile.ExtraPkgs)
+	}
+	if d.packageManager == zypperPackageManager {
+		return mergePackages(d.getPackageNames(list), deffile.ExtraPkgs)
+	}
+	return mergePackages(list, deffile.ExtraPkgs)
+}
+
+// addDependencies adds the installation of a list of packages and of the extra packages to the post section,
+// using the package manager of the Linux distribution. Nothing is added when there is no package to install.
+// The installed packages are recorded so that they can be reported with the content of the image.
+func addDependencies(f io.Writer, deffile *DefFileData, list []string) error {
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d == nil {
+		return nil
+	}
+
+	err := checkExtraPkgs(deffile.ExtraPkgs)
+	if err != nil {
+		return err
+	}
+
+	pkgs := getDependencies(d, deffile, list)
+	deffile.packages = mergePackages(deffile.packages, pkgs)
+
+	if d.packageFormat == apkPackageFormat {
+		return addApkDependencies(f, pkgs)
+	}
+	if d.packageManager == zypperPackageManager {
+		return addZypperDependencies(f, d, pkgs)
+	}
+
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	switch d.packageFormat {
+	case rpmPackageFormat:
+		return addRPMDependencies(f, d.packageManager, pkgs)
+	case debPackageFormat:
+		return addDebianDependencies(f, deffile, pkgs)
+	}
+	return nil
+}
+
+// getBuildLeftovers returns the files and directories only needed during the build, removed at the end of the
+// post section: with the hybrid model, the tarball of the application and the directory where MPI is built
+func getBuildLeftovers(app *app.Info, deffile *DefFileData) []string {
+	if deffile.Model != container.HybridModel {
+		return nil
+	}
+
+	var leftovers []string
+	if util.DetectURLType(app.Source) == util.HttpURL {
+		leftovers = append(leftovers, deffile.layout().AppRoot+"/"+getTarball(deffile, AppSourceArg, app.Source))
+	}
+	return append(leftovers, deffile.layout().MPIBuildDir)
+}
+
+// addCleanUp adds to the post section the removal of the files only needed during the build and the cleanup
+// of the cache of the package manager of the Linux distribution
+func addCleanUp(f io.Writer, app *app.Info, deffile *DefFileData) error {
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d == nil {
+		return fmt.Errorf("unsupported distro: %s", deffile.DistroID.Name)
+	}
+
+	content := ""
+	for _, leftover := range getBuildLeftovers(app, deffile) {
+		content += "\trm -rf " + leftover + "\n"
+	}
+	for _, cmd := range d.cleanup {
+		content += "\t" + cmd + "\n"
+	}
+	_, err := io.WriteString(f, content)
+	if err != nil {
+		return fmt.Errorf("failed to add cleanup section: %s", err)
+	}
+
+	return nil
+}
+
+// normalizeContent ensures that the content of a definition file only uses LF line endings
+// and ends with exactly one newline
+func normalizeContent(content string) string {
+	content = strings.Replace(content, "\r\n", "\n", -1)
+	content = strings.Replace(content, "\r", "\n", -1)
+	return strings.TrimRight(content, "\n") + "\n"
+}
+
+// renderFn writes the content of a definition file
+type renderFn func(w io.Writer) error
+
+// renderNormalized writes to w the content produced by render, normalized. Some tools are picky about
+// line endings and missing trailing newlines, so this is the last step when writing any definition file.
+// With StrictPortability, the content is rejected if it relies on directories of the host.
+func renderNormalized(w io.Writer, data *DefFileData, sysCfg *sys.Config, render renderFn) error {
+	var buf bytes.Buffer
+	data.packages = nil
+	err := render(&buf)
+	if err != nil {
+		return err
+	}
+
+	content := normalizeContent(buf.String())
+	if sysCfg.StrictPortability {
+		err = checkPortability(content, data, sysCfg)
 		if err != nil {
-			return fmt.Errorf("failed to add cleanup section: %s", err)
+			return fmt.Errorf("definition file is not portable: %s", err)
 		}
 	}
 
+	_, err = io.WriteString(w, content)
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	return nil
+}
+
+// writeDefFile writes the content produced by render to the definition file of data. The content is
+// generated in memory first so that the definition file is not left half-written on error.
+func writeDefFile(data *DefFileData, sysCfg *sys.Config, render renderFn) error {
+	var buf bytes.Buffer
+	err := renderNormalized(&buf, data, sysCfg, render)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(data.Path, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", data.Path, err)
+	}
+
 	return nil
 }
 
-// CreateHybridDefFile creates a definition file for a given bybrid-based configuration.
-func CreateHybridDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+// createHybridDefFile creates a definition file for a given bybrid-based configuration.
+func createHybridDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
 	// Some sanity checks
 	if data.Path == "" {
 		return fmt.Errorf("invalid parameter(s)")
 	}
 
 	log.Printf("- Defintion file is %s\n", data.Path)
-	f, err := os.Create(data.Path)
+	return writeDefFile(data, sysCfg, func(w io.Writer) error {
+		return renderHybridDefFile(w, app, data, sysCfg)
+	})
+}
+
+// renderHybridDefFile writes the content of a definition file for a given hybrid-based configuration
+func renderHybridDefFile(f io.Writer, app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+	if sysCfg.MinimalBase {
+		return fmt.Errorf("MPI is compiled in the image with the hybrid model, a minimal base without compilers cannot be used")
+	}
+
+	err := checkLayout(app, data)
 	if err != nil {
-		return fmt.Errorf("failed to create %s: %s", data.Path, err)
+		return fmt.Errorf("invalid image layout: %s", err)
+	}
+
+	err = checkBuildJobs(data.BuildJobs)
+	if err != nil {
+		return err
 	}
 
 	err = AddBootstrap(f, data, sysCfg)
@@ -594,12 +1585,17 @@ func CreateHybridDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) e
 		return fmt.Errorf("failed to create the bootstrap section of the definition file: %s", err)
 	}
 
+	err = addArguments(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the arguments section of the definition file: %s", err)
+	}
+
 	err = addLabels(f, app, data)
 	if err != nil {
 		return fmt.Errorf("failed to create the labels section of the definition file: %s", err)
 	}
 
-	if util.DetectURLType(app.Source) == util.FileURL {
+	if util.DetectURLType(app.Source) == util.FileURL || len(getDocFiles(app)) > 0 {
 		err = createFilesSection(f, app, data, sysCfg)
 		if err != nil {
 			return fmt.Errorf("failed to create the files section of the definition file: %s", err)
@@ -616,6 +1612,16 @@ func CreateHybridDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) e
 		return fmt.Errorf("failed to add the code initializing the distro: %s", err)
 	}
 
+	err = addDependencies(f, data, getAppBuildPackages(app, data))
+	if err != nil {
+		return fmt.Errorf("failed to add the extra packages to the definition file: %s", err)
+	}
+
+	err = addStagedCopies(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the copy of the staged directories: %s", err)
+	}
+
 	err = addAppDownload(f, app, data)
 	if err != nil {
 		return fmt.Errorf("failed to add the section to download the app: %s", err)
@@ -626,34 +1632,90 @@ func CreateHybridDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) e
 		return fmt.Errorf("failed to create the post section of the definition file: %s", err)
 	}
 
+	err = addBenchmarksInstall(f, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the installation of the benchmarks: %s", err)
+	}
+
 	err = addAppInstall(f, app, data)
 	if err != nil {
 		return fmt.Errorf("failed to create the post section of the definition file: %s", err)
 	}
 
-	err = addMPICleanup(f, app, data)
+	err = addToolchainLabels(f, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the capture of the versions of the compilers: %s", err)
+	}
+
+	err = addCleanUp(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add code to clean up: %s", err)
+	}
+
+	err = addMPIWrapper(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the MPI wrapper: %s", err)
+	}
+
+	err = addLaunchInfo(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the launch information: %s", err)
+	}
+
+	err = addUserCreation(f, data)
+	if err != nil {
+		return fmt.Errorf("failed to add code to create the default user: %s", err)
+	}
+
+	err = addRunscript(f, app, data)
 	if err != nil {
-		return fmt.Errorf("failed to add code to cleanup MPI files: %s", err)
+		return fmt.Errorf("failed to create the runscript section of the definition file: %s", err)
 	}
 
-	f.Close()
+	err = addTestSection(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the test section of the definition file: %s", err)
+	}
 
 	return nil
 }
 
-// CreateBindDefFile creates a definition file for a given bind-based configuration.
+// checkMPILinkage warns when a binary is not dynamically linked against MPI, since the bind model would not provide any benefit
+func checkMPILinkage(binPath string, libs []string) {
+	if !ldd.IsLinkedToMPI(libs) {
+		sylog.Warn("%s is not dynamically linked against MPI, the bind model will not provide any benefit", binPath)
+	}
+}
+
+// createBindDefFile creates a definition file for a given bind-based configuration.
 //
 // Note that the application must have been compiled on the host prior to calling this function.
-// All data to handle the application once compiled is available in app.
-func CreateBindDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+// All data to handle the application once compiled is available in app, unless hostBuild, the
+// result of buildenv.BuildHostApp, is provided, in which case the verified binary is used.
+func createBindDefFile(app *app.Info, data *DefFileData, hostBuild *buildenv.BuildOutput, sysCfg *sys.Config) error {
 	// Some sanity checks
 	if data.Path == "" {
 		return fmt.Errorf("invalid parameter(s)")
 	}
 
-	f, err := os.Create(data.Path)
+	return writeDefFile(data, sysCfg, func(w io.Writer) error {
+		return renderBindDefFile(w, app, data, hostBuild, sysCfg)
+	})
+}
+
+// renderBindDefFile writes the content of a definition file for a given bind-based configuration, see
+// createBindDefFile
+func renderBindDefFile(f io.Writer, app *app.Info, data *DefFileData, hostBuild *buildenv.BuildOutput, sysCfg *sys.Config) error {
+	if hostBuild != nil {
+		if hostBuild.BinPath == "" {
+			return fmt.Errorf("the application was not successfully compiled on the host")
+		}
+		app.BinPath = hostBuild.BinPath
+	}
+
+	err := checkLayout(app, data)
 	if err != nil {
-		return fmt.Errorf("failed to create %s: %s", data.Path, err)
+		return fmt.Errorf("invalid image layout: %s", err)
 	}
 
 	// At this point the application already has been installed on the host.
@@ -664,21 +1726,22 @@ func CreateBindDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) err
 		return fmt.Errorf("failed to load a workable ldd module")
 	}
 	log.Printf("* Getting dependencies for %s\n", app.BinPath)
-	pkgs := lddMod.GetPackageDependenciesForFile(app.BinPath)
-
-	// Add some packages we always want in the image
-	// todo: find a way to do this in a clean and maintainable way
-	pkgs = append(pkgs, "libc-bin")
-	pkgs = append(pkgs, "libopensm-dev")
-	pkgs = append(pkgs, "librdmacm-dev")
-	pkgs = append(pkgs, "librdmacm1")
-	pkgs = append(pkgs, "kmod")
-	pkgs = append(pkgs, "libmlx4-1")
-	pkgs = append(pkgs, "libibverbs-dev")
-	pkgs = append(pkgs, "libibverbs1")
-	pkgs = append(pkgs, "libnl-3-dev")
-	pkgs = append(pkgs, "infiniband-diags")
-	pkgs = append(pkgs, "ibverbs-utils")
+	pkgs, static := lddMod.GetPackageDependenciesForFile(app.BinPath)
+
+	// The linkage of binaries compiled with buildenv.BuildHostApp is already verified
+	if hostBuild == nil {
+		libs, err := ldd.GetLibraries(app.BinPath)
+		if err != nil {
+			log.Printf("failed to get the libraries of %s: %s", app.BinPath, err)
+		} else {
+			checkMPILinkage(app.BinPath, libs)
+		}
+	}
+
+	// Add some packages we always want in the image, with the names used by the distro
+	if d := getDistroSupport(data.DistroID.Name); d != nil {
+		pkgs = append(pkgs, pkgmap.Resolve(d.packageFormat, pkgmap.InfinibandPackages)...)
+	}
 
 	err = AddBootstrap(f, data, sysCfg)
 	if err != nil {
@@ -706,37 +1769,76 @@ func CreateBindDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) err
 		return fmt.Errorf("failed to add the code initializing the distro: %s", err)
 	}
 
+	// Statically linked binaries do not need any package, besides the extra ones
+	if static {
+		pkgs = nil
+	}
 	err = addDependencies(f, data, pkgs)
 	if err != nil {
 		return fmt.Errorf("failed to add package dependencies to the definition file: %s", err)
 	}
 
 	// Create the directory where MPI will be mounted
-	_, err = f.WriteString("\tmkdir -p " + data.InternalEnv.InstallDir + "\n\n")
+	_, err = io.WriteString(f, "\tmkdir -p "+data.layout().MPIPrefix+"\n\n")
 	if err != nil {
 		return fmt.Errorf("failed to write to definition file: %s", err)
 	}
 
-	err = addCleanUp(f, data)
+	err = addToolchainLabels(f, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the capture of the versions of the compilers: %s", err)
+	}
+
+	err = addCleanUp(f, app, data)
 	if err != nil {
 		return fmt.Errorf("failed to add code to clean up: %s", err)
 	}
 
-	f.Close()
+	err = addMPIWrapper(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the MPI wrapper: %s", err)
+	}
+
+	err = addLaunchInfo(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the launch information: %s", err)
+	}
+
+	err = addUserCreation(f, data)
+	if err != nil {
+		return fmt.Errorf("failed to add code to create the default user: %s", err)
+	}
+
+	err = addRunscript(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the runscript section of the definition file: %s", err)
+	}
+
+	err = addTestSection(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the test section of the definition file: %s", err)
+	}
 
 	return nil
 }
 
-// CreateBasicDefFile creates a definition file for a given non-MPI configuration.
-func CreateBasicDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+// createBasicDefFile creates a definition file for a given non-MPI configuration.
+func createBasicDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
 	// Some sanity checks
 	if data.Path == "" {
 		return fmt.Errorf("invalid parameter(s)")
 	}
 
-	f, err := os.Create(data.Path)
+	return writeDefFile(data, sysCfg, func(w io.Writer) error {
+		return renderBasicDefFile(w, app, data, sysCfg)
+	})
+}
+
+// renderBasicDefFile writes the content of a definition file for a given non-MPI configuration
+func renderBasicDefFile(f io.Writer, app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+	err := checkLayout(app, data)
 	if err != nil {
-		return fmt.Errorf("failed to create %s: %s", data.Path, err)
+		return fmt.Errorf("invalid image layout: %s", err)
 	}
 
 	// At this point the application already has been installed on the host.
@@ -747,7 +1849,7 @@ func CreateBasicDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) er
 		return fmt.Errorf("failed to load a workable ldd module")
 	}
 	log.Printf("* Getting dependencies for %s\n", app.BinPath)
-	pkgs := lddMod.GetPackageDependenciesForFile(app.BinPath)
+	pkgs, static := lddMod.GetPackageDependenciesForFile(app.BinPath)
 
 	err = AddBootstrap(f, data, sysCfg)
 	if err != nil {
@@ -770,21 +1872,134 @@ func CreateBasicDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) er
 		return fmt.Errorf("failed to add the code initializing the distro: %s", err)
 	}
 
+	err = addStagedCopies(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the copy of the staged directories: %s", err)
+	}
+
+	// Statically linked binaries do not need any package, besides the extra ones
+	if static {
+		pkgs = nil
+	}
 	err = addDependencies(f, data, pkgs)
 	if err != nil {
 		return fmt.Errorf("failed to add package dependencies to the definition file: %s", err)
 	}
 
-	err = addCleanUp(f, data)
+	err = addToolchainLabels(f, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the capture of the versions of the compilers: %s", err)
+	}
+
+	err = addCleanUp(f, app, data)
 	if err != nil {
 		return fmt.Errorf("failed to add code to clean up: %s", err)
 	}
 
-	f.Close()
+	err = addUserCreation(f, data)
+	if err != nil {
+		return fmt.Errorf("failed to add code to create the default user: %s", err)
+	}
+
+	err = addRunscript(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the runscript section of the definition file: %s", err)
+	}
+
+	err = addTestSection(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the test section of the definition file: %s", err)
+	}
 
 	return nil
 }
 
+// Validate checks that the data describes a definition file that can be generated
+func (d *DefFileData) Validate() error {
+	if d.Path == "" {
+		return fmt.Errorf("path to the definition file is undefined")
+	}
+
+	if !isSupportedDistro(d.DistroID) {
+		return fmt.Errorf("unsupported distro: %s %s", d.DistroID.Name, d.DistroID.Version)
+	}
+
+	if d.MpiImplm != nil {
+		if _, ok := configureArgsFns[d.MpiImplm.ID]; !ok {
+			return fmt.Errorf("unsupported MPI implementation: %s", d.MpiImplm.ID)
+		}
+		if d.InternalEnv == nil {
+			return fmt.Errorf("build environment for MPI is undefined")
+		}
+		if d.MpiImplm.ID == implem.MPICH {
+			device, err := getMPICHDevice(d.MpiImplm)
+			if err != nil {
+				return err
+			}
+			_, err = getMPICHSharedMemArgs(d, device)
+			if err != nil {
+				return err
+			}
+		}
+		err := checkConfigureArgs(d.MpiImplm.ConfigureArgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.Arch != "" {
+		err := checkArch(d.Arch)
+		if err != nil {
+			return err
+		}
+	}
+	if d.MpiImplm != nil && d.MpiImplm.WithROCm && d.GetArch() != ArchX86_64 {
+		return fmt.Errorf("ROCm is only available on %s, not %s", ArchX86_64, d.GetArch())
+	}
+
+	if d.Model != "" && !container.IsSupportedModel(d.Model) {
+		return fmt.Errorf("unsupported model: %s", d.Model)
+	}
+
+	l := d.layout()
+	err := l.Validate()
+	if err != nil {
+		return err
+	}
+
+	_, err = getSharedMemPackages(d)
+	if err != nil {
+		return err
+	}
+
+	err = checkExtraPkgs(d.ExtraPkgs)
+	if err != nil {
+		return err
+	}
+
+	err = checkStageInclude(d.StageInclude)
+	if err != nil {
+		return err
+	}
+
+	err = checkEnvVars(d.EnvVars)
+	if err != nil {
+		return err
+	}
+
+	err = checkMirrors(d.Mirrors)
+	if err != nil {
+		return err
+	}
+
+	err = checkBuildJobs(d.BuildJobs)
+	if err != nil {
+		return err
+	}
+
+	return checkUser(d)
+}
+
 // Backup a definition file based on a build environment (copy the file from the build directory
 // to the install directory)
 func (d *DefFileData) Backup(env *buildenv.Info) error {
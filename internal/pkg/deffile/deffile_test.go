@@ -6,16 +6,26 @@
 package deffile
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/pkg/app"
 	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/container"
 	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
 	"github.com/sylabs/singularity-mpi/pkg/sys"
 )
 
@@ -91,5 +101,1803 @@ func TestCreateDefFile(t *testing.T) {
 		t.Fatalf("failed to create definition file for IMB: %s", err)
 	}
 
-	fmt.Printf("Definition files are in %s", tempDir)
+	t.Logf("Definition files are in %s", tempDir)
+}
+
+func getTestSysConfig(t *testing.T) sys.Config {
+	var sysCfg sys.Config
+
+	curDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get the current work directory: %s", err)
+	}
+	sysCfg.BinPath = filepath.Join(curDir, "../../..")
+	sysCfg.EtcDir = filepath.Join(sysCfg.BinPath, "etc")
+	sysCfg.TemplateDir = filepath.Join(sysCfg.EtcDir, "templates")
+
+	return sysCfg
+}
+
+func getTestDefFileData(dir string, name string) DefFileData {
+	var openmpi implem.Info
+	openmpi.ID = implem.OMPI
+	openmpi.URL = "https://download.open-mpi.org/release/open-mpi/v3.1/openmpi-3.1.4.tar.bz2"
+	openmpi.Tarball = "openmpi-3.1.4.tar.bz2"
+	openmpi.Version = "3.1.4"
+
+	var env buildenv.Info
+	env.InstallDir = "/opt/mpi"
+	env.SrcDir = "/opt"
+
+	var data DefFileData
+	data.Path = filepath.Join(dir, name+".def")
+	data.DistroID = distro.ParseDescr("ubuntu:disco")
+	data.MpiImplm = &openmpi
+	data.InternalEnv = &env
+
+	return data
+}
+
+func readDefFile(t *testing.T, path string) string {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", path, err)
+	}
+	return string(d)
+}
+
+func TestDefFileFinalization(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, "helloworld")
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+
+	content := readDefFile(t, data.Path)
+	if strings.Contains(content, "\r") {
+		t.Fatalf("definition file contains CR characters")
+	}
+	if !strings.HasSuffix(content, "\n") || strings.HasSuffix(content, "\n\n") {
+		t.Fatalf("definition file does not end with exactly one newline")
+	}
+
+	normalized := normalizeContent("Bootstrap: docker\r\nFrom: ubuntu\r\n\r\n\n")
+	if normalized != "Bootstrap: docker\nFrom: ubuntu\n" {
+		t.Fatalf("unexpected normalized content: %q", normalized)
+	}
+}
+
+// testHostBuild is the compilation of helloworld on the host used to create the bind definition files
+var testHostBuild = buildenv.BuildOutput{BinPath: "/scratch/helloworld/helloworld", MPIPrefix: "/opt/openmpi"}
+
+// setTestMPICH makes the configuration of a definition file use a version of MPICH with a given device
+func setTestMPICH(data *DefFileData, version string, device string) {
+	data.MpiImplm.ID = implem.MPICH
+	data.MpiImplm.Version = version
+	data.MpiImplm.Tarball = "mpich-" + version + ".tar.gz"
+	data.MpiImplm.URL = "http://www.mpich.org/static/downloads/" + version + "/" + data.MpiImplm.Tarball
+	data.MpiImplm.Device = device
+}
+
+// defFileOptionTest is a test of the definition file created with the options set by setup
+type defFileOptionTest struct {
+	// name is the name of the subtest
+	name string
+
+	// netpipe specifies whether the application of the image is NetPIPE instead of helloworld
+	netpipe bool
+
+	// model is the model of the image, container.HybridModel if not set
+	model string
+
+	// hostBuild is the compilation of the application on the host, with the bind model (optional)
+	hostBuild *buildenv.BuildOutput
+
+	// setup sets the options of the definition file, of the application and of the configuration (optional)
+	setup func(data *DefFileData, a *app.Info, sysCfg *sys.Config)
+
+	// invalid specifies whether the configuration is rejected by Validate; the definition file is then only
+	// created when fails is set
+	invalid bool
+
+	// fails specifies whether the creation of the definition file fails
+	fails bool
+
+	// section restricts the checks of unexpected to a section of the definition file, e.g., "%test"
+	section string
+
+	// expected are the strings that the definition file includes
+	expected []string
+
+	// unexpected are the strings that the definition file does not include
+	unexpected []string
+
+	// ordered are strings that the definition file includes in that order
+	ordered []string
+
+	// golden is the golden file in testdata that the definition file is compared to (optional)
+	golden string
+}
+
+func TestDefFileOptions(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// No base image is available from the library when the configuration directory is empty, so the distro is
+	// bootstrapped from its mirror
+	noLibrary := func(sysCfg *sys.Config) {
+		sysCfg.EtcDir = tempDir
+	}
+	mirror1 := "http://mirror1.example.com/ubuntu/"
+	mirror2 := "http://mirror2.example.com/ubuntu/"
+	mirrorFailover := "\tfor mirror in '" + mirror1 + "' '" + mirror2 + "'; do\n" +
+		"\t\tif " + getUbuntuMirrorSetup(&DefFileData{DistroID: distro.ParseDescr("ubuntu:disco")}) + "; then\n"
+	yumSnapshot := "http://snapshot.example.com/centos/7/20240101/os/$basearch/"
+	vaderEnv := "\tOMPI_MCA_btl_vader_single_copy_mechanism=\"none\"\n\texport OMPI_MCA_btl_vader_single_copy_mechanism\n"
+	netpipeExe := "/opt/NetPIPE-5.1.4/NPmpi"
+
+	tests := []defFileOptionTest{
+		// Devices of MPICH
+		{
+			name:       "mpich 3.3 default device",
+			setup:      func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "3.3", "") },
+			unexpected: []string{"--with-device", "libfabric"},
+		},
+		{
+			name:    "mpich 3.3 ucx",
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "3.3", MPICHDeviceUCX) },
+			invalid: true,
+			fails:   true,
+		},
+		{
+			name:       "mpich 3.3 ch3:sock",
+			setup:      func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "3.3", MPICHDeviceSock) },
+			expected:   []string{"./configure --prefix=$MPI_DIR --with-device=ch3:sock &&"},
+			unexpected: []string{"libfabric", "ucx"},
+		},
+		{
+			name: "mpich 4.0.2 ch3:sock on centos",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("centos:7")
+				setTestMPICH(data, "4.0.2", MPICHDeviceSock)
+			},
+			expected:   []string{"./configure --prefix=$MPI_DIR --with-device=ch3:sock &&", "\t" + container.MPIDeviceLabel + " ch3:sock\n"},
+			unexpected: []string{"libfabric", "ucx"},
+		},
+		{
+			name:     "mpich 4.0.2 ch4:ofi",
+			setup:    func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "4.0.2", MPICHDeviceOFI) },
+			expected: []string{"--with-device=ch4:ofi --with-libfabric=/usr", "\t" + container.MPIDeviceLabel + " ch4:ofi\n"},
+		},
+		{
+			name:     "mpich 3.4 default device",
+			setup:    func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "3.4", "") },
+			expected: []string{"apt-get install -y libfabric-dev libfabric1", "--with-device=ch4:ofi --with-libfabric=/usr"},
+		},
+		{
+			// ch3 is not removed by the versions of MPICH using ch4 by default
+			name:       "mpich 3.4 ch3:sock",
+			setup:      func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "3.4", MPICHDeviceSock) },
+			expected:   []string{"./configure --prefix=$MPI_DIR --with-device=ch3:sock &&"},
+			unexpected: []string{"libfabric", "ucx"},
+		},
+		{
+			name: "mpich 4.0.2 ch4:ucx on centos",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("centos:7")
+				setTestMPICH(data, "4.0.2", MPICHDeviceUCX)
+			},
+			expected:   []string{"yum install -y ucx-devel ucx", "--with-device=ch4:ucx --with-ucx=/usr"},
+			unexpected: []string{"libfabric"},
+		},
+		{
+			name:    "mpich unknown device",
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "4.0.2", "ch4:foo") },
+			invalid: true,
+			fails:   true,
+		},
+
+		// Compilers of MPI
+		{
+			name:     "default compilers",
+			expected: []string{"-$MPI_VERSION && ./configure --prefix=$MPI_DIR"},
+		},
+		{
+			name: "custom compilers",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.InternalEnv.Compilers.CC = "clang"
+				data.InternalEnv.Compilers.CXX = "clang++"
+			},
+			expected: []string{"-$MPI_VERSION && CC=clang CXX=clang++ ./configure --prefix=$MPI_DIR", "\tapt-get install -y clang\n"},
+		},
+		{
+			name: "custom compilers on centos",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("centos:7")
+				data.InternalEnv.Compilers.CC = "clang"
+				data.InternalEnv.Compilers.CXX = "clang++"
+				data.InternalEnv.Compilers.FC = "gfortran"
+			},
+			expected: []string{"CC=clang CXX=clang++ FC=gfortran ./configure", "\tyum install -y clang gcc-gfortran\n"},
+		},
+		{
+			name: "invalid compiler",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.InternalEnv.Compilers.CC = "clang; rm -rf /"
+			},
+			fails: true,
+		},
+
+		// Parallel jobs compiling MPI
+		{
+			name:     "default build jobs",
+			expected: []string{"./configure --prefix=$MPI_DIR && make -j" + strconv.Itoa(DefaultBuildJobs) + " install\n"},
+		},
+		{
+			name:     "2 build jobs",
+			setup:    func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.BuildJobs = 2 },
+			expected: []string{"./configure --prefix=$MPI_DIR && make -j2 install\n"},
+		},
+		{
+			name:     "64 build jobs",
+			setup:    func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.BuildJobs = 64 },
+			expected: []string{"./configure --prefix=$MPI_DIR && make -j64 install\n"},
+		},
+		{
+			name:     "build jobs of the build machine",
+			setup:    func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.BuildJobs = BuildJobsAuto },
+			expected: []string{"./configure --prefix=$MPI_DIR && make -j$(nproc) install\n"},
+		},
+		{
+			name:    "negative build jobs",
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.BuildJobs = -4 },
+			invalid: true,
+			fails:   true,
+		},
+
+		// Configure arguments of MPI
+		{
+			name: "configure arguments",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.MpiImplm.ConfigureArgs = []string{"--with-pmix=/usr", "--enable-mpi-fortran=all"}
+			},
+			expected: []string{"./configure --prefix=$MPI_DIR --with-pmix=/usr --enable-mpi-fortran=all && make"},
+		},
+		{
+			// Arguments with shell metacharacters are rejected
+			name: "invalid configure argument",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.MpiImplm.ConfigureArgs = []string{"--with-pmix=/usr; rm -rf /"}
+			},
+			invalid: true,
+			fails:   true,
+		},
+
+		// Mirrors of the distro
+		{
+			name:  "default mirror",
+			model: container.BindModel,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				a.BinPath = testHostBuild.BinPath
+				noLibrary(sysCfg)
+			},
+			expected: []string{"MirrorURL: " + defaultUbuntuMirror + "\n"},
+		},
+		{
+			// A single mirror only replaces the default one
+			name:  "single mirror",
+			model: container.BindModel,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				a.BinPath = testHostBuild.BinPath
+				noLibrary(sysCfg)
+				data.Mirrors = []string{mirror1}
+			},
+			golden: "bind-helloworld-mirror.def",
+		},
+		{
+			// Several mirrors are tried in order during the setup of the packages
+			name:  "mirror failover",
+			model: container.BindModel,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				a.BinPath = testHostBuild.BinPath
+				noLibrary(sysCfg)
+				data.Mirrors = []string{mirror1, mirror2}
+			},
+			expected: []string{"MirrorURL: " + mirror1 + "\n", "deb $mirror disco main", "\t\texit 1\n"},
+			ordered:  []string{mirrorFailover, "apt-get install"},
+		},
+		{
+			// The mirrors are used in the post section so they cannot include shell metacharacters
+			name: "invalid mirror",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.Mirrors = []string{mirror1, "http://mirror.example.com/ubuntu'; rm -rf /; echo '"}
+			},
+			invalid: true,
+		},
+
+		// Snapshots of the repositories of the distro, replacing the mirrors
+		{
+			name: "ubuntu snapshot",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				noLibrary(sysCfg)
+				sysCfg.RepoSnapshot = "20240101T000000Z"
+				data.Arch = ArchX86_64
+				data.Mirrors = []string{"http://mirror.example.com/"}
+			},
+			expected: []string{
+				"MirrorURL: http://snapshot.ubuntu.com/ubuntu/20240101T000000Z/\n",
+				"\tmirror='http://snapshot.ubuntu.com/ubuntu/20240101T000000Z/'\n\techo \"deb $mirror disco main restricted universe multiverse\" > /etc/apt/sources.list && apt-get update\n",
+			},
+			unexpected: []string{"mirror.example.com"},
+		},
+		{
+			name: "ubuntu snapshot on aarch64",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				sysCfg.RepoSnapshot = "20240101T000000Z"
+				data.Arch = ArchAarch64
+				data.Mirrors = []string{"http://mirror.example.com/"}
+			},
+			expected:   []string{"MirrorURL: http://snapshot.ubuntu.com/ubuntu-ports/20240101T000000Z/\n"},
+			unexpected: []string{"mirror.example.com"},
+		},
+		{
+			name: "centos snapshot",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				sysCfg.RepoSnapshot = yumSnapshot
+				data.DistroID = distro.ParseDescr("centos:7")
+				data.Arch = ArchX86_64
+				data.Mirrors = []string{"http://mirror.example.com/"}
+			},
+			expected:   []string{"MirrorURL: " + yumSnapshot + "\n", "\tmirror='" + yumSnapshot + "'\n\tprintf '[" + mirrorRepoName + "]"},
+			unexpected: []string{"mirror.example.com"},
+		},
+		{
+			name: "centos snapshot timestamp",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				sysCfg.RepoSnapshot = "20240101T000000Z"
+				data.DistroID = distro.ParseDescr("centos:7")
+			},
+			fails: true,
+		},
+		{
+			name:  "invalid snapshot",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { sysCfg.RepoSnapshot = "yesterday" },
+			fails: true,
+		},
+		{
+			name: "fedora snapshot",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				sysCfg.RepoSnapshot = "http://snapshot.example.com/fedora/"
+				data.DistroID = distro.ParseDescr("fedora:38")
+			},
+			fails: true,
+		},
+
+		// Runscript
+		{
+			// The bind model starts the binary copied in the application root
+			name:      "bind runscript",
+			model:     container.BindModel,
+			hostBuild: &testHostBuild,
+			setup:     func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { a.BinName = "helloworld" },
+			expected:  []string{"\tApp_exe /opt/helloworld\n", "%runscript\n\texec /opt/helloworld \"$@\"\n"},
+		},
+		{
+			// The hybrid model starts the binary of the application
+			name:     "hybrid runscript",
+			netpipe:  true,
+			expected: []string{"%runscript\n\texec " + netpipeExe + " \"$@\"\n"},
+		},
+		{
+			// Without the path to the binary, the hybrid model starts the symlink created in the application root
+			name:    "hybrid runscript without binary",
+			netpipe: true,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				a.BinPath = ""
+				a.BinName = "NPmpi"
+			},
+			expected: []string{"\tln -sf $APPDIR/NPmpi NPmpi\n", "%runscript\n\texec /opt/NPmpi \"$@\"\n"},
+		},
+		{
+			// A custom runscript replaces the default one
+			name:    "custom runscript",
+			netpipe: true,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.Runscript = "source /opt/site-env.sh\n\nexec /opt/launcher " + netpipeExe + " \"$@\"\n"
+			},
+			expected:   []string{"%runscript\n\tsource /opt/site-env.sh\n\n\texec /opt/launcher " + netpipeExe + " \"$@\"\n"},
+			unexpected: []string{"\texec " + netpipeExe + " \"$@\"\n"},
+		},
+
+		// Test section
+		{
+			name:       "test section disabled",
+			netpipe:    true,
+			unexpected: []string{"%test"},
+		},
+		{
+			name:    "hybrid openmpi test section",
+			netpipe: true,
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.EnableTest = true },
+			section: "%test",
+			expected: []string{
+				"%test\n\tset -e\n\ttest -x " + netpipeExe + "\n\t$MPI_DIR/bin/mpirun --version\n",
+				"\t$MPI_DIR/bin/mpicc -o $SYMPI_TEST_DIR/helloworld $SYMPI_TEST_DIR/helloworld.c\n",
+				"\t$MPI_DIR/bin/mpirun --allow-run-as-root --oversubscribe -np 2 $SYMPI_TEST_DIR/helloworld\n",
+				"MPI_Init(&argc, &argv);",
+			},
+		},
+		{
+			name:    "hybrid mpich test section",
+			netpipe: true,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.MpiImplm.ID = implem.MPICH
+				data.EnableTest = true
+			},
+			section:    "%test",
+			expected:   []string{"\t$MPI_DIR/bin/mpichversion\n", "\t$MPI_DIR/bin/mpiexec -n 2 $SYMPI_TEST_DIR/helloworld\n"},
+			unexpected: []string{"mpirun"},
+		},
+		{
+			name:    "bind test section",
+			netpipe: true,
+			model:   container.BindModel,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				a.BinName = "NPmpi"
+				data.EnableTest = true
+			},
+			section:    "%test",
+			expected:   []string{"%test\n\tset -e\n\ttest -x /opt/NPmpi\n"},
+			unexpected: []string{"mpirun", "mpicc"},
+		},
+
+		// Extra packages of the distro
+		{
+			// Extra packages are merged with the packages always installed with the bind model
+			name:      "extra packages with the bind model",
+			model:     container.BindModel,
+			hostBuild: &testHostBuild,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				a.BinName = "helloworld"
+				data.ExtraPkgs = []string{"numactl", "libibverbs1", "numactl"}
+			},
+			expected: []string{"\tapt install -y libc-bin libopensm-dev librdmacm-dev librdmacm1 kmod libmlx4-1 libibverbs-dev libibverbs1 libnl-3-dev infiniband-diags ibverbs-utils numactl\n"},
+		},
+		{
+			name:       "no extra package",
+			netpipe:    true,
+			unexpected: []string{"apt install"},
+		},
+		{
+			// The package manager of the distro is used
+			name:    "extra packages on centos",
+			netpipe: true,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("centos:7")
+				data.ExtraPkgs = []string{"hwloc", "libpmi2"}
+			},
+			expected: []string{"\tyum install -y hwloc libpmi2\n"},
+		},
+		{
+			name:    "invalid extra package",
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.ExtraPkgs = []string{"hwloc; reboot"} },
+			invalid: true,
+			fails:   true,
+		},
+
+		// ROCm
+		{
+			name:       "no rocm",
+			unexpected: []string{"rocm"},
+		},
+		{
+			name:  "rocm",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.MpiImplm.WithROCm = true },
+			expected: []string{
+				"\twget -q -O - " + rocmRepoURL + "/rocm.gpg.key | gpg --dearmor > " + rocmKeyring + "\n",
+				"\techo 'deb [arch=amd64 signed-by=" + rocmKeyring + "] " + rocmRepoURL + "/apt/debian/ disco main' > /etc/apt/sources.list.d/rocm.list\n",
+				"apt-get install -y rocm-dev", "--with-rocm", "\tROCm true\n",
+			},
+			unexpected: []string{"apt-key"},
+			// ROCm is installed before MPI is configured
+			ordered: []string{rocmKeyring, "rocm-dev", "--with-rocm"},
+		},
+		{
+			name: "rocm on bionic",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("ubuntu:bionic")
+				data.MpiImplm.WithROCm = true
+			},
+			expected:   []string{rocmRepoURL + "/apt/debian/ bionic main"},
+			unexpected: []string{"xenial"},
+		},
+		{
+			name: "rocm on centos",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("centos:7")
+				data.MpiImplm.WithROCm = true
+			},
+			expected: []string{rocmRepoURL + "/yum/rpm", "yum install -y rocm-dev", "--with-rocm"},
+		},
+		{
+			name: "rocm on aarch64",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.Arch = ArchAarch64
+				data.MpiImplm.WithROCm = true
+			},
+			invalid: true,
+		},
+
+		// Shared-memory transports
+		{
+			name:       "no shared-memory transport",
+			unexpected: []string{"--with-xpmem", "libxpmem-dev"},
+		},
+		{
+			name: "shared-memory transports",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.SharedMemTransports = []string{XPMEMTransport, KNEMTransport}
+			},
+			expected: []string{"apt-get install -y libxpmem-dev knem", "--with-xpmem=/usr", "--with-knem=/usr"},
+		},
+		{
+			name:    "unsupported shared-memory transport",
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.SharedMemTransports = []string{"cma"} },
+			invalid: true,
+			fails:   true,
+		},
+		{
+			name: "xpmem with mpich ch4",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				setTestMPICH(data, "4.0.2", MPICHDeviceUCX)
+				data.SharedMemTransports = []string{XPMEMTransport}
+			},
+			expected: []string{"apt-get install -y libxpmem-dev", "--with-device=ch4:ucx --with-ucx=/usr --with-xpmem=/usr"},
+		},
+		{
+			// MPICH must not be built without a transport that was requested
+			name: "xpmem with mpich ch3",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				setTestMPICH(data, "4.0.2", MPICHDeviceSock)
+				data.SharedMemTransports = []string{XPMEMTransport}
+			},
+			invalid: true,
+			fails:   true,
+		},
+		{
+			name: "xpmem with the default device of mpich 3.3",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				setTestMPICH(data, "3.3", "")
+				data.SharedMemTransports = []string{XPMEMTransport}
+			},
+			invalid: true,
+			fails:   true,
+		},
+		{
+			name: "knem with mpich",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				setTestMPICH(data, "4.0.2", MPICHDeviceOFI)
+				data.SharedMemTransports = []string{KNEMTransport}
+			},
+			invalid: true,
+			fails:   true,
+		},
+
+		// Default user
+		{
+			name:       "no default user",
+			unexpected: []string{"useradd", "setpriv"},
+		},
+		{
+			name:     "default user",
+			setup:    func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.User = "appuser" },
+			expected: []string{"groupadd -f appuser\n", "useradd -m -g appuser -s /bin/sh appuser\n", "%runscript\n", "setpriv --reuid=appuser --regid=appuser --init-groups", "exec su -s /bin/sh appuser"},
+			// The user is created in the post section
+			ordered: []string{"useradd", "%runscript"},
+		},
+		{
+			name: "default user and group",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.User = "appuser"
+				data.Group = "hpc"
+			},
+			expected: []string{"groupadd -f hpc\n", "useradd -m -g hpc -s /bin/sh appuser\n"},
+		},
+		{
+			name:    "invalid default user",
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.User = "app user; rm -rf /" },
+			invalid: true,
+			fails:   true,
+		},
+
+		// Default environment of MPI
+		{
+			name:     "default open mpi environment",
+			expected: []string{vaderEnv},
+			ordered:  []string{vaderEnv, "%post"},
+		},
+		{
+			// The defaults are overridden by the variables of the definition file
+			name: "overridden open mpi environment",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.EnvVars = map[string]string{"OMPI_MCA_btl_vader_single_copy_mechanism": "cma", "OMPI_MCA_btl": "^openib"}
+			},
+			expected:   []string{"\tOMPI_MCA_btl=\"^openib\"\n\texport OMPI_MCA_btl\n\tOMPI_MCA_btl_vader_single_copy_mechanism=\"cma\"\n"},
+			unexpected: []string{vaderEnv},
+		},
+		{
+			// The defaults of Open MPI are not set for other implementations
+			name:       "default mpich environment",
+			setup:      func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { setTestMPICH(data, "3.3", "") },
+			unexpected: []string{"OMPI_MCA"},
+		},
+		{
+			name: "invalid environment variable",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.EnvVars = map[string]string{"INVALID-NAME": "1"}
+			},
+			invalid: true,
+		},
+
+		// Minimal base image
+		{
+			name:      "minimal base",
+			model:     container.BindModel,
+			hostBuild: &testHostBuild,
+			setup:     func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { sysCfg.MinimalBase = true },
+			section:   "%post",
+			expected:  []string{"apt-get install -y --no-install-recommends "},
+			unexpected: []string{
+				" gcc ", " gcc\n", " gfortran ", " gfortran\n", " g++ ", " g++\n", " make ", " make\n",
+				" software-properties-common ", " software-properties-common\n",
+			},
+		},
+		{
+			// MPI cannot be compiled without compilers
+			name:  "minimal base with the hybrid model",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { sysCfg.MinimalBase = true },
+			fails: true,
+		},
+
+		// Directory of MPI created as mount point
+		{
+			name:       "no mpi mount point",
+			netpipe:    true,
+			unexpected: []string{"mkdir -p $MPI_DIR\n"},
+		},
+		{
+			// The directory of MPI is created before installing MPI
+			name:    "mpi mount point",
+			netpipe: true,
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.MPIMountPoint = true },
+			ordered: []string{"\texport MPI_DIR=/opt/mpi\n\tmkdir -p $MPI_DIR\n", "wget -c $MPI_URL"},
+		},
+
+		// Architectures
+		{
+			// No base image is available from the library for aarch64 so the image is bootstrapped from the ports mirror
+			name:       "aarch64",
+			netpipe:    true,
+			setup:      func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.Arch = ArchAarch64 },
+			expected:   []string{"Bootstrap: debootstrap\nOSVersion: disco\nMirrorURL: " + defaultUbuntuPortsMirror + "\n"},
+			unexpected: []string{"x86_64", "amd64", "library://"},
+		},
+		{
+			// The x86_64 images of the library are used for x86_64
+			name:     "x86_64",
+			netpipe:  true,
+			setup:    func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.Arch = ArchX86_64 },
+			expected: []string{"Bootstrap: library\nFrom: library://"},
+		},
+		{
+			name:    "unsupported architecture",
+			setup:   func(data *DefFileData, a *app.Info, sysCfg *sys.Config) { data.Arch = "sparc" },
+			invalid: true,
+		},
+
+		// Distros
+		{
+			name: "fedora",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("fedora:38")
+				setTestMPICH(data, "3.4", MPICHDeviceUCX)
+			},
+			golden: "hybrid-helloworld-fedora.def",
+		},
+		{
+			name:    "rocky",
+			netpipe: true,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("rocky:8")
+				data.ExtraPkgs = []string{"numactl"}
+			},
+			golden: "hybrid-netpipe-rocky.def",
+		},
+		{
+			name:    "almalinux",
+			netpipe: true,
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("almalinux:9")
+				data.ExtraPkgs = []string{"numactl"}
+			},
+			golden: "hybrid-netpipe-almalinux.def",
+		},
+		{
+			name: "opensuse",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("opensuse:15.5")
+				data.InternalEnv.Compilers.FC = "gfortran"
+			},
+			golden: "hybrid-helloworld-opensuse.def",
+		},
+		{
+			name: "alpine",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("alpine:3.18")
+				data.InternalEnv.Compilers.FC = "gfortran"
+			},
+			golden: "hybrid-helloworld-alpine.def",
+		},
+		{
+			// The default user is created with the commands of BusyBox
+			name: "alpine default user",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("alpine:3.18")
+				data.InternalEnv.Compilers.FC = "gfortran"
+				data.User = "appuser"
+			},
+			golden: "hybrid-helloworld-alpine-user.def",
+		},
+		{
+			// ROCm is not available on Alpine
+			name: "alpine rocm",
+			setup: func(data *DefFileData, a *app.Info, sysCfg *sys.Config) {
+				data.DistroID = distro.ParseDescr("alpine:3.18")
+				data.MpiImplm.WithROCm = true
+			},
+			fails: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sysCfg := getTestSysConfig(t)
+			a := app.GetHelloworld(&sysCfg)
+			if tt.netpipe {
+				a = app.GetNetpipe(&sysCfg)
+			}
+			data := getTestDefFileData(tempDir, a.Name)
+			data.Model = tt.model
+			if data.Model == "" {
+				data.Model = container.HybridModel
+			}
+			if tt.setup != nil {
+				tt.setup(&data, &a, &sysCfg)
+			}
+
+			err := data.Validate()
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("invalid configuration was accepted")
+				}
+				if !tt.fails {
+					return
+				}
+			} else if err != nil && !tt.fails {
+				t.Fatalf("invalid configuration: %s", err)
+			}
+
+			err = Create(&a, &data, &sysCfg, CreateOptions{HostBuild: tt.hostBuild})
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("creation of the definition file succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create definition file: %s", err)
+			}
+
+			if tt.golden != "" {
+				checkGolden(t, data.Path, filepath.Join("testdata", tt.golden), &sysCfg)
+			}
+			content := readDefFile(t, data.Path)
+			prev := -1
+			for _, o := range tt.ordered {
+				idx := strings.Index(content, o)
+				if idx == -1 || idx < prev {
+					t.Fatalf("definition file does not include %q after %q:\n%s", o, tt.ordered, content)
+				}
+				prev = idx
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(content, e) {
+					t.Fatalf("definition file does not include %q:\n%s", e, content)
+				}
+			}
+			if tt.section != "" {
+				content = getSection(content, tt.section)
+			}
+			for _, u := range tt.unexpected {
+				if strings.Contains(content, u) {
+					t.Fatalf("definition file includes %q:\n%s", u, content)
+				}
+			}
+		})
+	}
+}
+
+func TestAddDependencies(t *testing.T) {
+	// The dependencies are named after the packages of the host: they are translated on Alpine, where the
+	// unknown ones are skipped, and renamed after the openSUSE packages. The extra packages are kept as is.
+	tests := []struct {
+		distro    string
+		pkgs      []string
+		extraPkgs []string
+		expected  string
+	}{
+		{distro: "alpine:3.18", pkgs: []string{"libnl-3-dev", "libfoo1", "kmod"}, expected: "\tapk add --no-cache libnl3-dev kmod\n"},
+		{distro: "alpine:3.18", pkgs: []string{"libc-bin", "libibverbs1"}, extraPkgs: []string{"numactl"}, expected: "\tapk add --no-cache musl-utils numactl\n"},
+		{distro: "alpine:3.18", pkgs: []string{"libibverbs1", "libmlx4-1"}, expected: ""},
+		{distro: "opensuse:15.5", pkgs: []string{"glibc", "libibverbs-devel", "librdmacm-devel", "libmlx4"}, extraPkgs: []string{"libibverbs", "numactl"}, expected: "\tzypper --non-interactive install glibc rdma-core-devel libmlx4-1 libibverbs numactl\n"},
+	}
+
+	for _, tt := range tests {
+		data := DefFileData{DistroID: distro.ParseDescr(tt.distro), ExtraPkgs: tt.extraPkgs}
+		var buf bytes.Buffer
+		err := addDependencies(&buf, &data, tt.pkgs)
+		if err != nil {
+			t.Fatalf("%s %v: failed to add dependencies: %s", tt.distro, tt.pkgs, err)
+		}
+		if buf.String() != tt.expected {
+			t.Fatalf("%s %v: %q instead of %q", tt.distro, tt.pkgs, buf.String(), tt.expected)
+		}
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, "helloworld")
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	expected := fmt.Sprintf("until wget -c $MPI_URL; do n=$((n+1)); if [ $n -ge %d ]; then", DefaultDownloadRetries)
+	if !strings.Contains(content, expected) || !strings.Contains(content, fmt.Sprintf("sleep %d; done", DefaultDownloadRetryDelay)) {
+		t.Fatalf("definition file does not retry the download of MPI:\n%s", content)
+	}
+	if strings.Contains(content, "sha256sum") {
+		t.Fatalf("checksum is verified while not available")
+	}
+
+	data.DownloadRetries = 5
+	data.DownloadRetryDelay = 30
+	data.MpiImplm.Checksum = "1234abcd"
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	for _, expected := range []string{"if [ $n -ge 5 ]; then", "sleep 30; done", "echo \"1234abcd  openmpi-3.1.4.tar.bz2\" | sha256sum -c -"} {
+		if !strings.Contains(content, expected) {
+			t.Fatalf("definition file does not include %s:\n%s", expected, content)
+		}
+	}
+	if strings.Index(content, "sha256sum") > strings.Index(content, "tar -xjf") {
+		t.Fatalf("checksum is verified after extracting the tarball")
+	}
+}
+
+func TestCheckMPILinkage(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer sylog.Flush()
+
+	checkMPILinkage("/opt/serial", []string{"linux-vdso.so.1", "libc.so.6", "ld-linux-x86-64.so.2"})
+	if !strings.Contains(buf.String(), "/opt/serial is not dynamically linked against MPI") {
+		t.Fatalf("no warning for a binary without MPI dependency: %s", buf.String())
+	}
+
+	buf.Reset()
+	checkMPILinkage("/opt/mpitest", []string{"linux-vdso.so.1", "libmpi.so.40", "libc.so.6"})
+	if buf.Len() != 0 {
+		t.Fatalf("warning for a binary linked against MPI: %s", buf.String())
+	}
+}
+
+func TestGetImageContent(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	netpipe := app.GetNetpipe(&sysCfg)
+	data := getTestDefFileData(tempDir, "netpipe")
+	data.Model = container.HybridModel
+	data.ExtraPkgs = []string{"numactl"}
+	// Rendering twice checks that the packages are not recorded twice
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		err = data.Render(&buf, &netpipe, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to render definition file: %s", err)
+		}
+	}
+
+	content := GetImageContent(&netpipe, &data)
+	if content.Labels["Model"] != container.HybridModel || content.Labels["App_exe"] != "/opt/NetPIPE-5.1.4/NPmpi" {
+		t.Fatalf("invalid labels: %v", content.Labels)
+	}
+	expectedEnv := "MPI_DIR=/opt/mpi PATH=$MPI_DIR/bin:$PATH LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH OMPI_MCA_btl_vader_single_copy_mechanism=none"
+	if strings.Join(content.Environment, " ") != expectedEnv {
+		t.Fatalf("invalid environment: %v", content.Environment)
+	}
+	if strings.Join(content.Dependencies, " ") != "numactl" {
+		t.Fatalf("invalid dependencies: %v", content.Dependencies)
+	}
+}
+
+// updateGolden specifies whether the golden files are updated with the generated definition files
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// goldenRootPlaceholder replaces the root of the checkout in the golden files, so that they do not depend on
+// where the sources are
+const goldenRootPlaceholder = "@SYMPI_ROOT@"
+
+// checkGolden compares a definition file to a golden file, the paths to the files of the checkout, e.g., the
+// templates, being replaced with goldenRootPlaceholder
+func checkGolden(t *testing.T, path string, golden string, sysCfg *sys.Config) {
+	content := strings.Replace(readDefFile(t, path), sysCfg.BinPath, goldenRootPlaceholder, -1)
+	if *updateGolden {
+		err := ioutil.WriteFile(golden, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("failed to update %s: %s", golden, err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", golden, err)
+	}
+	if content != string(expected) {
+		t.Fatalf("%s differs from %s:\n%s", path, golden, content)
+	}
+}
+
+func TestIdempotentPost(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	imb := app.GetIMB(&sysCfg)
+	netpipe := app.GetNetpipe(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		app       app.Info
+		buildArgs bool
+		expected  []string
+	}{
+		{app: imb, expected: []string{"cd /opt && (git clone https://github.com/intel/mpi-benchmarks.git || (cd mpi-benchmarks && git pull))\n", "rm -rf $MPI_BUILDDIR/openmpi-$MPI_VERSION\n\ttar -xjf"}},
+		{app: imb, buildArgs: true, expected: []string{"cd /opt && (git clone {{ APP_SOURCE }} || (cd \"$(basename {{ APP_SOURCE }} .git)\" && git pull))\n"}},
+		{app: netpipe, expected: []string{"TOPDIR=`tar -tf NetPIPE-5.1.4.tar.gz | head -1 | cut -d/ -f1`\n\tif [ -n \"$TOPDIR\" ] && [ \"$TOPDIR\" != \".\" ]; then rm -rf \"$TOPDIR\"; fi\n\ttar -xzf NetPIPE-5.1.4.tar.gz\n"}},
+	}
+
+	for _, tt := range tests {
+		data := getTestDefFileData(tempDir, tt.app.Name)
+		data.Model = container.HybridModel
+		if tt.buildArgs {
+			data.BuildArgs = true
+			data.TargetSingularityVersion = BuildArgsMinVersion
+		}
+		err = CreateHybridDefFile(&tt.app, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to create definition file for %s: %s", tt.app.Name, err)
+		}
+		content := readDefFile(t, data.Path)
+		for _, expected := range tt.expected {
+			if !strings.Contains(content, expected) {
+				t.Fatalf("definition file for %s does not include %s:\n%s", tt.app.Name, expected, content)
+			}
+		}
+	}
+}
+
+func TestDocFiles(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	imb := app.GetIMB(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, imb.Name)
+	data.Model = container.HybridModel
+	err = CreateHybridDefFile(&imb, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if strings.Contains(content, "%files") || strings.Contains(content, LicenseLabel) {
+		t.Fatalf("license is copied while not requested:\n%s", content)
+	}
+
+	imb.LicenseFile = "/home/user/mpi-benchmarks/license/license.txt"
+	err = CreateHybridDefFile(&imb, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	for _, expected := range []string{"%files\n\t/home/user/mpi-benchmarks/license/license.txt /opt/license.txt\n\n", "\tLicense /opt/license.txt\n"} {
+		if !strings.Contains(content, expected) {
+			t.Fatalf("definition file does not include %s:\n%s", expected, content)
+		}
+	}
+	if strings.Contains(content, ReadmeLabel) || strings.Contains(content, imb.Source+" /opt") {
+		t.Fatalf("definition file copies unexpected files:\n%s", content)
+	}
+
+	imb.ReadmeFile = "/home/user/mpi-benchmarks/README.md"
+	data.Layout.AppRoot = "/apps"
+	err = CreateHybridDefFile(&imb, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	for _, expected := range []string{"\t/home/user/mpi-benchmarks/README.md /apps/README.md\n", "\tReadme /apps/README.md\n", "\tLicense /apps/license.txt\n"} {
+		if !strings.Contains(content, expected) {
+			t.Fatalf("definition file does not include %s:\n%s", expected, content)
+		}
+	}
+}
+
+// getInspectOutput converts the labels section of a definition file to the output of 'singularity inspect'
+func getInspectOutput(content string) string {
+	var output string
+	inLabels := false
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "%") {
+			inLabels = line == "%labels"
+			continue
+		}
+		tokens := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if inLabels && len(tokens) == 2 {
+			output += tokens[0] + ": " + tokens[1] + "\n"
+		}
+	}
+	return output
+}
+
+func TestHealthCheckLabel(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	sysCfg.SingularityBin = filepath.Join(tempDir, "bin", "singularity")
+
+	tests := []struct {
+		name        string
+		healthCheck string
+	}{
+		{name: "no health check"},
+		{name: "default health check", healthCheck: container.DefaultHealthCheck},
+		{name: "custom health check", healthCheck: "mpirun -n 2 /opt/helloworld"},
+	}
+
+	for _, tt := range tests {
+		data := getTestDefFileData(tempDir, helloworld.Name)
+		data.Model = container.HybridModel
+		data.HealthCheck = tt.healthCheck
+		err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to create definition file: %s", tt.name, err)
+		}
+		content := readDefFile(t, data.Path)
+		if tt.healthCheck == "" && strings.Contains(content, container.HealthCheckLabel) {
+			t.Fatalf("%s: unexpected health-check label:\n%s", tt.name, content)
+		}
+
+		fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{{Stdout: getInspectOutput(content)}}}
+		defaultRunner := container.SetRunner(fakeRunner)
+		metadata, _, err := container.GetMetadata(filepath.Join(tempDir, "helloworld.sif"), &sysCfg)
+		container.SetRunner(defaultRunner)
+		if err != nil {
+			t.Fatalf("%s: failed to get metadata: %s", tt.name, err)
+		}
+		if metadata.HealthCheck != tt.healthCheck {
+			t.Fatalf("%s: health check is %q instead of %q", tt.name, metadata.HealthCheck, tt.healthCheck)
+		}
+	}
+}
+
+func TestBindHostBuild(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+	helloworld.BinPath = "/nonexistent/helloworld"
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.BindModel
+	err = CreateBindDefFile(&helloworld, &data, &buildenv.BuildOutput{}, &sysCfg)
+	if err == nil {
+		t.Fatalf("definition file created for an application that was not compiled")
+	}
+
+	hostBuild := buildenv.BuildOutput{BinPath: "/scratch/helloworld/helloworld", MPIPrefix: "/opt/openmpi"}
+	err = CreateBindDefFile(&helloworld, &data, &hostBuild, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if !strings.Contains(content, "\t/scratch/helloworld/helloworld /opt\n") || strings.Contains(content, "/nonexistent/helloworld") {
+		t.Fatalf("definition file does not use the binary compiled on the host:\n%s", content)
+	}
+}
+
+func TestTarballSize(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name      string
+		size      int64
+		buildArgs bool
+		expected  string
+	}{
+		{name: "no size"},
+		{name: "size", size: 9530765, expected: "\ttest $(stat -c%s openmpi-3.1.4.tar.bz2) -eq 9530765 || "},
+		{name: "size with build arguments", size: 9530765, buildArgs: true, expected: "\ttest $(stat -c%s $(basename {{ MPI_URL }})) -eq {{ MPI_TARBALL_SIZE }} || "},
+	}
+
+	for _, tt := range tests {
+		data := getTestDefFileData(tempDir, "helloworld")
+		data.MpiImplm.TarballSize = tt.size
+		data.MpiImplm.Checksum = "900bf751be72eccf06de9d186f7b1c4b5c2fa9fa66458e53b77778dffdfe4057"
+		data.BuildArgs = tt.buildArgs
+		data.TargetSingularityVersion = "4.0"
+		err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to create definition file: %s", tt.name, err)
+		}
+		content := readDefFile(t, data.Path)
+		if tt.expected == "" {
+			if strings.Contains(content, "stat -c%s") {
+				t.Fatalf("%s: definition file checks the size of the tarball:\n%s", tt.name, content)
+			}
+			continue
+		}
+
+		// The size is checked right after the download, before the checksum
+		download := strings.Index(content, "$MPI_URL")
+		check := strings.Index(content, tt.expected)
+		checksum := strings.Index(content, "sha256sum -c -")
+		if check == -1 || check < download || check > checksum {
+			t.Fatalf("%s: definition file does not check the size of the tarball after downloading it:\n%s", tt.name, content)
+		}
+		if tt.buildArgs && !strings.Contains(content, "\tMPI_TARBALL_SIZE=9530765\n") {
+			t.Fatalf("%s: default value of the tarball size is missing:\n%s", tt.name, content)
+		}
+	}
+}
+
+// getFieldNames returns the names of the fields of a structure, in order
+func getFieldNames(v interface{}) []string {
+	var names []string
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		names = append(names, typ.Field(i).Name)
+	}
+	return names
+}
+
+func TestInterconnectLabel(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	sysCfg.SingularityBin = filepath.Join(tempDir, "bin", "singularity")
+
+	for _, interconnect := range append([]string{""}, container.SupportedInterconnects()...) {
+		data := getTestDefFileData(tempDir, helloworld.Name)
+		data.Model = container.HybridModel
+		data.Interconnect = interconnect
+		err = Create(&helloworld, &data, &sysCfg, CreateOptions{})
+		if err != nil {
+			t.Fatalf("failed to create definition file: %s", err)
+		}
+		content := readDefFile(t, data.Path)
+		if interconnect == "" && strings.Contains(content, container.InterconnectLabel) {
+			t.Fatalf("unexpected interconnect label:\n%s", content)
+		}
+
+		fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{{Stdout: getInspectOutput(content)}}}
+		defaultRunner := container.SetRunner(fakeRunner)
+		metadata, _, err := container.GetMetadata(filepath.Join(tempDir, "helloworld.sif"), &sysCfg)
+		container.SetRunner(defaultRunner)
+		if err != nil {
+			t.Fatalf("failed to get metadata: %s", err)
+		}
+		if metadata.Interconnect != interconnect {
+			t.Fatalf("interconnect is %q instead of %q", metadata.Interconnect, interconnect)
+		}
+	}
+}
+
+// getPostSection returns the content of the post section of a definition file
+func getPostSection(t *testing.T, content string) string {
+	start := strings.Index(content, "%post\n")
+	if start == -1 {
+		t.Fatalf("definition file does not have a post section:\n%s", content)
+	}
+	post := content[start+len("%post\n"):]
+	end := strings.Index(post, "\n%")
+	if end != -1 {
+		post = post[:end]
+	}
+	return strings.TrimRight(post, "\n") + "\n"
+}
+
+func TestCleanUp(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	netpipe := app.GetNetpipe(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	expectedCleanup := map[string]string{
+		"ubuntu":    "\tapt-get clean\n\trm -rf /var/lib/apt/lists/*\n",
+		"centos":    "\tyum clean all\n\trm -rf /var/cache/yum\n",
+		"fedora":    "\tdnf clean all\n\trm -rf /var/cache/dnf\n",
+		"rocky":     "\tdnf clean all\n\trm -rf /var/cache/dnf\n",
+		"almalinux": "\tdnf clean all\n\trm -rf /var/cache/dnf\n",
+		"alpine":    "\trm -rf /var/cache/apk/*\n",
+		"opensuse":  "\tzypper clean --all\n",
+	}
+	leftovers := "\trm -rf " + DefaultAppRoot + "/NetPIPE-5.1.4.tar.gz\n\trm -rf " + DefaultMPIBuildDir + "\n"
+	for _, id := range SupportedDistros() {
+		expected, ok := expectedCleanup[id.Name]
+		if !ok {
+			t.Fatalf("cleanup of %s is not tested", id.Name)
+		}
+
+		data := getTestDefFileData(tempDir, "netpipe")
+		data.DistroID = id
+		data.Model = container.HybridModel
+		err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s:%s: failed to create definition file: %s", id.Name, id.Version, err)
+		}
+		post := getPostSection(t, readDefFile(t, data.Path))
+		if !strings.HasSuffix(post, leftovers+expected) {
+			t.Fatalf("%s:%s: post section does not end with %q:\n%s", id.Name, id.Version, leftovers+expected, post)
+		}
+	}
+
+	// Nothing is built in the image with the bind model
+	data := getTestDefFileData(tempDir, "netpipe")
+	data.Model = container.BindModel
+	if len(getBuildLeftovers(&netpipe, &data)) != 0 {
+		t.Fatalf("files to remove with the bind model: %v", getBuildLeftovers(&netpipe, &data))
+	}
+
+	data.DistroID = distro.ParseDescr("gentoo:17")
+	f, err := os.Create(data.Path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", data.Path, err)
+	}
+	defer f.Close()
+	if addCleanUp(f, &netpipe, &data) == nil {
+		t.Fatalf("cleanup of an unsupported distro accepted")
+	}
+}
+
+func TestXZTarball(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	url := "https://download.open-mpi.org/release/open-mpi/v4.1/openmpi-4.1.5.tar.xz"
+
+	// Template substitution
+	var data DefFileData
+	openmpi := implem.Info{ID: implem.OMPI, Version: "4.1.5", URL: url}
+	data.MpiImplm = &openmpi
+	data.Tags.Version = "OMPIVERSION"
+	data.Tags.URL = "OMPIURL"
+	data.Tags.Tarball = "OMPITARBALL"
+	data.DistroID = distro.ParseDescr("ubuntu:disco")
+	data.Path = filepath.Join(tempDir, "openmpi.def")
+	template := "Bootstrap: docker\nFrom: ubuntu:DISTROCODENAME\n\n%post\n\twget OMPIURL\n\ttar TARARGS OMPITARBALL\n"
+	err = ioutil.WriteFile(data.Path, []byte(template), 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", data.Path, err)
+	}
+	err = UpdateDeffileTemplate(data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to update template: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if !strings.Contains(content, "\ttar -xJf openmpi-4.1.5.tar.xz\n") {
+		t.Fatalf("definition file does not extract the xz tarball:\n%s", content)
+	}
+
+	// Generated definition file
+	data = getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	data.MpiImplm.Version = "4.1.5"
+	data.MpiImplm.URL = url
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	// The tarball is extracted in a directory named after it, where MPI is compiled
+	srcDir := strings.TrimSuffix(path.Base(url), ".tar.xz")
+	if srcDir != implem.OMPI+"-"+data.MpiImplm.Version {
+		t.Fatalf("unexpected source directory: %s", srcDir)
+	}
+	expected := []string{
+		"\tcd $MPI_BUILDDIR\n\tn=0; until wget -c $MPI_URL;",
+		"\ttar -xJf " + path.Base(url) + "\n",
+		"\tcd $MPI_BUILDDIR/openmpi-$MPI_VERSION && ./configure",
+		"\texport MPI_VERSION=4.1.5\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(content, e) {
+			t.Fatalf("definition file does not include %q:\n%s", e, content)
+		}
+	}
+}
+
+func TestAppTestSection(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name       string
+		appTest    bool
+		enableTest bool
+		ranks      int
+		model      string
+		expected   []string
+		missing    []string
+		fails      bool
+	}{
+		{
+			name:    "disabled",
+			model:   container.HybridModel,
+			missing: []string{"%test", "make check"},
+		},
+		{
+			name:     "serial",
+			appTest:  true,
+			model:    container.HybridModel,
+			expected: []string{"%test\n\tset -e\n\tcd /opt/NetPIPE-5.1.4 && make check\n"},
+		},
+		{
+			name:     "mpi",
+			appTest:  true,
+			ranks:    4,
+			model:    container.HybridModel,
+			expected: []string{"\tcd /opt/NetPIPE-5.1.4 && $MPI_DIR/bin/mpirun --allow-run-as-root --oversubscribe -np 4 make check\n"},
+		},
+		{
+			name:       "with MPI test",
+			appTest:    true,
+			enableTest: true,
+			model:      container.HybridModel,
+			expected:   []string{"$SYMPI_TEST_DIR/helloworld\n\trm -rf $SYMPI_TEST_DIR\n\tcd /opt/NetPIPE-5.1.4 && make check\n"},
+			missing:    []string{"set -e\n\tcd"},
+		},
+		{
+			name:    "bind with ranks",
+			appTest: true,
+			ranks:   2,
+			model:   container.BindModel,
+			fails:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		netpipe := app.GetNetpipe(&sysCfg)
+		netpipe.TestCmd = "make check"
+		netpipe.TestRanks = tt.ranks
+		data := getTestDefFileData(tempDir, netpipe.Name)
+		data.MpiImplm.ID = implem.OMPI
+		data.Model = tt.model
+		data.AppTest = tt.appTest
+		data.EnableTest = tt.enableTest
+		var buf bytes.Buffer
+		err = data.Render(&buf, &netpipe, &sysCfg)
+		if tt.fails {
+			if err == nil {
+				t.Fatalf("%s: rendering the definition file succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to render definition file: %s", tt.name, err)
+		}
+		content := buf.String()
+		for _, e := range tt.expected {
+			if !strings.Contains(content, e) {
+				t.Fatalf("%s: definition file does not include %q:\n%s", tt.name, e, content)
+			}
+		}
+		for _, m := range tt.missing {
+			if strings.Contains(content, m) {
+				t.Fatalf("%s: definition file includes %q:\n%s", tt.name, m, content)
+			}
+		}
+	}
+}
+
+func TestOsmcompSymlink(t *testing.T) {
+	var buf bytes.Buffer
+	data := DefFileData{Arch: ArchX86_64}
+	err := addDebianDependencies(&buf, &data, []string{"libc6", "libopensm-dev", "libibverbs1"})
+	if err != nil {
+		t.Fatalf("failed to add dependencies: %s", err)
+	}
+	if strings.Contains(buf.String(), "libosmcomp.so") {
+		t.Fatalf("libosmcomp symlink is created while libosmcomp is not a dependency:\n%s", buf.String())
+	}
+
+	for arch, libDir := range map[string]string{ArchX86_64: "/usr/lib/x86_64-linux-gnu", ArchAarch64: "/usr/lib/aarch64-linux-gnu"} {
+		buf.Reset()
+		data.Arch = arch
+		err = addDebianDependencies(&buf, &data, []string{"libc6", "libosmcomp3"})
+		if err != nil {
+			t.Fatalf("failed to add dependencies: %s", err)
+		}
+		expected := "\tln -sf " + libDir + "/libosmcomp.so " + libDir + "/libosmcomp.so.3\n"
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("libosmcomp symlink is not created in %s:\n%s", libDir, buf.String())
+		}
+	}
+}
+
+func TestAppChecksum(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	netpipe := app.GetNetpipe(&sysCfg)
+	tarball := path.Base(netpipe.Source)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, netpipe.Name)
+	data.Model = container.HybridModel
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if strings.Contains(content, "sha256sum") {
+		t.Fatalf("checksum of the application is verified while not available:\n%s", content)
+	}
+
+	netpipe.SourceChecksum = "900bf751be72eccf06de9d186f7b1c4b5c2fa9fa66458e53b77778dffdfe4057"
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	check := strings.Index(content, "\techo \""+netpipe.SourceChecksum+"  "+tarball+"\" | sha256sum -c -\n")
+	download := strings.Index(content, "wget -c "+netpipe.Source)
+	extract := strings.Index(content, "tar -tf "+tarball)
+	if check == -1 || check < download || check > extract {
+		t.Fatalf("checksum of the application is not verified between the download and the extraction:\n%s", content)
+	}
+
+	// The checksum is a build argument when the URL of the application is
+	data.BuildArgs = true
+	data.TargetSingularityVersion = "4.0"
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if !strings.Contains(content, "\tAPP_CHECKSUM="+netpipe.SourceChecksum+"\n") || !strings.Contains(content, "\techo \"{{ APP_CHECKSUM }}  $(basename {{ APP_SOURCE }})\" | sha256sum -c -\n") {
+		t.Fatalf("checksum of the application is not a build argument:\n%s", content)
+	}
+
+	// Only downloaded tarballs are checked
+	helloworld := app.GetHelloworld(&sysCfg)
+	helloworld.SourceChecksum = netpipe.SourceChecksum
+	data = getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if strings.Contains(content, "sha256sum") {
+		t.Fatalf("checksum of a local source file is verified:\n%s", content)
+	}
+}
+
+func TestAppSymlink(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	netpipe := app.GetNetpipe(&sysCfg)
+	netpipe.BinPath = ""
+	netpipe.BinName = "NPmpi"
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The executable of the application is the symlink, the build fails if the binary does not exist
+	data := getTestDefFileData(tempDir, netpipe.Name)
+	data.Model = container.HybridModel
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	expected := "\tcd /opt\n" +
+		"\tif [ ! -e $APPDIR/NPmpi ]; then echo \"cannot find the binary of the application: $APPDIR/NPmpi\" >&2; exit 1; fi\n" +
+		"\tln -sf $APPDIR/NPmpi NPmpi\n"
+	if !strings.Contains(content, expected) || strings.Contains(content, "|| true") {
+		t.Fatalf("definition file does not create the symlink to the binary:\n%s", content)
+	}
+
+	// The symlink points to the binary when its path is known
+	netpipe.BinPath = "/opt/NetPIPE-5.1.4/NPmpi"
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if !strings.Contains(content, "\tln -sf /opt/NetPIPE-5.1.4/NPmpi NPmpi\n") {
+		t.Fatalf("definition file does not create the symlink to %s:\n%s", netpipe.BinPath, content)
+	}
+
+	data.NoAppSymlink = true
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if strings.Contains(content, "ln -sf") {
+		t.Fatalf("symlink to the binary is created while disabled:\n%s", content)
+	}
+}
+
+func TestGitRef(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	imb := app.GetIMB(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name     string
+		ref      string
+		depth    int
+		expected string
+	}{
+		{name: "default branch", expected: "\tcd /opt && (git clone " + imb.Source + " || (cd mpi-benchmarks && git pull))\n"},
+		{name: "shallow clone", depth: 10, expected: "\tcd /opt && (git clone --depth 10 " + imb.Source + " || (cd mpi-benchmarks && git pull))\n"},
+		{name: "tag", ref: "v4.1.2", expected: "\tcd /opt && (git clone --branch v4.1.2 --depth 1 " + imb.Source + " || (cd mpi-benchmarks && git fetch --depth 1 origin v4.1.2 && git checkout FETCH_HEAD))\n"},
+		{name: "commit", ref: "4aa1bd1", depth: 1, expected: "\tcd /opt && (git clone " + imb.Source + " || (cd mpi-benchmarks && git fetch)) && (cd mpi-benchmarks && git checkout 4aa1bd1)\n"},
+	}
+
+	for _, tt := range tests {
+		imb.Ref = tt.ref
+		imb.Depth = tt.depth
+		data := getTestDefFileData(tempDir, imb.Name)
+		data.Model = container.HybridModel
+		err = CreateHybridDefFile(&imb, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to create definition file: %s", tt.name, err)
+		}
+		content := readDefFile(t, data.Path)
+		clone := strings.Index(content, tt.expected)
+		if clone == -1 {
+			t.Fatalf("%s: definition file does not include %q:\n%s", tt.name, tt.expected, content)
+		}
+		// The directory of the application is detected after the checkout
+		if strings.Index(content, "\tAPPDIR="+strings.TrimSuffix(path.Base(imb.Source), ".git")+"\n") < clone {
+			t.Fatalf("%s: the directory of the application is not detected after the clone:\n%s", tt.name, content)
+		}
+	}
+
+	imb.Ref = "v1; rm -rf /"
+	data := getTestDefFileData(tempDir, imb.Name)
+	data.Model = container.HybridModel
+	if CreateHybridDefFile(&imb, &data, &sysCfg) == nil {
+		t.Fatalf("invalid Git reference accepted")
+	}
+}
+
+func TestAppDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		sourceDir string
+		buildArgs bool
+		expected  string
+	}{
+		{name: "git", source: "https://github.com/intel/mpi-benchmarks.git", expected: "mpi-benchmarks"},
+		{name: "tar.gz", source: "http://netpipe.cs.ksu.edu/download/NetPIPE-5.1.4.tar.gz", expected: "NetPIPE-5.1.4"},
+		{name: "tar.bz2", source: "https://example.com/app-1.0.tar.bz2", expected: "app-1.0"},
+		{name: "override", source: "https://example.com/download/v2.3.tar.gz", sourceDir: "myapp-2.3", expected: "myapp-2.3"},
+		{name: "git override", source: "https://github.com/intel/mpi-benchmarks.git", sourceDir: "imb", expected: "imb"},
+		{name: "git build args", source: "https://github.com/intel/mpi-benchmarks.git", buildArgs: true, expected: "\"$(basename {{ " + AppSourceArg + " }} .git)\""},
+		{name: "tarball build args", source: "http://netpipe.cs.ksu.edu/download/NetPIPE-5.1.4.tar.gz", buildArgs: true, expected: "\"$TOPDIR\""},
+	}
+
+	for _, tt := range tests {
+		a := app.Info{Name: "app", Source: tt.source, SourceDir: tt.sourceDir}
+		data := DefFileData{BuildArgs: tt.buildArgs}
+		if tt.buildArgs {
+			data.TargetSingularityVersion = BuildArgsMinVersion
+		}
+		dir, err := getAppDir(&a, &data)
+		if err != nil {
+			t.Fatalf("%s: failed to get the directory of the application: %s", tt.name, err)
+		}
+		if dir != tt.expected {
+			t.Fatalf("%s: directory of the application is %s instead of %s", tt.name, dir, tt.expected)
+		}
+
+		var buf bytes.Buffer
+		err = addAppDownload(&buf, &a, &data)
+		if err != nil {
+			t.Fatalf("%s: failed to add the download of the application: %s", tt.name, err)
+		}
+		expected := "\tAPPDIR=" + tt.expected + "\n\tif [ ! -d /opt/$APPDIR ]; then echo \"cannot find the directory of the application: /opt/$APPDIR\" >&2; exit 1; fi\n"
+		if !strings.HasSuffix(buf.String(), expected+"\n") {
+			t.Fatalf("%s: APPDIR is not set after the download:\n%s", tt.name, buf.String())
+		}
+		if strings.Contains(buf.String(), "ls -l") {
+			t.Fatalf("%s: the directory of the application is detected from the content of /opt:\n%s", tt.name, buf.String())
+		}
+	}
+
+	// A Git repository is cloned in the requested directory
+	a := app.Info{Source: "https://github.com/intel/mpi-benchmarks.git", SourceDir: "imb"}
+	var buf bytes.Buffer
+	err := addAppDownload(&buf, &a, &DefFileData{})
+	if err != nil {
+		t.Fatalf("failed to add the download of the application: %s", err)
+	}
+	if !strings.Contains(buf.String(), "git clone "+a.Source+" imb || (cd imb && git pull)") {
+		t.Fatalf("the repository is not cloned in imb:\n%s", buf.String())
+	}
+
+	for _, dir := range []string{"..", "a/b", "a b", "$(reboot)"} {
+		a := app.Info{Source: "http://netpipe.cs.ksu.edu/download/NetPIPE-5.1.4.tar.gz", SourceDir: dir}
+		_, err := getAppDir(&a, &DefFileData{})
+		if err == nil {
+			t.Fatalf("invalid directory %q is accepted", dir)
+		}
+	}
+}
+
+func TestUpdateDeffileTemplateDestPath(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var data DefFileData
+	data.Tags.Version = "OMPIVERSION"
+	data.Tags.URL = "OMPIURL"
+	data.Tags.Tarball = "OMPITARBALL"
+	data.DistroID = distro.ParseDescr("ubuntu:disco")
+	data.Path = filepath.Join(tempDir, "openmpi.def.tmpl")
+	template := "Bootstrap: docker\nFrom: ubuntu:DISTROCODENAME\n\n%post\n\twget OMPIURL\n\ttar TARARGS OMPITARBALL\n"
+	err = ioutil.WriteFile(data.Path, []byte(template), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", data.Path, err)
+	}
+
+	// Several definition files are generated from the same template
+	var sysCfg sys.Config
+	for _, version := range []string{"3.1.4", "4.0.2"} {
+		openmpi := implem.Info{ID: implem.OMPI, Version: version, URL: "https://download.open-mpi.org/release/open-mpi/openmpi-" + version + ".tar.bz2"}
+		data.MpiImplm = &openmpi
+		data.DestPath = filepath.Join(tempDir, "defs", version, "openmpi.def")
+		err = UpdateDeffileTemplate(data, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to update template for %s: %s", version, err)
+		}
+
+		content := readDefFile(t, data.DestPath)
+		if !strings.Contains(content, "\ttar -xjf openmpi-"+version+".tar.bz2\n") {
+			t.Fatalf("invalid definition file for %s:\n%s", version, content)
+		}
+		fi, err := os.Stat(data.DestPath)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", data.DestPath, err)
+		}
+		if fi.Mode().Perm() != 0644 {
+			t.Fatalf("%s has mode %o instead of 0644", data.DestPath, fi.Mode().Perm())
+		}
+	}
+	if readDefFile(t, data.Path) != template {
+		t.Fatalf("template was modified")
+	}
+
+	// Without destination, the template is updated in place
+	data.DestPath = ""
+	err = UpdateDeffileTemplate(data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to update template: %s", err)
+	}
+	if !strings.Contains(readDefFile(t, data.Path), "From: ubuntu:disco\n") {
+		t.Fatalf("template was not updated in place")
+	}
 }
@@ -0,0 +1,220 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/internal/pkg/pkgmap"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// debPackageFormat is the identifier of distributions using Debian packages
+	debPackageFormat = pkgmap.DebFormat
+
+	// rpmPackageFormat is the identifier of distributions using RPM packages
+	rpmPackageFormat = pkgmap.RPMFormat
+
+	// apkPackageFormat is the identifier of distributions using Alpine packages
+	apkPackageFormat = pkgmap.ApkFormat
+
+	// zypperPackageManager is the package manager of openSUSE, which uses RPM packages
+	zypperPackageManager = "zypper"
+)
+
+// openSUSEPackageNames are the RPM packages that openSUSE names differently than the RHEL-based distributions
+var openSUSEPackageNames = map[string]string{
+	"gcc-gfortran":     "gcc-fortran",
+	"libibverbs":       "libibverbs1",
+	"libibverbs-devel": "rdma-core-devel",
+	"librdmacm":        "librdmacm1",
+	"librdmacm-devel":  "rdma-core-devel",
+	"libmlx4":          "libmlx4-1",
+	"libfabric":        "libfabric1",
+}
+
+// distroSectionFn is a "function pointer" for the distribution-specific code adding a section to a definition file
+type distroSectionFn func(io.Writer, *DefFileData, *sys.Config) error
+
+// distroSupport describes how definition files are generated for a given Linux distribution
+type distroSupport struct {
+	// name is the name of the Linux distribution, e.g., ubuntu
+	name string
+
+	// versions is the list of supported versions, using the format of the distribution descriptions (e.g., disco for ubuntu:disco)
+	versions []string
+
+	// packageFormat is the format of the packages of the Linux distribution
+	packageFormat string
+
+	// packageManager is the command used to install packages, e.g., yum
+	packageManager string
+
+	// packageNames are the names of the packages of the distribution that differ from the usual names of
+	// packageFormat, e.g., gcc-fortran instead of gcc-gfortran on openSUSE (optional)
+	packageNames map[string]string
+
+	// cleanup are the commands cleaning up the cache of the package manager at the end of the post section
+	cleanup []string
+
+	// bootstrap adds the bootstrap section when no base image is available from the library
+	bootstrap distroSectionFn
+
+	// init adds the code initializing the Linux distribution to the post section
+	init distroSectionFn
+
+	// minimalInit adds the code initializing a minimal version of the Linux distribution, with only the runtime
+	// dependencies, to the post section; nil if not available
+	minimalInit distroSectionFn
+
+	// mirrorSetup returns the commands pointing the package manager to the mirror in $mirror and refreshing the
+	// index of the packages; nil if mirrors are not supported
+	mirrorSetup func(*DefFileData) string
+
+	// snapshotMirror returns the URL of the snapshot of the repositories at a given point in time; nil if no
+	// snapshot service is known for the distribution
+	snapshotMirror snapshotMirrorFn
+
+	// rocmInit adds the code installing the ROCm runtime and development packages to the post section; nil if
+	// ROCm is not available
+	rocmInit distroSectionFn
+}
+
+// distros is the list of Linux distributions for which we can generate definition files
+var distros = []distroSupport{
+	{
+		name:           "ubuntu",
+		versions:       []string{"xenial", "bionic", "disco", "eoan", "focal", "groovy"},
+		packageFormat:  debPackageFormat,
+		packageManager: "apt-get",
+		cleanup:        []string{"apt-get clean", "rm -rf /var/lib/apt/lists/*"},
+		bootstrap:      addUbuntuBootstrap,
+		init:           addUbuntuInit,
+		minimalInit:    addUbuntuMinimalInit,
+		mirrorSetup:    getUbuntuMirrorSetup,
+		snapshotMirror: getUbuntuSnapshotMirror,
+		rocmInit:       addUbuntuROCmInit,
+	},
+	{
+		name:           "centos",
+		versions:       []string{"6", "7"},
+		packageFormat:  rpmPackageFormat,
+		packageManager: "yum",
+		cleanup:        []string{"yum clean all", "rm -rf /var/cache/yum"},
+		bootstrap:      addCentosBootstrap,
+		init:           addCentosInit,
+		mirrorSetup:    getCentosMirrorSetup,
+		rocmInit:       addCentosROCmInit,
+	},
+	{
+		name:           "fedora",
+		versions:       []string{"37", "38", "39"},
+		packageFormat:  rpmPackageFormat,
+		packageManager: "dnf",
+		cleanup:        []string{"dnf clean all", "rm -rf /var/cache/dnf"},
+		bootstrap:      addFedoraBootstrap,
+		init:           addDnfInit,
+		rocmInit:       addDnfROCmInit,
+	},
+	{
+		name:           "rocky",
+		versions:       []string{"8", "9"},
+		packageFormat:  rpmPackageFormat,
+		packageManager: "dnf",
+		cleanup:        []string{"dnf clean all", "rm -rf /var/cache/dnf"},
+		bootstrap:      addRockyBootstrap,
+		init:           addDnfInit,
+		rocmInit:       addDnfROCmInit,
+	},
+	{
+		name:           "almalinux",
+		versions:       []string{"8", "9"},
+		packageFormat:  rpmPackageFormat,
+		packageManager: "dnf",
+		cleanup:        []string{"dnf clean all", "rm -rf /var/cache/dnf"},
+		bootstrap:      addAlmaLinuxBootstrap,
+		init:           addDnfInit,
+		rocmInit:       addDnfROCmInit,
+	},
+	{
+		name:           "alpine",
+		versions:       []string{"3.17", "3.18", "3.19"},
+		packageFormat:  apkPackageFormat,
+		packageManager: "apk",
+		cleanup:        []string{"rm -rf /var/cache/apk/*"},
+		bootstrap:      addAlpineBootstrap,
+		init:           addAlpineInit,
+	},
+	{
+		name:           "opensuse",
+		versions:       []string{"15.4", "15.5", "15.6"},
+		packageFormat:  rpmPackageFormat,
+		packageManager: zypperPackageManager,
+		packageNames:   openSUSEPackageNames,
+		cleanup:        []string{"zypper clean --all"},
+		bootstrap:      addOpenSUSEBootstrap,
+		init:           addZypperInit,
+	},
+}
+
+// getInstallCmd returns the command installing packages with the package manager of the Linux distribution
+func (d *distroSupport) getInstallCmd() string {
+	switch {
+	case d.packageFormat == apkPackageFormat:
+		return "apk add --no-cache"
+	case d.packageManager == zypperPackageManager:
+		return "zypper --non-interactive install"
+	}
+	return d.packageManager + " install -y"
+}
+
+// getPackageNames returns the names of a list of packages of packageFormat for the Linux distribution
+func (d *distroSupport) getPackageNames(pkgs []string) []string {
+	if d.packageNames == nil {
+		return pkgs
+	}
+	var names []string
+	for _, pkg := range pkgs {
+		if name, ok := d.packageNames[pkg]; ok {
+			pkg = name
+		}
+		names = append(names, pkg)
+	}
+	return names
+}
+
+// getDistroSupport returns the description of how to generate definition files for a Linux distribution, nil if not supported
+func getDistroSupport(name string) *distroSupport {
+	for i := range distros {
+		if distros[i].name == name {
+			return &distros[i]
+		}
+	}
+	return nil
+}
+
+// SupportedDistros returns the list of Linux distributions for which definition files can be generated
+func SupportedDistros() []distro.ID {
+	var ids []distro.ID
+	for _, d := range distros {
+		for _, v := range d.versions {
+			ids = append(ids, distro.ParseDescr(d.name+":"+v))
+		}
+	}
+	return ids
+}
+
+// isSupportedDistro checks whether a Linux distribution is in the list of supported distributions
+func isSupportedDistro(id distro.ID) bool {
+	for _, supported := range SupportedDistros() {
+		if supported == id {
+			return true
+		}
+	}
+	return false
+}
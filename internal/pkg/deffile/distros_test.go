@@ -0,0 +1,98 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+func TestSupportedCombinations(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	expectedDistros := []string{
+		"ubuntu:xenial", "ubuntu:bionic", "ubuntu:disco", "ubuntu:eoan", "ubuntu:focal", "ubuntu:groovy",
+		"centos:6", "centos:7",
+		"fedora:37", "fedora:38", "fedora:39",
+		"rocky:8", "rocky:9",
+		"almalinux:8", "almalinux:9",
+		"alpine:3.17", "alpine:3.18", "alpine:3.19",
+		"opensuse:15.4", "opensuse:15.5", "opensuse:15.6",
+	}
+	expectedMPIs := []string{implem.OMPI, implem.MPICH}
+	expectedModels := []string{container.HybridModel, container.BindModel}
+
+	var distros []distro.ID
+	for _, d := range expectedDistros {
+		distros = append(distros, distro.ParseDescr(d))
+	}
+	if !reflect.DeepEqual(SupportedDistros(), distros) {
+		t.Fatalf("invalid list of distros: %v", SupportedDistros())
+	}
+	var mpis []string
+	for _, mpi := range SupportedImplementations() {
+		mpis = append(mpis, mpi.ID)
+	}
+	if !reflect.DeepEqual(mpis, expectedMPIs) {
+		t.Fatalf("invalid list of MPI implementations: %v", mpis)
+	}
+	if !reflect.DeepEqual(container.SupportedModels(), expectedModels) {
+		t.Fatalf("invalid list of models: %v", container.SupportedModels())
+	}
+
+	for _, d := range distros {
+		for _, mpi := range expectedMPIs {
+			for _, model := range expectedModels {
+				data := getTestDefFileData(tempDir, d.Name+d.Version+mpi+model)
+				data.DistroID = d
+				data.MpiImplm.ID = mpi
+				data.Model = model
+				err := data.Validate()
+				if err != nil {
+					t.Fatalf("combination %s %s/%s/%s is invalid: %s", d.Name, d.Version, mpi, model, err)
+				}
+			}
+		}
+
+		data := getTestDefFileData(tempDir, d.Name+d.Version)
+		data.DistroID = d
+		err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to create definition file for %s %s: %s", d.Name, d.Version, err)
+		}
+	}
+
+	// Intel MPI is only installed on the host
+	data := getTestDefFileData(tempDir, "invalid")
+	data.MpiImplm.ID = implem.IMPI
+	if data.Validate() == nil {
+		t.Fatalf("MPI implementation without generator was successfully validated")
+	}
+	data = getTestDefFileData(tempDir, "invalid")
+	data.DistroID = distro.ParseDescr("gentoo:17")
+	if data.Validate() == nil {
+		t.Fatalf("unsupported distro was successfully validated")
+	}
+	data = getTestDefFileData(tempDir, "invalid")
+	data.Model = "unknown"
+	if data.Validate() == nil {
+		t.Fatalf("unsupported model was successfully validated")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+// mpiDefaultEnv is the environment set by default in the images of each MPI implementation, to work around
+// the common issues of MPI in containers
+var mpiDefaultEnv = map[string]map[string]string{
+	implem.OMPI: {
+		// Cross-memory attach fails between containers (ptrace restrictions), which makes vader hang
+		"OMPI_MCA_btl_vader_single_copy_mechanism": "none",
+	},
+}
+
+// getMPIEnv returns the environment variables of the image: the defaults of the MPI implementation
+// overridden by the variables of the definition file
+func getMPIEnv(deffile *DefFileData) map[string]string {
+	env := make(map[string]string)
+	if deffile.MpiImplm != nil {
+		for name, value := range mpiDefaultEnv[deffile.MpiImplm.ID] {
+			env[name] = value
+		}
+	}
+	for name, value := range deffile.EnvVars {
+		env[name] = value
+	}
+	return env
+}
+
+// checkEnvVars checks the environment variables set in the image
+func checkEnvVars(env map[string]string) error {
+	for name, value := range env {
+		if !envVarRegexp.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name: %s", name)
+		}
+		if strings.ContainsAny(value, "\"\n") {
+			return fmt.Errorf("invalid value of environment variable %s: %s", name, value)
+		}
+	}
+	return nil
+}
+
+// getEnvNames returns the sorted names of a set of environment variables
+func getEnvNames(env map[string]string) []string {
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getEnvContent returns the content of the environment section setting the environment variables
+func getEnvContent(env map[string]string) string {
+	content := ""
+	for _, name := range getEnvNames(env) {
+		content += "\t" + name + "=\"" + env[name] + "\"\n\texport " + name + "\n"
+	}
+	return content
+}
+
+// getImageEnv returns the environment set by the environment section of MPI images, as NAME=value
+func getImageEnv(deffile *DefFileData) []string {
+	imageEnv := []string{
+		"MPI_DIR=" + deffile.layout().MPIPrefix,
+		"PATH=$MPI_DIR/bin:$PATH",
+		"LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH",
+	}
+	env := getMPIEnv(deffile)
+	for _, name := range getEnvNames(env) {
+		imageEnv = append(imageEnv, name+"="+env[name])
+	}
+	return imageEnv
+}
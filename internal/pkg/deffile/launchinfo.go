@@ -0,0 +1,80 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+const (
+	// LaunchInfoFileName is the name of the file describing how to launch the image, in the application root
+	LaunchInfoFileName = "launch-info"
+
+	// launchNP is the placeholder of the number of ranks in the launch command
+	launchNP = "<NP>"
+
+	// launchImage is the placeholder of the path to the image in the launch command
+	launchImage = "<IMAGE>"
+
+	// launchHostMPIDir is the placeholder of the directory of MPI on the host in the launch command
+	launchHostMPIDir = "<HOST_MPI_DIR>"
+)
+
+// hasLaunchInfo checks whether the image reports its launch command, which only makes sense for MPI images
+func hasLaunchInfo(deffile *DefFileData) bool {
+	return deffile.LaunchInfo && deffile.MpiImplm != nil && (deffile.Model == container.HybridModel || deffile.Model == container.BindModel)
+}
+
+// GetLaunchInfoPath returns the path to the file describing how to launch the image
+func GetLaunchInfoPath(deffile *DefFileData) string {
+	return deffile.layout().AppRoot + "/" + LaunchInfoFileName
+}
+
+// getLaunchCommand returns the recommended command to launch the application of the image: the MPI of the
+// host starts the containers with the hybrid model while the MPI of the host is bound in the containers
+// started by the job manager with the bind model
+func getLaunchCommand(app *app.Info, deffile *DefFileData) string {
+	appExe := getAppExe(app, deffile)
+	if deffile.Model == container.BindModel {
+		return "srun -n " + launchNP + " singularity exec --bind " + launchHostMPIDir + ":" + deffile.layout().MPIPrefix + " " + launchImage + " " + appExe
+	}
+	return "mpirun -np " + launchNP + " singularity exec " + launchImage + " " + appExe
+}
+
+// getLaunchInfo returns the content of the file describing how to launch the image
+func getLaunchInfo(app *app.Info, deffile *DefFileData) string {
+	mpi := deffile.MpiImplm.ID + " " + getValue(deffile, MPIVersionArg, deffile.MpiImplm.Version)
+	content := "Model: " + deffile.Model + "\n" +
+		"MPI: " + mpi + "\n" +
+		"Launch command: " + getLaunchCommand(app, deffile) + "\n\n" +
+		launchNP + " is the number of ranks and " + launchImage + " the path to this image.\n"
+	if deffile.Model == container.BindModel {
+		content += launchHostMPIDir + " is the installation directory of " + mpi + " on the host, it is mounted on " + deffile.layout().MPIPrefix + ".\n"
+	} else {
+		content += "mpirun is the one of a MPI installation of the host compatible with " + mpi + ".\n"
+	}
+	return content
+}
+
+// addLaunchInfo adds to the post section the creation of the file describing how to launch the image, so that
+// users receiving the image know how to run it
+func addLaunchInfo(f io.Writer, app *app.Info, deffile *DefFileData) error {
+	if !hasLaunchInfo(deffile) {
+		return nil
+	}
+
+	_, err := io.WriteString(f, "\tmkdir -p "+deffile.layout().AppRoot+"\n"+
+		"\tcat > "+GetLaunchInfoPath(deffile)+" << 'EOF'\n"+getLaunchInfo(app, deffile)+"EOF\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestLaunchInfo(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		model    string
+		expected []string
+		missing  []string
+	}{
+		{
+			model: container.HybridModel,
+			expected: []string{
+				"\tLaunch_command mpirun -np <NP> singularity exec <IMAGE> /opt/NetPIPE-5.1.4/NPmpi\n",
+				"Model: hybrid\nMPI: openmpi 3.1.4\nLaunch command: mpirun -np <NP> singularity exec <IMAGE> /opt/NetPIPE-5.1.4/NPmpi\n",
+			},
+			missing: []string{"srun", "--bind"},
+		},
+		{
+			model: container.BindModel,
+			expected: []string{
+				"\tLaunch_command srun -n <NP> singularity exec --bind <HOST_MPI_DIR>:/opt/mpi <IMAGE> /opt/NPmpi\n",
+				"Model: bind\nMPI: openmpi 3.1.4\nLaunch command: srun -n <NP> singularity exec --bind <HOST_MPI_DIR>:/opt/mpi <IMAGE> /opt/NPmpi\n",
+				"<HOST_MPI_DIR> is the installation directory of openmpi 3.1.4 on the host, it is mounted on /opt/mpi.\n",
+			},
+			missing: []string{"mpirun -np"},
+		},
+	}
+
+	infos := make(map[string]string)
+	for _, tt := range tests {
+		netpipe := app.GetNetpipe(&sysCfg)
+		data := getTestDefFileData(tempDir, netpipe.Name)
+		data.Model = tt.model
+		if tt.model == container.BindModel {
+			netpipe.BinName = "NPmpi"
+		}
+
+		var buf bytes.Buffer
+		err = data.Render(&buf, &netpipe, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to render definition file: %s", tt.model, err)
+		}
+		if strings.Contains(buf.String(), "Launch_command") || strings.Contains(buf.String(), LaunchInfoFileName) {
+			t.Fatalf("%s: launch information is recorded while not requested:\n%s", tt.model, buf.String())
+		}
+
+		buf.Reset()
+		data.LaunchInfo = true
+		err = data.Render(&buf, &netpipe, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to render definition file: %s", tt.model, err)
+		}
+		content := buf.String()
+		start := "\tcat > /opt/" + LaunchInfoFileName + " << 'EOF'\n"
+		idx := strings.Index(content, start)
+		if idx == -1 {
+			t.Fatalf("%s: launch-info file is not created:\n%s", tt.model, content)
+		}
+		info := content[idx+len(start):]
+		info = info[:strings.Index(info, "EOF\n")]
+		infos[tt.model] = info
+
+		for _, e := range tt.expected {
+			if !strings.Contains(content, e) {
+				t.Fatalf("%s: definition file does not include %q:\n%s", tt.model, e, content)
+			}
+		}
+		for _, m := range tt.missing {
+			if strings.Contains(info, m) {
+				t.Fatalf("%s: launch-info includes %q:\n%s", tt.model, m, info)
+			}
+		}
+	}
+
+	if infos[container.HybridModel] == infos[container.BindModel] {
+		t.Fatalf("launch-info is the same with the hybrid and bind models:\n%s", infos[container.HybridModel])
+	}
+}
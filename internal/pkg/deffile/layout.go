@@ -0,0 +1,135 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+)
+
+const (
+	// DefaultAppRoot is the default directory where the application is downloaded and installed in the image
+	DefaultAppRoot = "/opt"
+
+	// DefaultMPIBuildDir is the default directory where MPI is built in the image
+	DefaultMPIBuildDir = "/opt/build-mpi"
+
+	// DefaultExtrasRoot is the default directory where additional software (e.g., UCX, PMIx) is installed in the image
+	DefaultExtrasRoot = "/opt/extras"
+)
+
+// ImageLayout gathers the well-known paths used in the image; empty fields are set to their default value
+type ImageLayout struct {
+	// AppRoot is the directory where the application is downloaded and installed
+	AppRoot string
+
+	// MPIBuildDir is the directory where MPI is built, removed at the end of the build
+	MPIBuildDir string
+
+	// MPIPrefix is the directory where MPI is installed; the install directory of the build environment by default
+	MPIPrefix string
+
+	// ExtrasRoot is the directory where additional software is installed
+	ExtrasRoot string
+}
+
+// layout returns the layout of the image with the default value of all the fields that are not set
+func (d *DefFileData) layout() ImageLayout {
+	l := d.Layout
+	if l.AppRoot == "" {
+		l.AppRoot = DefaultAppRoot
+	}
+	if l.MPIBuildDir == "" {
+		l.MPIBuildDir = DefaultMPIBuildDir
+	}
+	if l.MPIPrefix == "" && d.InternalEnv != nil {
+		l.MPIPrefix = d.InternalEnv.InstallDir
+	}
+	if l.ExtrasRoot == "" {
+		l.ExtrasRoot = DefaultExtrasRoot
+	}
+	return l
+}
+
+// isSubPath checks whether a path is equal to or nested in a directory
+func isSubPath(p string, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// overlap checks whether one of two paths is equal to or nested in the other
+func overlap(p1 string, p2 string) bool {
+	return isSubPath(p1, p2) || isSubPath(p2, p1)
+}
+
+// Validate checks that all the paths of the layout are absolute and do not collide.
+//
+// MPIBuildDir and ExtrasRoot may be nested in AppRoot (this is the default) but AppRoot cannot be nested in
+// any other directory. MPIPrefix may be nested in AppRoot but the build and install directories of MPI cannot
+// overlap since the build directory is removed at the end of the build.
+func (l *ImageLayout) Validate() error {
+	paths := []struct {
+		name  string
+		value string
+	}{
+		{"AppRoot", l.AppRoot},
+		{"MPIBuildDir", l.MPIBuildDir},
+		{"MPIPrefix", l.MPIPrefix},
+		{"ExtrasRoot", l.ExtrasRoot},
+	}
+	for _, p := range paths {
+		// MPIPrefix is not set when the definition file does not install MPI
+		if p.value == "" && p.name == "MPIPrefix" {
+			continue
+		}
+		if !path.IsAbs(p.value) || path.Clean(p.value) != p.value || p.value == "/" {
+			return fmt.Errorf("invalid %s: %s must be an absolute and clean path other than /", p.name, p.value)
+		}
+	}
+
+	if l.MPIBuildDir == l.AppRoot || l.ExtrasRoot == l.AppRoot {
+		return fmt.Errorf("%s is used for both the application and MPI or additional software", l.AppRoot)
+	}
+	if overlap(l.MPIBuildDir, l.ExtrasRoot) {
+		return fmt.Errorf("the build directory of MPI (%s) and the directory of additional software (%s) overlap", l.MPIBuildDir, l.ExtrasRoot)
+	}
+	if l.MPIPrefix != "" {
+		if isSubPath(l.AppRoot, l.MPIPrefix) {
+			return fmt.Errorf("the application directory (%s) is in the install directory of MPI (%s)", l.AppRoot, l.MPIPrefix)
+		}
+		if overlap(l.MPIPrefix, l.MPIBuildDir) {
+			return fmt.Errorf("the build (%s) and install (%s) directories of MPI overlap", l.MPIBuildDir, l.MPIPrefix)
+		}
+		if overlap(l.MPIPrefix, l.ExtrasRoot) {
+			return fmt.Errorf("the install directory of MPI (%s) and the directory of additional software (%s) overlap", l.MPIPrefix, l.ExtrasRoot)
+		}
+	}
+
+	return nil
+}
+
+// checkLayout checks the layout of the image and that the application's executable, linked in AppRoot,
+// does not collide with the reserved paths of the layout
+func checkLayout(app *app.Info, d *DefFileData) error {
+	l := d.layout()
+	err := l.Validate()
+	if err != nil {
+		return err
+	}
+	if app == nil || app.BinName == "" {
+		return nil
+	}
+
+	appPath := path.Join(l.AppRoot, app.BinName)
+	for _, reserved := range []string{l.MPIBuildDir, l.MPIPrefix, l.ExtrasRoot} {
+		if reserved != "" && overlap(appPath, reserved) {
+			return fmt.Errorf("the executable of %s (%s) collides with %s", app.Name, appPath, reserved)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestDefaultLayoutGolden(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	hybridApps := map[string]app.Info{
+		"helloworld": app.GetHelloworld(&sysCfg),
+		"netpipe":    app.GetNetpipe(&sysCfg),
+		"imb":        app.GetIMB(&sysCfg),
+	}
+	for name, a := range hybridApps {
+		data := getTestDefFileData(tempDir, name)
+		data.Model = container.HybridModel
+		err = CreateHybridDefFile(&a, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to create definition file for %s: %s", name, err)
+		}
+		checkGolden(t, data.Path, filepath.Join("testdata", "hybrid-"+name+".def"), &sysCfg)
+	}
+
+	helloworld := app.GetHelloworld(&sysCfg)
+	helloworld.BinPath = "/nonexistent/helloworld"
+	data := getTestDefFileData(tempDir, "helloworld")
+	data.Model = container.BindModel
+	err = CreateBindDefFile(&helloworld, &data, nil, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	checkGolden(t, data.Path, filepath.Join("testdata", "bind-helloworld.def"), &sysCfg)
+}
+
+func TestCustomLayout(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	netpipe := app.GetNetpipe(&sysCfg)
+	// The path to the executable set by the application takes precedence over the layout
+	netpipe.BinPath = ""
+	netpipe.BinName = "NPmpi"
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, "netpipe")
+	data.Model = container.HybridModel
+	data.Layout = ImageLayout{
+		AppRoot:     "/apps",
+		MPIBuildDir: "/tmp/build-mpi",
+		MPIPrefix:   "/usr/local/mpi",
+		ExtrasRoot:  "/usr/local/extras",
+	}
+	err = data.Validate()
+	if err != nil {
+		t.Fatalf("failed to validate custom layout: %s", err)
+	}
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if strings.Contains(content, "/opt") {
+		t.Fatalf("definition file with a custom layout uses default paths:\n%s", content)
+	}
+	expected := []string{
+		"MPI_Directory /usr/local/mpi\n",
+		"App_exe /apps/NPmpi\n",
+		"%environment\n\tMPI_DIR=/usr/local/mpi\n",
+		"\tcd /apps\n",
+		"\tAPPDIR=NetPIPE-5.1.4\n\tif [ ! -d /apps/$APPDIR ]; then",
+		"export MPI_DIR=/usr/local/mpi\n",
+		"export MPI_BUILDDIR=/tmp/build-mpi\n",
+		"cd /apps/$APPDIR && ",
+		"\tcd /apps\n\tif [ ! -e $APPDIR/NPmpi ]; then",
+		"\tln -sf $APPDIR/NPmpi NPmpi\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(content, e) {
+			t.Fatalf("definition file does not include %s:\n%s", e, content)
+		}
+	}
+
+	invalidLayouts := []ImageLayout{
+		{AppRoot: "opt"},
+		{AppRoot: "/"},
+		{AppRoot: "/opt/"},
+		{MPIBuildDir: "/opt"},
+		{MPIBuildDir: "/opt/mpi/build"},
+		{MPIPrefix: "/opt/build-mpi/install"},
+		{MPIPrefix: "/opt"},
+		{ExtrasRoot: "/opt/build-mpi"},
+		{ExtrasRoot: "/opt/mpi"},
+	}
+	for _, l := range invalidLayouts {
+		data = getTestDefFileData(tempDir, "netpipe")
+		data.Layout = l
+		if data.Validate() == nil {
+			t.Fatalf("layout %+v is valid", l)
+		}
+		if CreateHybridDefFile(&netpipe, &data, &sysCfg) == nil {
+			t.Fatalf("creation of a definition file with layout %+v succeeded", l)
+		}
+	}
+
+	// The application's executable cannot collide with the reserved paths
+	netpipe.BinName = "build-mpi"
+	data = getTestDefFileData(tempDir, "netpipe")
+	if CreateHybridDefFile(&netpipe, &data, &sysCfg) == nil {
+		t.Fatalf("creation of a definition file for an application named build-mpi succeeded")
+	}
+}
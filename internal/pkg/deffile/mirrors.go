@@ -0,0 +1,196 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// defaultUbuntuMirror is the mirror used to bootstrap Ubuntu when no mirror is configured
+	defaultUbuntuMirror = "http://us.archive.ubuntu.com/ubuntu/"
+
+	// defaultUbuntuPortsMirror is the mirror used to bootstrap Ubuntu on architectures other than x86_64
+	defaultUbuntuPortsMirror = "http://ports.ubuntu.com/ubuntu-ports/"
+
+	// defaultCentosMirror is the mirror used to bootstrap CentOS when no mirror is configured
+	defaultCentosMirror = "http://mirror.centos.org/centos-%{OSVERSION}/%{OSVERSION}/os/$basearch/"
+
+	// defaultCentosAltarchMirror is the mirror used to bootstrap CentOS on architectures other than x86_64
+	defaultCentosAltarchMirror = "http://mirror.centos.org/altarch/%{OSVERSION}/os/$basearch/"
+
+	// ubuntuSnapshotMirror is the snapshot service of the Ubuntu archive, followed by the point in time
+	ubuntuSnapshotMirror = "http://snapshot.ubuntu.com/ubuntu/"
+
+	// ubuntuPortsSnapshotMirror is the snapshot service of the Ubuntu archive on architectures other than x86_64
+	ubuntuPortsSnapshotMirror = "http://snapshot.ubuntu.com/ubuntu-ports/"
+
+	// mirrorRepoName is the name of the yum repository pointing to the selected mirror
+	mirrorRepoName = "sympi-mirror"
+)
+
+// mirrorRegexp is the format of mirror URLs. The variables of the package managers (e.g., $basearch) are
+// allowed but no quote, space or other shell metacharacter since the URLs are used in the post section.
+var mirrorRegexp = regexp.MustCompile(`^(https?|ftp)://[A-Za-z0-9_./:%{}$@+=~-]+$`)
+
+// snapshotRegexp is the format of the points in time of the snapshots of the repositories, e.g., 20240101T000000Z
+var snapshotRegexp = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}Z$`)
+
+// checkMirrors checks the URLs of the mirrors of the Linux distribution
+func checkMirrors(mirrors []string) error {
+	for _, mirror := range mirrors {
+		if !mirrorRegexp.MatchString(mirror) {
+			return fmt.Errorf("invalid mirror URL: %s", mirror)
+		}
+	}
+	return nil
+}
+
+// snapshotMirrorFn returns the URL of the snapshot of the repositories of a Linux distribution at a given point in time
+type snapshotMirrorFn func(*DefFileData, string) string
+
+// getSnapshotMirror returns the URL of the snapshot of the repositories of the Linux distribution configured
+// with sysCfg.RepoSnapshot, if any. RepoSnapshot is either the URL of a snapshot mirror or a point in time,
+// which requires the snapshot service of the distribution, snapshotMirror, to be known.
+func getSnapshotMirror(deffile *DefFileData, sysCfg *sys.Config, snapshotMirror snapshotMirrorFn) (string, error) {
+	if sysCfg == nil || sysCfg.RepoSnapshot == "" {
+		return "", nil
+	}
+
+	if strings.Contains(sysCfg.RepoSnapshot, "://") {
+		err := checkMirrors([]string{sysCfg.RepoSnapshot})
+		if err != nil {
+			return "", err
+		}
+		return sysCfg.RepoSnapshot, nil
+	}
+	if !snapshotRegexp.MatchString(sysCfg.RepoSnapshot) {
+		return "", fmt.Errorf("invalid snapshot %s: must be a URL or a point in time, e.g., 20240101T000000Z", sysCfg.RepoSnapshot)
+	}
+	if snapshotMirror == nil {
+		return "", fmt.Errorf("no snapshot service is known for %s, the URL of a snapshot mirror must be specified", deffile.DistroID.Name)
+	}
+	return snapshotMirror(deffile, sysCfg.RepoSnapshot), nil
+}
+
+// getBootstrapMirror returns the mirror used in the bootstrap section, i.e., the snapshot of the repositories
+// when configured, the first configured mirror or the default one of the Linux distribution otherwise
+func getBootstrapMirror(deffile *DefFileData, sysCfg *sys.Config, defaultMirror string, snapshotMirror snapshotMirrorFn) (string, error) {
+	snapshot, err := getSnapshotMirror(deffile, sysCfg, snapshotMirror)
+	if err != nil {
+		return "", err
+	}
+	if snapshot != "" {
+		return snapshot, nil
+	}
+	if len(deffile.Mirrors) == 0 {
+		return defaultMirror, nil
+	}
+	return deffile.Mirrors[0], nil
+}
+
+// getDefaultUbuntuMirror returns the default mirror of Ubuntu for the target architecture of the image
+func getDefaultUbuntuMirror(deffile *DefFileData) string {
+	if deffile.GetArch() != ArchX86_64 {
+		return defaultUbuntuPortsMirror
+	}
+	return defaultUbuntuMirror
+}
+
+// getDefaultCentosMirror returns the default mirror of CentOS for the target architecture of the image
+func getDefaultCentosMirror(deffile *DefFileData) string {
+	if deffile.GetArch() != ArchX86_64 {
+		return defaultCentosAltarchMirror
+	}
+	return defaultCentosMirror
+}
+
+// getUbuntuMirrorSetup returns the commands pointing apt to the mirror in $mirror
+func getUbuntuMirrorSetup(deffile *DefFileData) string {
+	return "echo \"deb $mirror " + deffile.DistroID.Codename + " main restricted universe multiverse\" > /etc/apt/sources.list && apt-get update"
+}
+
+// getUbuntuSnapshotMirror returns the URL of the snapshot of the Ubuntu archive at a given point in time
+func getUbuntuSnapshotMirror(deffile *DefFileData, snapshot string) string {
+	if deffile.GetArch() != ArchX86_64 {
+		return ubuntuPortsSnapshotMirror + snapshot + "/"
+	}
+	return ubuntuSnapshotMirror + snapshot + "/"
+}
+
+// getCentosMirrorSetup returns the commands pointing yum to the mirror in $mirror
+func getCentosMirrorSetup(deffile *DefFileData) string {
+	return "printf '[" + mirrorRepoName + "]\\nname=" + mirrorRepoName + "\\nbaseurl=%s\\ngpgcheck=1\\ngpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-CentOS-" + deffile.DistroID.Version + "\\n' \"$mirror\" > /etc/yum.repos.d/" + mirrorRepoName + ".repo && " +
+		"yum --disablerepo='*' --enablerepo=" + mirrorRepoName + " makecache"
+}
+
+// addSnapshotSetup adds to the post section the setup of the package manager with the snapshot of the
+// repositories, so that the packages installed in the image are pinned to the snapshot
+func addSnapshotSetup(f io.Writer, deffile *DefFileData, d *distroSupport, snapshot string) error {
+	if len(deffile.Mirrors) > 0 {
+		sylog.Warn("the mirrors of %s are ignored, using the snapshot %s", deffile.DistroID.Name, snapshot)
+	}
+	_, err := io.WriteString(f, "\tmirror='"+snapshot+"'\n\t"+d.mirrorSetup(deffile)+"\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	return nil
+}
+
+// addMirrorFailover adds to the post section the selection of the first available mirror for the setup of
+// the packages of the Linux distribution. The bootstrap section can only use a single mirror so this is only
+// done when several mirrors are configured; the build fails if none of them is available. When a snapshot
+// of the repositories is configured, it is used instead of the mirrors.
+func addMirrorFailover(f io.Writer, deffile *DefFileData, d *distroSupport, sysCfg *sys.Config) error {
+	if sysCfg != nil && sysCfg.RepoSnapshot != "" && d.mirrorSetup == nil {
+		return fmt.Errorf("snapshots of the repositories are not supported with %s", deffile.DistroID.Name)
+	}
+	snapshot, err := getSnapshotMirror(deffile, sysCfg, d.snapshotMirror)
+	if err != nil {
+		return err
+	}
+	if snapshot != "" {
+		return addSnapshotSetup(f, deffile, d, snapshot)
+	}
+
+	if len(deffile.Mirrors) == 0 {
+		return nil
+	}
+	if d.mirrorSetup == nil {
+		sylog.Warn("mirrors are not supported with %s, using the default ones", deffile.DistroID.Name)
+		return nil
+	}
+	if len(deffile.Mirrors) == 1 {
+		return nil
+	}
+
+	content := "\tSYMPI_MIRROR=\"\"\n\tfor mirror in"
+	for _, mirror := range deffile.Mirrors {
+		content += " '" + mirror + "'"
+	}
+	content += "; do\n" +
+		"\t\tif " + d.mirrorSetup(deffile) + "; then\n" +
+		"\t\t\tSYMPI_MIRROR=$mirror\n" +
+		"\t\t\tbreak\n" +
+		"\t\tfi\n" +
+		"\t\techo \"mirror $mirror is not available, trying the next one\" >&2\n" +
+		"\tdone\n" +
+		"\tif [ -z \"$SYMPI_MIRROR\" ]; then\n" +
+		"\t\techo \"none of the mirrors is available\" >&2\n" +
+		"\t\texit 1\n" +
+		"\tfi\n\n"
+	_, err = io.WriteString(f, content)
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func TestMirrorFailoverWithoutConfig(t *testing.T) {
+	// Without configuration, the mirrors are used
+	data := DefFileData{DistroID: distro.ParseDescr("ubuntu:disco"), Mirrors: []string{"http://mirror1.example.com/", "http://mirror2.example.com/"}}
+	var buf bytes.Buffer
+	err := addMirrorFailover(&buf, &data, getDistroSupport(data.DistroID.Name), nil)
+	if err != nil {
+		t.Fatalf("failed to add the mirror failover without configuration: %s", err)
+	}
+	if !strings.Contains(buf.String(), "mirror1.example.com") {
+		t.Fatalf("the mirrors are not used without configuration:\n%s", buf.String())
+	}
+}
+
+func TestBootstrapMirror(t *testing.T) {
+	var sysCfg sys.Config
+
+	// The bootstrap section uses the first mirror, the default one of the distro otherwise
+	tests := []struct {
+		distro   string
+		mirrors  []string
+		expected string
+	}{
+		{distro: "ubuntu:disco", expected: "Bootstrap: debootstrap\nOSVersion: disco\nMirrorURL: " + defaultUbuntuMirror + "\n"},
+		{distro: "ubuntu:disco", mirrors: []string{"http://mirror.example.com/ubuntu/"}, expected: "Bootstrap: debootstrap\nOSVersion: disco\nMirrorURL: http://mirror.example.com/ubuntu/\n"},
+		{distro: "ubuntu:focal", expected: "Bootstrap: debootstrap\nOSVersion: focal\nMirrorURL: " + defaultUbuntuMirror + "\n"},
+		{distro: "ubuntu:groovy", expected: "Bootstrap: debootstrap\nOSVersion: groovy\nMirrorURL: " + defaultUbuntuMirror + "\n"},
+		{distro: "centos:7", expected: "Bootstrap: yum\nOSVersion: 7\nMirrorURL: " + defaultCentosMirror + "\n"},
+		{distro: "centos:7", mirrors: []string{"http://mirror.example.com/centos/7/os/$basearch/", "http://mirror2.example.com/centos/7/os/$basearch/"}, expected: "Bootstrap: yum\nOSVersion: 7\nMirrorURL: http://mirror.example.com/centos/7/os/$basearch/\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		data := DefFileData{DistroID: distro.ParseDescr(tt.distro), Mirrors: tt.mirrors, Arch: ArchX86_64}
+		err := AddBootstrap(&buf, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to add the bootstrap section: %s", tt.distro, err)
+		}
+		if !strings.HasPrefix(buf.String(), tt.expected) {
+			t.Fatalf("%s: bootstrap section is:\n%s\ninstead of:\n%s", tt.distro, buf.String(), tt.expected)
+		}
+	}
+}
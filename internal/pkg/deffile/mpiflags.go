@@ -0,0 +1,223 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+	"github.com/sylabs/singularity-mpi/pkg/checker"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+const (
+	// MPICHDeviceSock is the identifier of the MPICH ch3 device based on sockets, available with all the versions
+	MPICHDeviceSock = "ch3:sock"
+
+	// MPICHDeviceOFI is the identifier of the MPICH ch4 device based on libfabric
+	MPICHDeviceOFI = "ch4:ofi"
+
+	// MPICHDeviceUCX is the identifier of the MPICH ch4 device based on UCX
+	MPICHDeviceUCX = "ch4:ucx"
+
+	// mpichCh4Version is the first version of MPICH using the ch4 device by default
+	mpichCh4Version = "3.4"
+
+	// devicePrefix is the prefix where the packages of the network libraries install their files
+	devicePrefix = "/usr"
+)
+
+// mpichDeviceConfigureArgs are the configure arguments required by the MPICH devices
+var mpichDeviceConfigureArgs = map[string][]string{
+	MPICHDeviceSock: {"--with-device=" + MPICHDeviceSock},
+	MPICHDeviceOFI:  {"--with-device=" + MPICHDeviceOFI, "--with-libfabric=" + devicePrefix},
+	MPICHDeviceUCX:  {"--with-device=" + MPICHDeviceUCX, "--with-ucx=" + devicePrefix},
+}
+
+// mpichDevicePackages are the development and runtime packages required by the MPICH devices, per package format
+var mpichDevicePackages = map[string]map[string][]string{
+	MPICHDeviceOFI: {
+		debPackageFormat: {"libfabric-dev", "libfabric1"},
+		rpmPackageFormat: {"libfabric-devel", "libfabric"},
+	},
+	MPICHDeviceUCX: {
+		debPackageFormat: {"libucx-dev", "libucx0"},
+		rpmPackageFormat: {"ucx-devel", "ucx"},
+	},
+}
+
+// mpichSharedMemDevices are the MPICH devices supporting the shared-memory transports; only the ch4 devices support
+// xpmem, and knem, which is only supported by ch3:nemesis, is not handled
+var mpichSharedMemDevices = map[string][]string{
+	XPMEMTransport: {MPICHDeviceOFI, MPICHDeviceUCX},
+}
+
+// configureArgRegexp is the format of the additional configure arguments we accept, i.e., without shell metacharacters
+var configureArgRegexp = regexp.MustCompile(`^[A-Za-z0-9_./+=,:@-]+$`)
+
+// configureArgsFn is a "function pointer" returning the configure arguments and the extra packages required to build a MPI implementation
+type configureArgsFn func(*DefFileData) ([]string, []string, error)
+
+// configureArgsFns is the registry of the functions returning the configure arguments of the MPI implementations
+var configureArgsFns = map[string]configureArgsFn{
+	implem.OMPI:  getOpenMPIConfigureArgs,
+	implem.MPICH: getMPICHConfigureArgs,
+}
+
+// SupportedImplementations returns the MPI implementations for which definition files can be generated, i.e.,
+// the implementations that have configure arguments in configureArgsFns. Intel MPI is only installed on the host.
+func SupportedImplementations() []implem.Descriptor {
+	var descrs []implem.Descriptor
+	for _, d := range implem.SupportedImplementations() {
+		if _, ok := configureArgsFns[d.ID]; ok {
+			descrs = append(descrs, d)
+		}
+	}
+	return descrs
+}
+
+// warnUnsupportedOptions warns about the options that are only supported with Open MPI
+func warnUnsupportedOptions(deffile *DefFileData) {
+	if deffile.MpiImplm.WithROCm {
+		sylog.Warn("ROCm support is only configured for Open MPI, ignoring it")
+	}
+}
+
+// getOpenMPIConfigureArgs returns the configure arguments for Open MPI
+func getOpenMPIConfigureArgs(deffile *DefFileData) ([]string, []string, error) {
+	var args []string
+
+	// The same flags are understood by UCX's configure
+	for _, transport := range deffile.SharedMemTransports {
+		args = append(args, "--with-"+transport+"="+sharedMemPrefix)
+	}
+
+	if deffile.MpiImplm.WithROCm {
+		args = append(args, "--with-rocm")
+	}
+
+	return args, nil, nil
+}
+
+// getMPICHDevice returns the device to use to build MPICH, an empty string if MPICH's default must be used.
+// The default device depends on the version: ch4:ofi is selected from MPICH 3.4, the first version using ch4
+// by default, while MPICH's default (ch3:nemesis) is kept with older versions, which only support ch3 devices.
+// The ch3 devices are still shipped with the versions using ch4 by default, so ch3:sock is accepted with all versions.
+func getMPICHDevice(mpi *implem.Info) (string, error) {
+	if _, ok := mpichDeviceConfigureArgs[mpi.Device]; mpi.Device != "" && !ok {
+		return "", fmt.Errorf("unsupported MPICH device: %s, please use %s, %s or %s", mpi.Device, MPICHDeviceSock, MPICHDeviceOFI, MPICHDeviceUCX)
+	}
+
+	ch4 := checker.CompareVersions(mpi.Version, mpichCh4Version) >= 0
+	switch {
+	case mpi.Device == "" && ch4:
+		return MPICHDeviceOFI, nil
+	case !ch4 && strings.HasPrefix(mpi.Device, "ch4"):
+		return "", fmt.Errorf("the %s device requires MPICH %s or later", mpi.Device, mpichCh4Version)
+	}
+	return mpi.Device, nil
+}
+
+// getMPICHSharedMemArgs returns the configure arguments enabling the shared-memory transports with a given MPICH
+// device. An error is returned when the device does not support one of the transports, so that MPICH is never
+// built without a transport that was requested.
+func getMPICHSharedMemArgs(deffile *DefFileData, device string) ([]string, error) {
+	var args []string
+	for _, transport := range deffile.SharedMemTransports {
+		devices, ok := mpichSharedMemDevices[transport]
+		if !ok {
+			return nil, fmt.Errorf("the %s shared-memory transport is not supported with MPICH", transport)
+		}
+		supported := false
+		for _, d := range devices {
+			if d == device {
+				supported = true
+			}
+		}
+		if !supported {
+			if device == "" {
+				device = "the default device of MPICH " + deffile.MpiImplm.Version
+			}
+			return nil, fmt.Errorf("the %s shared-memory transport requires one of the MPICH devices %s, not %s", transport, strings.Join(devices, ", "), device)
+		}
+		args = append(args, "--with-"+transport+"="+sharedMemPrefix)
+	}
+	return args, nil
+}
+
+// getMPICHConfigureArgs returns the configure arguments for MPICH
+func getMPICHConfigureArgs(deffile *DefFileData) ([]string, []string, error) {
+	warnUnsupportedOptions(deffile)
+
+	device, err := getMPICHDevice(deffile.MpiImplm)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedMemArgs, err := getMPICHSharedMemArgs(deffile, device)
+	if err != nil {
+		return nil, nil, err
+	}
+	if device == "" {
+		return nil, nil, nil
+	}
+
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d == nil {
+		return nil, nil, fmt.Errorf("unsupported distro: %s", deffile.DistroID.Name)
+	}
+
+	args := append(append([]string{}, mpichDeviceConfigureArgs[device]...), sharedMemArgs...)
+	return args, mpichDevicePackages[device][d.packageFormat], nil
+}
+
+// checkConfigureArgs checks the additional arguments passed to configure when building MPI
+func checkConfigureArgs(args []string) error {
+	for _, arg := range args {
+		if !configureArgRegexp.MatchString(arg) {
+			return fmt.Errorf("invalid configure argument: %q", arg)
+		}
+	}
+	return nil
+}
+
+// getMPIConfigureArgs returns the configure arguments and the extra packages required to build MPI in the container.
+// The additional arguments of the MPI configuration come last so they take precedence.
+func getMPIConfigureArgs(deffile *DefFileData) ([]string, []string, error) {
+	err := checkConfigureArgs(deffile.MpiImplm.ConfigureArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var args, pkgs []string
+	fn, ok := configureArgsFns[deffile.MpiImplm.ID]
+	if ok {
+		args, pkgs, err = fn(deffile)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		warnUnsupportedOptions(deffile)
+	}
+	return append(args, deffile.MpiImplm.ConfigureArgs...), pkgs, nil
+}
+
+// addPackages adds the installation of a list of packages to the post section
+func addPackages(f io.Writer, deffile *DefFileData, pkgs []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d == nil {
+		return fmt.Errorf("unsupported distro: %s", deffile.DistroID.Name)
+	}
+
+	_, err := io.WriteString(f, "\t"+d.getInstallCmd()+" "+strings.Join(mergePackages(d.getPackageNames(pkgs)), " ")+"\n")
+	return err
+}
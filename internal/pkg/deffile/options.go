@@ -0,0 +1,119 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// CreateOptions are the options used to create a definition file. New capabilities are added as new
+// fields so the signature of Create does not change; the zero value creates the definition file the
+// same way than CreateHybridDefFile, CreateBindDefFile and CreateBasicDefFile.
+type CreateOptions struct {
+	// HostBuild is the result of the compilation of the application on the host (see buildenv.BuildHostApp),
+	// only valid with the bind model (optional)
+	HostBuild *buildenv.BuildOutput
+
+	// Progress is called with a short description of each step of the creation of the definition file (optional)
+	Progress func(step string)
+}
+
+// validate checks that the options are consistent with each other and with the configuration
+func (o *CreateOptions) validate(data *DefFileData) error {
+	if o.HostBuild != nil && data.Model != container.BindModel {
+		return fmt.Errorf("the result of a compilation on the host can only be used with the %s model", container.BindModel)
+	}
+	return nil
+}
+
+// progress reports a step of the creation of a definition file
+func (o *CreateOptions) progress(step string) {
+	if o.Progress != nil {
+		o.Progress(step)
+	}
+}
+
+// Create creates a definition file based on the model of data: hybrid, bind or, when no model is specified,
+// a basic image without MPI.
+func Create(app *app.Info, data *DefFileData, sysCfg *sys.Config, opts CreateOptions) error {
+	if app == nil || data == nil || sysCfg == nil {
+		return fmt.Errorf("invalid parameter(s)")
+	}
+
+	err := opts.validate(data)
+	if err != nil {
+		return fmt.Errorf("invalid options: %s", err)
+	}
+
+	switch data.Model {
+	case container.HybridModel:
+		opts.progress("creating hybrid definition file " + data.Path)
+		err = createHybridDefFile(app, data, sysCfg)
+	case container.BindModel:
+		opts.progress("creating bind definition file " + data.Path)
+		err = createBindDefFile(app, data, opts.HostBuild, sysCfg)
+	case "":
+		opts.progress("creating definition file " + data.Path)
+		err = createBasicDefFile(app, data, sysCfg)
+	default:
+		return fmt.Errorf("unsupported model: %s", data.Model)
+	}
+	if err != nil {
+		return err
+	}
+
+	opts.progress("definition file " + data.Path + " created")
+	return nil
+}
+
+// Render writes the complete definition file described by d to w, based on its model: hybrid, bind or, when
+// no model is specified, a basic image without MPI. Nothing is written to the file system so the definition
+// file can be generated in memory, e.g., in a bytes.Buffer; d.Path is not used.
+func (d *DefFileData) Render(w io.Writer, app *app.Info, sysCfg *sys.Config) error {
+	if w == nil || app == nil || sysCfg == nil {
+		return fmt.Errorf("invalid parameter(s)")
+	}
+
+	return renderNormalized(w, d, sysCfg, func(w io.Writer) error {
+		switch d.Model {
+		case container.HybridModel:
+			return renderHybridDefFile(w, app, d, sysCfg)
+		case container.BindModel:
+			return renderBindDefFile(w, app, d, nil, sysCfg)
+		case "":
+			return renderBasicDefFile(w, app, d, sysCfg)
+		default:
+			return fmt.Errorf("unsupported model: %s", d.Model)
+		}
+	})
+}
+
+// CreateHybridDefFile creates a definition file for a given bybrid-based configuration.
+//
+// Deprecated: use Create with data.Model set to container.HybridModel.
+func CreateHybridDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+	return createHybridDefFile(app, data, sysCfg)
+}
+
+// CreateBindDefFile creates a definition file for a given bind-based configuration.
+//
+// Deprecated: use Create with data.Model set to container.BindModel and CreateOptions.HostBuild.
+func CreateBindDefFile(app *app.Info, data *DefFileData, hostBuild *buildenv.BuildOutput, sysCfg *sys.Config) error {
+	return createBindDefFile(app, data, hostBuild, sysCfg)
+}
+
+// CreateBasicDefFile creates a definition file for a given non-MPI configuration.
+//
+// Deprecated: use Create without model.
+func CreateBasicDefFile(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+	return createBasicDefFile(app, data, sysCfg)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestRender(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	netpipe := app.GetNetpipe(&sysCfg)
+	data := getTestDefFileData(tempDir, "netpipe")
+	data.Model = container.HybridModel
+	var buf bytes.Buffer
+	err = data.Render(&buf, &netpipe, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to render definition file: %s", err)
+	}
+	if _, err := os.Stat(data.Path); !os.IsNotExist(err) {
+		t.Fatalf("%s was created while rendering the definition file", data.Path)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "hybrid-netpipe.def"))
+	if err != nil {
+		t.Fatalf("failed to read golden file: %s", err)
+	}
+	if buf.String() != string(expected) {
+		t.Fatalf("rendered definition file differs from the golden file:\n%s", buf.String())
+	}
+
+	data.Model = "unknown"
+	err = data.Render(&buf, &netpipe, &sysCfg)
+	if err == nil {
+		t.Fatalf("rendering a definition file with an unsupported model succeeded")
+	}
+}
+
+func TestCreateOptions(t *testing.T) {
+	// The options are part of the API, they must not be renamed or removed
+	expected := []string{"HostBuild", "Progress"}
+	names := getFieldNames(CreateOptions{})
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("options are %s instead of %s", strings.Join(names, ", "), strings.Join(expected, ", "))
+	}
+
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	hostBuild := buildenv.BuildOutput{BinPath: "/scratch/helloworld/helloworld", MPIPrefix: "/opt/openmpi"}
+	err = Create(&helloworld, &data, &sysCfg, CreateOptions{HostBuild: &hostBuild})
+	if err == nil {
+		t.Fatalf("result of a compilation on the host accepted with the %s model", data.Model)
+	}
+
+	var steps []string
+	err = Create(&helloworld, &data, &sysCfg, CreateOptions{Progress: func(step string) { steps = append(steps, step) }})
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	if len(steps) != 2 {
+		t.Fatalf("progress reported %d steps instead of 2: %s", len(steps), strings.Join(steps, "; "))
+	}
+
+	// The default options generate the same definition file than the deprecated function
+	content := readDefFile(t, data.Path)
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	if readDefFile(t, data.Path) != content {
+		t.Fatalf("Create and CreateHybridDefFile generate different definition files")
+	}
+
+	data.Model = "unknown"
+	err = Create(&helloworld, &data, &sysCfg, CreateOptions{})
+	if err == nil {
+		t.Fatalf("definition file created for an unknown model")
+	}
+}
+
+func TestBindPackages(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	helloworld := app.GetHelloworld(&sysCfg)
+	helloworld.BinName = "helloworld"
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.DistroID = distro.ParseDescr("centos:7")
+	data.Model = container.BindModel
+	hostBuild := buildenv.BuildOutput{BinPath: "/scratch/helloworld/helloworld", MPIPrefix: "/opt/openmpi"}
+	err = CreateBindDefFile(&helloworld, &data, &hostBuild, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if !strings.Contains(content, "\tyum install -y glibc opensm-devel librdmacm-devel librdmacm kmod libmlx4 libibverbs-devel libibverbs libnl3-devel infiniband-diags libibverbs-utils\n") {
+		t.Fatalf("the packages of CentOS are not installed:\n%s", content)
+	}
+	for _, deb := range []string{"libc-bin", "libmlx4-1", "librdmacm1"} {
+		if strings.Contains(content, deb) {
+			t.Fatalf("CentOS definition file includes the Debian package %s:\n%s", deb, content)
+		}
+	}
+}
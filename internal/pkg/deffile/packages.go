@@ -0,0 +1,40 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// packageNameRegexp is the format of the names of the extra packages, which are used in the post section
+var packageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.+:-]*$`)
+
+// checkExtraPkgs checks the names of the extra packages installed in the image
+func checkExtraPkgs(pkgs []string) error {
+	for _, pkg := range pkgs {
+		if !packageNameRegexp.MatchString(pkg) {
+			return fmt.Errorf("invalid package name: %s", pkg)
+		}
+	}
+	return nil
+}
+
+// mergePackages returns the packages of the lists, in order and without duplicates
+func mergePackages(lists ...[]string) []string {
+	var pkgs []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, pkg := range list {
+			if pkg == "" || seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// getSection returns the content of a section of a definition file, e.g., %post, empty if the section does not exist
+func getSection(content string, section string) string {
+	var lines []string
+	in := false
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "%") {
+			in = strings.TrimSpace(line) == section
+			continue
+		}
+		if in {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// getHostDirs returns the directories that only exist on the host where the definition file is generated.
+// The directories including a directory of the image, e.g., the home directory when MPI is installed in
+// ~/.sympi on the host and at the same place in the image, are not considered host-specific.
+func getHostDirs(data *DefFileData, sysCfg *sys.Config) []string {
+	candidates := []string{sysCfg.ScratchDir, os.Getenv("HOME")}
+	if data.InternalEnv != nil {
+		candidates = append(candidates, data.InternalEnv.SrcDir, data.InternalEnv.ScratchDir, data.InternalEnv.BuildDir)
+	}
+
+	l := data.layout()
+	var dirs []string
+	for _, dir := range candidates {
+		dir = path.Clean(dir)
+		if !path.IsAbs(dir) || dir == "/" {
+			continue
+		}
+		inImage := false
+		for _, imageDir := range []string{l.AppRoot, l.MPIPrefix, l.MPIBuildDir, l.ExtrasRoot} {
+			if imageDir != "" && isSubPath(imageDir, dir) {
+				inImage = true
+				break
+			}
+		}
+		if !inImage {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// checkPortability checks that the post section of a definition file does not use any path that only exists
+// on the host, which would make the definition file specific to the host where it was generated
+func checkPortability(content string, data *DefFileData, sysCfg *sys.Config) error {
+	post := getSection(content, "%post")
+	for _, dir := range getHostDirs(data, sysCfg) {
+		hostPathRegexp := regexp.MustCompile(regexp.QuoteMeta(dir) + `(/|\s|$|"|')`)
+		if hostPathRegexp.MatchString(post) {
+			return fmt.Errorf("the post section uses the host directory %s, use a path of the image instead", dir)
+		}
+	}
+	return nil
+}
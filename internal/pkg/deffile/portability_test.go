@@ -0,0 +1,58 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestStrictPortability(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	sysCfg.StrictPortability = true
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The source file of the application is compiled from the directory where it was downloaded on the host
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	data.InternalEnv.SrcDir = filepath.Join(tempDir, "src")
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err == nil {
+		t.Fatalf("definition file using %s in the post section was accepted", data.InternalEnv.SrcDir)
+	}
+	if _, err := os.Stat(data.Path); err == nil {
+		t.Fatalf("%s was created", data.Path)
+	}
+
+	// Without strict portability, the definition file is generated
+	sysCfg.StrictPortability = false
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+
+	// Applications downloaded in the image do not rely on the host
+	sysCfg.StrictPortability = true
+	netpipe := app.GetNetpipe(&sysCfg)
+	data = getTestDefFileData(tempDir, netpipe.Name)
+	data.Model = container.HybridModel
+	data.InternalEnv.SrcDir = filepath.Join(tempDir, "src")
+	err = CreateHybridDefFile(&netpipe, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create portable definition file: %s", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+const (
+	// hostOSFile is the file describing the Linux distribution of the host
+	hostOSFile = "/etc/os-release"
+
+	// hostKernelFile is the file giving the release of the kernel of the host
+	hostKernelFile = "/proc/sys/kernel/osrelease"
+
+	// unknownProvenance is the value of the provenance labels that cannot be determined
+	unknownProvenance = "unknown"
+)
+
+// toolchainLabels are the labels recording the versions of the compilers of the image, with the compiler
+var toolchainLabels = []struct {
+	label    string
+	compiler string
+}{
+	{label: container.GCCVersionLabel, compiler: "gcc"},
+	{label: container.GFortranVersionLabel, compiler: "gfortran"},
+}
+
+// readHostFile returns the content of a file of the host, it can be replaced for testing
+var readHostFile = ioutil.ReadFile
+
+// getHostOS returns the name of the Linux distribution of the host
+func getHostOS() string {
+	d, err := readHostFile(hostOSFile)
+	if err != nil {
+		return unknownProvenance
+	}
+	for _, line := range strings.Split(string(d), "\n") {
+		if strings.HasPrefix(line, "PRETTY_NAME=") {
+			name := strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), "\"'")
+			if name != "" {
+				return name
+			}
+		}
+	}
+	return unknownProvenance
+}
+
+// getHostKernel returns the release of the kernel of the host
+func getHostKernel() string {
+	d, err := readHostFile(hostKernelFile)
+	if err != nil || strings.TrimSpace(string(d)) == "" {
+		return unknownProvenance
+	}
+	return strings.TrimSpace(string(d))
+}
+
+// getHostProvenanceLabels returns the labels describing the host where the image is built
+func getHostProvenanceLabels() []label {
+	return []label{
+		{container.BuildHostOSLabel, getHostOS()},
+		{container.BuildHostKernelLabel, getHostKernel()},
+	}
+}
+
+// addToolchainLabels adds to the post section the capture of the versions of the compilers installed in the
+// image, written to the labels of the image. Compilers that are not installed are skipped.
+func addToolchainLabels(f io.Writer, deffile *DefFileData) error {
+	if !deffile.Provenance {
+		return nil
+	}
+
+	var content string
+	for _, t := range toolchainLabels {
+		content += "\tif command -v " + t.compiler + " > /dev/null 2>&1; then\n" +
+			"\t\techo \"" + t.label + " $(" + t.compiler + " --version | head -n 1)\" >> \"$SINGULARITY_LABELS\"\n" +
+			"\tfi\n"
+	}
+	_, err := io.WriteString(f, content+"\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	return nil
+}
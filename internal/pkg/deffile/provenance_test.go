@@ -0,0 +1,86 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestProvenance(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	netpipe := app.GetNetpipe(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	hostFiles := map[string]string{
+		hostOSFile:     "NAME=\"Ubuntu\"\nPRETTY_NAME=\"Ubuntu 22.04.3 LTS\"\nID=ubuntu\n",
+		hostKernelFile: "5.15.0-91-generic\n",
+	}
+	defer func(previous func(string) ([]byte, error)) { readHostFile = previous }(readHostFile)
+	readHostFile = func(path string) ([]byte, error) {
+		content, ok := hostFiles[path]
+		if !ok {
+			return nil, fmt.Errorf("%s does not exist", path)
+		}
+		return []byte(content), nil
+	}
+
+	data := getTestDefFileData(tempDir, netpipe.Name)
+	data.Model = container.HybridModel
+	var buf bytes.Buffer
+	err = data.Render(&buf, &netpipe, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to render definition file: %s", err)
+	}
+	if strings.Contains(buf.String(), container.BuildHostOSLabel) || strings.Contains(buf.String(), "$SINGULARITY_LABELS") {
+		t.Fatalf("provenance is recorded while not requested:\n%s", buf.String())
+	}
+
+	data.Provenance = true
+	buf.Reset()
+	err = data.Render(&buf, &netpipe, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to render definition file: %s", err)
+	}
+	content := buf.String()
+	for _, expected := range []string{"\tBuild_host_OS Ubuntu 22.04.3 LTS\n", "\tBuild_host_kernel 5.15.0-91-generic\n"} {
+		if !strings.Contains(content, expected) {
+			t.Fatalf("labels do not include %q:\n%s", expected, content)
+		}
+	}
+	post := getPostSection(t, content)
+	for _, expected := range []string{
+		"\t\techo \"GCC_version $(gcc --version | head -n 1)\" >> \"$SINGULARITY_LABELS\"\n",
+		"\t\techo \"GFortran_version $(gfortran --version | head -n 1)\" >> \"$SINGULARITY_LABELS\"\n",
+	} {
+		if !strings.Contains(post, expected) {
+			t.Fatalf("post section does not capture the version of the compilers with %q:\n%s", expected, post)
+		}
+	}
+
+	// The labels are still generated when the host cannot be inspected
+	hostFiles = nil
+	buf.Reset()
+	err = data.Render(&buf, &netpipe, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to render definition file: %s", err)
+	}
+	if !strings.Contains(buf.String(), "\tBuild_host_kernel unknown\n") {
+		t.Fatalf("unknown kernel is not recorded:\n%s", buf.String())
+	}
+}
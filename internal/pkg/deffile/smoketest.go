@@ -0,0 +1,182 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// mpiBinDir is the directory of the MPI binaries used by the %test section, so that the MPI of the image is
+// checked even if another MPI is in the PATH
+const mpiBinDir = "$MPI_DIR/bin/"
+
+// mpiTest describes how to check a MPI implementation in the %test section
+type mpiTest struct {
+	// version is the command printing the version of MPI, relative to mpiBinDir
+	version string
+
+	// launcher is the command starting MPI programs, relative to mpiBinDir
+	launcher string
+
+	// npFlag is the option of the launcher specifying the number of ranks
+	npFlag string
+}
+
+// launch returns the command starting a given number of ranks of a MPI program
+func (t *mpiTest) launch(ranks int) string {
+	return mpiBinDir + t.launcher + " " + t.npFlag + " " + strconv.Itoa(ranks)
+}
+
+// mpiTests are the commands checking the MPI implementations; defaultMPITest is used for the others
+var mpiTests = map[string]mpiTest{
+	// The test is executed as root when building with sudo or fakeroot
+	implem.OMPI:  {version: "mpirun --version", launcher: "mpirun --allow-run-as-root --oversubscribe", npFlag: "-np"},
+	implem.MPICH: {version: "mpichversion", launcher: "mpiexec", npFlag: "-n"},
+}
+
+// defaultMPITest is the test of the MPI implementations that are not in mpiTests
+var defaultMPITest = mpiTest{version: "mpirun --version", launcher: "mpirun", npFlag: "-np"}
+
+// mpiHelloworld is the MPI program compiled and executed by the %test section
+const mpiHelloworld = `#include <mpi.h>
+#include <stdio.h>
+
+int main(int argc, char **argv) {
+    int rank, size;
+    MPI_Init(&argc, &argv);
+    MPI_Comm_rank(MPI_COMM_WORLD, &rank);
+    MPI_Comm_size(MPI_COMM_WORLD, &size);
+    printf("Hello, I am rank %d/%d\n", rank, size);
+    MPI_Finalize();
+    return 0;
+}
+`
+
+// getMPITest returns the commands checking the MPI implementation of the image
+func getMPITest(deffile *DefFileData) mpiTest {
+	if t, ok := mpiTests[deffile.MpiImplm.ID]; ok {
+		return t
+	}
+	return defaultMPITest
+}
+
+// getMPITestContent returns the content of the %test section checking that the application's executable
+// exists and, with the hybrid model, that the MPI of the image works: its version is displayed and a hello
+// world is compiled and executed with 2 ranks, using the binaries of $MPI_DIR. MPI is not available at build
+// time with the bind model.
+func getMPITestContent(app *app.Info, deffile *DefFileData) string {
+	content := "\tset -e\n"
+	appExe := getAppExe(app, deffile)
+	if !strings.HasSuffix(appExe, "/") {
+		content += "\ttest -x " + appExe + "\n"
+	}
+	if deffile.Model != container.HybridModel || deffile.MpiImplm == nil {
+		return content
+	}
+
+	t := getMPITest(deffile)
+	content += "\t" + mpiBinDir + t.version + "\n" +
+		"\tSYMPI_TEST_DIR=$(mktemp -d)\n" +
+		"\tcat > $SYMPI_TEST_DIR/helloworld.c << 'EOF'\n" + mpiHelloworld + "EOF\n" +
+		"\t" + mpiBinDir + "mpicc -o $SYMPI_TEST_DIR/helloworld $SYMPI_TEST_DIR/helloworld.c\n" +
+		"\t" + t.launch(2) + " $SYMPI_TEST_DIR/helloworld\n" +
+		"\trm -rf $SYMPI_TEST_DIR\n"
+	return content
+}
+
+// getAppTestContent returns the content of the %test section running the test suite of the application from
+// the directory of its sources, with TestRanks ranks of the MPI of the image when set. MPI is not available at
+// build time with the bind model so the tests cannot be started with MPI.
+func getAppTestContent(app *app.Info, deffile *DefFileData) (string, error) {
+	if app.TestRanks < 0 {
+		return "", fmt.Errorf("invalid number of ranks for the tests of %s: %d", app.Name, app.TestRanks)
+	}
+
+	if deffile.useBuildArgs() && app.SourceDir == "" && util.DetectURLType(app.Source) != util.GitURL {
+		// The directory of the sources is the top directory of the tarball, which is only known in the post section
+		return "", fmt.Errorf("the directory of the sources of %s must be specified to run its tests with build arguments", app.Name)
+	}
+	dir, err := getAppDir(app, deffile)
+	if err != nil {
+		return "", err
+	}
+
+	testCmd := app.TestCmd
+	if app.TestRanks > 0 {
+		if deffile.Model != container.HybridModel || deffile.MpiImplm == nil {
+			return "", fmt.Errorf("the tests of %s can only be started with MPI with the %s model", app.Name, container.HybridModel)
+		}
+		t := getMPITest(deffile)
+		testCmd = t.launch(app.TestRanks) + " " + testCmd
+	}
+
+	return "\tcd " + deffile.layout().AppRoot + "/" + dir + " && " + testCmd + "\n", nil
+}
+
+// addTestSection adds the %test section of the definition file, which checks the installation of MPI when
+// EnableTest is set, runs the test suite of the application when AppTest is set and runs the health check
+// of the image, if any
+func addTestSection(f io.Writer, app *app.Info, deffile *DefFileData) error {
+	var content string
+	if deffile.EnableTest {
+		content += getMPITestContent(app, deffile)
+	}
+	if deffile.AppTest && app.TestCmd != "" {
+		appTest, err := getAppTestContent(app, deffile)
+		if err != nil {
+			return err
+		}
+		if content == "" {
+			content = "\tset -e\n"
+		}
+		content += appTest
+	}
+	if deffile.HealthCheck != "" {
+		content += "\t" + deffile.HealthCheck + "\n"
+	}
+	if content == "" {
+		return nil
+	}
+
+	_, err := io.WriteString(f, "%test\n"+content+"\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	return nil
+}
+
+// SmokeTest creates the definition file of an application and validates it: the definition file is built
+// into a temporary sandbox, the %test section is executed and the sandbox deleted. No image is created, which
+// makes it suitable to check recipes, e.g., in CI.
+func SmokeTest(app *app.Info, data *DefFileData, sysCfg *sys.Config) error {
+	err := Create(app, data, sysCfg, CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	c := container.Config{
+		DefFile:  data.Path,
+		BuildDir: filepath.Dir(data.Path),
+		Model:    data.Model,
+	}
+	err = container.SmokeTest(&c, sysCfg)
+	if err != nil {
+		return fmt.Errorf("smoke test of %s failed: %s", data.Path, err)
+	}
+
+	return nil
+}
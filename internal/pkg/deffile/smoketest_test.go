@@ -0,0 +1,81 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
+)
+
+func TestSmokeTest(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	sysCfg.SingularityBin = filepath.Join(tempDir, "bin", "singularity")
+
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	data.HealthCheck = container.DefaultHealthCheck
+
+	tests := []struct {
+		name       string
+		testResult syexec.Result
+		succeed    bool
+	}{
+		{name: "successful test", succeed: true},
+		{name: "failing test", testResult: syexec.Result{Err: fmt.Errorf("exit status 1")}},
+	}
+
+	for _, tt := range tests {
+		fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{{}, tt.testResult}}
+		defaultRunner := container.SetRunner(fakeRunner)
+		err = SmokeTest(&helloworld, &data, &sysCfg)
+		container.SetRunner(defaultRunner)
+		if tt.succeed && err != nil {
+			t.Fatalf("%s: smoke test failed: %s", tt.name, err)
+		}
+		if !tt.succeed && err == nil {
+			t.Fatalf("%s: smoke test succeeded", tt.name)
+		}
+
+		content := readDefFile(t, data.Path)
+		if !strings.Contains(content, "%test\n\t"+container.DefaultHealthCheck+"\n") {
+			t.Fatalf("%s: definition file does not have a test section:\n%s", tt.name, content)
+		}
+
+		if len(fakeRunner.Cmds) != 2 {
+			t.Fatalf("%s: %d command(s) executed instead of 2", tt.name, len(fakeRunner.Cmds))
+		}
+		build := fakeRunner.Cmds[0].CmdArgs
+		if len(build) != 4 || build[0] != "build" || build[1] != "--sandbox" || build[3] != data.Path {
+			t.Fatalf("%s: invalid build command: %s", tt.name, strings.Join(build, " "))
+		}
+		sandbox := build[2]
+		if filepath.Dir(filepath.Dir(sandbox)) != tempDir {
+			t.Fatalf("%s: sandbox %s is not in %s", tt.name, sandbox, tempDir)
+		}
+		test := fakeRunner.Cmds[1].CmdArgs
+		if len(test) != 2 || test[0] != "test" || test[1] != sandbox {
+			t.Fatalf("%s: invalid test command: %s", tt.name, strings.Join(test, " "))
+		}
+		if _, err := os.Stat(filepath.Dir(sandbox)); !os.IsNotExist(err) {
+			t.Fatalf("%s: sandbox %s was not removed", tt.name, sandbox)
+		}
+	}
+}
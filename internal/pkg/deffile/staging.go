@@ -0,0 +1,162 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/checker"
+)
+
+const (
+	// BuildBindMinVersion is the first version of Singularity supporting binds at build time
+	BuildBindMinVersion = "3.10"
+
+	// DefaultStageThreshold is the size in bytes above which a directory is staged when StageLargeFiles is set
+	DefaultStageThreshold = 256 << 20
+
+	// StageMountDir is the directory of the build container where the staged directories are bound
+	StageMountDir = "/.sympi-stage"
+)
+
+// stagePatternRegexp is the format of the patterns selecting the files copied from a staged directory, i.e.,
+// relative paths with shell wildcards but without any other shell metacharacter
+var stagePatternRegexp = regexp.MustCompile(`^[A-Za-z0-9_./*?\[\]-]+$`)
+
+// fileEntry is a file or directory of the host copied into a directory of the image
+type fileEntry struct {
+	// src is the path on the host
+	src string
+
+	// dst is the directory of the image where src is copied
+	dst string
+}
+
+// useBuildBinds checks whether large directories are bound at build time instead of being copied with %files
+func (d *DefFileData) useBuildBinds() bool {
+	if !d.StageLargeFiles {
+		return false
+	}
+	if d.TargetSingularityVersion == "" || checker.CompareVersions(d.TargetSingularityVersion, BuildBindMinVersion) < 0 {
+		sylog.Warn("binds at build time require Singularity %s or later, large directories are copied with %%files", BuildBindMinVersion)
+		return false
+	}
+	return true
+}
+
+// getStageThreshold returns the size in bytes above which a directory is staged
+func (d *DefFileData) getStageThreshold() int64 {
+	if d.StageThreshold <= 0 {
+		return DefaultStageThreshold
+	}
+	return d.StageThreshold
+}
+
+// getDirSize returns the size in bytes of the files of a directory, -1 if the path is not an existing directory
+func getDirSize(dir string) (int64, error) {
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return -1, nil
+	}
+
+	var size int64
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("failed to get the size of %s: %s", dir, err)
+	}
+	return size, nil
+}
+
+// isStaged checks whether a file entry is bound at build time instead of being copied with %files
+func isStaged(entry fileEntry, d *DefFileData) bool {
+	size, err := getDirSize(entry.src)
+	if err != nil {
+		sylog.Warn("%s", err)
+		return false
+	}
+	return size > d.getStageThreshold()
+}
+
+// getStagedFiles returns the directories bound at build time, in the order of their mount points
+func getStagedFiles(app *app.Info, d *DefFileData) []fileEntry {
+	if !d.useBuildBinds() {
+		return nil
+	}
+
+	var staged []fileEntry
+	for _, entry := range getAppFiles(app, d) {
+		if isStaged(entry, d) {
+			staged = append(staged, entry)
+		}
+	}
+	return staged
+}
+
+// getStageMountPoint returns the directory of the build container where the i-th staged directory is bound
+func getStageMountPoint(i int) string {
+	return StageMountDir + "/" + strconv.Itoa(i)
+}
+
+// BuildBinds returns the binds (src:dst) to pass to Singularity when building the image, nil if no directory is staged
+func BuildBinds(app *app.Info, d *DefFileData) []string {
+	var binds []string
+	for i, entry := range getStagedFiles(app, d) {
+		binds = append(binds, entry.src+":"+getStageMountPoint(i))
+	}
+	return binds
+}
+
+// checkStageInclude checks the patterns selecting the files copied from the staged directories
+func checkStageInclude(patterns []string) error {
+	for _, pattern := range patterns {
+		if !stagePatternRegexp.MatchString(pattern) || path.IsAbs(pattern) || strings.HasPrefix(path.Clean(pattern), "..") {
+			return fmt.Errorf("invalid pattern of staged files: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// addStagedCopies adds to the post section the copy of the staged directories, bound at build time, into the
+// image. Only the files matching StageInclude are copied when set.
+func addStagedCopies(f io.Writer, app *app.Info, d *DefFileData) error {
+	err := checkStageInclude(d.StageInclude)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range getStagedFiles(app, d) {
+		target := entry.dst + "/" + filepath.Base(entry.src)
+		content := "\tmkdir -p " + target + "\n"
+		if len(d.StageInclude) == 0 {
+			content += "\tcp -a " + getStageMountPoint(i) + "/. " + target + "/\n"
+		} else {
+			content += "\tcd " + getStageMountPoint(i) + " && cp -a --parents " + strings.Join(d.StageInclude, " ") + " " + target + "/\n"
+		}
+		_, err = io.WriteString(f, content)
+		if err != nil {
+			return fmt.Errorf("failed to write to definition file: %s", err)
+		}
+	}
+
+	return nil
+}
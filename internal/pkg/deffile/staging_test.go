@@ -0,0 +1,96 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestStagedCopies(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	appDir := filepath.Join(tempDir, "dataset")
+	err = os.MkdirAll(filepath.Join(appDir, "bin"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", appDir, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(appDir, "bin", "data"), make([]byte, 2048), 0644)
+	if err != nil {
+		t.Fatalf("failed to create data file: %s", err)
+	}
+	helloworld.Source = "file://" + appDir
+
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	data.StageLargeFiles = true
+	data.StageThreshold = 1024
+	data.StageInclude = []string{"bin/*"}
+	data.TargetSingularityVersion = "3.10.0"
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+
+	content := readDefFile(t, data.Path)
+	if strings.Contains(content, appDir+" ") {
+		t.Fatalf("staged directory is copied with %%files:\n%s", content)
+	}
+	expected := []string{
+		"\tmkdir -p " + DefaultAppRoot + "/dataset\n",
+		"\tcd " + StageMountDir + "/0 && cp -a --parents bin/* " + DefaultAppRoot + "/dataset/\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(content, e) {
+			t.Fatalf("definition file does not include %q:\n%s", e, content)
+		}
+	}
+	binds := BuildBinds(&helloworld, &data)
+	if !reflect.DeepEqual(binds, []string{appDir + ":" + StageMountDir + "/0"}) {
+		t.Fatalf("invalid build binds: %v", binds)
+	}
+
+	// Directories below the threshold are copied with %files
+	data.StageThreshold = 4096
+	if BuildBinds(&helloworld, &data) != nil {
+		t.Fatalf("directory below the threshold is staged")
+	}
+
+	// Binds at build time are not supported by older versions of Singularity
+	data.StageThreshold = 1024
+	data.TargetSingularityVersion = "3.9.0"
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if !strings.Contains(content, appDir+" "+DefaultAppRoot) || strings.Contains(content, StageMountDir) {
+		t.Fatalf("directory is not copied with %%files:\n%s", content)
+	}
+	if BuildBinds(&helloworld, &data) != nil {
+		t.Fatalf("directory is staged with Singularity 3.9")
+	}
+
+	// Patterns cannot escape the staged directory
+	data.StageInclude = []string{"../etc/passwd"}
+	if checkStageInclude(data.StageInclude) == nil {
+		t.Fatalf("invalid pattern is accepted")
+	}
+}
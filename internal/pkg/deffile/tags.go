@@ -0,0 +1,135 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+)
+
+const (
+	// tarArgsTag is the tag used to refer to the arguments of tar in templates
+	tarArgsTag = "TARARGS"
+
+	// redactedValue is the value displayed instead of the value of extra tags when redacted
+	redactedValue = "<redacted>"
+)
+
+// builtinTag is a tag substituted by UpdateDeffileTemplate and the value to use
+type builtinTag struct {
+	tag   string
+	value string
+}
+
+// getBuiltinTags returns the tags that are always substituted in templates, in the order they are substituted
+func getBuiltinTags(data *DefFileData, tarball string, tarArgs string) []builtinTag {
+	return []builtinTag{
+		{tag: data.Tags.Version, value: data.MpiImplm.Version},
+		{tag: data.Tags.URL, value: data.MpiImplm.URL},
+		{tag: data.Tags.Tarball, value: tarball},
+		{tag: tarArgsTag, value: tarArgs},
+		{tag: distroCodenameTag, value: data.DistroID.Codename},
+	}
+}
+
+// tagsOverlap checks whether substituting one of the tags could modify the other one
+func tagsOverlap(t1 string, t2 string) bool {
+	return strings.Contains(t1, t2) || strings.Contains(t2, t1)
+}
+
+// checkExtraTags validates extra tags against the built-in tags and returns the sorted list of extra tags to substitute.
+// An extra tag identical to a built-in tag is ignored since the built-in tag takes precedence.
+func checkExtraTags(extraTags map[string]string, builtins []builtinTag) ([]string, error) {
+	var keys []string
+	for key := range extraTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var tags []string
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("empty extra tag")
+		}
+
+		collision := false
+		for _, b := range builtins {
+			// The tags of text/template templates are not set
+			if b.tag == "" {
+				continue
+			}
+			if key == b.tag {
+				sylog.Warn("extra tag %s collides with a built-in tag, the built-in value takes precedence", key)
+				collision = true
+				break
+			}
+			if tagsOverlap(key, b.tag) {
+				return nil, fmt.Errorf("extra tag %s overlaps with built-in tag %s", key, b.tag)
+			}
+		}
+		if collision {
+			continue
+		}
+
+		for _, t := range tags {
+			if tagsOverlap(key, t) {
+				return nil, fmt.Errorf("extra tag %s overlaps with extra tag %s", key, t)
+			}
+		}
+		tags = append(tags, key)
+	}
+
+	return tags, nil
+}
+
+// applyTags substitutes the built-in and extra tags in the content of a template and returns the updated content and the list of extra tags
+// that were applied. Built-in tags without value, e.g., DISTROCODENAME for distributions without codename, are replaced with an empty string.
+// The substitutions are recorded in trace, if not nil.
+func applyTags(content string, builtins []builtinTag, extraTags map[string]string, tags []string, trace *Trace) (string, []string) {
+	for _, b := range builtins {
+		trace.record(content, b.tag, false)
+		content = strings.Replace(content, b.tag, b.value, -1)
+	}
+
+	var applied []string
+	for _, t := range tags {
+		trace.record(content, t, true)
+		if !strings.Contains(content, t) {
+			sylog.Warn("extra tag %s is not used in the template", t)
+			continue
+		}
+		content = strings.Replace(content, t, extraTags[t], -1)
+		applied = append(applied, t)
+	}
+
+	return content, applied
+}
+
+// addExtraTagsHeader adds a comment listing the extra tags that were applied, right before the first section of the definition file
+func addExtraTagsHeader(content string, data *DefFileData, applied []string) string {
+	if len(applied) == 0 {
+		return content
+	}
+
+	header := "# Extra tags applied:\n"
+	for _, t := range applied {
+		value := data.ExtraTags[t]
+		if data.RedactExtraTags {
+			value = redactedValue
+		}
+		header += "#   " + t + "=" + value + "\n"
+	}
+	header += "\n"
+
+	idx := strings.Index(content, "\n%")
+	if idx == -1 {
+		return content + "\n" + header
+	}
+	return content[:idx+1] + header + content[idx+1:]
+}
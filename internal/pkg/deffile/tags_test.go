@@ -0,0 +1,73 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+func TestExtraTags(t *testing.T) {
+	var data DefFileData
+	var openmpi implem.Info
+	openmpi.Version = "4.0.2"
+	openmpi.URL = "https://download.open-mpi.org/release/open-mpi/v4.0/openmpi-4.0.2.tar.bz2"
+	data.MpiImplm = &openmpi
+	data.Tags.Version = "OMPIVERSION"
+	data.Tags.URL = "OMPIURL"
+	data.Tags.Tarball = "OMPITARBALL"
+	data.DistroID = distro.ParseDescr("ubuntu:disco")
+	builtins := getBuiltinTags(&data, "openmpi-4.0.2.tar.bz2", "-xjf")
+
+	template := "Bootstrap: docker\nFrom: ubuntu:DISTROCODENAME\n\n%post\n\twget OMPIURL\n\tmodule load COMPILERMODULE\n\techo CLUSTERNAME\n"
+
+	// An extra tag identical to a built-in tag is ignored, the built-in value takes precedence
+	data.ExtraTags = map[string]string{"OMPIVERSION": "1.0", "COMPILERMODULE": "gcc/9.2", "CLUSTERNAME": "mycluster", "UNUSEDTAG": "foo"}
+	tags, err := checkExtraTags(data.ExtraTags, builtins)
+	if err != nil {
+		t.Fatalf("failed to check extra tags: %s", err)
+	}
+	if strings.Join(tags, ",") != "CLUSTERNAME,COMPILERMODULE,UNUSEDTAG" {
+		t.Fatalf("invalid list of extra tags: %v", tags)
+	}
+	content, applied := applyTags(template, builtins, data.ExtraTags, tags, nil)
+	if strings.Join(applied, ",") != "CLUSTERNAME,COMPILERMODULE" {
+		t.Fatalf("invalid list of applied tags: %v", applied)
+	}
+	if !strings.Contains(content, "From: ubuntu:disco") || !strings.Contains(content, "module load gcc/9.2") || !strings.Contains(content, "echo mycluster") {
+		t.Fatalf("tags were not correctly substituted:\n%s", content)
+	}
+
+	data.RedactExtraTags = true
+	content = addExtraTagsHeader(content, &data, applied)
+	if !strings.HasPrefix(content, "Bootstrap: docker") || !strings.Contains(content, "#   CLUSTERNAME=<redacted>\n") || strings.Contains(content, "=mycluster") {
+		t.Fatalf("invalid header:\n%s", content)
+	}
+	if strings.Index(content, "# Extra tags applied") > strings.Index(content, "%post") {
+		t.Fatalf("header is not before the first section:\n%s", content)
+	}
+
+	// Extra tags overlapping with a built-in tag are rejected
+	_, err = checkExtraTags(map[string]string{"OMPIVERSIONMAJOR": "4"}, builtins)
+	if err == nil {
+		t.Fatalf("extra tag overlapping with a built-in tag was accepted")
+	}
+	_, err = checkExtraTags(map[string]string{"CLUSTER": "a", "CLUSTERNAME": "b"}, builtins)
+	if err == nil {
+		t.Fatalf("overlapping extra tags were accepted")
+	}
+
+	// Built-in tags without value are replaced with an empty string
+	data.DistroID = distro.ParseDescr("centos:7")
+	builtins = getBuiltinTags(&data, "openmpi-4.0.2.tar.bz2", "-xjf")
+	content, _ = applyTags(template, builtins, nil, nil, nil)
+	if !strings.Contains(content, "From: ubuntu:\n") || strings.Contains(content, "DISTROCODENAME") {
+		t.Fatalf("built-in tag without value was not substituted:\n%s", content)
+	}
+}
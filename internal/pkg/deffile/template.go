@@ -0,0 +1,280 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/internal/pkg/archive"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+)
+
+// templateExtraField is the field of TemplateData giving access to the extra tags
+const templateExtraField = "Extra"
+
+// templateFieldRegexp matches the actions of text/template templates starting with a field, e.g., {{.MPIVersion}}
+// or {{- .Extra.SITE }}; the build arguments of legacy templates, e.g., {{ MPI_VERSION }}, do not match
+var templateFieldRegexp = regexp.MustCompile(`\{\{-?\s*\.`)
+
+// TemplateData is the data available to the text/template templates of definition files, e.g., {{.MPIVersion}}
+// or {{.Extra.REGISTRY}} for the extra tag REGISTRY
+type TemplateData struct {
+	// MPIVersion is the version of MPI
+	MPIVersion string
+
+	// MPIURL is the URL of the tarball of MPI
+	MPIURL string
+
+	// Tarball is the name of the tarball of MPI
+	Tarball string
+
+	// TarArgs are the arguments of tar to extract the tarball of MPI
+	TarArgs string
+
+	// DistroCodename is the codename of the Linux distribution, e.g., disco
+	DistroCodename string
+
+	// InstallDir is the directory of the image where MPI is installed
+	InstallDir string
+
+	// Extra are the extra tags of the definition file
+	Extra map[string]string
+}
+
+// fields returns the values of the fields of the template data, by name
+func (d *TemplateData) fields() map[string]string {
+	return map[string]string{
+		"MPIVersion":     d.MPIVersion,
+		"MPIURL":         d.MPIURL,
+		"Tarball":        d.Tarball,
+		"TarArgs":        d.TarArgs,
+		"DistroCodename": d.DistroCodename,
+		"InstallDir":     d.InstallDir,
+	}
+}
+
+// getTarArgs returns the arguments of tar to extract a tarball
+func getTarArgs(tarball string) (string, error) {
+	switch archive.DetectTarballFormat(tarball) {
+	case util.FormatBZ2:
+		return "-xjf", nil
+	case util.FormatGZ:
+		return "-xzf", nil
+	case util.FormatTAR:
+		return "-xf", nil
+	case archive.FormatXZ:
+		return "-xJf", nil
+	}
+	return "", fmt.Errorf("un-supported tarball format for %s", tarball)
+}
+
+// getTemplateData returns the data available to the templates of definition files
+func getTemplateData(data *DefFileData) (*TemplateData, error) {
+	if data.MpiImplm == nil || data.MpiImplm.Version == "" || data.MpiImplm.URL == "" || data.DistroID.Name == "" {
+		return nil, fmt.Errorf("invalid parameter(s)")
+	}
+
+	tarball := path.Base(data.MpiImplm.URL)
+	tarArgs, err := getTarArgs(tarball)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TemplateData{
+		MPIVersion:     data.MpiImplm.Version,
+		MPIURL:         data.MpiImplm.URL,
+		Tarball:        tarball,
+		TarArgs:        tarArgs,
+		DistroCodename: data.DistroID.Codename,
+		InstallDir:     data.layout().MPIPrefix,
+		Extra:          data.ExtraTags,
+	}, nil
+}
+
+// parseGoTemplate parses a text/template template of a definition file and returns the fields it refers to.
+// The template is nil for legacy templates: they do not parse, e.g., build arguments such as {{ MPI_VERSION }}
+// are not template functions, or they do not refer to any field of TemplateData. Templates referring to fields
+// that do not parse are malformed text/template templates, not legacy templates.
+func parseGoTemplate(name string, content string) (*template.Template, map[string]bool, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		if templateFieldRegexp.MatchString(content) {
+			return nil, nil, fmt.Errorf("failed to parse %s: %s", name, err)
+		}
+		return nil, nil, nil
+	}
+	if tmpl.Tree == nil {
+		return nil, nil, nil
+	}
+
+	fields := make(map[string]bool)
+	getTemplateFields(tmpl.Tree.Root, fields)
+	known := (&TemplateData{}).fields()
+	for field := range fields {
+		if _, ok := known[field]; ok || strings.HasPrefix(field, templateExtraField+".") {
+			return tmpl, fields, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// getTemplateFields returns the fields, e.g., MPIVersion or Extra.REGISTRY, referred to by the nodes of a template
+func getTemplateFields(node parse.Node, fields map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			getTemplateFields(child, fields)
+		}
+	case *parse.ActionNode:
+		getTemplateFields(n.Pipe, fields)
+	case *parse.IfNode:
+		getTemplateFields(n.Pipe, fields)
+		getTemplateFields(n.List, fields)
+		getTemplateFields(n.ElseList, fields)
+	case *parse.RangeNode:
+		getTemplateFields(n.Pipe, fields)
+		getTemplateFields(n.List, fields)
+		getTemplateFields(n.ElseList, fields)
+	case *parse.WithNode:
+		getTemplateFields(n.Pipe, fields)
+		getTemplateFields(n.List, fields)
+		getTemplateFields(n.ElseList, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				getTemplateFields(arg, fields)
+			}
+		}
+	case *parse.FieldNode:
+		fields[strings.Join(n.Ident, ".")] = true
+	}
+}
+
+// getUnexpandedFields returns the sorted list of the fields of a template that have no value in the template data
+func getUnexpandedFields(fields map[string]bool, data *TemplateData) []string {
+	values := data.fields()
+	var unexpanded []string
+	for field := range fields {
+		if strings.HasPrefix(field, templateExtraField+".") {
+			if data.Extra[strings.TrimPrefix(field, templateExtraField+".")] != "" {
+				continue
+			}
+		} else if field == templateExtraField || values[field] != "" {
+			continue
+		}
+		unexpanded = append(unexpanded, field)
+	}
+	sort.Strings(unexpanded)
+	return unexpanded
+}
+
+// renderGoTemplate renders a text/template template of a definition file and returns the content and the list of
+// extra tags that were applied. The fields are recorded in trace, if not nil, as .MPIVersion or .Extra.SITE.
+func renderGoTemplate(tmpl *template.Template, fields map[string]bool, content string, data *TemplateData, extraTags []string, trace *Trace) (string, []string, error) {
+	unexpanded := getUnexpandedFields(fields, data)
+	if len(unexpanded) > 0 {
+		return "", nil, fmt.Errorf("unexpanded template variables in %s: %s", tmpl.Name(), strings.Join(unexpanded, ", "))
+	}
+
+	var builtins []string
+	for field := range data.fields() {
+		builtins = append(builtins, field)
+	}
+	sort.Strings(builtins)
+	for _, field := range builtins {
+		trace.record(content, "."+field, false)
+	}
+
+	var applied []string
+	for _, t := range extraTags {
+		trace.record(content, "."+templateExtraField+"."+t, true)
+		if !fields[templateExtraField+"."+t] {
+			sylog.Warn("extra tag %s is not used in the template", t)
+			continue
+		}
+		applied = append(applied, t)
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to render %s: %s", tmpl.Name(), err)
+	}
+	return buf.String(), applied, nil
+}
+
+// renderLegacyTemplate substitutes the tags of a legacy template and returns the content and the list of
+// extra tags that were applied. The substitutions are recorded in trace, if not nil.
+func renderLegacyTemplate(content string, data *DefFileData, builtins []builtinTag, extraTags []string, trace *Trace) (string, []string, error) {
+	if data.Tags.Version == "" || data.Tags.URL == "" || data.Tags.Tarball == "" {
+		return "", nil, fmt.Errorf("invalid parameter(s)")
+	}
+
+	content, appliedTags := applyTags(content, builtins, data.ExtraTags, extraTags, trace)
+	return content, appliedTags, nil
+}
+
+// renderTemplate renders the template of a definition file, either a text/template template or a legacy
+// template using tags, and returns the content and the list of extra tags that were applied. Both kinds of
+// templates validate the extra tags the same way and list the extra tags applied in a header.
+func renderTemplate(templatePath string, data *DefFileData, trace *Trace) (string, []string, error) {
+	tmplData, err := getTemplateData(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	d, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read %s: %s", templatePath, err)
+	}
+
+	builtins := getBuiltinTags(data, tmplData.Tarball, tmplData.TarArgs)
+	extraTags, err := checkExtraTags(data.ExtraTags, builtins)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to update %s: invalid extra tags: %s", templatePath, err)
+	}
+
+	tmpl, fields, err := parseGoTemplate(path.Base(templatePath), string(d))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to update %s: %s", templatePath, err)
+	}
+
+	var content string
+	var appliedTags []string
+	if tmpl != nil {
+		content, appliedTags, err = renderGoTemplate(tmpl, fields, string(d), tmplData, extraTags, trace)
+	} else {
+		content, appliedTags, err = renderLegacyTemplate(string(d), data, builtins, extraTags, trace)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to update %s: %s", templatePath, err)
+	}
+
+	return normalizeContent(addExtraTagsHeader(content, data, appliedTags)), appliedTags, nil
+}
+
+// RenderTemplate renders the template of a definition file and returns the content of the definition file
+// without writing it, so that it can be inspected. Templates use text/template with TemplateData; templates
+// that do not refer to any field of TemplateData are legacy templates, the tags of data.Tags, TARARGS and DISTROCODENAME are substituted.
+func RenderTemplate(templatePath string, data DefFileData) (string, error) {
+	content, _, err := renderTemplate(templatePath, &data, nil)
+	return content, err
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var data DefFileData
+	var openmpi implem.Info
+	openmpi.Version = "4.0.2"
+	openmpi.URL = "https://download.open-mpi.org/release/open-mpi/v4.0/openmpi-4.0.2.tar.bz2"
+	data.MpiImplm = &openmpi
+	data.Tags.Version = "OMPIVERSION"
+	data.Tags.URL = "OMPIURL"
+	data.Tags.Tarball = "OMPITARBALL"
+	data.DistroID = distro.ParseDescr("ubuntu:disco")
+	data.Layout.MPIPrefix = "/opt/ompi"
+	data.ExtraTags = map[string]string{"CLUSTERNAME": "mycluster"}
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+		traced   string
+		err      string
+	}{
+		{
+			name:     "template",
+			traced:   ".Extra.CLUSTERNAME",
+			template: "From: ubuntu:{{.DistroCodename}}\n\n%post\n\twget {{.MPIURL}}\n\ttar {{.TarArgs}} {{.Tarball}}\n\t./configure --prefix={{.InstallDir}} # {{.MPIVersion}}\n\techo {{.Extra.CLUSTERNAME}}\n",
+			expected: "From: ubuntu:disco\n\n# Extra tags applied:\n#   CLUSTERNAME=mycluster\n\n%post\n\twget " + openmpi.URL + "\n\ttar -xjf openmpi-4.0.2.tar.bz2\n\t./configure --prefix=/opt/ompi # 4.0.2\n\techo mycluster\n",
+		},
+		{
+			name:     "build arguments",
+			template: "From: ubuntu:DISTROCODENAME\n\n%arguments\n\tMPI_VERSION=OMPIVERSION\n\n%post\n\techo {{ MPI_VERSION }}\n",
+			expected: "From: ubuntu:disco\n\n%arguments\n\tMPI_VERSION=4.0.2\n\n%post\n\techo {{ MPI_VERSION }}\n",
+		},
+		{
+			name:     "legacy",
+			traced:   "CLUSTERNAME",
+			template: "From: ubuntu:DISTROCODENAME\n\n%post\n\twget OMPIURL\n\ttar TARARGS OMPITARBALL\n\techo CLUSTERNAME",
+			expected: "From: ubuntu:disco\n\n# Extra tags applied:\n#   CLUSTERNAME=mycluster\n\n%post\n\twget " + openmpi.URL + "\n\ttar -xjf openmpi-4.0.2.tar.bz2\n\techo mycluster\n",
+		},
+		{
+			name:     "unexpanded",
+			template: "From: ubuntu:{{.DistroCodename}}\n\n%post\n\techo {{.Extra.SITE}} {{.Compiler}}\n",
+			err:      "unexpanded template variables in unexpanded.def.tmpl: Compiler, Extra.SITE",
+		},
+		{
+			name:     "invalid",
+			template: "From: ubuntu:{{.DistroCodename\n",
+			err:      "failed to parse invalid.def.tmpl",
+		},
+	}
+
+	for _, tt := range tests {
+		templatePath := filepath.Join(tempDir, tt.name+".def.tmpl")
+		err = ioutil.WriteFile(templatePath, []byte(tt.template), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", templatePath, err)
+		}
+
+		var trace Trace
+		content, _, err := renderTemplate(templatePath, &data, &trace)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("%s: expected error %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to render template: %s", tt.name, err)
+		}
+		if content != tt.expected {
+			t.Fatalf("%s: invalid content:\n%s\ninstead of:\n%s", tt.name, content, tt.expected)
+		}
+
+		// The template is left untouched
+		if readDefFile(t, templatePath) != tt.template {
+			t.Fatalf("%s: template was modified", tt.name)
+		}
+
+		// Both kinds of templates record the extra tags in the trace
+		if tt.traced != "" {
+			found := false
+			for _, tagTrace := range trace.Tags {
+				if tagTrace.Tag == tt.traced && tagTrace.Extra && tagTrace.Occurrences == 1 {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("%s: %s is not traced: %+v", tt.name, tt.traced, trace.Tags)
+			}
+		}
+	}
+
+	// The extra tags of text/template templates are validated against the built-in tags
+	templatePath := filepath.Join(tempDir, "overlap.def.tmpl")
+	err = ioutil.WriteFile(templatePath, []byte("From: ubuntu:{{.DistroCodename}}\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", templatePath, err)
+	}
+	data.ExtraTags = map[string]string{"OMPIVERSIONMAJOR": "4"}
+	_, err = RenderTemplate(templatePath, data)
+	if err == nil {
+		t.Fatalf("extra tag overlapping with a built-in tag was accepted")
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TraceFileSuffix is the suffix of the file, next to the definition file, where the trace of a template expansion is saved
+	TraceFileSuffix = ".trace.json"
+
+	// diffContext is the number of unchanged lines displayed around the changes in a diff
+	diffContext = 3
+)
+
+// TagTrace records the substitution of a tag during the expansion of a template
+type TagTrace struct {
+	// Tag is the tag that was substituted
+	Tag string `json:"tag"`
+
+	// Extra specifies whether the tag is an extra tag instead of a built-in tag
+	Extra bool `json:"extra"`
+
+	// Occurrences is the number of occurrences of the tag that were replaced
+	Occurrences int `json:"occurrences"`
+
+	// Lines are the line numbers (starting at 1) of the occurrences, in the content at the time the tag was substituted
+	Lines []int `json:"lines,omitempty"`
+
+	// Unused specifies whether the tag does not appear in the template, which usually means that the template
+	// and the tags do not match
+	Unused bool `json:"unused"`
+}
+
+// Trace records the expansion of a template into a definition file
+type Trace struct {
+	// Template is the path to the template that was expanded
+	Template string `json:"template"`
+
+	// Tags are the traces of the tags, in the order they were substituted
+	Tags []TagTrace `json:"tags"`
+
+	// Diff is the unified diff between the template and the resulting definition file
+	Diff string `json:"diff"`
+}
+
+// record adds the trace of a tag about to be substituted in content
+func (t *Trace) record(content string, tag string, extra bool) {
+	if t == nil {
+		return
+	}
+
+	tagTrace := TagTrace{Tag: tag, Extra: extra}
+	for i, line := range strings.Split(content, "\n") {
+		n := strings.Count(line, tag)
+		if n == 0 {
+			continue
+		}
+		tagTrace.Occurrences += n
+		tagTrace.Lines = append(tagTrace.Lines, i+1)
+	}
+	tagTrace.Unused = tagTrace.Occurrences == 0
+	t.Tags = append(t.Tags, tagTrace)
+}
+
+// UnusedTags returns the tags that do not appear in the template
+func (t *Trace) UnusedTags() []string {
+	var tags []string
+	for _, tagTrace := range t.Tags {
+		if tagTrace.Unused {
+			tags = append(tags, tagTrace.Tag)
+		}
+	}
+	return tags
+}
+
+// Save writes the trace in JSON to a file
+func (t *Trace) Save(path string) error {
+	d, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode the trace: %s", err)
+	}
+
+	err = ioutil.WriteFile(path, append(d, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// diffOp is an operation of a line-based diff: ' ' for an unchanged line, '-' for a removed line and '+' for an added line
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the operations transforming the lines a into the lines b, based on their longest common subsequence
+func diffLines(a []string, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{kind: '-', line: a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{kind: '-', line: a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{kind: '+', line: b[j]})
+	}
+	return ops
+}
+
+// getHunkRange returns the range of a hunk as displayed in its header
+func getHunkRange(start int, count int) string {
+	if count == 0 {
+		return strconv.Itoa(start) + ",0"
+	}
+	return strconv.Itoa(start+1) + "," + strconv.Itoa(count)
+}
+
+// unifiedDiff returns the unified diff between two contents, empty if they are identical
+func unifiedDiff(from string, to string, fromName string, toName string) string {
+	ops := diffLines(strings.Split(strings.TrimSuffix(from, "\n"), "\n"), strings.Split(strings.TrimSuffix(to, "\n"), "\n"))
+
+	var diff strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+
+		// Extend the hunk until the changes are separated by more than twice the context
+		end := start
+		for end < len(ops) {
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next + 1
+		}
+
+		hunkStart := start - diffContext
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		hunkEnd := end + diffContext
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+
+		// Line numbers of the beginning of the hunk in both contents
+		fromLine, toLine := 0, 0
+		for _, op := range ops[:hunkStart] {
+			if op.kind != '+' {
+				fromLine++
+			}
+			if op.kind != '-' {
+				toLine++
+			}
+		}
+		fromCount, toCount := 0, 0
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != '+' {
+				fromCount++
+			}
+			if op.kind != '-' {
+				toCount++
+			}
+		}
+
+		if diff.Len() == 0 {
+			diff.WriteString("--- " + fromName + "\n+++ " + toName + "\n")
+		}
+		diff.WriteString("@@ -" + getHunkRange(fromLine, fromCount) + " +" + getHunkRange(toLine, toCount) + " @@\n")
+		for _, op := range ops[hunkStart:hunkEnd] {
+			diff.WriteString(string(op.kind) + op.line + "\n")
+		}
+		start = hunkEnd
+	}
+	return diff.String()
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func TestUpdateDeffileTemplateWithTrace(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var data DefFileData
+	var openmpi implem.Info
+	openmpi.Version = "4.0.2"
+	openmpi.URL = "https://download.open-mpi.org/release/open-mpi/v4.0/openmpi-4.0.2.tar.bz2"
+	data.MpiImplm = &openmpi
+	data.Tags.Version = "OMPIVERSION"
+	data.Tags.URL = "OMPIURL"
+	data.Tags.Tarball = "OMPITARBALL"
+	data.DistroID = distro.ParseDescr("ubuntu:disco")
+	data.ExtraTags = map[string]string{"CLUSTERNAME": "mycluster"}
+	data.Path = filepath.Join(tempDir, "openmpi.def")
+
+	template := "Bootstrap: docker\nFrom: ubuntu:DISTROCODENAME\n\n%post\n\twget OMPIURL\n\ttar TARARGS OMPITARBALL\n\techo OMPIURL OMPIURL\n"
+	err = ioutil.WriteFile(data.Path, []byte(template), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", data.Path, err)
+	}
+
+	var sysCfg sys.Config
+	trace, err := UpdateDeffileTemplateWithTrace(data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to update template: %s", err)
+	}
+
+	expected := map[string]TagTrace{
+		"OMPIVERSION":     {Tag: "OMPIVERSION", Unused: true},
+		"OMPIURL":         {Tag: "OMPIURL", Occurrences: 3, Lines: []int{5, 7}},
+		"OMPITARBALL":     {Tag: "OMPITARBALL", Occurrences: 1, Lines: []int{6}},
+		tarArgsTag:        {Tag: tarArgsTag, Occurrences: 1, Lines: []int{6}},
+		distroCodenameTag: {Tag: distroCodenameTag, Occurrences: 1, Lines: []int{2}},
+		"CLUSTERNAME":     {Tag: "CLUSTERNAME", Extra: true, Unused: true},
+	}
+	if len(trace.Tags) != len(expected) {
+		t.Fatalf("%d tags traced instead of %d", len(trace.Tags), len(expected))
+	}
+	for _, tagTrace := range trace.Tags {
+		if !reflect.DeepEqual(tagTrace, expected[tagTrace.Tag]) {
+			t.Fatalf("invalid trace for %s: %+v instead of %+v", tagTrace.Tag, tagTrace, expected[tagTrace.Tag])
+		}
+	}
+	if strings.Join(trace.UnusedTags(), ",") != "OMPIVERSION,CLUSTERNAME" {
+		t.Fatalf("invalid list of unused tags: %v", trace.UnusedTags())
+	}
+
+	expectedDiff := "--- " + data.Path + ".tmpl\n+++ " + data.Path + "\n" +
+		"@@ -1,7 +1,7 @@\n" +
+		" Bootstrap: docker\n" +
+		"-From: ubuntu:DISTROCODENAME\n" +
+		"+From: ubuntu:disco\n" +
+		" \n" +
+		" %post\n" +
+		"-\twget OMPIURL\n" +
+		"-\ttar TARARGS OMPITARBALL\n" +
+		"-\techo OMPIURL OMPIURL\n" +
+		"+\twget " + openmpi.URL + "\n" +
+		"+\ttar -xjf openmpi-4.0.2.tar.bz2\n" +
+		"+\techo " + openmpi.URL + " " + openmpi.URL + "\n"
+	if trace.Diff != expectedDiff {
+		t.Fatalf("invalid diff:\n%s\ninstead of:\n%s", trace.Diff, expectedDiff)
+	}
+
+	traceFile := data.Path + TraceFileSuffix
+	err = trace.Save(traceFile)
+	if err != nil {
+		t.Fatalf("failed to save trace: %s", err)
+	}
+	if !strings.Contains(readDefFile(t, traceFile), "\"unused\": true") {
+		t.Fatalf("unused tags are not flagged in %s", traceFile)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// isAppLabel checks whether a label describes the application of an image, in which case it is not carried
+// forward when the application layer is rebuilt
+func isAppLabel(label string) bool {
+	if strings.HasPrefix(label, "org.label-schema.") {
+		// Labels generated by Singularity at build time
+		return true
+	}
+	switch label {
+	case "Application", "App_exe", container.LaunchCommandLabel, LicenseLabel, ReadmeLabel, container.MetadataFormatLabel, container.AppBuildGenerationLabel:
+		return true
+	}
+	return false
+}
+
+// checkParentImage checks that the application layer of an image can be rebuilt with the configuration of a
+// definition file, i.e., the image was built by us with the same MPI and Linux distribution
+func checkParentImage(labels map[string]string, data *DefFileData) error {
+	if labels["MPI_Implementation"] == "" {
+		return fmt.Errorf("the image does not have any MPI metadata, it was not created by this tool")
+	}
+	if labels["Model"] != container.HybridModel {
+		return fmt.Errorf("only the application of hybrid images can be rebuilt, not %s images", labels["Model"])
+	}
+	if data.MpiImplm == nil {
+		return fmt.Errorf("MPI configuration is undefined")
+	}
+	mpiVersion := getValue(data, MPIVersionArg, data.MpiImplm.Version)
+	if labels["MPI_Implementation"] != data.MpiImplm.ID || labels["MPI_Version"] != mpiVersion {
+		return fmt.Errorf("the image was built with %s %s, not %s %s", labels["MPI_Implementation"], labels["MPI_Version"], data.MpiImplm.ID, mpiVersion)
+	}
+	if labels["Linux_distribution"] != data.DistroID.Name || labels["Linux_version"] != data.DistroID.Version {
+		return fmt.Errorf("the image is based on %s %s, not %s %s", labels["Linux_distribution"], labels["Linux_version"], data.DistroID.Name, data.DistroID.Version)
+	}
+	if labels["App_exe"] == getMPIWrapperPath(data) {
+		return fmt.Errorf("the application of images with a MPI wrapper cannot be rebuilt")
+	}
+	return nil
+}
+
+// addParentBootstrap adds the bootstrap section of a definition file building on top of an existing image
+func addParentBootstrap(f io.Writer, parentImage string) error {
+	_, err := io.WriteString(f, "Bootstrap: localimage\nFrom: "+parentImage+"\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to add bootstrap section to definition file: %s", err)
+	}
+	return nil
+}
+
+// addUpdateLabels adds the labels section of a definition file rebuilding the application of an image: the
+// labels of the parent image are carried forward, except the ones describing the application which are
+// replaced, and the generation of the application layer is incremented
+func addUpdateLabels(f io.Writer, app *app.Info, data *DefFileData, labels map[string]string) error {
+	generation, err := container.GetAppBuildGeneration(labels)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range labels {
+		if !isAppLabel(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	content := "%labels\n"
+	content += "\t" + container.MetadataFormatLabel + " " + strconv.Itoa(container.MetadataFormat) + "\n"
+	for _, name := range names {
+		value := labels[name]
+		if name == container.HealthCheckLabel && data.HealthCheck != "" {
+			value = data.HealthCheck
+		}
+		content += "\t" + name + " " + value + "\n"
+	}
+	if app.BinPath == "" {
+		app.BinPath = data.layout().AppRoot + "/" + app.BinName
+	}
+	content += "\tApplication " + app.Name + "\n"
+	content += "\tApp_exe " + getAppExe(app, data) + "\n"
+	if hasLaunchInfo(data) {
+		content += "\t" + container.LaunchCommandLabel + " " + getLaunchCommand(app, data) + "\n"
+	}
+	content += "\t" + container.AppBuildGenerationLabel + " " + strconv.Itoa(generation+1) + "\n"
+	for _, doc := range getDocFiles(app) {
+		content += "\t" + doc.label + " " + getDocFilePath(doc.path, data) + "\n"
+	}
+
+	_, err = io.WriteString(f, content+"\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	return nil
+}
+
+// addAppRemoval adds the beginning of the post section of a definition file rebuilding the application of
+// an image: the MPI environment of the image is set and the previous application is removed. Only the
+// directory of the previous application is removed, never the application root or the MPI installation.
+func addAppRemoval(f io.Writer, data *DefFileData, labels map[string]string) error {
+	appRoot := data.layout().AppRoot
+	mpiDir := labels["MPI_Directory"]
+	if mpiDir == "" {
+		mpiDir = data.layout().MPIPrefix
+	}
+
+	content := "%post\n" +
+		"\texport MPI_DIR=" + mpiDir + "\n" +
+		"\texport PATH=$MPI_DIR/bin:$PATH\n" +
+		"\texport LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH\n\n"
+
+	oldExe := labels["App_exe"]
+	if oldExe != "" {
+		content += "\tif [ -e " + oldExe + " ]; then\n" +
+			"\t\tOLD_APPDIR=$(dirname \"$(readlink -f " + oldExe + ")\")\n" +
+			"\t\tcase \"$OLD_APPDIR\" in\n" +
+			"\t\t\t" + appRoot + "/*)\n" +
+			"\t\t\t\tif [ \"$OLD_APPDIR\" != \"$MPI_DIR\" ]; then\n" +
+			"\t\t\t\t\trm -rf \"$OLD_APPDIR\"\n" +
+			"\t\t\t\tfi\n" +
+			"\t\t\t\t;;\n" +
+			"\t\tesac\n" +
+			"\t\trm -f " + oldExe + "\n" +
+			"\tfi\n\n"
+	}
+
+	_, err := io.WriteString(f, content)
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+	return nil
+}
+
+// CreateAppUpdateDefFile creates a definition file rebuilding only the application of an existing image,
+// whose labels are given: the image is used as bootstrap, the previous application removed and the new one
+// downloaded and installed. The MPI installation and the Linux distribution of the image are left untouched.
+func CreateAppUpdateDefFile(app *app.Info, data *DefFileData, parentImage string, labels map[string]string, sysCfg *sys.Config) error {
+	// Some sanity checks
+	if data.Path == "" || parentImage == "" {
+		return fmt.Errorf("invalid parameter(s)")
+	}
+
+	err := checkParentImage(labels, data)
+	if err != nil {
+		return fmt.Errorf("cannot rebuild the application of %s: %s", parentImage, err)
+	}
+
+	data.Model = container.HybridModel
+	if data.HealthCheck == "" {
+		data.HealthCheck = labels[container.HealthCheckLabel]
+	}
+
+	log.Printf("- Defintion file is %s\n", data.Path)
+	return writeDefFile(data, sysCfg, func(w io.Writer) error {
+		return renderAppUpdateDefFile(w, app, data, parentImage, labels, sysCfg)
+	})
+}
+
+// renderAppUpdateDefFile writes the content of a definition file rebuilding only the application of an
+// existing image, see CreateAppUpdateDefFile
+func renderAppUpdateDefFile(f io.Writer, app *app.Info, data *DefFileData, parentImage string, labels map[string]string, sysCfg *sys.Config) error {
+	err := checkLayout(app, data)
+	if err != nil {
+		return fmt.Errorf("invalid image layout: %s", err)
+	}
+
+	err = addParentBootstrap(f, parentImage)
+	if err != nil {
+		return fmt.Errorf("failed to create the bootstrap section of the definition file: %s", err)
+	}
+
+	err = addArguments(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the arguments section of the definition file: %s", err)
+	}
+
+	err = addUpdateLabels(f, app, data, labels)
+	if err != nil {
+		return fmt.Errorf("failed to create the labels section of the definition file: %s", err)
+	}
+
+	if util.DetectURLType(app.Source) == util.FileURL || len(getDocFiles(app)) > 0 {
+		err = createFilesSection(f, app, data, sysCfg)
+		if err != nil {
+			return fmt.Errorf("failed to create the files section of the definition file: %s", err)
+		}
+	}
+
+	err = addAppRemoval(f, data, labels)
+	if err != nil {
+		return fmt.Errorf("failed to add the code removing the previous application: %s", err)
+	}
+
+	err = addAppDownload(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the section to download the app: %s", err)
+	}
+
+	err = addAppInstall(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the post section of the definition file: %s", err)
+	}
+
+	err = addLaunchInfo(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to add the launch information: %s", err)
+	}
+
+	err = addRunscript(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the runscript section of the definition file: %s", err)
+	}
+
+	err = addTestSection(f, app, data)
+	if err != nil {
+		return fmt.Errorf("failed to create the test section of the definition file: %s", err)
+	}
+
+	return nil
+}
+
+// UpdateApp rebuilds only the application layer of an image created by this tool, which is much faster
+// than building the image from scratch when only the application changed. The new image records the
+// digest of the parent image in its build manifest.
+func UpdateApp(app *app.Info, data *DefFileData, parentImage string, image *container.Config, sysCfg *sys.Config) error {
+	labels, err := container.GetLabels(parentImage, sysCfg)
+	if err != nil {
+		return fmt.Errorf("failed to get the labels of %s: %s", parentImage, err)
+	}
+
+	err = CreateAppUpdateDefFile(app, data, parentImage, labels, sysCfg)
+	if err != nil {
+		return err
+	}
+
+	image.DefFile = data.Path
+	image.Model = data.Model
+	return container.CreateWithOptions(image, sysCfg, container.CreateOptions{Parent: parentImage})
+}
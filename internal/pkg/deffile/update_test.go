@@ -0,0 +1,159 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+func TestLayeredRebuild(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Without a base image, the previous MPI directory is ignored
+	data := getTestDefFileData(tempDir, "helloworld")
+	data.OldMPIDir = "/opt/mpi-old"
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if strings.Contains(content, "rm -rf $OLD_MPI_DIR") || strings.Contains(content, "localimage") {
+		t.Fatalf("definition file without base image removes MPI:\n%s", content)
+	}
+
+	data = getTestDefFileData(tempDir, "helloworld")
+	data.BaseImage = "/tmp/base.sif"
+	data.OldMPIDir = "/opt/mpi-old/"
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if !strings.Contains(content, "Bootstrap: localimage\nFrom: /tmp/base.sif\n") {
+		t.Fatalf("definition file does not bootstrap from the base image:\n%s", content)
+	}
+	removeIdx := strings.Index(content, "export OLD_MPI_DIR=/opt/mpi-old\n\trm -rf $OLD_MPI_DIR\n")
+	installIdx := strings.Index(content, "make -j8 install")
+	if removeIdx == -1 || installIdx == -1 || removeIdx > installIdx {
+		t.Fatalf("removal of the previous MPI installation does not precede the installation:\n%s", content)
+	}
+
+	for _, dir := range []string{"/", "opt/mpi"} {
+		data = getTestDefFileData(tempDir, "helloworld")
+		data.BaseImage = "/tmp/base.sif"
+		data.OldMPIDir = dir
+		err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+		if err == nil {
+			t.Fatalf("creation of a definition file removing %s succeeded", dir)
+		}
+	}
+}
+
+func TestCreateAppUpdateDefFile(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	var netpipe app.Info
+	netpipe.Name = "netpipe"
+	netpipe.BinName = "NPmpi"
+	netpipe.Source = "http://netpipe.cs.ksu.edu/download/NetPIPE-5.1.4.tar.gz"
+	netpipe.InstallCmd = "make mpi"
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	parent := filepath.Join(tempDir, "parent.sif")
+	labels := map[string]string{
+		container.MetadataFormatLabel:     "2",
+		"Linux_distribution":              "ubuntu",
+		"Linux_version":                   "19.04",
+		"MPI_Implementation":              implem.OMPI,
+		"MPI_Version":                     "3.1.4",
+		"MPI_Directory":                   "/opt/mpi",
+		"Model":                           container.HybridModel,
+		"Application":                     "oldapp",
+		"App_exe":                         "/opt/oldapp",
+		container.HealthCheckLabel:        container.DefaultHealthCheck,
+		container.AppBuildGenerationLabel: "2",
+		"org.label-schema.build-date":     "Monday_1_January_2019",
+	}
+
+	data := getTestDefFileData(tempDir, netpipe.Name)
+	err = CreateAppUpdateDefFile(&netpipe, &data, parent, labels, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+
+	content := readDefFile(t, data.Path)
+	expected := []string{
+		"Bootstrap: localimage\nFrom: " + parent + "\n",
+		"\tMPI_Implementation " + implem.OMPI + "\n",
+		"\tMPI_Directory /opt/mpi\n",
+		"\tApplication " + netpipe.Name + "\n",
+		"\tApp_exe /opt/NPmpi\n",
+		"\t" + container.AppBuildGenerationLabel + " 3\n",
+		"%test\n\t" + container.DefaultHealthCheck + "\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(content, e) {
+			t.Fatalf("definition file does not include %q:\n%s", e, content)
+		}
+	}
+	for _, e := range []string{"Application oldapp", "org.label-schema", "MPI_BUILDDIR"} {
+		if strings.Contains(content, e) {
+			t.Fatalf("definition file includes %q:\n%s", e, content)
+		}
+	}
+	removal := strings.Index(content, "rm -f /opt/oldapp")
+	download := strings.Index(content, "wget -c "+netpipe.Source)
+	if removal == -1 || download == -1 || removal > download {
+		t.Fatalf("the previous application is not removed before the download:\n%s", content)
+	}
+
+	// The application cannot be rebuilt on top of an image with a different MPI or distro
+	tests := []struct {
+		label string
+		value string
+	}{
+		{label: "MPI_Version", value: "4.0.2"},
+		{label: "MPI_Implementation", value: implem.MPICH},
+		{label: "Linux_version", value: "18.04"},
+		{label: "Model", value: container.BindModel},
+		{label: "MPI_Implementation", value: ""},
+	}
+	for _, tt := range tests {
+		invalidLabels := make(map[string]string)
+		for k, v := range labels {
+			invalidLabels[k] = v
+		}
+		invalidLabels[tt.label] = tt.value
+
+		data := getTestDefFileData(tempDir, "invalid")
+		err = CreateAppUpdateDefFile(&netpipe, &data, parent, invalidLabels, &sysCfg)
+		if err == nil {
+			t.Fatalf("application rebuilt on top of an image with %s=%q", tt.label, tt.value)
+		}
+		if _, err := os.Stat(data.Path); err == nil {
+			t.Fatalf("definition file created for an image with %s=%q", tt.label, tt.value)
+		}
+	}
+}
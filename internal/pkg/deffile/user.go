@@ -0,0 +1,146 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+// userNameRegexp is the format of the user and group names we accept, i.e., portable POSIX names
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// getGroup returns the group of the default user of the container; when not specified, a group with the same name than the user is used
+func getGroup(deffile *DefFileData) string {
+	if deffile.Group != "" {
+		return deffile.Group
+	}
+	return deffile.User
+}
+
+// checkUser checks that the default user and group of the container are valid
+func checkUser(deffile *DefFileData) error {
+	if deffile.User == "" {
+		if deffile.Group != "" {
+			return fmt.Errorf("group %s is specified without a user", deffile.Group)
+		}
+		return nil
+	}
+
+	if !userNameRegexp.MatchString(deffile.User) {
+		return fmt.Errorf("invalid user name: %s", deffile.User)
+	}
+	if !userNameRegexp.MatchString(getGroup(deffile)) {
+		return fmt.Errorf("invalid group name: %s", deffile.Group)
+	}
+
+	return nil
+}
+
+// getAppExe returns the path to the application's executable in the container, i.e., the MPI wrapper
+// when one is generated
+func getAppExe(app *app.Info, deffile *DefFileData) string {
+	if deffile.MPIWrapper {
+		return getMPIWrapperPath(deffile)
+	}
+	return getAppBinary(app, deffile)
+}
+
+// getAppBinary returns the path to the application's binary in the container
+func getAppBinary(app *app.Info, deffile *DefFileData) string {
+	if deffile.Model == container.BindModel || app.BinPath == "" {
+		return deffile.layout().AppRoot + "/" + app.BinName
+	}
+	return app.BinPath
+}
+
+// getUserCreationCmds returns the commands creating the container's default user and its group. Alpine only
+// provides the BusyBox commands, which do not support the options of groupadd and useradd.
+func getUserCreationCmds(deffile *DefFileData) []string {
+	group := getGroup(deffile)
+	d := getDistroSupport(deffile.DistroID.Name)
+	if d != nil && d.packageFormat == apkPackageFormat {
+		return []string{
+			"grep -q '^" + group + ":' /etc/group || addgroup " + group,
+			"id -u " + deffile.User + " > /dev/null 2>&1 || adduser -D -G " + group + " -s /bin/sh " + deffile.User,
+		}
+	}
+	return []string{
+		"groupadd -f " + group,
+		"id -u " + deffile.User + " > /dev/null 2>&1 || useradd -m -g " + group + " -s /bin/sh " + deffile.User,
+	}
+}
+
+// addUserCreation adds the creation of the container's default user and group to the post section
+func addUserCreation(f io.Writer, deffile *DefFileData) error {
+	err := checkUser(deffile)
+	if err != nil {
+		return err
+	}
+	if deffile.User == "" {
+		return nil
+	}
+
+	_, err = io.WriteString(f, "\t"+strings.Join(getUserCreationCmds(deffile), "\n\t")+"\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	return nil
+}
+
+// indentRunscript returns a custom runscript indented as a section of the definition file
+func indentRunscript(runscript string) string {
+	var content string
+	for _, line := range strings.Split(strings.TrimRight(runscript, "\n"), "\n") {
+		if line != "" {
+			line = "\t" + line
+		}
+		content += line + "\n"
+	}
+	return content
+}
+
+// addRunscript adds a runscript section starting the application's executable (App_exe label) with the
+// arguments of the container, or the custom runscript of the definition file when set. When the container
+// has a default user, the application is started as this user.
+//
+// Singularity runs the container as the user invoking it, so we can only switch to the default
+// user when the container is started as root (e.g., with sudo or fakeroot).
+func addRunscript(f io.Writer, app *app.Info, deffile *DefFileData) error {
+	var runscript string
+	appExe := getAppExe(app, deffile)
+	switch {
+	case deffile.Runscript != "":
+		runscript = indentRunscript(deffile.Runscript)
+	case strings.HasSuffix(appExe, "/"):
+		// The executable of the application is unknown, there is nothing to start
+		return nil
+	case deffile.User == "":
+		runscript = "\texec " + appExe + " \"$@\"\n"
+	default:
+		group := getGroup(deffile)
+		runscript = "\tif [ \"$(id -u)\" = \"0\" ]; then\n" +
+			"\t\tif command -v setpriv > /dev/null 2>&1; then\n" +
+			"\t\t\texec setpriv --reuid=" + deffile.User + " --regid=" + group + " --init-groups " + appExe + " \"$@\"\n" +
+			"\t\tfi\n" +
+			"\t\texec su -s /bin/sh " + deffile.User + " -c 'exec \"$0\" \"$@\"' " + appExe + " \"$@\"\n" +
+			"\tfi\n" +
+			"\texec " + appExe + " \"$@\"\n"
+	}
+
+	_, err := io.WriteString(f, "%runscript\n"+runscript+"\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+)
+
+// MPIWrapperName is the name of the wrapper setting up the MPI environment before starting the application,
+// installed in the application directory of the image
+const MPIWrapperName = "mpi-run"
+
+// getMPIWrapperPath returns the path to the MPI wrapper in the container
+func getMPIWrapperPath(deffile *DefFileData) string {
+	return deffile.layout().AppRoot + "/" + MPIWrapperName
+}
+
+// getMPIWrapper returns the content of the wrapper exporting the MPI environment and starting the application.
+// The %environment section is not sourced when the application is started with 'singularity exec' from a
+// shell that already defines the variables, or by tools bypassing the container's environment, so the
+// wrapper sets the environment explicitly.
+func getMPIWrapper(app *app.Info, deffile *DefFileData) string {
+	return "#!/bin/sh\n" +
+		"MPI_DIR=" + deffile.layout().MPIPrefix + "\n" +
+		"export MPI_DIR\n" +
+		"export PATH=$MPI_DIR/bin:$PATH\n" +
+		"export LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH\n" +
+		"export MANPATH=$MPI_DIR/share/man:$MANPATH\n" +
+		"exec " + getAppBinary(app, deffile) + " \"$@\"\n"
+}
+
+// addMPIWrapper adds to the post section the creation of the wrapper setting up the MPI environment
+// before starting the application. The wrapper is then used as the application's executable.
+func addMPIWrapper(f io.Writer, app *app.Info, deffile *DefFileData) error {
+	if !deffile.MPIWrapper {
+		return nil
+	}
+
+	wrapper := getMPIWrapperPath(deffile)
+	_, err := io.WriteString(f, "\tmkdir -p "+deffile.layout().AppRoot+"\n"+
+		"\tcat > "+wrapper+" << 'EOF'\n"+getMPIWrapper(app, deffile)+"EOF\n"+
+		"\tchmod 755 "+wrapper+"\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to definition file: %s", err)
+	}
+
+	return nil
+}
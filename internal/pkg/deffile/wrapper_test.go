@@ -0,0 +1,71 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package deffile
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+)
+
+func TestMPIWrapper(t *testing.T) {
+	sysCfg := getTestSysConfig(t)
+	helloworld := app.GetHelloworld(&sysCfg)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	data := getTestDefFileData(tempDir, helloworld.Name)
+	data.Model = container.HybridModel
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content := readDefFile(t, data.Path)
+	if strings.Contains(content, MPIWrapperName) || !strings.Contains(content, "%runscript\n\texec "+helloworld.BinPath+" \"$@\"\n") {
+		t.Fatalf("MPI wrapper is generated while not requested:\n%s", content)
+	}
+
+	helloworld.BinPath = ""
+	data.MPIWrapper = true
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	expected := []string{
+		"\tApp_exe /opt/mpi-run\n",
+		"\tcat > /opt/mpi-run << 'EOF'\n#!/bin/sh\n",
+		"MPI_DIR=" + data.InternalEnv.InstallDir + "\nexport MPI_DIR\n",
+		"export PATH=$MPI_DIR/bin:$PATH\n",
+		"export LD_LIBRARY_PATH=$MPI_DIR/lib:$LD_LIBRARY_PATH\n",
+		"exec /opt/" + helloworld.BinName + " \"$@\"\nEOF\n\tchmod 755 /opt/mpi-run\n",
+		"%runscript\n\texec /opt/mpi-run \"$@\"\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(content, e) {
+			t.Fatalf("definition file does not include %s:\n%s", e, content)
+		}
+	}
+
+	// The runscript switching to the default user starts the wrapper
+	data.User = "mpiuser"
+	err = CreateHybridDefFile(&helloworld, &data, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to create definition file: %s", err)
+	}
+	content = readDefFile(t, data.Path)
+	if !strings.Contains(content, "\texec /opt/mpi-run \"$@\"\n") || strings.Contains(content, "exec /opt/"+helloworld.BinName+" \"$@\"\n\n") {
+		t.Fatalf("runscript does not start the MPI wrapper:\n%s", content)
+	}
+}
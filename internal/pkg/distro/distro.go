@@ -26,8 +26,13 @@ type ID struct {
 	Codename string
 }
 
-// GetBaseImageLibraryURL returns the library URL to use as base image (when possible)
-func GetBaseImageLibraryURL(linuxDistro ID, sysCfg *sys.Config) string {
+// defaultLibraryArch is the architecture of the base images listed without architecture in the configuration files
+const defaultLibraryArch = "x86_64"
+
+// GetBaseImageLibraryURL returns the library URL to use as base image for an architecture (when possible). Each
+// line of the configuration file of the distribution is the version, the URL and, optionally, the architecture
+// of the image, separated by tabs; images without architecture are x86_64 images.
+func GetBaseImageLibraryURL(linuxDistro ID, arch string, sysCfg *sys.Config) string {
 	configFile := filepath.Join(sysCfg.EtcDir, "sympi_"+linuxDistro.Name+".conf")
 
 	if !util.FileExists(configFile) {
@@ -43,8 +48,18 @@ func GetBaseImageLibraryURL(linuxDistro ID, sysCfg *sys.Config) string {
 	lines := strings.Split(content, "\n")
 	for _, line := range lines {
 		words := strings.Split(line, "\t")
+		if len(words) < 2 {
+			continue
+		}
+		imageArch := defaultLibraryArch
+		if len(words) > 2 {
+			imageArch = words[2]
+		}
+		if imageArch != arch {
+			continue
+		}
 		// The configuration file may be based on the codename or version
-		if len(words) == 2 && words[0] == linuxDistro.Version || words[0] == linuxDistro.Codename {
+		if words[0] == linuxDistro.Version || (linuxDistro.Codename != "" && words[0] == linuxDistro.Codename) {
 			return words[1]
 		}
 	}
@@ -7,6 +7,10 @@ package distro
 
 func ubuntuCodenameToVersion(codename string) string {
 	switch codename {
+	case "groovy":
+		return "20.10"
+	case "focal":
+		return "20.04"
 	case "eoan":
 		return "19.10"
 	case "disco":
@@ -0,0 +1,188 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package integration exercises the complete path from the generation of a definition file to the
+// execution of a container. The pipeline runs either against a real installation of Singularity or,
+// by default, against transcripts of the Singularity commands recorded with the syrecord tool.
+package integration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// ModeEnvVar is the environment variable selecting the mode of the integration tests
+	ModeEnvVar = "SYMPI_INTEGRATION"
+
+	// RealMode is the value of ModeEnvVar to run the integration tests against a real installation of Singularity
+	RealMode = "real"
+
+	// PipelineTranscript is the name of the transcript of the pipeline in the testdata directory
+	PipelineTranscript = "pipeline.json"
+
+	// WorkDirPlaceholder replaces the work directory of the pipeline in transcripts
+	WorkDirPlaceholder = "@WORKDIR@"
+
+	// SingularityPlaceholder replaces the path to the singularity binary in transcripts
+	SingularityPlaceholder = "@SINGULARITY@"
+
+	// RegistryPlaceholder replaces the registry where the image is uploaded in transcripts
+	RegistryPlaceholder = "@REGISTRY@"
+
+	// probeOutput is what the probe image displays when executed
+	probeOutput = "sympi probe"
+)
+
+// probeDefFile is the definition file of the probe image, the smallest image we can build and execute
+const probeDefFile = `Bootstrap: docker
+From: alpine:3.12
+
+%post
+	echo "` + probeOutput + `" > /probe.txt
+`
+
+// Placeholders returns the host-specific values replaced by placeholders in transcripts
+func Placeholders(workDir string, sysCfg *sys.Config) map[string]string {
+	return map[string]string{
+		WorkDirPlaceholder:     workDir,
+		SingularityPlaceholder: sysCfg.SingularityBin,
+		RegistryPlaceholder:    sysCfg.Registry,
+	}
+}
+
+// Anonymize replaces the host-specific values of a transcript with placeholders
+func Anonymize(t *syexec.Transcript, workDir string, sysCfg *sys.Config) {
+	// The path to singularity may be in the work directory so it is replaced first
+	placeholders := Placeholders(workDir, sysCfg)
+	for _, placeholder := range []string{SingularityPlaceholder, RegistryPlaceholder, WorkDirPlaceholder} {
+		t.Replace(placeholders[placeholder], placeholder)
+	}
+}
+
+// Instantiate replaces the placeholders of a transcript with host-specific values
+func Instantiate(t *syexec.Transcript, workDir string, sysCfg *sys.Config) {
+	for placeholder, value := range Placeholders(workDir, sysCfg) {
+		t.Replace(placeholder, value)
+	}
+}
+
+// setPipelineConfig sets the parts of the configuration that the composed commands depend on, so that
+// transcripts can be replayed on any host
+func setPipelineConfig(sysCfg *sys.Config) {
+	sysCfg.Nopriv = true
+	sysCfg.SudoSyCmds = nil
+	sysCfg.ExposeIBDevices = false
+	sysCfg.PrepareOnly = false
+	sysCfg.Persistent = ""
+}
+
+// RunPipeline generates the definition file of the helloworld application, builds, signs and uploads the
+// image, and executes the application in the container. The image is created in workDir and uploaded to
+// sysCfg.Registry; the output of the application is returned.
+func RunPipeline(workDir string, sysCfg *sys.Config) (string, error) {
+	setPipelineConfig(sysCfg)
+
+	for _, op := range []string{container.OperationSign, container.OperationUpload} {
+		err := container.ValidateEnvForOperation(op, sysCfg)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	helloworld := app.GetHelloworld(sysCfg)
+	openmpi := implem.Info{
+		ID:      implem.OMPI,
+		Version: "4.0.2",
+		URL:     "https://download.open-mpi.org/release/open-mpi/v4.0/openmpi-4.0.2.tar.bz2",
+		Tarball: "openmpi-4.0.2.tar.bz2",
+	}
+	env := buildenv.Info{InstallDir: "/opt/mpi", SrcDir: deffile.DefaultAppRoot}
+	data := deffile.DefFileData{
+		Path:        filepath.Join(workDir, "helloworld.def"),
+		DistroID:    distro.ParseDescr("ubuntu:disco"),
+		MpiImplm:    &openmpi,
+		InternalEnv: &env,
+		Model:       container.HybridModel,
+	}
+	err := deffile.Create(&helloworld, &data, sysCfg, deffile.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create definition file: %s", err)
+	}
+
+	c := container.Config{
+		Name:       "helloworld.sif",
+		Path:       filepath.Join(workDir, "helloworld.sif"),
+		BuildDir:   workDir,
+		InstallDir: workDir,
+		DefFile:    data.Path,
+		Model:      container.HybridModel,
+		AppExe:     helloworld.BinPath,
+		MPIDir:     env.InstallDir,
+	}
+	err = container.CreateWithOptions(&c, sysCfg, container.CreateOptions{Sign: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to create and sign image: %s", err)
+	}
+
+	err = container.Upload(&c, sysCfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload image: %s", err)
+	}
+
+	return container.ExecWithOptions(&c, &implem.Info{}, &buildenv.Info{}, sysCfg, container.ExecOptions{})
+}
+
+// RunProbe builds the probe image in workDir and executes it, making sure that Singularity can build and run images
+func RunProbe(workDir string, sysCfg *sys.Config) error {
+	setPipelineConfig(sysCfg)
+
+	report, err := sys.CheckRuntimeEnvironment(sys.Requirements{UserNamespaces: sysCfg.Nopriv})
+	if err != nil {
+		return fmt.Errorf("failed to check the runtime environment: %s", err)
+	}
+	if !report.Passed() {
+		return fmt.Errorf("the runtime environment does not meet the requirements:\n%s", report.String())
+	}
+
+	defFile := filepath.Join(workDir, "probe.def")
+	err = ioutil.WriteFile(defFile, []byte(probeDefFile), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", defFile, err)
+	}
+
+	c := container.Config{
+		Name:       "probe.sif",
+		Path:       filepath.Join(workDir, "probe.sif"),
+		BuildDir:   workDir,
+		InstallDir: workDir,
+		DefFile:    defFile,
+		AppExe:     "/bin/cat",
+		AppArgs:    []string{"/probe.txt"},
+	}
+	err = container.CreateWithOptions(&c, sysCfg, container.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create probe image: %s", err)
+	}
+
+	output, err := container.ExecWithOptions(&c, &implem.Info{}, &buildenv.Info{}, sysCfg, container.ExecOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to execute probe image: %s", err)
+	}
+	if output != probeOutput+"\n" {
+		return fmt.Errorf("unexpected output from the probe image: %s", output)
+	}
+	return nil
+}
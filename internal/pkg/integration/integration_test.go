@@ -0,0 +1,103 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package integration
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func getTestSysConfig(t *testing.T) sys.Config {
+	var sysCfg sys.Config
+
+	curDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get the current work directory: %s", err)
+	}
+	sysCfg.BinPath = filepath.Join(curDir, "../../..")
+	sysCfg.EtcDir = filepath.Join(sysCfg.BinPath, "etc")
+	sysCfg.TemplateDir = filepath.Join(sysCfg.EtcDir, "templates")
+
+	return sysCfg
+}
+
+func TestRecordedPipeline(t *testing.T) {
+	if os.Getenv(ModeEnvVar) == RealMode {
+		t.Skip("running against a real installation of Singularity")
+	}
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sysCfg := getTestSysConfig(t)
+	// The binary does not exist so nothing can be executed outside of the runner
+	sysCfg.SingularityBin = filepath.Join(tempDir, "bin", "singularity")
+	sysCfg.Registry = "library://sympi/test/helloworld:latest"
+	defer os.Setenv(container.KeyPassphrase, os.Getenv(container.KeyPassphrase))
+	os.Setenv(container.KeyPassphrase, "passphrase")
+
+	transcript, err := syexec.LoadTranscript(filepath.Join("testdata", PipelineTranscript))
+	if err != nil {
+		t.Fatalf("failed to load transcript: %s", err)
+	}
+	Instantiate(transcript, tempDir, &sysCfg)
+
+	// The image would be created by the build
+	err = ioutil.WriteFile(filepath.Join(tempDir, "helloworld.sif"), nil, 0644)
+	if err != nil {
+		t.Fatalf("failed to create image: %s", err)
+	}
+
+	fakeRunner := &syexec.FakeRunner{Results: transcript.Results()}
+	defaultRunner := container.SetRunner(fakeRunner)
+	defer container.SetRunner(defaultRunner)
+
+	output, err := RunPipeline(tempDir, &sysCfg)
+	if err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+	err = transcript.Check(fakeRunner.Cmds)
+	if err != nil {
+		t.Fatalf("pipeline does not match the transcript: %s", err)
+	}
+	if !strings.Contains(output, "Hello, I am rank 0/1") {
+		t.Fatalf("unexpected output: %s", output)
+	}
+}
+
+func TestRealProbe(t *testing.T) {
+	if os.Getenv(ModeEnvVar) != RealMode {
+		t.Skip("set " + ModeEnvVar + "=" + RealMode + " to run against a real installation of Singularity")
+	}
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sysCfg := getTestSysConfig(t)
+	sysCfg.SingularityBin, err = exec.LookPath("singularity")
+	if err != nil {
+		t.Fatalf("singularity is not available: %s", err)
+	}
+
+	err = RunProbe(tempDir, &sysCfg)
+	if err != nil {
+		t.Fatalf("probe failed: %s", err)
+	}
+}
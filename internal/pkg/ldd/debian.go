@@ -6,15 +6,11 @@
 package ldd
 
 import (
-	"bytes"
-	"context"
 	"log"
-	"os/exec"
 	"runtime"
 	"strings"
-	"time"
 
-	"github.com/sylabs/singularity-mpi/pkg/sys"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 )
 
 // todo: should be in a util package
@@ -53,33 +49,22 @@ func DebianGetDependencies(output string) []string {
 	var dependencies []string
 
 	// Get path to dpkg
-	dpkgPath, err := exec.LookPath("dpkg")
+	dpkgPath, err := probes.LookPath("dpkg")
 	if err != nil {
-		log.Println("[WARN] cannot find dpkg")
+		sylog.Warn("cannot find dpkg")
 		return dependencies
 	}
 
-	lines := strings.Split(output, "\n")
-
-	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*time.Minute)
-	defer cancel()
-
 	// the package of interest is the one for the current architecture
-	for i := 0; i < len(lines); i++ {
-		words := strings.Split(lines[i], " ")
-		words[0] = strings.Trim(words[0], " \t")
+	for _, lib := range ParseLibraries(output) {
 		// Run dpkg -S <file>
-		cmd := exec.CommandContext(ctx, dpkgPath, "-S", words[0])
-		var dpkgStdout, dpkgStderr bytes.Buffer
-		cmd.Stdout = &dpkgStdout
-		cmd.Stderr = &dpkgStderr
-		err = cmd.Run()
+		dpkgOutput, err := probes.Run(dpkgPath, "-S", lib)
 		if err != nil {
-			log.Printf("dpkg returned an error for %s, skipping... (%s; stdout: %s; stderr: %s)", words[0], err, dpkgStdout.String(), dpkgStderr.String())
+			log.Printf("dpkg returned an error for %s, skipping... (%s)", lib, err)
 			continue
 		}
 
-		dependencies = parseDpkgOutput(dependencies, dpkgStdout.String())
+		dependencies = parseDpkgOutput(dependencies, dpkgOutput)
 	}
 
 	return dependencies
@@ -93,7 +78,7 @@ func DebianLoad() (bool, Module) {
 	Debian.GetDependencies = DebianGetDependencies
 
 	// Get path to dpkg
-	_, err := exec.LookPath("dpkg")
+	_, err := probes.LookPath("dpkg")
 	if err != nil {
 		return false, Debian
 	}
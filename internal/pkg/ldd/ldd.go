@@ -6,14 +6,10 @@
 package ldd
 
 import (
-	"bytes"
-	"context"
 	"fmt"
 	"log"
-	"os/exec"
-	"time"
-
-	"github.com/sylabs/singularity-mpi/pkg/sys"
+	"path/filepath"
+	"strings"
 )
 
 // GetDependenciesFn is a function "pointer" for a distribution-specific
@@ -27,40 +23,164 @@ type Module struct {
 	GetDependencies GetDependenciesFn
 }
 
+// staticMarkers are the messages printed by ldd for binaries that are statically linked
+var staticMarkers = []string{"not a dynamic executable", "statically linked"}
+
+// isStatic checks whether the output of ldd is the one of a statically linked binary
+func isStatic(output string) bool {
+	for _, marker := range staticMarkers {
+		if strings.Contains(output, marker) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetPackageDependenciesForFile finds all the binary-package dependencies
 // for a specific file, by running ldd and the appropriate module for the
-// target linux distribution
-func (m *Module) GetPackageDependenciesForFile(file string) []string {
+// target linux distribution. It also returns whether the file is statically
+// linked, in which case it does not have any dependency.
+func (m *Module) GetPackageDependenciesForFile(file string) ([]string, bool) {
 	var dependencies []string
 
-	// Get the path to ldd
-	lddPath, err := exec.LookPath("ldd")
+	output, static, err := runLdd(file)
+	if err != nil {
+		log.Printf("%s", err)
+		return dependencies, false
+	}
+	if static {
+		log.Printf("%s is statically linked, it does not depend on any package", file)
+		return []string{}, true
+	}
+
+	// Parse the result
+	dependencies = m.GetDependencies(output)
+
+	return dependencies, false
+}
+
+// mpiLibPrefixes are the prefixes of the names of the libraries provided by MPI implementations
+var mpiLibPrefixes = []string{"libmpi.", "libmpi_", "libmpich"}
+
+// ParseLibraries returns the names of the libraries listed in the output of ldd
+func ParseLibraries(output string) []string {
+	var libs []string
+	for _, line := range strings.Split(output, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 || words[0] == "not" {
+			continue
+		}
+		libs = append(libs, filepath.Base(words[0]))
+	}
+	return libs
+}
+
+// Library is a library a binary depends on
+type Library struct {
+	// Name is the name of the library, e.g., libmpi.so.40
+	Name string
+
+	// Path is the path to the library the dependency resolves to, empty if the library is not found
+	Path string
+}
+
+// ParseLibraryPaths returns the libraries listed in the output of ldd, with the path they resolve to
+func ParseLibraryPaths(output string) []Library {
+	var libs []Library
+	for _, line := range strings.Split(output, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 || words[0] == "not" {
+			continue
+		}
+		lib := Library{Name: filepath.Base(words[0])}
+		switch {
+		case len(words) >= 3 && words[1] == "=>":
+			if words[2] != "not" {
+				lib.Path = words[2]
+			}
+		case filepath.IsAbs(words[0]):
+			lib.Path = words[0]
+		}
+		libs = append(libs, lib)
+	}
+	return libs
+}
+
+// runLdd executes ldd against a file and returns its output and whether the file is statically linked, in
+// which case the output is empty
+func runLdd(file string) (string, bool, error) {
+	lddPath, err := probes.LookPath("ldd")
 	if err != nil {
-		log.Println("[WARN] cannot find ldd")
-		return dependencies
+		return "", false, fmt.Errorf("cannot find ldd: %s", err)
 	}
 
-	// Run ldd against the binary
-	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*time.Second)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, lddPath, file)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+	// ldd fails with static binaries, which is not an error for us
+	output, err := probes.Run(lddPath, file)
+	if isStatic(output) {
+		return "", true, nil
+	}
 	if err != nil {
-		log.Printf("failed to execute dpkg: %s; stdout: %s; stderr: %s", err, stdout.String(), stderr.String())
-		return dependencies
+		return "", false, fmt.Errorf("failed to execute ldd: %s", err)
 	}
 
-	// Parse the result
-	dependencies = m.GetDependencies(stdout.String())
+	return output, false, nil
+}
+
+// GetLibraries returns the names of all the libraries a binary depends on, directly or not
+func GetLibraries(file string) ([]string, error) {
+	output, _, err := runLdd(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLibraries(output), nil
+}
 
-	return dependencies
+// GetLibraryPaths returns all the libraries a binary depends on, directly or not, with the path they resolve to
+func GetLibraryPaths(file string) ([]Library, error) {
+	output, _, err := runLdd(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLibraryPaths(output), nil
+}
+
+// IsMPILibrary checks whether a library is provided by a MPI implementation based on its name
+func IsMPILibrary(lib string) bool {
+	for _, prefix := range mpiLibPrefixes {
+		if strings.HasPrefix(lib, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
-// Detect finds the ldd module applicable to the current system
+// IsLinkedToMPI checks whether a list of libraries includes a MPI library
+func IsLinkedToMPI(libs []string) bool {
+	for _, lib := range libs {
+		if IsMPILibrary(lib) {
+			return true
+		}
+	}
+	return false
+}
+
+// Detect finds the ldd module applicable to the current system. The module is selected based on the
+// distribution of the host when known, e.g., so that rpm is used on CentOS even if dpkg is installed;
+// otherwise the first module whose package manager is available is used.
 func Detect() (Module, error) {
+	switch getHostPackageFormat() {
+	case debianFormat:
+		loaded, mod := DebianLoad()
+		if loaded {
+			return mod, nil
+		}
+	case rpmFormat:
+		loaded, mod := RPMLoad()
+		if loaded {
+			return mod, nil
+		}
+	}
+
 	loaded, mod := DebianLoad()
 	if loaded {
 		return mod, nil
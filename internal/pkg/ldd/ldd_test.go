@@ -6,6 +6,9 @@
 package ldd
 
 import (
+	"fmt"
+	"path"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -23,10 +26,213 @@ func TestPackageDependenciesForFile(t *testing.T) {
 		t.Skipf("%s not available, skipping test", testBin)
 	}
 
-	packages := lddMod.GetPackageDependenciesForFile(testBin)
+	packages, static := lddMod.GetPackageDependenciesForFile(testBin)
+	if static {
+		t.Skipf("%s is statically linked, skipping test", testBin)
+	}
 	if len(packages) == 0 {
 		t.Fatal("We did not find any dependencies, which is not possible")
 	}
 
 	t.Logf("Dependencies: %s", strings.Join(packages, ","))
 }
+
+func TestParseLibraries(t *testing.T) {
+	output := "\tlinux-vdso.so.1 (0x00007ffc4b5f2000)\n" +
+		"\tlibmpi.so.40 => /usr/lib/x86_64-linux-gnu/libmpi.so.40 (0x00007f1b2c9e6000)\n" +
+		"\tlibc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x00007f1b2c7f5000)\n" +
+		"\t/lib64/ld-linux-x86-64.so.2 (0x00007f1b2cb2e000)\n"
+	libs := ParseLibraries(output)
+	if strings.Join(libs, ",") != "linux-vdso.so.1,libmpi.so.40,libc.so.6,ld-linux-x86-64.so.2" {
+		t.Fatalf("invalid list of libraries: %v", libs)
+	}
+	if !IsLinkedToMPI(libs) {
+		t.Fatalf("libmpi.so was not detected")
+	}
+	if !IsLinkedToMPI([]string{"libmpich.so.12"}) {
+		t.Fatalf("libmpich.so was not detected")
+	}
+	if IsLinkedToMPI([]string{"libc.so.6", "libm.so.6", "libmpfr.so.6"}) {
+		t.Fatalf("MPI detected in a list without MPI library")
+	}
+}
+
+func TestParseLibraryPaths(t *testing.T) {
+	output := "\tlinux-vdso.so.1 (0x00007ffc4b5f2000)\n" +
+		"\tlibmpi.so.40 => /opt/openmpi/lib/libmpi.so.40 (0x00007f1b2c9e6000)\n" +
+		"\tlibopen-pal.so.40 => not found\n" +
+		"\t/lib64/ld-linux-x86-64.so.2 (0x00007f1b2cb2e000)\n"
+	expected := []Library{
+		{Name: "linux-vdso.so.1"},
+		{Name: "libmpi.so.40", Path: "/opt/openmpi/lib/libmpi.so.40"},
+		{Name: "libopen-pal.so.40"},
+		{Name: "ld-linux-x86-64.so.2", Path: "/lib64/ld-linux-x86-64.so.2"},
+	}
+	libs := ParseLibraryPaths(output)
+	if len(libs) != len(expected) {
+		t.Fatalf("invalid list of libraries: %v", libs)
+	}
+	for i := range expected {
+		if libs[i] != expected[i] {
+			t.Fatalf("library %d is %v instead of %v", i, libs[i], expected[i])
+		}
+	}
+}
+
+// cannedLddOutput is the output of ldd for a MPI application on a x86_64 host
+const cannedLddOutput = "\tlinux-vdso.so.1 (0x00007ffc4b5f2000)\n" +
+	"\tlibmpi.so.40 => /usr/lib64/openmpi/lib/libmpi.so.40 (0x00007f1b2c9e6000)\n" +
+	"\tlibm.so.6 => /lib64/libm.so.6 (0x00007f1b2c8a0000)\n" +
+	"\tlibc.so.6 => /lib64/libc.so.6 (0x00007f1b2c7f5000)\n" +
+	"\tlibfoo.so.1 => not found\n" +
+	"\t/lib64/ld-linux-x86-64.so.2 (0x00007f1b2cb2e000)\n"
+
+// setTestProbes replaces the probes with ones answering the package queries from a map of arguments to
+// outputs, with only the given commands installed and the given content of /etc/os-release. The previous
+// probes are returned.
+func setTestProbes(cmds []string, osRelease string, answers map[string]string) Probes {
+	return SetProbes(Probes{
+		LookPath: func(file string) (string, error) {
+			for _, cmd := range cmds {
+				if cmd == file {
+					return "/usr/bin/" + file, nil
+				}
+			}
+			return "", fmt.Errorf("%s not found", file)
+		},
+		Run: func(cmd string, args ...string) (string, error) {
+			key := path.Base(cmd) + " " + strings.Join(args, " ")
+			output, ok := answers[key]
+			if !ok {
+				return "", fmt.Errorf("no package owns the file: %s", key)
+			}
+			return output, nil
+		},
+		ReadFile: func(file string) ([]byte, error) {
+			if osRelease == "" {
+				return nil, fmt.Errorf("%s does not exist", file)
+			}
+			return []byte(osRelease), nil
+		},
+	})
+}
+
+func TestRPMGetDependencies(t *testing.T) {
+	rpmQuery := "rpm -qf --queryformat %{NAME}\\n "
+	previous := setTestProbes([]string{"rpm"}, "", map[string]string{
+		rpmQuery + "/usr/lib64/openmpi/lib/libmpi.so.40": "openmpi\n",
+		rpmQuery + "/lib64/libm.so.6":                    "glibc\n",
+		rpmQuery + "/lib64/libc.so.6":                    "glibc\n",
+		rpmQuery + "/lib64/ld-linux-x86-64.so.2":         "glibc\n",
+	})
+	defer SetProbes(previous)
+
+	deps := RPMGetDependencies(cannedLddOutput)
+	if strings.Join(deps, ",") != "openmpi,glibc" {
+		t.Fatalf("invalid list of RPM packages: %v", deps)
+	}
+}
+
+func TestDebianGetDependencies(t *testing.T) {
+	arch := runtime.GOARCH
+	previous := setTestProbes([]string{"dpkg"}, "", map[string]string{
+		"dpkg -S libmpi.so.40":         "libopenmpi3:" + arch + ": /usr/lib64/openmpi/lib/libmpi.so.40\n",
+		"dpkg -S libm.so.6":            "libc6:" + arch + ": /lib64/libm.so.6\nlibc6:fakearch: /lib/libm.so.6\n",
+		"dpkg -S libc.so.6":            "libc6:" + arch + ": /lib64/libc.so.6\n",
+		"dpkg -S ld-linux-x86-64.so.2": "libc6:" + arch + ": /lib64/ld-linux-x86-64.so.2\n",
+	})
+	defer SetProbes(previous)
+
+	deps := DebianGetDependencies(cannedLddOutput)
+	if strings.Join(deps, ",") != "libopenmpi3,libc6" {
+		t.Fatalf("invalid list of Debian packages: %v", deps)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	defer SetProbes(probes)
+
+	tests := []struct {
+		name      string
+		cmds      []string
+		osRelease string
+		expected  string
+	}{
+		{name: "ubuntu", cmds: []string{"dpkg", "rpm"}, osRelease: "NAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n", expected: "dpkg"},
+		{name: "centos", cmds: []string{"dpkg", "rpm"}, osRelease: "NAME=\"CentOS Linux\"\nID=\"centos\"\nID_LIKE=\"rhel fedora\"\n", expected: "rpm"},
+		{name: "rocky", cmds: []string{"dpkg", "rpm"}, osRelease: "ID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"\n", expected: "rpm"},
+		{name: "unknown distro", cmds: []string{"rpm"}, osRelease: "ID=unknown\n", expected: "rpm"},
+		{name: "no os-release", cmds: []string{"dpkg", "rpm"}, expected: "dpkg"},
+	}
+
+	for _, tt := range tests {
+		var used string
+		setTestProbes(tt.cmds, tt.osRelease, nil)
+		probes.Run = func(cmd string, args ...string) (string, error) {
+			used = path.Base(cmd)
+			return "", nil
+		}
+
+		mod, err := Detect()
+		if err != nil {
+			t.Fatalf("%s: Detect() failed: %s", tt.name, err)
+		}
+		mod.GetDependencies(cannedLddOutput)
+		if used != tt.expected {
+			t.Fatalf("%s: the module uses %s instead of %s", tt.name, used, tt.expected)
+		}
+	}
+
+	setTestProbes(nil, "ID=centos\n", nil)
+	_, err := Detect()
+	if err == nil {
+		t.Fatalf("Detect() succeeded without any package manager")
+	}
+}
+
+func TestStaticBinary(t *testing.T) {
+	lddOutputs := map[string]struct {
+		output string
+		err    error
+	}{
+		"/opt/dynamic":    {output: cannedLddOutput},
+		"/opt/static":     {output: "\tnot a dynamic executable\n", err: fmt.Errorf("exit status 1")},
+		"/opt/static-pie": {output: "\tstatically linked\n"},
+		"/opt/missing":    {output: "ldd: /opt/missing: No such file or directory\n", err: fmt.Errorf("exit status 1")},
+	}
+	previous := setTestProbes([]string{"ldd", "rpm"}, "", nil)
+	defer SetProbes(previous)
+	probes.Run = func(cmd string, args ...string) (string, error) {
+		if path.Base(cmd) == "rpm" {
+			return "glibc\n", nil
+		}
+		result := lddOutputs[args[0]]
+		return result.output, result.err
+	}
+	mod := Module{GetDependencies: RPMGetDependencies}
+
+	deps, static := mod.GetPackageDependenciesForFile("/opt/dynamic")
+	if static || strings.Join(deps, ",") != "glibc" {
+		t.Fatalf("invalid dependencies of a dynamic binary: %v (static: %t)", deps, static)
+	}
+
+	for _, file := range []string{"/opt/static", "/opt/static-pie"} {
+		deps, static = mod.GetPackageDependenciesForFile(file)
+		if !static || deps == nil || len(deps) != 0 {
+			t.Fatalf("invalid dependencies of static binary %s: %v (static: %t)", file, deps, static)
+		}
+		libs, err := GetLibraries(file)
+		if err != nil || len(libs) != 0 {
+			t.Fatalf("invalid libraries of static binary %s: %v (%v)", file, libs, err)
+		}
+	}
+
+	deps, static = mod.GetPackageDependenciesForFile("/opt/missing")
+	if static || len(deps) != 0 {
+		t.Fatalf("invalid dependencies of a missing binary: %v (static: %t)", deps, static)
+	}
+	_, err := GetLibraries("/opt/missing")
+	if err == nil {
+		t.Fatalf("getting the libraries of a missing binary succeeded")
+	}
+}
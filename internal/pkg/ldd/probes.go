@@ -0,0 +1,114 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package ldd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// osReleaseFile is the file describing the Linux distribution of the host
+	osReleaseFile = "/etc/os-release"
+
+	// debianFormat identifies the distributions using Debian packages
+	debianFormat = "deb"
+
+	// rpmFormat identifies the distributions using RPM packages
+	rpmFormat = "rpm"
+)
+
+// distroPackageFormats maps the identifiers of /etc/os-release (ID and ID_LIKE) to the format of the packages
+var distroPackageFormats = map[string]string{
+	"debian":    debianFormat,
+	"ubuntu":    debianFormat,
+	"rhel":      rpmFormat,
+	"centos":    rpmFormat,
+	"fedora":    rpmFormat,
+	"rocky":     rpmFormat,
+	"almalinux": rpmFormat,
+}
+
+// Probes are the functions used to inspect the host, which can be replaced for testing
+type Probes struct {
+	// LookPath returns the path to a command
+	LookPath func(file string) (string, error)
+
+	// Run executes a command and returns its standard output; on failure, the standard output and error
+	// are returned with the error
+	Run func(cmd string, args ...string) (string, error)
+
+	// ReadFile returns the content of a file, e.g., /etc/os-release
+	ReadFile func(path string) ([]byte, error)
+}
+
+// run executes a command and returns its standard output, or its standard output and error on failure
+func run(cmdPath string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, cmdPath, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return stdout.String() + stderr.String(), fmt.Errorf("%s; stdout: %s; stderr: %s", err, stdout.String(), stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// probes are the probes used by the ldd modules
+var probes = Probes{
+	LookPath: exec.LookPath,
+	Run:      run,
+	ReadFile: ioutil.ReadFile,
+}
+
+// SetProbes replaces the probes used to inspect the host and returns the previous ones
+func SetProbes(p Probes) Probes {
+	previous := probes
+	probes = p
+	return previous
+}
+
+// parseOSRelease returns the identifiers of the distribution (ID then ID_LIKE) from the content of /etc/os-release
+func parseOSRelease(content string) []string {
+	var ids []string
+	var like []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "ID="):
+			ids = append(ids, strings.Trim(strings.TrimPrefix(line, "ID="), "\"'"))
+		case strings.HasPrefix(line, "ID_LIKE="):
+			like = strings.Fields(strings.Trim(strings.TrimPrefix(line, "ID_LIKE="), "\"'"))
+		}
+	}
+	return append(ids, like...)
+}
+
+// getHostPackageFormat returns the format of the packages of the host distribution, an empty string if the
+// distribution is unknown
+func getHostPackageFormat() string {
+	data, err := probes.ReadFile(osReleaseFile)
+	if err != nil {
+		return ""
+	}
+	for _, id := range parseOSRelease(string(data)) {
+		if format, ok := distroPackageFormats[id]; ok {
+			return format
+		}
+	}
+	return ""
+}
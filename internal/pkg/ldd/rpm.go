@@ -6,57 +6,54 @@
 package ldd
 
 import (
-	"bytes"
-	"context"
 	"log"
-	"os/exec"
 	"strings"
-	"time"
 
-	"github.com/sylabs/singularity-mpi/pkg/sys"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 )
 
+// parseRPMOutput adds to a list of dependencies the names of the packages printed by rpm -qf, one per line
+func parseRPMOutput(dependencies []string, output string) []string {
+	for _, line := range strings.Split(output, "\n") {
+		name := strings.TrimSpace(line)
+		if name != "" && !isInSlice(dependencies, name) {
+			dependencies = append(dependencies, name)
+		}
+	}
+	return dependencies
+}
+
 // RPMGetDependencies parses the ldd output and figure out the required
-// dependencies in term of Debian packages
+// dependencies in term of RPM packages. Contrary to dpkg, rpm requires the
+// path to the file so the libraries that do not resolve to a file are skipped.
 func RPMGetDependencies(output string) []string {
 	var dependencies []string
 
 	// Get path to rpm
-	rpmPath, err := exec.LookPath("rpm")
+	rpmPath, err := probes.LookPath("rpm")
 	if err != nil {
-		log.Println("[WARN] cannot find rpm")
+		sylog.Warn("cannot find rpm")
 		return dependencies
 	}
 
-	lines := strings.Split(output, "\n")
-
-	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*time.Minute)
-	defer cancel()
-
-	// the package of interest is the one for the current architecture
-	for i := 0; i < len(lines); i++ {
-		words := strings.Split(lines[i], " ")
-		words[0] = strings.Trim(words[0], " \t")
+	for _, lib := range ParseLibraryPaths(output) {
+		if lib.Path == "" {
+			continue
+		}
 		// Run rpm -qf <file>
-		cmd := exec.CommandContext(ctx, rpmPath, "--qf", "'%{NAME}", "-qf", words[0])
-		var rpmStdout, rpmStderr bytes.Buffer
-		cmd.Stdout = &rpmStdout
-		cmd.Stderr = &rpmStderr
-		err = cmd.Run()
+		rpmOutput, err := probes.Run(rpmPath, "-qf", "--queryformat", "%{NAME}\\n", lib.Path)
 		if err != nil {
-			log.Printf("rpm returned an error for %s, skipping... (%s; stdout: %s; stderr: %s)", words[0], err, rpmStdout.String(), rpmStderr.String())
+			log.Printf("rpm returned an error for %s, skipping... (%s)", lib.Path, err)
 			continue
 		}
 
-		if rpmStdout.String() != "" {
-			dependencies = append(dependencies, rpmStdout.String())
-		}
+		dependencies = parseRPMOutput(dependencies, rpmOutput)
 	}
 
 	return dependencies
 }
 
-// RpmLoad is the function called to see if the module is usable on the
+// RPMLoad is the function called to see if the module is usable on the
 // current system. If so, the module structure returned has all the functions
 // required for RPM-based systems.
 func RPMLoad() (bool, Module) {
@@ -64,7 +61,7 @@ func RPMLoad() (bool, Module) {
 	RPM.GetDependencies = RPMGetDependencies
 
 	// Get path to rpm
-	_, err := exec.LookPath("rpm")
+	_, err := probes.LookPath("rpm")
 	if err != nil {
 		return false, RPM
 	}
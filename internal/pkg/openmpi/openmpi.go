@@ -7,12 +7,12 @@ package openmpi
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/gvallee/kv/pkg/kv"
 	"github.com/sylabs/singularity-mpi/internal/pkg/autotools"
 	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
 	"github.com/sylabs/singularity-mpi/internal/pkg/network"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/pkg/buildenv"
 	"github.com/sylabs/singularity-mpi/pkg/sy"
 	"github.com/sylabs/singularity-mpi/pkg/sys"
@@ -69,20 +69,20 @@ func GetExtraConfigureArgs(sysCfg *sys.Config) []string {
 	if sysCfg.IBEnabled {
 		kvs, err := sy.LoadMPIConfigFile()
 		if err != nil {
-			log.Printf("[WARN] Unable to load the configuration of the tool; unable to fully Infiniband: %s\n", err)
+			sylog.Warn("Unable to load the configuration of the tool; unable to fully Infiniband: %s", err)
 			return extraArgs
 		}
 
 		mlxDir := kv.GetValue(kvs, network.MXMDirKey)
 		if mlxDir == "" {
-			log.Printf("[WARN] Infiniband detected but the MXM directory is undefined in the configuration file")
+			sylog.Warn("Infiniband detected but the MXM directory is undefined in the configuration file")
 		} else {
 			extraArgs = append(extraArgs, "--with-mxm="+mlxDir)
 		}
 
 		knemDir := kv.GetValue(kvs, network.KNEMDirKey)
 		if knemDir == "" {
-			log.Printf("[WARN] Infiniband detected but the KNEM directory is undefined in the configuration file")
+			sylog.Warn("Infiniband detected but the KNEM directory is undefined in the configuration file")
 		} else {
 			extraArgs = append(extraArgs, "--with-knem="+knemDir)
 		}
@@ -0,0 +1,156 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package pkgmap
+
+import (
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+)
+
+const (
+	// DebFormat is the identifier of the distros using Debian packages
+	DebFormat = "deb"
+
+	// RPMFormat is the identifier of the distros using RPM packages
+	RPMFormat = "rpm"
+
+	// ApkFormat is the identifier of the distros using Alpine packages
+	ApkFormat = "apk"
+)
+
+const (
+	// Ldconfig is the canonical name of the package providing ldconfig
+	Ldconfig = "ldconfig"
+
+	// Kmod is the canonical name of the package providing the tools to manage kernel modules
+	Kmod = "kmod"
+
+	// IBVerbs is the canonical name of the package providing the Infiniband verbs library
+	IBVerbs = "ibverbs"
+
+	// IBVerbsDev is the canonical name of the package providing the development files of the Infiniband verbs library
+	IBVerbsDev = "ibverbs-dev"
+
+	// IBVerbsUtils is the canonical name of the package providing the Infiniband verbs tools, e.g., ibv_devinfo
+	IBVerbsUtils = "ibverbs-utils"
+
+	// RDMACM is the canonical name of the package providing the RDMA connection manager library
+	RDMACM = "rdmacm"
+
+	// RDMACMDev is the canonical name of the package providing the development files of the RDMA connection manager library
+	RDMACMDev = "rdmacm-dev"
+
+	// OpenSMDev is the canonical name of the package providing the development files of the Infiniband subnet manager
+	OpenSMDev = "opensm-dev"
+
+	// MLX4 is the canonical name of the package providing the Mellanox ConnectX-3 userspace driver
+	MLX4 = "mlx4"
+
+	// NL3Dev is the canonical name of the package providing the development files of the netlink library
+	NL3Dev = "nl3-dev"
+
+	// InfinibandDiags is the canonical name of the package providing the Infiniband diagnostic tools
+	InfinibandDiags = "infiniband-diags"
+
+	// CMake is the canonical name of the package providing cmake
+	CMake = "cmake"
+)
+
+// InfinibandPackages is the canonical list of packages required to use Infiniband in a container
+var InfinibandPackages = []string{
+	Ldconfig,
+	OpenSMDev,
+	RDMACMDev,
+	RDMACM,
+	Kmod,
+	MLX4,
+	IBVerbsDev,
+	IBVerbs,
+	NL3Dev,
+	InfinibandDiags,
+	IBVerbsUtils,
+}
+
+// packageNames maps the canonical names of the packages to their names for each package format
+var packageNames = map[string]map[string]string{
+	DebFormat: {
+		Ldconfig:        "libc-bin",
+		Kmod:            "kmod",
+		IBVerbs:         "libibverbs1",
+		IBVerbsDev:      "libibverbs-dev",
+		IBVerbsUtils:    "ibverbs-utils",
+		RDMACM:          "librdmacm1",
+		RDMACMDev:       "librdmacm-dev",
+		OpenSMDev:       "libopensm-dev",
+		MLX4:            "libmlx4-1",
+		NL3Dev:          "libnl-3-dev",
+		InfinibandDiags: "infiniband-diags",
+		CMake:           "cmake",
+	},
+	RPMFormat: {
+		Ldconfig:        "glibc",
+		Kmod:            "kmod",
+		IBVerbs:         "libibverbs",
+		IBVerbsDev:      "libibverbs-devel",
+		IBVerbsUtils:    "libibverbs-utils",
+		RDMACM:          "librdmacm",
+		RDMACMDev:       "librdmacm-devel",
+		OpenSMDev:       "opensm-devel",
+		MLX4:            "libmlx4",
+		NL3Dev:          "libnl3-devel",
+		InfinibandDiags: "infiniband-diags",
+		CMake:           "cmake",
+	},
+	// Alpine is based on musl, the packages of the Infiniband stack are not known yet
+	ApkFormat: {
+		Ldconfig: "musl-utils",
+		Kmod:     "kmod",
+		NL3Dev:   "libnl3-dev",
+		CMake:    "cmake",
+	},
+}
+
+// GetPackageName returns the name of a package for a package format and whether the package is known
+func GetPackageName(format string, canonical string) (string, bool) {
+	names, ok := packageNames[format]
+	if !ok {
+		return "", false
+	}
+	name, ok := names[canonical]
+	return name, ok
+}
+
+// Translate returns the name, for a package format, of a package named after any of the known package formats,
+// e.g., libibverbs-dev or libibverbs-devel, and whether the package is known
+func Translate(format string, name string) (string, bool) {
+	if _, ok := packageNames[format]; !ok {
+		return "", false
+	}
+	for _, names := range packageNames {
+		for canonical, n := range names {
+			if n == name {
+				if translated, ok := GetPackageName(format, canonical); ok {
+					return translated, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// Resolve translates a list of canonical package names to the names used by a package format. The packages
+// without a known name are skipped, with a warning, so that they do not break the build.
+func Resolve(format string, canonical []string) []string {
+	var pkgs []string
+	for _, c := range canonical {
+		name, ok := GetPackageName(format, c)
+		if !ok {
+			sylog.Warn("no %s package known for %s, skipping", format, c)
+			continue
+		}
+		pkgs = append(pkgs, name)
+	}
+	return pkgs
+}
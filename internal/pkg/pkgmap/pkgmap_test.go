@@ -0,0 +1,62 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package pkgmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		format    string
+		canonical []string
+		expected  []string
+	}{
+		{format: DebFormat, canonical: []string{Ldconfig, IBVerbs, MLX4}, expected: []string{"libc-bin", "libibverbs1", "libmlx4-1"}},
+		{format: RPMFormat, canonical: []string{Ldconfig, IBVerbs, MLX4}, expected: []string{"glibc", "libibverbs", "libmlx4"}},
+		{format: RPMFormat, canonical: []string{"unknown", RDMACMDev}, expected: []string{"librdmacm-devel"}},
+		{format: ApkFormat, canonical: []string{IBVerbs}, expected: nil},
+	}
+
+	for _, tt := range tests {
+		pkgs := Resolve(tt.format, tt.canonical)
+		if !reflect.DeepEqual(pkgs, tt.expected) {
+			t.Fatalf("%s: %v resolved to %v instead of %v", tt.format, tt.canonical, pkgs, tt.expected)
+		}
+	}
+
+	// All the packages required for Infiniband are known for all the formats
+	for _, format := range []string{DebFormat, RPMFormat} {
+		for _, c := range InfinibandPackages {
+			if _, ok := GetPackageName(format, c); !ok {
+				t.Fatalf("no %s package for %s", format, c)
+			}
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		format   string
+		name     string
+		expected string
+		ok       bool
+	}{
+		{format: ApkFormat, name: "libnl-3-dev", expected: "libnl3-dev", ok: true},
+		{format: ApkFormat, name: "glibc", expected: "musl-utils", ok: true},
+		{format: RPMFormat, name: "libc-bin", expected: "glibc", ok: true},
+		{format: ApkFormat, name: "libibverbs1", ok: false},
+		{format: DebFormat, name: "unknown", ok: false},
+	}
+
+	for _, tt := range tests {
+		name, ok := Translate(tt.format, tt.name)
+		if ok != tt.ok || name != tt.expected {
+			t.Fatalf("%s: %s translated to %q (%v) instead of %q (%v)", tt.format, tt.name, name, ok, tt.expected, tt.ok)
+		}
+	}
+}
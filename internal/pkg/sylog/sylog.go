@@ -0,0 +1,117 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package sylog provides a thin layer on top of the standard logger that collapses
+// repeated warnings, which otherwise drown real problems when running a large
+// number of operations (e.g., when creating a matrix of images).
+package sylog
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWindow is the default period during which identical warnings are collapsed
+	DefaultWindow = 5 * time.Minute
+
+	warnPrefix  = "[WARN] "
+	errorPrefix = "[ERROR] "
+)
+
+type warning struct {
+	// first is the time at which the warning was logged for the first time in the current window
+	first time.Time
+
+	// count is the number of times the warning was suppressed in the current window
+	count int
+}
+
+var (
+	mutex    sync.Mutex
+	window   = DefaultWindow
+	warnings = make(map[string]*warning)
+
+	// now is the function used to get the current time; it can be replaced for testing
+	now = time.Now
+)
+
+// SetWindow sets the period during which identical warnings are collapsed
+func SetWindow(d time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	window = d
+}
+
+func logRepeated(msg string, w *warning) {
+	if w.count > 0 {
+		log.Printf("%s%s (repeated %d times)", warnPrefix, msg, w.count)
+		w.count = 0
+	}
+}
+
+// Warn logs a warning. Identical warnings logged within the window are not displayed
+// but counted; the number of repetitions is logged when the window expires or Flush() is called.
+func Warn(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	t := now()
+	w, ok := warnings[msg]
+	if ok && t.Sub(w.first) < window {
+		w.count++
+		return
+	}
+
+	if ok {
+		logRepeated(msg, w)
+		w.first = t
+	} else {
+		warnings[msg] = &warning{first: t}
+	}
+	log.Printf("%s%s", warnPrefix, msg)
+}
+
+// Error logs an error. Errors are never suppressed.
+func Error(format string, a ...interface{}) {
+	log.Printf("%s%s", errorPrefix, fmt.Sprintf(format, a...))
+}
+
+// Flush logs the number of repetitions of all the warnings that were suppressed and
+// resets the state of the logger. It is meant to be called when terminating.
+func Flush() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var msgs []string
+	for msg := range warnings {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+
+	for _, msg := range msgs {
+		logRepeated(msg, warnings[msg])
+	}
+	warnings = make(map[string]*warning)
+}
+
+// Fatalf flushes the suppressed warnings and terminates like log.Fatalf. Deferred calls, including the one to
+// Flush() at the beginning of the commands, are not executed when terminating with log.Fatalf or os.Exit.
+func Fatalf(format string, a ...interface{}) {
+	Flush()
+	log.Fatalf(format, a...)
+}
+
+// Exit flushes the suppressed warnings and terminates with a given status code, like os.Exit
+func Exit(code int) {
+	Flush()
+	os.Exit(code)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sylog
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarnDedup(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	curTime := time.Now()
+	now = func() time.Time { return curTime }
+	defer func() { now = time.Now }()
+
+	for i := 0; i < 4; i++ {
+		Warn("cannot find %s", "ldd")
+	}
+	Error("something failed")
+	Error("something failed")
+
+	output := buf.String()
+	if strings.Count(output, "cannot find ldd") != 1 {
+		t.Fatalf("repeated warnings were not collapsed: %s", output)
+	}
+	if strings.Count(output, "something failed") != 2 {
+		t.Fatalf("errors were suppressed: %s", output)
+	}
+
+	Flush()
+	output = buf.String()
+	if !strings.Contains(output, "cannot find ldd (repeated 3 times)") {
+		t.Fatalf("flush did not report the number of repetitions: %s", output)
+	}
+
+	// Once the window expired, the warning is displayed again
+	buf.Reset()
+	Warn("cannot find ldd")
+	curTime = curTime.Add(DefaultWindow + time.Second)
+	Warn("cannot find ldd")
+	if strings.Count(buf.String(), "cannot find ldd") != 2 {
+		t.Fatalf("warning was suppressed after the window expired: %s", buf.String())
+	}
+	Flush()
+}
+
+// fatalEnvVar is the environment variable making the test executable terminate with Fatalf, for
+// TestFatalfFlush to check what is logged before terminating
+const fatalEnvVar = "SYLOG_TEST_FATAL"
+
+func TestFatalfFlush(t *testing.T) {
+	if os.Getenv(fatalEnvVar) != "" {
+		log.SetOutput(os.Stdout)
+		for i := 0; i < 3; i++ {
+			Warn("cannot find %s", "ldd")
+		}
+		Fatalf("terminating")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestFatalfFlush")
+	cmd.Env = append(os.Environ(), fatalEnvVar+"=1")
+	output, err := cmd.Output()
+	if err == nil {
+		t.Fatalf("Fatalf did not terminate with an error")
+	}
+	if !strings.Contains(string(output), "cannot find ldd (repeated 2 times)") {
+		t.Fatalf("suppressed warnings were not flushed before terminating: %s", output)
+	}
+}
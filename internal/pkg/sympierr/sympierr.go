@@ -5,7 +5,10 @@
 
 package sympierr
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // ErrNotAvailable is the error returned when an element that is being looked up is not available
 var ErrNotAvailable = errors.New("item not available")
@@ -15,3 +18,19 @@ var ErrFileExists = errors.New("file already exists")
 
 // ErrSingularityNotInstalled is the error returned when Singularity is not installed
 var ErrSingularityNotInstalled = errors.New("Singularity not available")
+
+// ErrBadPassphrase is the error returned when the passphrase of the key used to sign an image is rejected
+var ErrBadPassphrase = errors.New("invalid key passphrase")
+
+// ErrFeatureUnavailable is the error returned when the installed version of Singularity does not support an optional feature
+type ErrFeatureUnavailable struct {
+	// Feature is the name of the feature, e.g., "overlay create"
+	Feature string
+
+	// MinVersion is the first version supporting the feature, e.g., Singularity 3.5
+	MinVersion string
+}
+
+func (e *ErrFeatureUnavailable) Error() string {
+	return fmt.Sprintf("%s is not supported by the installed version of Singularity (requires %s or later)", e.Feature, e.MinVersion)
+}
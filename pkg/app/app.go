@@ -5,6 +5,32 @@
 
 package app
 
+const (
+	// CompilerAuto is the identifier used to select the compiler based on the extension of the application's source file
+	CompilerAuto = "auto"
+
+	// CompilerC is the identifier of the C compiler
+	CompilerC = "c"
+
+	// CompilerCXX is the identifier of the C++ compiler
+	CompilerCXX = "cxx"
+
+	// CompilerFortran is the identifier of the Fortran compiler
+	CompilerFortran = "fortran"
+
+	// BuildSystemAuto is the identifier used to detect the build system based on the content of the application's sources
+	BuildSystemAuto = "auto"
+
+	// BuildSystemMake is the identifier of applications built with make
+	BuildSystemMake = "make"
+
+	// BuildSystemCMake is the identifier of applications built with CMake
+	BuildSystemCMake = "cmake"
+
+	// BuildSystemMPICC is the identifier of applications made of a single source file compiled with the MPI compiler wrapper
+	BuildSystemMPICC = "mpicc"
+)
+
 // Info gathers information about a given application
 type Info struct {
 	// Name is the name of the application
@@ -19,9 +45,52 @@ type Info struct {
 	// Source is the URL to get the source. It can be a single file or a URI to a file to download
 	Source string
 
+	// SourceChecksum is the optional SHA-256 checksum of the tarball of the application, verified after the
+	// download when the source is a http/https URL
+	SourceChecksum string
+
+	// Ref is the branch, tag or commit of the Git repository of the application to build when the source is a
+	// Git repository; the default branch if not set
+	Ref string
+
+	// Depth is the depth of the clone of the Git repository of the application, the full history if not set.
+	// Branches and tags are cloned with a depth of 1 by default, commits always with the full history.
+	Depth int
+
+	// SourceDir is the name of the directory of the application's sources once downloaded, when it is not
+	// the name of the tarball without its extension or the name of the Git repository (optional)
+	SourceDir string
+
 	// InstallCmd is the command to use to install the application
 	InstallCmd string
 
+	// Compiler is the language of the compiler to use to compile the application (c, cxx, fortran or auto, the default)
+	Compiler string
+
+	// BuildSystem is the build system of the application (make, cmake, mpicc or auto, the default) used when
+	// compiling the application on the host; ignored when InstallCmd is set. When set to cmake, the
+	// application is also built with CMake in hybrid images.
+	BuildSystem string
+
+	// CMakeArgs are the additional arguments of cmake when the application is built with CMake, e.g., -DBUILD_SHARED_LIBS=ON
+	CMakeArgs []string
+
+	// BuildEnv are the environment variables to set before compiling the application, e.g., CFLAGS
+	BuildEnv map[string]string
+
+	// LicenseFile is the path on the host to the license of the application, copied into the image when set
+	LicenseFile string
+
+	// ReadmeFile is the path on the host to the README of the application, copied into the image when set
+	ReadmeFile string
+
+	// TestCmd is the command running the test suite of the application from the directory of its sources in
+	// the image, e.g., make check (optional)
+	TestCmd string
+
+	// TestRanks is the number of ranks of the MPI job running TestCmd; TestCmd is executed directly when not set
+	TestRanks int
+
 	// ExpectedRankOutput specifies what is the expected output from EACH rank
 	// A few keyword can be used for runtime-specific parameters
 	// Use '#NP' to specify the job size
@@ -0,0 +1,76 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+// mpiWrappers are the compiler wrappers of the MPI implementations, per language
+var mpiWrappers = map[string]map[string]string{
+	implem.OMPI: {
+		CompilerC:       "mpicc",
+		CompilerCXX:     "mpicxx",
+		CompilerFortran: "mpifort",
+	},
+	implem.MPICH: {
+		CompilerC:       "mpicc",
+		CompilerCXX:     "mpicxx",
+		CompilerFortran: "mpifort",
+	},
+	implem.IMPI: {
+		CompilerC:       "mpiicc",
+		CompilerCXX:     "mpiicpc",
+		CompilerFortran: "mpiifort",
+	},
+}
+
+// sourceLanguages associates the extensions of source files to the language of the compiler to use
+var sourceLanguages = map[string]string{
+	".c":   CompilerC,
+	".cc":  CompilerCXX,
+	".cpp": CompilerCXX,
+	".cxx": CompilerCXX,
+	".C":   CompilerCXX,
+	".f":   CompilerFortran,
+	".F":   CompilerFortran,
+	".f90": CompilerFortran,
+	".F90": CompilerFortran,
+	".f95": CompilerFortran,
+	".f03": CompilerFortran,
+	".f08": CompilerFortran,
+}
+
+// GetCompilerLanguage returns the language of the compiler to use for an application
+func GetCompilerLanguage(a *Info) (string, error) {
+	switch a.Compiler {
+	case CompilerC, CompilerCXX, CompilerFortran:
+		return a.Compiler, nil
+	case "", CompilerAuto:
+		if lang, ok := sourceLanguages[filepath.Ext(a.Source)]; ok {
+			return lang, nil
+		}
+		return CompilerC, nil
+	default:
+		return "", fmt.Errorf("unsupported compiler: %s", a.Compiler)
+	}
+}
+
+// GetCompilerWrapper returns the compiler wrapper of a MPI implementation for a given language
+func GetCompilerWrapper(mpiID string, lang string) (string, error) {
+	wrappers, ok := mpiWrappers[mpiID]
+	if !ok {
+		return "", fmt.Errorf("no compiler wrapper for %s", mpiID)
+	}
+	wrapper, ok := wrappers[lang]
+	if !ok {
+		return "", fmt.Errorf("unsupported compiler: %s", lang)
+	}
+	return wrapper, nil
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package audit scans the images of a set of directories and reports their drift from the current policies.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/pkg/checker"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/manifest"
+	"github.com/sylabs/singularity-mpi/pkg/sy"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// SingularityVersionLabel is the label recording the version of Singularity used to build an image
+	SingularityVersionLabel = "org.label-schema.usage.singularity.version"
+
+	// ArchLabel is the label recording the architecture of an image
+	ArchLabel = "org.label-schema.build-arch"
+
+	// buildManifest is the name of the manifest recorded next to an image when it is built
+	buildManifest = "build.MANIFEST"
+
+	// imageExt is the extension of the image files
+	imageExt = ".sif"
+)
+
+const (
+	// ManifestOK means that the files recorded in the build manifest of the image did not change
+	ManifestOK = "ok"
+
+	// ManifestMissing means that the image does not have a build manifest
+	ManifestMissing = "missing"
+
+	// ManifestMismatch means that some files recorded in the build manifest of the image changed
+	ManifestMismatch = "mismatch"
+)
+
+// DefaultRequiredLabels are the labels every image we create is expected to have
+var DefaultRequiredLabels = []string{
+	container.MetadataFormatLabel,
+	"Linux_distribution",
+	"MPI_Implementation",
+	"MPI_Version",
+	"Model",
+}
+
+// getLabels and verify are "function pointers" so they can be replaced for testing
+var getLabels = container.GetLabels
+var verify = container.Verify
+
+// Policy gathers the policies images are checked against
+type Policy struct {
+	// RequiredLabels are the labels an image must have; DefaultRequiredLabels if not set
+	RequiredLabels []string
+
+	// MinSingularityVersion is the oldest version of Singularity images can be built with (optional)
+	MinSingularityVersion string
+
+	// RequireSignature specifies whether unsigned images are reported as drifting
+	RequireSignature bool
+}
+
+// ImageReport is the audit report of a single image
+type ImageReport struct {
+	Path               string   `json:"path"`
+	MissingLabels      []string `json:"missing_labels,omitempty"`
+	Signed             bool     `json:"signed"`
+	Arch               string   `json:"arch,omitempty"`
+	MPIImplementation  string   `json:"mpi_implementation,omitempty"`
+	MPIVersion         string   `json:"mpi_version,omitempty"`
+	SingularityVersion string   `json:"singularity_version,omitempty"`
+	OutdatedBuild      bool     `json:"outdated_build"`
+	Manifest           string   `json:"manifest"`
+	Errors             []string `json:"errors,omitempty"`
+}
+
+// FleetReport is the audit report of a set of images
+type FleetReport struct {
+	Images []ImageReport `json:"images"`
+}
+
+// Drift checks whether an image does not comply with the policies it was checked against
+func (r *ImageReport) Drift(policy *Policy) bool {
+	return len(r.Errors) > 0 || len(r.MissingLabels) > 0 || r.OutdatedBuild || r.Manifest == ManifestMismatch || (policy.RequireSignature && !r.Signed)
+}
+
+// String returns a summary of the report as a table, one image per line
+func (r FleetReport) String() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tMPI\tARCH\tSINGULARITY\tSIGNED\tMANIFEST\tMISSING LABELS\tERRORS")
+	for _, img := range r.Images {
+		mpi := strings.TrimSuffix(img.MPIImplementation+":"+img.MPIVersion, ":")
+		singularity := img.SingularityVersion
+		if img.OutdatedBuild {
+			singularity += " (outdated)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%d\t%d\n", img.Path, mpi, img.Arch, singularity, img.Signed, img.Manifest, len(img.MissingLabels), len(img.Errors))
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// findImages returns the path to all the images in a set of directories and their sub-directories
+func findImages(dirs []string) ([]string, error) {
+	var images []string
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && filepath.Ext(path) == imageExt {
+				images = append(images, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %s", dir, err)
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// checkManifest checks the build manifest of an image, if any
+func checkManifest(imgPath string) string {
+	path := filepath.Join(filepath.Dir(imgPath), buildManifest)
+	if !util.FileExists(path) {
+		return ManifestMissing
+	}
+	err := manifest.Check(path)
+	if err != nil {
+		return ManifestMismatch
+	}
+	return ManifestOK
+}
+
+// auditImage audits a single image; failures are recorded in the report
+func auditImage(imgPath string, policy *Policy, sysCfg *sys.Config) ImageReport {
+	report := ImageReport{Path: imgPath}
+
+	labels, err := getLabels(imgPath, sysCfg)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		requiredLabels := policy.RequiredLabels
+		if len(requiredLabels) == 0 {
+			requiredLabels = DefaultRequiredLabels
+		}
+		for _, label := range requiredLabels {
+			if labels[label] == "" {
+				report.MissingLabels = append(report.MissingLabels, label)
+			}
+		}
+		report.Arch = labels[ArchLabel]
+		report.MPIImplementation = labels["MPI_Implementation"]
+		report.MPIVersion = labels["MPI_Version"]
+		report.SingularityVersion = labels[SingularityVersionLabel]
+		if policy.MinSingularityVersion != "" && report.SingularityVersion != "" {
+			report.OutdatedBuild = checker.CompareVersions(sy.ParseVersion(report.SingularityVersion), policy.MinSingularityVersion) < 0
+		}
+	}
+
+	err = verify(imgPath, sysCfg)
+	report.Signed = err == nil
+
+	report.Manifest = checkManifest(imgPath)
+
+	return report
+}
+
+// Run audits all the images of a set of directories against a policy. The failure to audit an image
+// is recorded in its report and does not abort the scan.
+func Run(ctx context.Context, dirs []string, policy Policy, sysCfg *sys.Config) (FleetReport, error) {
+	var report FleetReport
+
+	images, err := findImages(dirs)
+	if err != nil {
+		return report, err
+	}
+
+	for _, img := range images {
+		if ctx.Err() != nil {
+			return report, fmt.Errorf("audit interrupted: %s", ctx.Err())
+		}
+		report.Images = append(report.Images, auditImage(img, &policy, sysCfg))
+	}
+
+	return report, nil
+}
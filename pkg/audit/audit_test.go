@@ -0,0 +1,130 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/manifest"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func createFile(t *testing.T, path string, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatalf("failed to create directory for %s: %s", path, err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", path, err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A compliant image, an image with missing labels and a changed manifest, and an image that cannot be inspected
+	good := filepath.Join(tempDir, "good", "good.sif")
+	drift := filepath.Join(tempDir, "drift", "drift.sif")
+	broken := filepath.Join(tempDir, "broken.sif")
+	createFile(t, good, "good")
+	createFile(t, drift, "drift")
+	createFile(t, broken, "broken")
+	createFile(t, filepath.Join(tempDir, "notes.txt"), "not an image")
+	err = manifest.Create(filepath.Join(tempDir, "good", buildManifest), manifest.HashFiles([]string{good}))
+	if err != nil {
+		t.Fatalf("failed to create manifest: %s", err)
+	}
+	err = manifest.Create(filepath.Join(tempDir, "drift", buildManifest), manifest.HashFiles([]string{drift}))
+	if err != nil {
+		t.Fatalf("failed to create manifest: %s", err)
+	}
+	createFile(t, drift, "modified")
+
+	defaultGetLabels := getLabels
+	defaultVerify := verify
+	defer func() {
+		getLabels = defaultGetLabels
+		verify = defaultVerify
+	}()
+	getLabels = func(imgPath string, sysCfg *sys.Config) (map[string]string, error) {
+		switch imgPath {
+		case good:
+			return map[string]string{"Metadata_format": "2", "Linux_distribution": "ubuntu", "MPI_Implementation": "openmpi", "MPI_Version": "4.0.2", "Model": "hybrid", ArchLabel: "amd64", SingularityVersionLabel: "3.5.2-1.el7"}, nil
+		case drift:
+			return map[string]string{"MPI_Implementation": "mpich", "MPI_Version": "3.3", SingularityVersionLabel: "3.2.1"}, nil
+		}
+		return nil, fmt.Errorf("failed to inspect %s", imgPath)
+	}
+	verify = func(imgPath string, sysCfg *sys.Config) error {
+		if imgPath == good {
+			return nil
+		}
+		return fmt.Errorf("%s is not signed", imgPath)
+	}
+
+	var sysCfg sys.Config
+	policy := Policy{MinSingularityVersion: "3.5", RequireSignature: true}
+	report, err := Run(context.Background(), []string{tempDir}, policy, &sysCfg)
+	if err != nil {
+		t.Fatalf("audit failed: %s", err)
+	}
+	if len(report.Images) != 3 {
+		t.Fatalf("invalid number of images: %d", len(report.Images))
+	}
+
+	reports := make(map[string]ImageReport)
+	for _, img := range report.Images {
+		reports[img.Path] = img
+	}
+
+	r := reports[good]
+	if r.Drift(&policy) || !r.Signed || r.Arch != "amd64" || r.Manifest != ManifestOK || r.MPIVersion != "4.0.2" {
+		t.Fatalf("invalid report for compliant image: %+v", r)
+	}
+
+	r = reports[drift]
+	if !r.Drift(&policy) || r.Signed || !r.OutdatedBuild || r.Manifest != ManifestMismatch {
+		t.Fatalf("invalid report for drifting image: %+v", r)
+	}
+	expectedLabels := []string{"Metadata_format", "Linux_distribution", "Model"}
+	if !reflect.DeepEqual(r.MissingLabels, expectedLabels) {
+		t.Fatalf("invalid missing labels: %v (expected: %v)", r.MissingLabels, expectedLabels)
+	}
+
+	r = reports[broken]
+	if len(r.Errors) != 1 || r.Manifest != ManifestMissing {
+		t.Fatalf("invalid report for broken image: %+v", r)
+	}
+
+	_, err = json.Marshal(report)
+	if err != nil {
+		t.Fatalf("failed to serialize report: %s", err)
+	}
+	table := report.String()
+	if !strings.Contains(table, "3.2.1 (outdated)") || len(strings.Split(strings.TrimSpace(table), "\n")) != 4 {
+		t.Fatalf("invalid summary:\n%s", table)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Run(ctx, []string{tempDir}, policy, &sysCfg)
+	if err == nil {
+		t.Fatalf("audit with a canceled context succeeded")
+	}
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/gvallee/go_util/pkg/util"
 	"github.com/gvallee/kv/pkg/kv"
+	"github.com/sylabs/singularity-mpi/internal/pkg/archive"
 	"github.com/sylabs/singularity-mpi/internal/pkg/persistent"
 	"github.com/sylabs/singularity-mpi/pkg/implem"
 	"github.com/sylabs/singularity-mpi/pkg/syexec"
@@ -60,8 +61,81 @@ type Info struct {
 	// BuildDir is the directory where the software is built
 	BuildDir string
 
+	// MPIDir is the installation directory of the MPI implementation the software is compiled against (optional)
+	MPIDir string
+
 	// Env is the environment to use with the build environment
 	Env []string
+
+	// Compilers are the compilers to use instead of the default ones when configuring software
+	Compilers Compilers
+
+	// Binds are additional directories bound in containers at execution time, e.g., the PMIx of the host
+	// when the MPI of the container is used. The order of the list is the precedence of the directories
+	// in PATH and LD_LIBRARY_PATH.
+	Binds []Bind
+
+	// InstallBenchmarks specifies whether the OSU micro-benchmarks are built against the MPI installed in an image
+	InstallBenchmarks bool
+}
+
+// Bind describes a directory of the host bound in containers at execution time
+type Bind struct {
+	// Source is the directory on the host
+	Source string
+
+	// Target is the directory in the container, the same as Source if empty
+	Target string
+
+	// ReadOnly specifies whether the directory is bound read-only
+	ReadOnly bool
+
+	// Paths specifies whether the bin and lib sub-directories of Target are added to PATH and LD_LIBRARY_PATH
+	Paths bool
+}
+
+// GetTarget returns the directory where a bind is mounted in the container
+func (b *Bind) GetTarget() string {
+	if b.Target == "" {
+		return b.Source
+	}
+	return b.Target
+}
+
+// String returns the bind in the format expected by the --bind option of Singularity (src[:dest[:opts]])
+func (b *Bind) String() string {
+	str := b.Source + ":" + b.GetTarget()
+	if b.ReadOnly {
+		str += ":ro"
+	}
+	return str
+}
+
+// Compilers gathers the compilers to use to build software; an empty field means the default compiler is used
+type Compilers struct {
+	// CC is the C compiler
+	CC string
+
+	// CXX is the C++ compiler
+	CXX string
+
+	// FC is the Fortran compiler
+	FC string
+}
+
+// GetEnv returns the environment variable assignments (e.g., CC=clang) for the compilers that are set
+func (c *Compilers) GetEnv() []string {
+	var env []string
+	if c.CC != "" {
+		env = append(env, "CC="+c.CC)
+	}
+	if c.CXX != "" {
+		env = append(env, "CXX="+c.CXX)
+	}
+	if c.FC != "" {
+		env = append(env, "FC="+c.FC)
+	}
+	return env
 }
 
 // Unpack extracts the source code from a package/tarball/zip file.
@@ -80,7 +154,7 @@ func (env *Info) Unpack() error {
 		return nil
 	}
 
-	format := util.DetectTarballFormat(env.SrcPath)
+	format := archive.DetectTarballFormat(env.SrcPath)
 	if format == "" {
 		// A typical use case here is a single file that just needs to be compiled
 		log.Printf("%s does not seem to need to be unpacked, skipping...", env.SrcPath)
@@ -95,7 +169,7 @@ func (env *Info) Unpack() error {
 		return fmt.Errorf("tar is not available: %s", err)
 	}
 
-	tarArg := util.GetTarArgs(format)
+	tarArg := archive.GetTarArgs(format)
 	if tarArg == "" {
 		return fmt.Errorf("unsupported format: %s", format)
 	}
@@ -423,6 +497,10 @@ func createMPIHostEnvCfg(env *Info, mpi *implem.Info, sysCfg *sys.Config) error
 	if err != nil {
 		return fmt.Errorf("failed to initialize directory %s: %s", env.BuildDir, err)
 	}
+	err = MarkBuildDir(env.BuildDir)
+	if err != nil {
+		return err
+	}
 
 	/* SET THE INSTALL DIRECTORY */
 
@@ -453,6 +531,10 @@ func createNoMPIHostEnvCfg(env *Info, sysCfg *sys.Config) error {
 	if err != nil {
 		return fmt.Errorf("failed to create scratch directory: %s", err)
 	}
+	err = MarkBuildDir(env.BuildDir)
+	if err != nil {
+		return err
+	}
 
 	/* SET THE INSTALL DIRECTORY */
 
@@ -524,7 +606,7 @@ func createContainerPersistentMPIBuildEnv(containerBuildEnv *Info, kvs []kv.KV,
 
 	containerBuildEnv.ScratchDir = filepath.Join(sysCfg.Persistent, "scratch_"+kv.GetValue(kvs, "app_name"))
 	containerBuildEnv.BuildDir = filepath.Join(sysCfg.Persistent, "build_"+kv.GetValue(kvs, "app_name"))
-	containerBuildEnv.InstallDir = filepath.Join(sysCfg.Persistent, sys.ContainerInstallDirPrefix+kv.GetValue(kvs, "app_name"))
+	containerBuildEnv.InstallDir = sys.GetWorkspacePath(sysCfg.Persistent, sys.WorkspaceImagesDir, sys.ContainerInstallDirPrefix+kv.GetValue(kvs, "app_name"))
 
 	cleanup = func() {
 		err := os.RemoveAll(containerBuildEnv.ScratchDir)
@@ -573,6 +655,10 @@ func (e *Info) Init(sysCfg *sys.Config) error {
 		if err != nil {
 			return fmt.Errorf("failed to create build directory %s: %s", e.BuildDir, err)
 		}
+		err = MarkBuildDir(e.BuildDir)
+		if err != nil {
+			return err
+		}
 	}
 	if !util.PathExists(e.InstallDir) {
 		err := os.MkdirAll(e.InstallDir, 0755)
@@ -0,0 +1,72 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package buildenv
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnpackXZ(t *testing.T) {
+	_, err := exec.LookPath("xz")
+	if err != nil {
+		t.Skip("xz is not available")
+	}
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Create a tarball similar to the ones of Open MPI
+	srcDir := filepath.Join(tempDir, "src", "openmpi-4.1.5")
+	err = os.MkdirAll(srcDir, 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", srcDir, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "configure"), []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create configure: %s", err)
+	}
+	tarball := filepath.Join(tempDir, "openmpi-4.1.5.tar.xz")
+	cmd := exec.Command("tar", "-cJf", tarball, "openmpi-4.1.5")
+	cmd.Dir = filepath.Dir(srcDir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to create %s: %s (%s)", tarball, err, out)
+	}
+
+	var env Info
+	env.BuildDir = filepath.Join(tempDir, "build")
+	err = os.MkdirAll(env.BuildDir, 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", env.BuildDir, err)
+	}
+	p := SoftwarePackage{Name: "openmpi", URL: "file://" + tarball}
+	err = env.Get(&p)
+	if err != nil {
+		t.Fatalf("failed to get %s: %s", p.URL, err)
+	}
+	err = env.Unpack()
+	if err != nil {
+		t.Fatalf("failed to unpack %s: %s", env.SrcPath, err)
+	}
+
+	// The source directory is named after the tarball
+	expected := strings.TrimSuffix(path.Base(p.URL), ".tar.xz")
+	if filepath.Base(env.SrcDir) != expected {
+		t.Fatalf("source directory is %s instead of %s", env.SrcDir, expected)
+	}
+	if _, err := os.Stat(filepath.Join(env.SrcDir, "configure")); err != nil {
+		t.Fatalf("tarball was not extracted in %s: %s", env.SrcDir, err)
+	}
+}
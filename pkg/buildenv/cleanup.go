@@ -0,0 +1,116 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package buildenv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// BuildDirMarker is the name of the file identifying the build directories created by the tool
+	BuildDirMarker = ".sympi-build"
+
+	// DefaultBuildArtifactsMaxAge is the default age after which build directories are considered stale
+	DefaultBuildArtifactsMaxAge = 24 * time.Hour
+
+	// maxCleanupDepth is how deep in the scratch and persistent directories we look for build directories
+	maxCleanupDepth = 3
+)
+
+// MarkBuildDir marks a directory as a build directory created by the tool so it can be cleaned up later on
+func MarkBuildDir(dir string) error {
+	marker := filepath.Join(dir, BuildDirMarker)
+	err := ioutil.WriteFile(marker, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", marker, err)
+	}
+	return nil
+}
+
+// isStaleBuildDir checks whether a directory is a build directory created by the tool that is older than maxAge
+func isStaleBuildDir(dir string, maxAge time.Duration) bool {
+	info, err := os.Lstat(filepath.Join(dir, BuildDirMarker))
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return time.Since(info.ModTime()) > maxAge
+}
+
+// cleanBuildDirs removes the stale build directories in a directory, looking into subdirectories up to depth
+func cleanBuildDirs(dir string, maxAge time.Duration, depth int) error {
+	if depth == 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", dir, err)
+	}
+
+	for _, entry := range entries {
+		// We never follow symlinks to make sure we only delete files located where we expect them
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if isStaleBuildDir(path, maxAge) {
+			log.Printf("-> Removing stale build directory %s", path)
+			err := os.RemoveAll(path)
+			if err != nil {
+				return fmt.Errorf("failed to remove %s: %s", path, err)
+			}
+			continue
+		}
+		err := cleanBuildDirs(path, maxAge, depth-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CleanBuildArtifacts removes the stale build directories created by the tool in the scratch and persistent directories
+func CleanBuildArtifacts(sysCfg *sys.Config) error {
+	maxAge := sysCfg.BuildArtifactsMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultBuildArtifactsMaxAge
+	}
+
+	for _, root := range []string{sysCfg.ScratchDir, sysCfg.Persistent} {
+		if root == "" {
+			continue
+		}
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path of %s: %s", root, err)
+		}
+		if absRoot == "/" || absRoot == os.Getenv("HOME") {
+			return fmt.Errorf("refusing to clean up %s", absRoot)
+		}
+		info, err := os.Lstat(absRoot)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", absRoot)
+		}
+
+		err = cleanBuildDirs(absRoot, maxAge, maxCleanupDepth)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
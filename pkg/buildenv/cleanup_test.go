@@ -0,0 +1,74 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package buildenv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func createBuildDir(t *testing.T, dir string, marked bool, age time.Duration) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", dir, err)
+	}
+	if !marked {
+		return
+	}
+	err = MarkBuildDir(dir)
+	if err != nil {
+		t.Fatalf("failed to mark %s: %s", dir, err)
+	}
+	mtime := time.Now().Add(-age)
+	err = os.Chtimes(filepath.Join(dir, BuildDirMarker), mtime, mtime)
+	if err != nil {
+		t.Fatalf("failed to age %s: %s", dir, err)
+	}
+}
+
+func TestCleanBuildArtifacts(t *testing.T) {
+	scratchDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	staleDir := filepath.Join(scratchDir, "mpi_build_openmpi_4.0.2")
+	nestedStaleDir := filepath.Join(scratchDir, "container", "build")
+	freshDir := filepath.Join(scratchDir, "mpi_build_mpich_3.3")
+	unmarkedDir := filepath.Join(scratchDir, "data")
+	createBuildDir(t, staleDir, true, 48*time.Hour)
+	createBuildDir(t, nestedStaleDir, true, 48*time.Hour)
+	createBuildDir(t, freshDir, true, time.Minute)
+	createBuildDir(t, unmarkedDir, false, 0)
+
+	var sysCfg sys.Config
+	sysCfg.ScratchDir = scratchDir
+	sysCfg.BuildArtifactsMaxAge = 24 * time.Hour
+	err = CleanBuildArtifacts(&sysCfg)
+	if err != nil {
+		t.Fatalf("failed to clean up build artifacts: %s", err)
+	}
+
+	if util.PathExists(staleDir) || util.PathExists(nestedStaleDir) {
+		t.Fatalf("stale build directories were not removed")
+	}
+	if !util.PathExists(freshDir) || !util.PathExists(unmarkedDir) {
+		t.Fatalf("fresh or unmarked directories were removed")
+	}
+
+	sysCfg.ScratchDir = "/"
+	err = CleanBuildArtifacts(&sysCfg)
+	if err == nil {
+		t.Fatalf("clean up of / was accepted")
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package buildenv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/internal/pkg/ldd"
+	"github.com/sylabs/singularity-mpi/internal/pkg/persistent"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// cmakeBuildDir is the name of the directory, in the application's source directory, where CMake builds the application
+const cmakeBuildDir = "build"
+
+// BuildOutput gathers the result of the compilation of an application on the host
+type BuildOutput struct {
+	// BinPath is the path to the application's binary, verified to be linked against the host MPI
+	BinPath string
+
+	// MPIPrefix is the installation directory of the host MPI the application is compiled against
+	MPIPrefix string
+
+	// BuildSystem is the build system used to compile the application, empty if a custom install command was used
+	BuildSystem string
+
+	// MPILibraries are the paths to the MPI libraries the binary is linked against
+	MPILibraries []string
+
+	// Compilers maps the MPI compiler wrappers available in MPIPrefix to the version they report
+	Compilers map[string]string
+}
+
+// getHostMPIPrefix returns the installation directory of the host MPI an application is compiled against
+func getHostMPIPrefix(hostMPI *implem.Info, env *Info, sysCfg *sys.Config) (string, error) {
+	if env.MPIDir != "" {
+		return env.MPIDir, nil
+	}
+	if sysCfg.Persistent != "" {
+		return persistent.GetPersistentHostMPIInstallDir(hostMPI, sysCfg), nil
+	}
+	return "", fmt.Errorf("unable to find the installation of %s %s", hostMPI.ID, hostMPI.Version)
+}
+
+// getHostAppEnv returns the environment used to compile an application against the MPI installed in prefix
+func getHostAppEnv(a *app.Info, prefix string) []string {
+	env := []string{
+		"PATH=" + filepath.Join(prefix, "bin") + ":" + os.Getenv("PATH"),
+		"LD_LIBRARY_PATH=" + filepath.Join(prefix, "lib") + ":" + os.Getenv("LD_LIBRARY_PATH"),
+	}
+
+	var names []string
+	for name := range a.BuildEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+a.BuildEnv[name])
+	}
+	return env
+}
+
+// detectBuildSystem returns the build system of an application based on the content of its source directory
+func detectBuildSystem(a *app.Info, srcDir string) string {
+	if a.BuildSystem != "" && a.BuildSystem != app.BuildSystemAuto {
+		return a.BuildSystem
+	}
+	for _, makefile := range []string{"GNUmakefile", "makefile", "Makefile"} {
+		if util.FileExists(filepath.Join(srcDir, makefile)) {
+			return app.BuildSystemMake
+		}
+	}
+	if util.FileExists(filepath.Join(srcDir, "CMakeLists.txt")) {
+		return app.BuildSystemCMake
+	}
+	return app.BuildSystemMPICC
+}
+
+// runHostCmd executes a command on the host from a given directory, using the environment of the
+// process extended with env
+func runHostCmd(ctx context.Context, dir string, env []string, bin string, args ...string) (string, error) {
+	log.Printf("* Executing (from %s): %s %s", dir, bin, strings.Join(args, " "))
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("command failed: %s - stdout: %s - stderr: %s", err, stdout.String(), stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// getWrappers returns the MPI compiler wrappers for the C, C++ and Fortran languages
+func getWrappers(hostMPI *implem.Info, prefix string) (map[string]string, error) {
+	wrappers := make(map[string]string)
+	for _, lang := range []string{app.CompilerC, app.CompilerCXX, app.CompilerFortran} {
+		wrapper, err := app.GetCompilerWrapper(hostMPI.ID, lang)
+		if err != nil {
+			return nil, err
+		}
+		wrappers[lang] = filepath.Join(prefix, "bin", wrapper)
+	}
+	return wrappers, nil
+}
+
+// buildHostApp invokes the build system of an application
+func buildHostApp(ctx context.Context, a *app.Info, buildSystem string, wrappers map[string]string, env *Info) error {
+	switch buildSystem {
+	case app.BuildSystemMake:
+		_, err := runHostCmd(ctx, env.SrcDir, env.Env, "make", "-j4")
+		return err
+	case app.BuildSystemCMake:
+		buildDir := filepath.Join(env.SrcDir, cmakeBuildDir)
+		err := os.MkdirAll(buildDir, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", buildDir, err)
+		}
+		args := []string{
+			"-DCMAKE_C_COMPILER=" + wrappers[app.CompilerC],
+			"-DCMAKE_CXX_COMPILER=" + wrappers[app.CompilerCXX],
+			"-DCMAKE_Fortran_COMPILER=" + wrappers[app.CompilerFortran],
+		}
+		args = append(args, a.CMakeArgs...)
+		_, err = runHostCmd(ctx, buildDir, env.Env, "cmake", append(args, "..")...)
+		if err != nil {
+			return err
+		}
+		_, err = runHostCmd(ctx, buildDir, env.Env, "make", "-j4")
+		return err
+	case app.BuildSystemMPICC:
+		lang, err := app.GetCompilerLanguage(a)
+		if err != nil {
+			return err
+		}
+		_, err = runHostCmd(ctx, env.SrcDir, env.Env, wrappers[lang], "-o", a.BinName, path.Base(a.Source))
+		return err
+	default:
+		return fmt.Errorf("unsupported build system: %s", buildSystem)
+	}
+}
+
+// findHostAppBinary returns the path to the binary of an application once compiled
+func findHostAppBinary(a *app.Info, env *Info) (string, error) {
+	candidates := []string{
+		filepath.Join(env.SrcDir, a.BinName),
+		filepath.Join(env.SrcDir, cmakeBuildDir, a.BinName),
+		filepath.Join(env.InstallDir, "bin", a.BinName),
+	}
+	for _, candidate := range candidates {
+		if util.FileExists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find %s in %s", a.BinName, strings.Join(candidates, ", "))
+}
+
+// resolvePath returns the path with all the symbolic links resolved, or the cleaned path if it cannot be resolved
+func resolvePath(p string) string {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return filepath.Clean(p)
+	}
+	return resolved
+}
+
+// checkHostMPILinkage checks that a binary is dynamically linked against the MPI libraries installed in
+// prefix and not against another MPI implementation available on the system. It returns the paths to
+// the MPI libraries the binary is linked against.
+func checkHostMPILinkage(binPath string, libs []ldd.Library, prefix string) ([]string, error) {
+	var mpiLibs []string
+	mpiPrefix := resolvePath(prefix)
+	for _, lib := range libs {
+		if !ldd.IsMPILibrary(lib.Name) {
+			continue
+		}
+		if lib.Path == "" {
+			return nil, fmt.Errorf("%s depends on %s, which cannot be found", binPath, lib.Name)
+		}
+		libPath := resolvePath(lib.Path)
+		if !strings.HasPrefix(libPath, mpiPrefix+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is linked against %s, which is not part of the MPI installation in %s", binPath, lib.Path, prefix)
+		}
+		mpiLibs = append(mpiLibs, lib.Path)
+	}
+	if len(mpiLibs) == 0 {
+		return nil, fmt.Errorf("%s is not dynamically linked against MPI", binPath)
+	}
+	return mpiLibs, nil
+}
+
+// getCompilerVersions returns the version reported by the MPI compiler wrappers that are available
+func getCompilerVersions(ctx context.Context, wrappers map[string]string, env *Info) map[string]string {
+	versions := make(map[string]string)
+	for _, wrapper := range wrappers {
+		if !util.FileExists(wrapper) {
+			continue
+		}
+		output, err := runHostCmd(ctx, env.SrcDir, env.Env, wrapper, "--version")
+		if err != nil {
+			log.Printf("-> Unable to get the version of %s: %s", wrapper, err)
+			continue
+		}
+		versions[filepath.Base(wrapper)] = strings.TrimSpace(strings.Split(output, "\n")[0])
+	}
+	return versions
+}
+
+// BuildHostApp compiles an application on the host against a MPI installation of the host, as required by
+// the bind model. The sources are fetched first if env.SrcDir is not set. The application is built with its
+// install command if any, otherwise with its build system, and the resulting binary is checked to be linked
+// against the libraries of the host MPI so that the image does not end up relying on another MPI.
+func BuildHostApp(ctx context.Context, a *app.Info, hostMPI *implem.Info, env *Info, sysCfg *sys.Config) (BuildOutput, error) {
+	var out BuildOutput
+
+	// Sanity checks
+	if a == nil || hostMPI == nil || env == nil || sysCfg == nil || a.BinName == "" {
+		return out, fmt.Errorf("invalid parameter(s)")
+	}
+
+	var err error
+	out.MPIPrefix, err = getHostMPIPrefix(hostMPI, env, sysCfg)
+	if err != nil {
+		return out, err
+	}
+	wrappers, err := getWrappers(hostMPI, out.MPIPrefix)
+	if err != nil {
+		return out, err
+	}
+
+	s := SoftwarePackage{Name: a.Name, URL: a.Source, InstallCmd: a.InstallCmd}
+	if env.SrcDir == "" {
+		err = env.Get(&s)
+		if err != nil {
+			return out, fmt.Errorf("unable to get the application from %s: %s", s.URL, err)
+		}
+		err = env.Unpack()
+		if err != nil {
+			return out, fmt.Errorf("unable to unpack the application %s: %s", env.SrcPath, err)
+		}
+	}
+
+	env.Env = getHostAppEnv(a, out.MPIPrefix)
+	log.Printf("-> Building the application against the MPI installed in %s...", out.MPIPrefix)
+	if a.InstallCmd != "" {
+		err = env.Install(&s)
+	} else {
+		out.BuildSystem = detectBuildSystem(a, env.SrcDir)
+		err = buildHostApp(ctx, a, out.BuildSystem, wrappers, env)
+	}
+	if err != nil {
+		return out, fmt.Errorf("failed to build %s: %s", a.Name, err)
+	}
+
+	binPath, err := findHostAppBinary(a, env)
+	if err != nil {
+		return out, err
+	}
+	libs, err := ldd.GetLibraryPaths(binPath)
+	if err != nil {
+		return out, fmt.Errorf("failed to get the libraries of %s: %s", binPath, err)
+	}
+	out.MPILibraries, err = checkHostMPILinkage(binPath, libs, out.MPIPrefix)
+	if err != nil {
+		return out, err
+	}
+	out.BinPath = binPath
+	out.Compilers = getCompilerVersions(ctx, wrappers, env)
+	log.Printf("-> Successfully created %s\n", out.BinPath)
+
+	return out, nil
+}
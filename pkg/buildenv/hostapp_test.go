@@ -0,0 +1,137 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package buildenv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/ldd"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+)
+
+// getLddOutput returns a fabricated output of ldd for a binary linked against the MPI library libmpi
+func getLddOutput(libmpi string) string {
+	return "\tlinux-vdso.so.1 (0x00007ffc4b5f2000)\n" +
+		"\tlibmpi.so.40 => " + libmpi + " (0x00007f1b2c9e6000)\n" +
+		"\tlibc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x00007f1b2c7f5000)\n" +
+		"\t/lib64/ld-linux-x86-64.so.2 (0x00007f1b2cb2e000)\n"
+}
+
+func TestCheckHostMPILinkage(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The host MPI is accessed through a symbolic link, e.g., a 'current' version
+	prefix := filepath.Join(tempDir, "mpi_install_openmpi-4.0.2")
+	err = os.MkdirAll(filepath.Join(prefix, "lib"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", prefix, err)
+	}
+	link := filepath.Join(tempDir, "openmpi")
+	err = os.Symlink(prefix, link)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", link, err)
+	}
+
+	tests := []struct {
+		name          string
+		output        string
+		prefix        string
+		expectedError string
+	}{
+		{
+			name:   "host MPI",
+			output: getLddOutput(filepath.Join(prefix, "lib", "libmpi.so.40")),
+			prefix: prefix,
+		},
+		{
+			name:   "host MPI through a symbolic link",
+			output: getLddOutput(filepath.Join(prefix, "lib", "libmpi.so.40")),
+			prefix: link,
+		},
+		{
+			name:          "other MPI",
+			output:        getLddOutput("/usr/lib/x86_64-linux-gnu/openmpi/lib/libmpi.so.40"),
+			prefix:        prefix,
+			expectedError: "not part of the MPI installation",
+		},
+		{
+			name:          "prefix of the name of the MPI directory",
+			output:        getLddOutput(prefix + "-debug/lib/libmpi.so.40"),
+			prefix:        prefix,
+			expectedError: "not part of the MPI installation",
+		},
+		{
+			name:          "MPI library not found",
+			output:        "\tlibmpi.so.40 => not found\n\tlibc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x00007f1b2c7f5000)\n",
+			prefix:        prefix,
+			expectedError: "cannot be found",
+		},
+		{
+			name:          "static MPI",
+			output:        "\tlinux-vdso.so.1 (0x00007ffc4b5f2000)\n\tlibc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x00007f1b2c7f5000)\n",
+			prefix:        prefix,
+			expectedError: "not dynamically linked against MPI",
+		},
+	}
+
+	for _, tt := range tests {
+		libs, err := checkHostMPILinkage("/scratch/helloworld", ldd.ParseLibraryPaths(tt.output), tt.prefix)
+		if tt.expectedError == "" {
+			if err != nil {
+				t.Fatalf("%s: linkage check failed: %s", tt.name, err)
+			}
+			if len(libs) != 1 || libs[0] != filepath.Join(prefix, "lib", "libmpi.so.40") {
+				t.Fatalf("%s: invalid list of MPI libraries: %v", tt.name, libs)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+			t.Fatalf("%s: linkage check returned %v instead of an error including %q", tt.name, err, tt.expectedError)
+		}
+	}
+}
+
+func TestDetectBuildSystem(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	a := app.Info{Source: "file:///home/user/mpitest.c"}
+	if bs := detectBuildSystem(&a, tempDir); bs != app.BuildSystemMPICC {
+		t.Fatalf("build system of a single source file is %s instead of %s", bs, app.BuildSystemMPICC)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tempDir, "CMakeLists.txt"), nil, 0644)
+	if err != nil {
+		t.Fatalf("failed to create CMakeLists.txt: %s", err)
+	}
+	if bs := detectBuildSystem(&a, tempDir); bs != app.BuildSystemCMake {
+		t.Fatalf("build system is %s instead of %s", bs, app.BuildSystemCMake)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tempDir, "Makefile"), nil, 0644)
+	if err != nil {
+		t.Fatalf("failed to create Makefile: %s", err)
+	}
+	if bs := detectBuildSystem(&a, tempDir); bs != app.BuildSystemMake {
+		t.Fatalf("build system is %s instead of %s", bs, app.BuildSystemMake)
+	}
+
+	a.BuildSystem = app.BuildSystemCMake
+	if bs := detectBuildSystem(&a, tempDir); bs != app.BuildSystemCMake {
+		t.Fatalf("build system is %s instead of the requested %s", bs, app.BuildSystemCMake)
+	}
+}
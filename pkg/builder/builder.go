@@ -10,11 +10,11 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/gvallee/go_util/pkg/util"
 	"github.com/sylabs/singularity-mpi/internal/pkg/autotools"
@@ -158,6 +158,14 @@ func (b *Builder) InstallOnHost(pkg *implem.Info, env *buildenv.Info, sysCfg *sy
 	}
 
 	log.Printf("* %s does not exists, installing from scratch\n", env.InstallDir)
+	if util.DetectURLType(pkg.URL) == util.HttpURL {
+		res.Err = pkg.SelectURLVariant(implem.URLExists)
+		if res.Err != nil {
+			res.Err = fmt.Errorf("failed to find a tarball of %s: %s", pkg.ID, res.Err)
+			return res
+		}
+	}
+
 	var s buildenv.SoftwarePackage
 	s.URL = pkg.URL
 	s.Name = pkg.ID + "-" + pkg.Version
@@ -278,10 +286,28 @@ func (b *Builder) createDefFileFromTemplate(defFileName string, mpiCfg *implem.I
 	f.MpiImplm = mpiCfg
 	f.InternalEnv = env
 	f.Tags = b.GetDeffileTemplateTags()
-	err = deffile.UpdateDeffileTemplate(f, sysCfg)
+	if !sysCfg.Debug {
+		err = deffile.UpdateDeffileTemplate(f, sysCfg)
+		if err != nil {
+			return f, fmt.Errorf("unable to generate definition file from template: %s", err)
+		}
+		return f, nil
+	}
+
+	// In debug mode, we keep the trace of the substitutions next to the definition file
+	trace, err := deffile.UpdateDeffileTemplateWithTrace(f, sysCfg)
 	if err != nil {
 		return f, fmt.Errorf("unable to generate definition file from template: %s", err)
 	}
+	for _, tag := range trace.UnusedTags() {
+		log.Printf("-> Tag %s does not appear in %s", tag, templateDefFile)
+	}
+	traceFile := f.Path + deffile.TraceFileSuffix
+	err = trace.Save(traceFile)
+	if err != nil {
+		// This is not a fatal error, the definition file is available
+		log.Printf("failed to save the trace of the template expansion: %s", err)
+	}
 
 	return f, nil
 }
@@ -361,6 +387,10 @@ func (b *Builder) CompileAppOnHost(appInfo *app.Info, buildEnv *buildenv.Info, s
 		if err != nil {
 			return fmt.Errorf("failed to initialize directory %s: %s", buildEnv.BuildDir, err)
 		}
+		err = buildenv.MarkBuildDir(buildEnv.BuildDir)
+		if err != nil {
+			return err
+		}
 	}
 	if !util.PathExists(buildEnv.InstallDir) {
 		err := util.DirInit(buildEnv.InstallDir)
@@ -403,11 +433,8 @@ func (b *Builder) CompileAppOnHost(appInfo *app.Info, buildEnv *buildenv.Info, s
 
 // CompileMPIAppOnHost compiles and installs a given application on the host, as well
 // as the required MPI implementation when necessary
-func (b *Builder) CompileMPIAppOnHost(appInfo *app.Info, mpiCfg *mpi.Config, buildEnv *buildenv.Info, sysCfg *sys.Config) error {
-	var s buildenv.SoftwarePackage
-	s.URL = appInfo.Source
-	s.Name = appInfo.Name
-	s.InstallCmd = appInfo.InstallCmd
+func (b *Builder) CompileMPIAppOnHost(appInfo *app.Info, mpiCfg *mpi.Config, buildEnv *buildenv.Info, sysCfg *sys.Config) (buildenv.BuildOutput, error) {
+	var out buildenv.BuildOutput
 
 	// Check whether the required MPI is already installed, if not install it
 	var mpi buildenv.SoftwarePackage
@@ -427,13 +454,17 @@ func (b *Builder) CompileMPIAppOnHost(appInfo *app.Info, mpiCfg *mpi.Config, bui
 	if !util.PathExists(buildEnv.BuildDir) {
 		err := util.DirInit(buildEnv.BuildDir)
 		if err != nil {
-			return fmt.Errorf("failed to initialize %s: %s", buildEnv.BuildDir, err)
+			return out, fmt.Errorf("failed to initialize %s: %s", buildEnv.BuildDir, err)
+		}
+		err = buildenv.MarkBuildDir(buildEnv.BuildDir)
+		if err != nil {
+			return out, err
 		}
 	}
 
 	res := b.InstallOnHost(&mpiCfg.Implem, buildEnv, sysCfg)
 	if res.Err != nil {
-		return fmt.Errorf("failed to install MPI on host: %s", res.Err)
+		return out, fmt.Errorf("failed to install MPI on host: %s", res.Err)
 	}
 
 	// Install the app on the host
@@ -442,49 +473,29 @@ func (b *Builder) CompileMPIAppOnHost(appInfo *app.Info, mpiCfg *mpi.Config, bui
 	if !util.PathExists(buildEnv.BuildDir) {
 		err := util.DirInit(buildEnv.BuildDir)
 		if err != nil {
-			return fmt.Errorf("failed to initialize directory %s: %s", buildEnv.BuildDir, err)
+			return out, fmt.Errorf("failed to initialize directory %s: %s", buildEnv.BuildDir, err)
+		}
+		err = buildenv.MarkBuildDir(buildEnv.BuildDir)
+		if err != nil {
+			return out, err
 		}
 	}
 	if !util.PathExists(buildEnv.InstallDir) {
 		err := util.DirInit(buildEnv.InstallDir)
 		if err != nil {
-			return fmt.Errorf("failed to initialize directory %s: %s", buildEnv.InstallDir, err)
+			return out, fmt.Errorf("failed to initialize directory %s: %s", buildEnv.InstallDir, err)
 		}
 	}
 
 	log.Printf("Build the application in %s\n", buildEnv.BuildDir)
 	log.Printf("Install the application in %s\n", buildEnv.InstallDir)
 
-	// Download the app
-	err := buildEnv.Get(&s)
-	if err != nil {
-		return fmt.Errorf("unable to get the application from %s: %s", s.URL, err)
-	}
-
-	// Unpacking the app
-	err = buildEnv.Unpack()
-	if err != nil {
-		return fmt.Errorf("unable to unpack the application %s: %s", buildEnv.SrcPath, err)
-	}
-
-	// Install the app
-	log.Println("-> Building the application...")
-	mpiPath := mpiCfg.Buildenv.GetEnvPath()
-	mpiLdPath := mpiCfg.Buildenv.GetEnvLDPath()
-	//buildEnv.Env = append([]string{"LD_LIBRARY_PATH=" + mpiLdPath}, os.Environ()...)
-	buildEnv.Env = []string{"LD_LIBRARY_PATH=" + mpiLdPath}
-	buildEnv.Env = append([]string{"PATH=" + mpiPath}, buildEnv.Env...)
-	log.Printf("* env:\n\t%s", strings.Join(buildEnv.Env, "\n\t"))
-	err = buildEnv.Install(&s)
+	buildEnv.MPIDir = mpiCfg.Buildenv.InstallDir
+	out, err := buildenv.BuildHostApp(context.Background(), appInfo, &mpiCfg.Implem, buildEnv, sysCfg)
 	if err != nil {
-		return fmt.Errorf("unable to install package: %s", err)
+		return out, fmt.Errorf("unable to build the application: %s", err)
 	}
+	appInfo.BinPath = out.BinPath
 
-	// todo: we do not have a good way to know if an app is actually install in InstallDir or
-	// if we must just use the binary in BuildDir. For now we assume that we use the binary in
-	// BuildDir.
-	appInfo.BinPath = filepath.Join(buildEnv.SrcDir, appInfo.BinName)
-	log.Printf("-> Successfully created %s\n", appInfo.BinPath)
-
-	return nil
+	return out, nil
 }
@@ -0,0 +1,111 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package capability
+
+import (
+	"sort"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/checker"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sy"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// Host gathers the capabilities of the host
+type Host struct {
+	// SingularityVersion is the version of Singularity installed on the host
+	SingularityVersion string
+
+	// Fakeroot specifies whether images are built with fakeroot (unprivileged installation of Singularity)
+	Fakeroot bool
+
+	// SudoCmds is the list of Singularity commands that are executed with sudo
+	SudoCmds []string
+
+	// Features is the list of Singularity features available on the host
+	Features []string
+}
+
+// Report gathers everything that the tool and the host support
+type Report struct {
+	// Distros is the list of Linux distributions that can be used in containers
+	Distros []distro.ID
+
+	// Implementations is the list of MPI implementations that can be used in containers
+	Implementations []implem.Descriptor
+
+	// Models is the list of MPI models that can be used in containers
+	Models []string
+
+	// Host gathers the capabilities of the host
+	Host Host
+}
+
+// singularityFeatures associates Singularity features to the first version of Singularity supporting them
+var singularityFeatures = map[string]string{
+	"fakeroot": "3.3",
+	"rocm":     "3.5",
+}
+
+// getHostCapabilities returns the capabilities of a host based on its configuration and version of Singularity
+func getHostCapabilities(sysCfg *sys.Config, singularityVersion string) Host {
+	var h Host
+	h.SingularityVersion = sy.ParseVersion(singularityVersion)
+	h.Fakeroot = sysCfg.Nopriv
+	h.SudoCmds = sysCfg.SudoSyCmds
+	if h.SingularityVersion == "" {
+		return h
+	}
+	for feature, minVersion := range singularityFeatures {
+		if checker.CompareVersions(h.SingularityVersion, minVersion) >= 0 {
+			h.Features = append(h.Features, feature)
+		}
+	}
+	sort.Strings(h.Features)
+	return h
+}
+
+// getDistroDescr returns the description string of a Linux distribution, e.g., ubuntu:disco or centos:7,
+// which is the format used on the command line and in configuration files
+func getDistroDescr(id distro.ID) string {
+	if id.Codename != "" {
+		return id.Name + ":" + id.Codename
+	}
+	return id.Name + ":" + id.Version
+}
+
+// SupportedDistros returns the description strings of the Linux distributions that can be used in containers,
+// e.g., for the completion of command line arguments
+func SupportedDistros() []string {
+	var descrs []string
+	for _, id := range deffile.SupportedDistros() {
+		descrs = append(descrs, getDistroDescr(id))
+	}
+	return descrs
+}
+
+// SupportedMPIImplementations returns the identifiers of the MPI implementations that can be used in containers,
+// e.g., for the completion of command line arguments
+func SupportedMPIImplementations() []string {
+	var ids []string
+	for _, d := range deffile.SupportedImplementations() {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+// GetReport returns the list of distros, MPI implementations and models supported by the tool, as well as the capabilities of the host
+func GetReport(sysCfg *sys.Config) Report {
+	var r Report
+	r.Distros = deffile.SupportedDistros()
+	r.Implementations = deffile.SupportedImplementations()
+	r.Models = container.SupportedModels()
+	r.Host = getHostCapabilities(sysCfg, sy.GetVersion(sysCfg))
+	return r
+}
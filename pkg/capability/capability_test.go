@@ -0,0 +1,82 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package capability
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func TestGetHostCapabilities(t *testing.T) {
+	var sysCfg sys.Config
+	sysCfg.Nopriv = true
+
+	h := getHostCapabilities(&sysCfg, "3.4.1-1.el7\n")
+	if h.SingularityVersion != "3.4.1" || !h.Fakeroot {
+		t.Fatalf("invalid host capabilities: %+v", h)
+	}
+	if strings.Join(h.Features, ",") != "fakeroot" {
+		t.Fatalf("invalid features for Singularity 3.4.1: %v", h.Features)
+	}
+
+	h = getHostCapabilities(&sysCfg, "singularity version 3.5.2")
+	if strings.Join(h.Features, ",") != "fakeroot,rocm" {
+		t.Fatalf("invalid features for Singularity 3.5.2: %v", h.Features)
+	}
+
+	h = getHostCapabilities(&sysCfg, "")
+	if len(h.Features) != 0 {
+		t.Fatalf("features reported while Singularity version is unknown: %v", h.Features)
+	}
+}
+
+func TestSupportedDistros(t *testing.T) {
+	var sysCfg sys.Config
+
+	descrs := SupportedDistros()
+	ids := deffile.SupportedDistros()
+	if len(descrs) == 0 || len(descrs) != len(ids) {
+		t.Fatalf("invalid list of distros: %v", descrs)
+	}
+	for i, descr := range descrs {
+		id := distro.ParseDescr(descr)
+		if id != ids[i] {
+			t.Fatalf("%s does not describe %+v", descr, ids[i])
+		}
+
+		// Definition files can be bootstrapped for all the distros
+		var buf bytes.Buffer
+		data := deffile.DefFileData{DistroID: id}
+		err := deffile.AddBootstrap(&buf, &data, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to bootstrap %s: %s", descr, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	data := deffile.DefFileData{DistroID: distro.ParseDescr("gentoo:17")}
+	if deffile.AddBootstrap(&buf, &data, &sysCfg) == nil {
+		t.Fatalf("unsupported distro was bootstrapped")
+	}
+}
+
+func TestSupportedMPIImplementations(t *testing.T) {
+	ids := SupportedMPIImplementations()
+	if len(ids) != len(deffile.SupportedImplementations()) {
+		t.Fatalf("invalid list of MPI implementations: %v", ids)
+	}
+	for _, id := range ids {
+		if !implem.IsMPI(&implem.Info{ID: id}) {
+			t.Fatalf("%s is not a MPI implementation", id)
+		}
+	}
+}
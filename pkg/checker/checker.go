@@ -50,6 +50,49 @@ func CheckDefFile(path string) error {
 	return nil
 }
 
+// getFilesSectionSources returns the host paths referenced in the files sections of the content of a definition file.
+// Files copied from another stage of a multi-stage build are ignored since they are not on the host.
+func getFilesSectionSources(content string) []string {
+	var sources []string
+	inFiles := false
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "%") {
+			fields := strings.Fields(trimmed)
+			inFiles = fields[0] == "%files" && len(fields) == 1
+			continue
+		}
+		if !inFiles || trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		sources = append(sources, strings.Fields(trimmed)[0])
+	}
+	return sources
+}
+
+// CheckDefFileSources checks that all the host files referenced in the files section of a definition file
+// exist and are readable, relative paths being relative to the directory where the build is executed
+func CheckDefFileSources(path string, execDir string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", path, err)
+	}
+
+	for _, src := range getFilesSectionSources(string(content)) {
+		hostPath := src
+		if !filepath.IsAbs(hostPath) {
+			hostPath = filepath.Join(execDir, hostPath)
+		}
+		f, err := os.Open(hostPath)
+		if err != nil {
+			return fmt.Errorf("%s, referenced in the files section of %s, is not available: %s", src, path, err)
+		}
+		f.Close()
+	}
+
+	return nil
+}
+
 // checkSingularityInstall makes sure that Singularity is correctly installed and works properly
 func checkSingularityInstall() error {
 
@@ -0,0 +1,54 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package checker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckDefFileSources(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	src := filepath.Join(tempDir, "mpitest.c")
+	err = ioutil.WriteFile(src, []byte("int main() { return 0; }\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", src, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(tempDir, "input.dat"), []byte("data\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create input file: %s", err)
+	}
+
+	defFile := filepath.Join(tempDir, "test.def")
+	content := "Bootstrap: docker\nFrom: ubuntu:disco\n\n%files\n\t" + src + " /opt\n\tinput.dat /opt\n\n%files from build\n\t/opt/app /opt/app\n\n%post\n\techo /nonexistent\n"
+	err = ioutil.WriteFile(defFile, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", defFile, err)
+	}
+	err = CheckDefFileSources(defFile, tempDir)
+	if err != nil {
+		t.Fatalf("valid definition file was rejected: %s", err)
+	}
+
+	missing := filepath.Join(tempDir, "missing.c")
+	content = "Bootstrap: docker\nFrom: ubuntu:disco\n\n%files\n\t" + src + " /opt\n\t" + missing + " /opt\n"
+	err = ioutil.WriteFile(defFile, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed to update %s: %s", defFile, err)
+	}
+	err = CheckDefFileSources(defFile, tempDir)
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("missing source file was not reported: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package checker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+// compatIssue describes a known problem when using a range of MPI versions with a range of versions of a Linux distribution
+type compatIssue struct {
+	// mpiID is the identifier of the MPI implementation
+	mpiID string
+
+	// mpiBefore is the first MPI version that is not affected by the issue
+	mpiBefore string
+
+	// distroName is the name of the Linux distribution
+	distroName string
+
+	// distroFrom is the first version of the Linux distribution affected by the issue
+	distroFrom string
+
+	// reason explains the problem
+	reason string
+}
+
+// compatMatrix is the list of known-problematic (MPI, distro) combinations
+var compatMatrix = []compatIssue{
+	{
+		mpiID:      implem.MPICH,
+		mpiBefore:  "3.4",
+		distroName: "ubuntu",
+		distroFrom: "20.10",
+		reason:     "gfortran 10 rejects the argument mismatches in the Fortran bindings of MPICH",
+	},
+	{
+		mpiID:      implem.OMPI,
+		mpiBefore:  "3.0",
+		distroName: "ubuntu",
+		distroFrom: "20.10",
+		reason:     "GCC 10 defaults to -fno-common, which breaks the link of old Open MPI versions",
+	},
+	{
+		mpiID:      implem.OMPI,
+		mpiBefore:  "2.0",
+		distroName: "centos",
+		distroFrom: "8",
+		reason:     "old Open MPI versions do not build with the GCC 8 toolchain",
+	},
+}
+
+// CompareVersions compares two dotted version strings and returns -1, 0 or 1
+func CompareVersions(v1 string, v2 string) int {
+	t1 := strings.Split(v1, ".")
+	t2 := strings.Split(v2, ".")
+	for i := 0; i < len(t1) || i < len(t2); i++ {
+		n1 := 0
+		n2 := 0
+		if i < len(t1) {
+			n1, _ = strconv.Atoi(t1[i])
+		}
+		if i < len(t2) {
+			n2, _ = strconv.Atoi(t2[i])
+		}
+		if n1 < n2 {
+			return -1
+		}
+		if n1 > n2 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// CheckCombination returns warnings for known-problematic combinations of a MPI implementation and a Linux distribution
+func CheckCombination(mpi *implem.Info, linuxDistro distro.ID) []string {
+	var warnings []string
+
+	if mpi == nil || mpi.Version == "" || linuxDistro.Version == "" {
+		return warnings
+	}
+
+	for _, issue := range compatMatrix {
+		if issue.mpiID != mpi.ID || issue.distroName != linuxDistro.Name {
+			continue
+		}
+		if CompareVersions(mpi.Version, issue.mpiBefore) < 0 && CompareVersions(linuxDistro.Version, issue.distroFrom) >= 0 {
+			warnings = append(warnings, fmt.Sprintf("%s %s on %s %s is known to be problematic: %s", mpi.ID, mpi.Version, linuxDistro.Name, linuxDistro.Version, issue.reason))
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package checker
+
+import (
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+func TestCheckCombination(t *testing.T) {
+	tests := []struct {
+		mpiID            string
+		mpiVersion       string
+		distro           string
+		expectedWarnings int
+	}{
+		{mpiID: implem.MPICH, mpiVersion: "3.3.2", distro: "ubuntu:groovy", expectedWarnings: 1},
+		{mpiID: implem.MPICH, mpiVersion: "3.4", distro: "ubuntu:groovy", expectedWarnings: 0},
+		{mpiID: implem.OMPI, mpiVersion: "2.1.6", distro: "ubuntu:groovy", expectedWarnings: 1},
+		{mpiID: implem.OMPI, mpiVersion: "4.0.2", distro: "ubuntu:disco", expectedWarnings: 0},
+		{mpiID: implem.OMPI, mpiVersion: "1.10.7", distro: "centos:7", expectedWarnings: 0},
+	}
+
+	for _, tt := range tests {
+		mpi := implem.Info{ID: tt.mpiID, Version: tt.mpiVersion}
+		warnings := CheckCombination(&mpi, distro.ParseDescr(tt.distro))
+		if len(warnings) != tt.expectedWarnings {
+			t.Fatalf("%s %s on %s: got %d warning(s) instead of %d: %v", tt.mpiID, tt.mpiVersion, tt.distro, len(warnings), tt.expectedWarnings, warnings)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package config loads the description of a complete build (distro, MPI, application and
+// container) from a single build manifest.
+//
+// The manifest is a JSON document, or a YAML document when the file has a .yaml or .yml
+// extension. Only the subset of YAML needed to describe a build is supported: block and flow
+// mappings and sequences, plain and quoted scalars, and comments. Anchors, aliases, tags and
+// block scalars are rejected. Versions that look like numbers (e.g., 4.0) must be quoted in YAML.
+// The schema is:
+//
+//	{
+//		"distro": "ubuntu:disco",            (required)
+//		"model": "hybrid",                   (required, hybrid or bind)
+//		"def_file": "/path/to/app.def",      (required)
+//		"image": "/path/to/app.sif",         (required)
+//		"mpi": {
+//			"implementation": "openmpi",     (required)
+//			"version": "4.0.2",              (required)
+//			"url": "https://...",            (required)
+//			"checksum": "...",
+//			"tarball_size": 12345678,
+//			"device": "ch4:ofi",
+//			"install_dir": "/opt/mpi"        (DefaultMPIDir if not set)
+//		},
+//		"app": {
+//			"name": "helloworld",            (required)
+//			"source": "https://...",         (required)
+//			"exe": "helloworld",
+//			"compile_cmd": "make",
+//			"compiler": "c",
+//			"build_env": {"CFLAGS": "-O2"},
+//			"license_file": "/path/to/LICENSE",
+//			"readme_file": "/path/to/README.md"
+//		},
+//		"binds": ["/scratch:/scratch"],
+//		"shared_mem": ["xpmem"],
+//		"rocm": false,
+//		"user": "mpiuser",
+//		"group": "mpiuser",
+//		"mpi_wrapper": false,
+//		"health_check": "mpirun -n 1 true",
+//		"interconnect": "infiniband"
+//	}
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+// DefaultMPIDir is the directory where MPI is installed in the container when not specified
+const DefaultMPIDir = "/opt/mpi"
+
+// MPIConfig is the MPI section of a build manifest
+type MPIConfig struct {
+	Implementation string `json:"implementation"`
+	Version        string `json:"version"`
+	URL            string `json:"url"`
+	Checksum       string `json:"checksum"`
+	TarballSize    int64  `json:"tarball_size"`
+	Device         string `json:"device"`
+	InstallDir     string `json:"install_dir"`
+}
+
+// AppConfig is the application section of a build manifest
+type AppConfig struct {
+	Name       string            `json:"name"`
+	Source     string            `json:"source"`
+	Exe        string            `json:"exe"`
+	CompileCmd string            `json:"compile_cmd"`
+	Compiler   string            `json:"compiler"`
+	BuildEnv   map[string]string `json:"build_env"`
+	License    string            `json:"license_file"`
+	Readme     string            `json:"readme_file"`
+}
+
+// Manifest is the description of a complete build
+type Manifest struct {
+	Distro    string    `json:"distro"`
+	Model     string    `json:"model"`
+	DefFile   string    `json:"def_file"`
+	Image     string    `json:"image"`
+	MPI       MPIConfig `json:"mpi"`
+	App       AppConfig `json:"app"`
+	Binds     []string  `json:"binds"`
+	SharedMem []string  `json:"shared_mem"`
+	ROCm      bool      `json:"rocm"`
+	User      string    `json:"user"`
+	Group     string    `json:"group"`
+	Wrapper   bool      `json:"mpi_wrapper"`
+	Health    string    `json:"health_check"`
+	Network   string    `json:"interconnect"`
+}
+
+// Validate checks that all the required fields of a build manifest are set and valid
+func (m *Manifest) Validate() error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"distro", m.Distro},
+		{"model", m.Model},
+		{"def_file", m.DefFile},
+		{"image", m.Image},
+		{"mpi.implementation", m.MPI.Implementation},
+		{"mpi.version", m.MPI.Version},
+		{"mpi.url", m.MPI.URL},
+		{"app.name", m.App.Name},
+		{"app.source", m.App.Source},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			return fmt.Errorf("missing required field: %s", field.name)
+		}
+	}
+
+	if !container.IsSupportedModel(m.Model) {
+		return fmt.Errorf("unsupported model: %s", m.Model)
+	}
+	if !implem.IsMPI(&implem.Info{ID: m.MPI.Implementation}) {
+		return fmt.Errorf("unsupported MPI implementation: %s", m.MPI.Implementation)
+	}
+	if m.MPI.TarballSize < 0 {
+		return fmt.Errorf("invalid mpi.tarball_size: %d", m.MPI.TarballSize)
+	}
+	if m.Group != "" && m.User == "" {
+		return fmt.Errorf("group %s is specified without a user", m.Group)
+	}
+	if m.Network != "" && !container.IsSupportedInterconnect(m.Network) {
+		return fmt.Errorf("unsupported interconnect: %s", m.Network)
+	}
+
+	return nil
+}
+
+// Parse parses the content of a build manifest
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse build manifest: %s", err)
+	}
+
+	err = m.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid build manifest: %s", err)
+	}
+
+	return &m, nil
+}
+
+// ParseYAML parses the content of a YAML build manifest
+func ParseYAML(data []byte) (*Manifest, error) {
+	jsonData, err := yamlToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse YAML build manifest: %s", err)
+	}
+
+	return Parse(jsonData)
+}
+
+// Load reads a build manifest and returns the matching definition file, application and container configurations
+func Load(path string) (*deffile.DefFileData, *app.Info, *container.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+
+	var m *Manifest
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		m, err = ParseYAML(data)
+	default:
+		m, err = Parse(data)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load %s: %s", path, err)
+	}
+
+	d, a, c := m.toConfig()
+	return d, a, c, nil
+}
+
+// toConfig converts a build manifest into the definition file, application and container configurations
+func (m *Manifest) toConfig() (*deffile.DefFileData, *app.Info, *container.Config) {
+	mpiDir := m.MPI.InstallDir
+	if mpiDir == "" {
+		mpiDir = DefaultMPIDir
+	}
+
+	mpi := &implem.Info{
+		ID:          m.MPI.Implementation,
+		Version:     m.MPI.Version,
+		URL:         m.MPI.URL,
+		Tarball:     path.Base(m.MPI.URL),
+		Checksum:    m.MPI.Checksum,
+		TarballSize: m.MPI.TarballSize,
+		Device:      m.MPI.Device,
+		WithROCm:    m.ROCm,
+	}
+
+	a := &app.Info{
+		Name:        m.App.Name,
+		Source:      m.App.Source,
+		BinName:     m.App.Exe,
+		InstallCmd:  m.App.CompileCmd,
+		Compiler:    m.App.Compiler,
+		BuildEnv:    m.App.BuildEnv,
+		LicenseFile: m.App.License,
+		ReadmeFile:  m.App.Readme,
+	}
+
+	c := &container.Config{
+		Name:                m.App.Name,
+		Path:                m.Image,
+		BuildDir:            path.Dir(m.Image),
+		InstallDir:          path.Dir(m.Image),
+		DefFile:             m.DefFile,
+		Distro:              m.Distro,
+		Model:               m.Model,
+		MPIDir:              mpiDir,
+		Binds:               m.Binds,
+		ROCm:                m.ROCm,
+		SharedMemTransports: m.SharedMem,
+		User:                m.User,
+		Group:               m.Group,
+		MPIWrapper:          m.Wrapper,
+		HealthCheck:         m.Health,
+		Interconnect:        m.Network,
+	}
+	if m.App.Exe != "" {
+		c.AppExe = "/opt/" + m.App.Exe
+	}
+	if m.Wrapper {
+		c.AppExe = "/opt/" + deffile.MPIWrapperName
+	}
+
+	d := &deffile.DefFileData{
+		Path:                m.DefFile,
+		DistroID:            distro.ParseDescr(m.Distro),
+		MpiImplm:            mpi,
+		InternalEnv:         &buildenv.Info{InstallDir: mpiDir},
+		Model:               m.Model,
+		SharedMemTransports: m.SharedMem,
+		User:                m.User,
+		Group:               m.Group,
+		MPIWrapper:          m.Wrapper,
+		HealthCheck:         m.Health,
+		Interconnect:        m.Network,
+	}
+
+	return d, a, c
+}
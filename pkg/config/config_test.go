@@ -0,0 +1,189 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+)
+
+func TestLoad(t *testing.T) {
+	for _, manifest := range []string{"testdata/build.json", "testdata/build.yaml"} {
+		t.Run(filepath.Base(manifest), func(t *testing.T) {
+			checkLoad(t, manifest)
+		})
+	}
+}
+
+// checkLoad loads a build manifest describing the helloworld build of the testdata directory and checks the resulting configurations
+func checkLoad(t *testing.T, manifest string) {
+	d, a, c, err := Load(manifest)
+	if err != nil {
+		t.Fatalf("failed to load build manifest %s: %s", manifest, err)
+	}
+
+	expectedMPI := implem.Info{
+		ID:       implem.OMPI,
+		Version:  "4.0.2",
+		URL:      "https://download.open-mpi.org/release/open-mpi/v4.0/openmpi-4.0.2.tar.bz2",
+		Tarball:  "openmpi-4.0.2.tar.bz2",
+		Checksum: "900bf751be72eccf06de9d186f7b1c4b5c2fa9fa66458e53b77778dffdfe4057",
+		WithROCm: true,
+	}
+	if d.Path != "/tmp/sympi/helloworld.def" || d.Model != container.HybridModel || d.User != "mpiuser" || d.Group != "mpi" {
+		t.Fatalf("invalid definition file configuration: %+v", d)
+	}
+	if d.DistroID != distro.ParseDescr("ubuntu:disco") {
+		t.Fatalf("invalid distro: %+v", d.DistroID)
+	}
+	if !reflect.DeepEqual(*d.MpiImplm, expectedMPI) {
+		t.Fatalf("invalid MPI configuration: %+v (expected: %+v)", *d.MpiImplm, expectedMPI)
+	}
+	if !reflect.DeepEqual(*d.InternalEnv, buildenv.Info{InstallDir: "/opt/openmpi"}) {
+		t.Fatalf("invalid build environment: %+v", *d.InternalEnv)
+	}
+	if !reflect.DeepEqual(d.SharedMemTransports, []string{"xpmem"}) {
+		t.Fatalf("invalid shared-memory transports: %v", d.SharedMemTransports)
+	}
+
+	expectedApp := app.Info{
+		Name:       "helloworld",
+		Source:     "https://example.com/helloworld.tar.gz",
+		BinName:    "helloworld",
+		InstallCmd: "make",
+		Compiler:   app.CompilerC,
+		BuildEnv:   map[string]string{"CFLAGS": "-O2"},
+	}
+	if !reflect.DeepEqual(*a, expectedApp) {
+		t.Fatalf("invalid application configuration: %+v (expected: %+v)", *a, expectedApp)
+	}
+
+	expectedContainer := container.Config{
+		Name:                "helloworld",
+		Path:                "/tmp/sympi/helloworld.sif",
+		BuildDir:            "/tmp/sympi",
+		InstallDir:          "/tmp/sympi",
+		DefFile:             "/tmp/sympi/helloworld.def",
+		Distro:              "ubuntu:disco",
+		Model:               container.HybridModel,
+		AppExe:              "/opt/helloworld",
+		MPIDir:              "/opt/openmpi",
+		Binds:               []string{"/scratch:/scratch"},
+		ROCm:                true,
+		SharedMemTransports: []string{"xpmem"},
+		User:                "mpiuser",
+		Group:               "mpi",
+	}
+	if !reflect.DeepEqual(*c, expectedContainer) {
+		t.Fatalf("invalid container configuration: %+v (expected: %+v)", *c, expectedContainer)
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The extension selects the parser, whatever its case
+	data, err := ioutil.ReadFile("testdata/build.yaml")
+	if err != nil {
+		t.Fatalf("failed to read testdata/build.yaml: %s", err)
+	}
+	manifestPath := filepath.Join(dir, "build.YML")
+	err = ioutil.WriteFile(manifestPath, data, 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", manifestPath, err)
+	}
+	checkLoad(t, manifestPath)
+
+	// YAML manifests are validated like JSON ones
+	invalidPath := filepath.Join(dir, "invalid.yaml")
+	err = ioutil.WriteFile(invalidPath, []byte("distro: ubuntu:disco\nmodel: hybrid\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", invalidPath, err)
+	}
+	_, _, _, err = Load(invalidPath)
+	if err == nil || !strings.Contains(err.Error(), "missing required field: def_file") {
+		t.Fatalf("loading %s returned %v", invalidPath, err)
+	}
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected string
+		err      string
+	}{
+		{name: "scalars", yaml: "a: b\nc: 'it''s'\nd: \"x\\ty\"\ne: 12\nf: 1.5\ng: true\nh: ~\ni:\n", expected: `{"a":"b","c":"it's","d":"x\ty","e":12,"f":1.5,"g":true,"h":null,"i":null}`},
+		{name: "version", yaml: "version: 4.0.2\nquoted: \"4.0\"\n", expected: `{"quoted":"4.0","version":"4.0.2"}`},
+		{name: "comments", yaml: "# manifest\na: b # comment\nc: \"d # e\"\nf: g#h\n", expected: `{"a":"b","c":"d # e","f":"g#h"}`},
+		{name: "nested mappings", yaml: "---\na:\n  b:\n    c: d\n  e: f\ng: h\n", expected: `{"a":{"b":{"c":"d"},"e":"f"},"g":"h"}`},
+		{name: "sequences", yaml: "a:\n- b\n- c\nd:\n    - e\n    -\n      f: g\n", expected: `{"a":["b","c"],"d":["e",{"f":"g"}]}`},
+		{name: "sequence of mappings", yaml: "a:\n  - b: c\n    d: e\n  - b: f\n", expected: `{"a":[{"b":"c","d":"e"},{"b":"f"}]}`},
+		{name: "flow collections", yaml: "a: [b, \"c, d\", [e]]\nf: {g: h, \"i\": [j], k: http://l:8080/m}\nn: []\n", expected: `{"a":["b","c, d",["e"]],"f":{"g":"h","i":["j"],"k":"http://l:8080/m"},"n":[]}`},
+		{name: "colons in values", yaml: "binds: /scratch:/scratch\nurl: https://example.com/a\n", expected: `{"binds":"/scratch:/scratch","url":"https://example.com/a"}`},
+		{name: "duplicate key", yaml: "a: b\na: c\n", err: "line 2: duplicate key a"},
+		{name: "bad indentation", yaml: "a:\n  b: c\n    d: e\n", err: "line 3: unexpected indentation"},
+		{name: "tab indentation", yaml: "a:\n\tb: c\n", err: "line 2: tabs cannot be used"},
+		{name: "not a mapping entry", yaml: "a: b\nc\n", err: "line 2: expected \"key: value\""},
+		{name: "anchor", yaml: "a: &x b\n", err: "line 1: anchors, aliases and tags are not supported"},
+		{name: "block scalar", yaml: "a: |\n  b\n", err: "line 1: block scalars are not supported"},
+		{name: "unterminated flow", yaml: "a: [b, c\n", err: "line 1: unterminated flow"},
+		{name: "multiple documents", yaml: "a: b\n---\nc: d\n", err: "line 2: multiple documents are not supported"},
+		{name: "empty", yaml: "# nothing\n", err: "empty document"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := yamlToJSON([]byte(tt.yaml))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("converting %q returned %v (expected: %s)", tt.yaml, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to convert %q: %s", tt.yaml, err)
+			}
+			if string(data) != tt.expected {
+				t.Fatalf("%q was converted to %s instead of %s", tt.yaml, string(data), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		manifest string
+		err      string
+	}{
+		{manifest: `{"distro": "ubuntu:disco"`, err: "failed to parse"},
+		{manifest: `{"model": "hybrid"}`, err: "missing required field: distro"},
+		{manifest: `{"distro": "ubuntu:disco", "model": "hybrid", "def_file": "a.def", "image": "a.sif", "mpi": {"implementation": "openmpi", "version": "4.0.2", "url": "http://a"}, "app": {"name": "a"}}`, err: "missing required field: app.source"},
+		{manifest: `{"distro": "ubuntu:disco", "model": "foo", "def_file": "a.def", "image": "a.sif", "mpi": {"implementation": "openmpi", "version": "4.0.2", "url": "http://a"}, "app": {"name": "a", "source": "http://b"}}`, err: "unsupported model"},
+		{manifest: `{"distro": "ubuntu:disco", "model": "bind", "def_file": "a.def", "image": "a.sif", "mpi": {"implementation": "foo", "version": "4.0.2", "url": "http://a"}, "app": {"name": "a", "source": "http://b"}}`, err: "unsupported MPI implementation"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.manifest))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("parsing %s returned %v (expected: %s)", tt.manifest, err, tt.err)
+		}
+	}
+}
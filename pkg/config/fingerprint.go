@@ -0,0 +1,257 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
+	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// FingerprintLength is the number of hexadecimal characters of a fingerprint
+const FingerprintLength = 16
+
+// CanonicalForm is the canonical JSON document describing a build configuration, from which its fingerprint is computed
+type CanonicalForm []byte
+
+// String returns the canonical JSON document
+func (f CanonicalForm) String() string {
+	return string(f)
+}
+
+// canonicalMPI is the canonical form of the MPI implementation installed in the image
+type canonicalMPI struct {
+	ID       string `json:"id"`
+	Version  string `json:"version"`
+	URL      string `json:"url"`
+	Checksum string `json:"checksum,omitempty"`
+	Device   string `json:"device,omitempty"`
+	ROCm     bool   `json:"rocm,omitempty"`
+
+	// Compilers are the compilers used to configure MPI, e.g., CC=clang
+	Compilers []string `json:"compilers,omitempty"`
+
+	// ConfigureArgs are the additional arguments of configure, in order since later arguments take precedence
+	ConfigureArgs []string `json:"configure_args,omitempty"`
+}
+
+// canonicalApp is the canonical form of the application installed in the image
+type canonicalApp struct {
+	Name       string            `json:"name"`
+	Source     string            `json:"source"`
+	Exe        string            `json:"exe,omitempty"`
+	CompileCmd string            `json:"compile_cmd,omitempty"`
+	Compiler   string            `json:"compiler,omitempty"`
+	BuildEnv   map[string]string `json:"build_env,omitempty"`
+	License    string            `json:"license,omitempty"`
+	Readme     string            `json:"readme,omitempty"`
+	TestCmd    string            `json:"test_cmd,omitempty"`
+	TestRanks  int               `json:"test_ranks,omitempty"`
+}
+
+// canonicalConfig is the canonical form of a build configuration. It only includes the fields that change
+// the content of the image: local paths, timestamps and runtime options are excluded. Fields are declared
+// in a fixed order and encoding/json sorts the keys of maps so the encoding is deterministic.
+type canonicalConfig struct {
+	Distro            string              `json:"distro"`
+	Model             string              `json:"model"`
+	MPI               *canonicalMPI       `json:"mpi,omitempty"`
+	App               canonicalApp        `json:"app"`
+	SharedMem         []string            `json:"shared_mem,omitempty"`
+	User              string              `json:"user,omitempty"`
+	Group             string              `json:"group,omitempty"`
+	ExtraTags         map[string]string   `json:"extra_tags,omitempty"`
+	BuildArgs         bool                `json:"build_args,omitempty"`
+	BuildArgValues    map[string]string   `json:"build_arg_values,omitempty"`
+	BaseImage         string              `json:"base_image,omitempty"`
+	OldMPIDir         string              `json:"old_mpi_dir,omitempty"`
+	Layout            deffile.ImageLayout `json:"layout"`
+	SquashfsBlockSize int                 `json:"squashfs_block_size,omitempty"`
+	Nopriv            bool                `json:"nopriv,omitempty"`
+	MPIWrapper        bool                `json:"mpi_wrapper,omitempty"`
+	HealthCheck       string              `json:"health_check,omitempty"`
+	Interconnect      string              `json:"interconnect,omitempty"`
+	BuildJobs         int                 `json:"build_jobs,omitempty"`
+	Mirrors           []string            `json:"mirrors,omitempty"`
+	Runscript         string              `json:"runscript,omitempty"`
+	EnableTest        bool                `json:"enable_test,omitempty"`
+	Arch              string              `json:"arch"`
+	ExtraPkgs         []string            `json:"extra_pkgs,omitempty"`
+	AppTest           bool                `json:"app_test,omitempty"`
+	RepoSnapshot      string              `json:"repo_snapshot,omitempty"`
+}
+
+// normalizeVersion returns the canonical form of a version, e.g., v4.0.2 and 4.0.2 are the same version
+func normalizeVersion(version string) string {
+	return strings.TrimPrefix(strings.TrimSpace(version), "v")
+}
+
+// normalizeURL returns the canonical form of a URL. Local files are only identified by their name so
+// that the fingerprint does not depend on where the sources are stored on the host.
+func normalizeURL(u string) string {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return ""
+	}
+	if strings.HasPrefix(u, "file://") || strings.HasPrefix(u, "/") {
+		return "file://" + path.Base(strings.TrimPrefix(u, "file://"))
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	return parsed.String()
+}
+
+// baseName returns the name of a local file, an empty string if the path is not set
+func baseName(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Base(p)
+}
+
+// getCanonicalDistro returns the canonical identifier of the Linux distribution of the image
+func getCanonicalDistro(data *deffile.DefFileData, c *container.Config) string {
+	id := data.DistroID
+	if id.Name == "" && c != nil {
+		id = distro.ParseDescr(c.Distro)
+	}
+	return strings.ToLower(id.Name) + ":" + id.Version
+}
+
+// getCanonicalLayout returns the layout of the image with the default values of the fields that are not set
+func getCanonicalLayout(data *deffile.DefFileData, c *container.Config) deffile.ImageLayout {
+	l := data.Layout
+	if l.AppRoot == "" {
+		l.AppRoot = deffile.DefaultAppRoot
+	}
+	if l.MPIBuildDir == "" {
+		l.MPIBuildDir = deffile.DefaultMPIBuildDir
+	}
+	if l.ExtrasRoot == "" {
+		l.ExtrasRoot = deffile.DefaultExtrasRoot
+	}
+	if l.MPIPrefix == "" && data.InternalEnv != nil {
+		l.MPIPrefix = data.InternalEnv.InstallDir
+	}
+	if l.MPIPrefix == "" && c != nil {
+		l.MPIPrefix = c.MPIDir
+	}
+	return l
+}
+
+// getCanonicalForm converts a build configuration to its canonical form
+func getCanonicalForm(a *app.Info, data *deffile.DefFileData, c *container.Config, sysCfg *sys.Config) canonicalConfig {
+	cfg := canonicalConfig{
+		Distro:       getCanonicalDistro(data, c),
+		Model:        data.Model,
+		User:         data.User,
+		Group:        data.Group,
+		ExtraTags:    data.ExtraTags,
+		BuildArgs:    data.BuildArgs,
+		BaseImage:    baseName(data.BaseImage),
+		OldMPIDir:    data.OldMPIDir,
+		Layout:       getCanonicalLayout(data, c),
+		MPIWrapper:   data.MPIWrapper,
+		HealthCheck:  strings.TrimSpace(data.HealthCheck),
+		Interconnect: strings.ToLower(data.Interconnect),
+		AppTest:      data.AppTest,
+		Arch:         data.GetArch(),
+		EnableTest:   data.EnableTest,
+		Runscript:    strings.TrimSpace(data.Runscript),
+		Mirrors:      data.Mirrors,
+		BuildJobs:    data.BuildJobs,
+		App: canonicalApp{
+			Name:       a.Name,
+			Source:     normalizeURL(a.Source),
+			Exe:        a.BinName,
+			CompileCmd: strings.TrimSpace(a.InstallCmd),
+			Compiler:   a.Compiler,
+			BuildEnv:   a.BuildEnv,
+			License:    baseName(a.LicenseFile),
+			Readme:     baseName(a.ReadmeFile),
+			TestCmd:    strings.TrimSpace(a.TestCmd),
+			TestRanks:  a.TestRanks,
+		},
+	}
+
+	if cfg.Model == "" && c != nil {
+		cfg.Model = c.Model
+	}
+	if cfg.App.Compiler == app.CompilerAuto {
+		cfg.App.Compiler = ""
+	}
+
+	if data.MpiImplm != nil {
+		cfg.MPI = &canonicalMPI{
+			ID:            data.MpiImplm.ID,
+			Version:       normalizeVersion(data.MpiImplm.Version),
+			URL:           normalizeURL(data.MpiImplm.URL),
+			Checksum:      strings.ToLower(data.MpiImplm.Checksum),
+			Device:        data.MpiImplm.Device,
+			ROCm:          data.MpiImplm.WithROCm,
+			ConfigureArgs: data.MpiImplm.ConfigureArgs,
+		}
+		if data.InternalEnv != nil {
+			cfg.MPI.Compilers = data.InternalEnv.Compilers.GetEnv()
+		}
+	}
+
+	// The order in which the shared-memory transports are specified does not matter
+	for _, transport := range data.SharedMemTransports {
+		cfg.SharedMem = append(cfg.SharedMem, strings.ToLower(transport))
+	}
+	sort.Strings(cfg.SharedMem)
+
+	// Same for the extra packages of the Linux distribution
+	cfg.ExtraPkgs = append(cfg.ExtraPkgs, data.ExtraPkgs...)
+	sort.Strings(cfg.ExtraPkgs)
+
+	if c != nil {
+		cfg.BuildArgValues = c.BuildArgs
+		cfg.SquashfsBlockSize = c.SquashfsBlockSize
+	}
+	if sysCfg != nil {
+		cfg.Nopriv = sysCfg.Nopriv
+		cfg.RepoSnapshot = sysCfg.RepoSnapshot
+	}
+
+	return cfg
+}
+
+// Fingerprint returns a stable identifier of a build configuration, i.e., two configurations producing
+// the same image have the same fingerprint, as well as the canonical form it is computed from for
+// debugging. Local paths (definition file, image, build directories) and options that do not change
+// the content of the image are not part of the fingerprint.
+func Fingerprint(a *app.Info, data *deffile.DefFileData, c *container.Config, sysCfg *sys.Config) (string, CanonicalForm, error) {
+	if a == nil || data == nil {
+		return "", nil, fmt.Errorf("invalid parameter(s)")
+	}
+
+	canonical, err := json.Marshal(getCanonicalForm(a, data, c, sysCfg))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode the canonical form of the configuration: %s", err)
+	}
+
+	hash := sha256.Sum256(canonical)
+	return hex.EncodeToString(hash[:])[:FingerprintLength], CanonicalForm(canonical), nil
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
+	"github.com/sylabs/singularity-mpi/pkg/app"
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func loadTestConfig(t *testing.T) (*deffile.DefFileData, *app.Info, *container.Config) {
+	d, a, c, err := Load("testdata/build.json")
+	if err != nil {
+		t.Fatalf("failed to load build manifest: %s", err)
+	}
+	return d, a, c
+}
+
+func getTestFingerprint(t *testing.T, a *app.Info, d *deffile.DefFileData, c *container.Config, sysCfg *sys.Config) string {
+	id, canonical, err := Fingerprint(a, d, c, sysCfg)
+	if err != nil {
+		t.Fatalf("failed to compute fingerprint: %s", err)
+	}
+	if len(id) != FingerprintLength {
+		t.Fatalf("invalid fingerprint: %s", id)
+	}
+	if !json.Valid(canonical) {
+		t.Fatalf("invalid canonical form: %s", canonical)
+	}
+	return id
+}
+
+func TestFingerprintInvariance(t *testing.T) {
+	d, a, c := loadTestConfig(t)
+	var sysCfg sys.Config
+	reference := getTestFingerprint(t, a, d, c, &sysCfg)
+
+	// Same manifest with the fields in a different order
+	reordered := []byte(`{"group": "mpi", "user": "mpiuser", "rocm": true, "shared_mem": ["xpmem"], "binds": ["/scratch:/scratch"],
+		"app": {"build_env": {"CFLAGS": "-O2"}, "compiler": "c", "compile_cmd": "make", "exe": "helloworld", "source": "https://example.com/helloworld.tar.gz", "name": "helloworld"},
+		"mpi": {"install_dir": "/opt/openmpi", "checksum": "900bf751be72eccf06de9d186f7b1c4b5c2fa9fa66458e53b77778dffdfe4057", "url": "https://download.open-mpi.org/release/open-mpi/v4.0/openmpi-4.0.2.tar.bz2", "version": "4.0.2", "implementation": "openmpi"},
+		"image": "/tmp/sympi/helloworld.sif", "def_file": "/tmp/sympi/helloworld.def", "model": "hybrid", "distro": "ubuntu:disco"}`)
+	m, err := Parse(reordered)
+	if err != nil {
+		t.Fatalf("failed to parse reordered build manifest: %s", err)
+	}
+	d2, a2, c2 := m.toConfig()
+	if fp := getTestFingerprint(t, a2, d2, c2, &sysCfg); fp != reference {
+		t.Fatalf("fingerprint of reordered manifest is %s instead of %s", fp, reference)
+	}
+
+	tests := []struct {
+		name   string
+		update func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config)
+	}{
+		{name: "local paths", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.Path = "/home/user/build/helloworld.def"
+			c.Path = "/home/user/images/helloworld.sif"
+			c.DefFile = d.Path
+			c.BuildDir = "/home/user/build"
+			c.InstallDir = "/home/user/images"
+			a.BinPath = "/home/user/build/helloworld"
+			sysCfg.ScratchDir = "/scratch"
+			sysCfg.Persistent = "/home/user/.sympi"
+		}},
+		{name: "runtime options", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			c.Binds = []string{"/data:/data"}
+			c.Lenient = true
+			d.DownloadRetries = 10
+			sysCfg.RetryTransient = 2
+		}},
+		{name: "normalized URLs and versions", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MpiImplm.Version = "v4.0.2"
+			d.MpiImplm.URL = "HTTPS://Download.Open-MPI.org/release/open-mpi/v4.0/openmpi-4.0.2.tar.bz2"
+			a.Source = "https://EXAMPLE.com/helloworld.tar.gz/"
+		}},
+	}
+
+	for _, tt := range tests {
+		d, a, c := loadTestConfig(t)
+		var sysCfg sys.Config
+		tt.update(d, a, c, &sysCfg)
+		if fp := getTestFingerprint(t, a, d, c, &sysCfg); fp != reference {
+			t.Fatalf("%s: fingerprint is %s instead of %s", tt.name, fp, reference)
+		}
+	}
+
+	// The order of the shared-memory transports does not matter
+	d.SharedMemTransports = []string{"xpmem", "knem"}
+	expected := getTestFingerprint(t, a, d, c, &sysCfg)
+	d.SharedMemTransports = []string{"knem", "xpmem"}
+	if fp := getTestFingerprint(t, a, d, c, &sysCfg); fp != expected {
+		t.Fatalf("fingerprint depends on the order of the shared-memory transports")
+	}
+}
+
+func TestFingerprintChanges(t *testing.T) {
+	d, a, c := loadTestConfig(t)
+	reference := getTestFingerprint(t, a, d, c, nil)
+
+	tests := []struct {
+		name   string
+		update func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config)
+	}{
+		{name: "distro", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.DistroID.Version = "18.04"
+		}},
+		{name: "model", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.Model = container.BindModel
+		}},
+		{name: "MPI version", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MpiImplm.Version = "4.0.3"
+		}},
+		{name: "MPI URL", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MpiImplm.URL = "https://mirror.example.com/openmpi-4.0.2.tar.bz2"
+		}},
+		{name: "MPI checksum", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MpiImplm.Checksum = ""
+		}},
+		{name: "MPI device", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MpiImplm.Device = "ch4:ucx"
+		}},
+		{name: "ROCm", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MpiImplm.WithROCm = false
+		}},
+		{name: "MPI compilers", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.InternalEnv.Compilers.CC = "clang"
+		}},
+		{name: "MPI directory", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.InternalEnv.InstallDir = "/usr/local/mpi"
+		}},
+		{name: "application source", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			a.Source = "https://example.com/helloworld-1.1.tar.gz"
+		}},
+		{name: "application compile command", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			a.InstallCmd = "make all"
+		}},
+		{name: "application build environment", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			a.BuildEnv = map[string]string{"CFLAGS": "-O3"}
+		}},
+		{name: "application license", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			a.LicenseFile = "/home/user/helloworld/LICENSE"
+		}},
+		{name: "shared-memory transports", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.SharedMemTransports = append(d.SharedMemTransports, "knem")
+		}},
+		{name: "user", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.User = "appuser"
+		}},
+		{name: "MPI wrapper", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MPIWrapper = true
+		}},
+		{name: "layout", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.Layout.AppRoot = "/apps"
+		}},
+		{name: "build arguments", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			c.BuildArgs = map[string]string{"MPI_VERSION": "4.0.3"}
+		}},
+		{name: "squashfs block size", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			c.SquashfsBlockSize = 1048576
+		}},
+		{name: "build jobs", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.BuildJobs = 4
+		}},
+		{name: "MPI configure arguments", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.MpiImplm.ConfigureArgs = []string{"--enable-debug"}
+		}},
+		{name: "mirrors", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.Mirrors = []string{"http://mirror.example.com/ubuntu/"}
+		}},
+		{name: "runscript", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.Runscript = "exec /opt/helloworld \"$@\""
+		}},
+		{name: "test section", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.EnableTest = true
+		}},
+		{name: "architecture", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			if d.GetArch() == deffile.ArchAarch64 {
+				d.Arch = deffile.ArchX86_64
+			} else {
+				d.Arch = deffile.ArchAarch64
+			}
+		}},
+		{name: "extra packages", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.ExtraPkgs = []string{"numactl"}
+		}},
+		{name: "test suite of the application", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			d.AppTest = true
+		}},
+		{name: "test command of the application", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			a.TestCmd = "make check"
+		}},
+		{name: "number of ranks of the tests", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			a.TestRanks = 4
+		}},
+		{name: "snapshot of the repositories", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			sysCfg.RepoSnapshot = "20240101T000000Z"
+		}},
+		{name: "unprivileged build", update: func(d *deffile.DefFileData, a *app.Info, c *container.Config, sysCfg *sys.Config) {
+			sysCfg.Nopriv = true
+		}},
+	}
+
+	for _, tt := range tests {
+		d, a, c := loadTestConfig(t)
+		var sysCfg sys.Config
+		tt.update(d, a, c, &sysCfg)
+		if fp := getTestFingerprint(t, a, d, c, &sysCfg); fp == reference {
+			t.Fatalf("%s: fingerprint did not change", tt.name)
+		}
+	}
+
+	_, _, err := Fingerprint(nil, d, c, nil)
+	if err == nil {
+		t.Fatalf("fingerprint of an invalid configuration succeeded")
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a significant line of a YAML document, i.e., without comments and blank lines
+type yamlLine struct {
+	// num is the number of the line in the document, used in error messages
+	num int
+
+	// indent is the number of spaces before the content of the line
+	indent int
+
+	// content is the content of the line without indentation and comments
+	content string
+}
+
+// yamlParser parses the subset of YAML used by build manifests: block mappings and sequences,
+// flow mappings and sequences, and plain or quoted scalars. Anchors, aliases, tags, block scalars
+// and multi-document streams are not supported.
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+var (
+	yamlInt   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+// yamlToJSON converts a YAML build manifest into its JSON equivalent
+func yamlToJSON(data []byte) ([]byte, error) {
+	lines, err := splitYAMLLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty document")
+	}
+
+	p := &yamlParser{lines: lines}
+	v, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+
+	return json.Marshal(v)
+}
+
+// splitYAMLLines splits a YAML document into its significant lines
+func splitYAMLLines(doc string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, l := range strings.Split(doc, "\n") {
+		l = strings.TrimRight(stripYAMLComment(l), " \t\r")
+		content := strings.TrimLeft(l, " ")
+		if content == "" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs cannot be used for indentation", i+1)
+		}
+		if content == "---" && len(lines) == 0 {
+			continue
+		}
+		if content == "---" || content == "..." {
+			return nil, fmt.Errorf("line %d: multiple documents are not supported", i+1)
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(l) - len(content), content: content})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes the comment at the end of a line, if any
+func stripYAMLComment(l string) string {
+	var quote byte
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case (c == '"' || c == '\'') && startsYAMLToken(l[:i]):
+			quote = c
+		case c == '#' && (i == 0 || l[i-1] == ' ' || l[i-1] == '\t'):
+			return l[:i]
+		}
+	}
+	return l
+}
+
+// startsYAMLToken checks whether a character following prefix starts a new scalar
+func startsYAMLToken(prefix string) bool {
+	prefix = strings.TrimRight(prefix, " ")
+	if prefix == "" {
+		return true
+	}
+	switch prefix[len(prefix)-1] {
+	case ':', '-', '[', '{', ',':
+		return true
+	}
+	return false
+}
+
+// parseBlock parses the block mapping or sequence starting at the current line
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	l := p.lines[p.pos]
+	if l.content == "-" || strings.HasPrefix(l.content, "- ") {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(l.content); ok {
+		return p.parseMapping(indent)
+	}
+
+	// A document can be a single flow collection or scalar
+	p.pos++
+	return parseYAMLValue(l.content, l.num)
+}
+
+// parseSequence parses a block sequence whose items are at the given indentation
+func (p *yamlParser) parseSequence(indent int) ([]interface{}, error) {
+	seq := []interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		if l.content != "-" && !strings.HasPrefix(l.content, "- ") {
+			break
+		}
+
+		item := strings.TrimLeft(strings.TrimPrefix(l.content, "-"), " ")
+		if item == "" {
+			p.pos++
+			v, err := p.parseNested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		// The item is parsed as if it was on its own line, e.g., "- name: a" starts a mapping
+		// whose keys are aligned with "name"
+		p.lines[p.pos] = yamlLine{num: l.num, indent: l.indent + len(l.content) - len(item), content: item}
+		v, err := p.parseBlock(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+// parseMapping parses a block mapping whose keys are at the given indentation
+func (p *yamlParser) parseMapping(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+
+		if l.content == "-" || strings.HasPrefix(l.content, "- ") {
+			return nil, fmt.Errorf("line %d: unexpected sequence item in a mapping", l.num)
+		}
+		key, value, ok := splitYAMLKey(l.content)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\": %s", l.num, l.content)
+		}
+		if _, exists := m[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %s", l.num, key)
+		}
+		p.pos++
+
+		if value == "" {
+			// Sequences can be at the same indentation as their key
+			v, err := p.parseNested(indent, true)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+
+		v, err := parseYAMLValue(value, l.num)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// parseNested parses the block that follows a key or a sequence indicator, if any
+func (p *yamlParser) parseNested(indent int, allowSameIndentSeq bool) (interface{}, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent {
+		return p.parseBlock(next.indent)
+	}
+	if allowSameIndentSeq && next.indent == indent && (next.content == "-" || strings.HasPrefix(next.content, "- ")) {
+		return p.parseSequence(indent)
+	}
+	return nil, nil
+}
+
+// splitYAMLKey splits a "key: value" line
+func splitYAMLKey(content string) (string, string, bool) {
+	if content[0] == '"' || content[0] == '\'' {
+		end := findYAMLQuoteEnd(content)
+		if end < 0 || !strings.HasPrefix(content[end+1:], ":") {
+			return "", "", false
+		}
+		rest := content[end+2:]
+		if rest != "" && rest[0] != ' ' {
+			return "", "", false
+		}
+		key, err := unquoteYAML(content[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest), true
+	}
+	if content[0] == '[' || content[0] == '{' {
+		return "", "", false
+	}
+
+	if strings.HasSuffix(content, ":") && !strings.Contains(content, ": ") {
+		return strings.TrimSpace(strings.TrimSuffix(content, ":")), "", true
+	}
+	idx := strings.Index(content, ": ")
+	if idx < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(content[:idx]), strings.TrimSpace(content[idx+2:]), true
+}
+
+// findYAMLQuoteEnd returns the index of the quote closing the quoted scalar at the beginning of s, -1 if none
+func findYAMLQuoteEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case quote == '\'' && s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// unquoteYAML returns the value of a single- or double-quoted scalar
+func unquoteYAML(s string) (string, error) {
+	if s[0] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return strconv.Unquote(s)
+}
+
+// parseYAMLValue parses the value of a mapping entry or sequence item that is on a single line
+func parseYAMLValue(s string, num int) (interface{}, error) {
+	switch s[0] {
+	case '&', '*', '!':
+		return nil, fmt.Errorf("line %d: anchors, aliases and tags are not supported", num)
+	case '|', '>':
+		return nil, fmt.Errorf("line %d: block scalars are not supported", num)
+	}
+
+	fp := flowParser{s: s}
+	v, err := fp.parseValue()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %s", num, err)
+	}
+	fp.skipSpaces()
+	if fp.pos < len(fp.s) {
+		return nil, fmt.Errorf("line %d: unexpected content: %s", num, fp.s[fp.pos:])
+	}
+	return v, nil
+}
+
+// flowParser parses a scalar or a flow collection, e.g., [a, b] or {a: b}
+type flowParser struct {
+	s   string
+	pos int
+
+	// depth is the nesting level of flow collections, plain scalars stop at flow indicators when not 0
+	depth int
+}
+
+// skipSpaces moves the current position to the next non-space character
+func (fp *flowParser) skipSpaces() {
+	for fp.pos < len(fp.s) && fp.s[fp.pos] == ' ' {
+		fp.pos++
+	}
+}
+
+// parseValue parses the scalar or flow collection at the current position
+func (fp *flowParser) parseValue() (interface{}, error) {
+	fp.skipSpaces()
+	if fp.pos >= len(fp.s) {
+		return nil, nil
+	}
+
+	switch fp.s[fp.pos] {
+	case '[':
+		return fp.parseSequence()
+	case '{':
+		return fp.parseMapping()
+	case '"', '\'':
+		end := findYAMLQuoteEnd(fp.s[fp.pos:])
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated quoted scalar: %s", fp.s[fp.pos:])
+		}
+		str, err := unquoteYAML(fp.s[fp.pos : fp.pos+end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted scalar %s: %s", fp.s[fp.pos:fp.pos+end+1], err)
+		}
+		fp.pos += end + 1
+		return str, nil
+	}
+
+	return resolveYAMLScalar(fp.parsePlain()), nil
+}
+
+// parsePlain returns the plain scalar at the current position
+func (fp *flowParser) parsePlain() string {
+	start := fp.pos
+	if fp.depth == 0 {
+		fp.pos = len(fp.s)
+		return strings.TrimSpace(fp.s[start:])
+	}
+	for fp.pos < len(fp.s) {
+		c := fp.s[fp.pos]
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+		if c == ':' && (fp.pos+1 == len(fp.s) || fp.s[fp.pos+1] == ' ' || fp.s[fp.pos+1] == ',' || fp.s[fp.pos+1] == '}') {
+			break
+		}
+		fp.pos++
+	}
+	return strings.TrimSpace(fp.s[start:fp.pos])
+}
+
+// parseSequence parses the flow sequence at the current position
+func (fp *flowParser) parseSequence() ([]interface{}, error) {
+	fp.pos++
+	fp.depth++
+	seq := []interface{}{}
+	for {
+		fp.skipSpaces()
+		if fp.pos >= len(fp.s) {
+			return nil, fmt.Errorf("unterminated flow sequence")
+		}
+		if fp.s[fp.pos] == ']' {
+			fp.pos++
+			fp.depth--
+			return seq, nil
+		}
+		v, err := fp.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+		err = fp.parseSeparator(']')
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseMapping parses the flow mapping at the current position
+func (fp *flowParser) parseMapping() (map[string]interface{}, error) {
+	fp.pos++
+	fp.depth++
+	m := make(map[string]interface{})
+	for {
+		fp.skipSpaces()
+		if fp.pos >= len(fp.s) {
+			return nil, fmt.Errorf("unterminated flow mapping")
+		}
+		if fp.s[fp.pos] == '}' {
+			fp.pos++
+			fp.depth--
+			return m, nil
+		}
+
+		k, err := fp.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprintf("%v", k)
+		}
+		fp.skipSpaces()
+		if fp.pos >= len(fp.s) || fp.s[fp.pos] != ':' {
+			return nil, fmt.Errorf("missing value for key %s in flow mapping", key)
+		}
+		fp.pos++
+		v, err := fp.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := m[key]; exists {
+			return nil, fmt.Errorf("duplicate key %s", key)
+		}
+		m[key] = v
+		err = fp.parseSeparator('}')
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseSeparator skips the comma between two entries of a flow collection
+func (fp *flowParser) parseSeparator(end byte) error {
+	fp.skipSpaces()
+	if fp.pos >= len(fp.s) {
+		return fmt.Errorf("unterminated flow collection")
+	}
+	switch fp.s[fp.pos] {
+	case ',':
+		fp.pos++
+		return nil
+	case end:
+		return nil
+	}
+	return fmt.Errorf("unexpected character in flow collection: %c", fp.s[fp.pos])
+}
+
+// resolveYAMLScalar returns the value of a plain scalar based on the YAML core schema
+func resolveYAMLScalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if yamlInt.MatchString(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	}
+	if yamlFloat.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
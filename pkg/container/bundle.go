@@ -0,0 +1,252 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/pkg/manifest"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// BundleSummaryFile is the name of the machine-readable summary of a build bundle
+	BundleSummaryFile = "summary.json"
+
+	// BundleDefFile is the name of the definition file stored in a build bundle
+	BundleDefFile = "container.def"
+
+	// BundleCommandsFile is the name of the file listing the planned command lines
+	BundleCommandsFile = "commands.txt"
+
+	// BundleDependenciesFile is the name of the dependency report of a build bundle
+	BundleDependenciesFile = "dependencies.txt"
+
+	// BundleSchemaVersion is the version of the format of the bundle summaries we create
+	BundleSchemaVersion = 2
+
+	// legacyBundleSchemaVersion is the version assigned to bundle summaries created before the introduction of schema versions
+	legacyBundleSchemaVersion = 1
+
+	// BundleManifestName is the name of the manifest recording the hashes of the bundle's files
+	BundleManifestName = "bundle"
+)
+
+// BundleSummary is the machine-readable description of a build bundle
+type BundleSummary struct {
+	// SchemaVersion is the version of the format of the summary
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Image is the path of the image that the bundle builds
+	Image string `json:"image"`
+
+	// DefFile is the path to the definition file in the bundle
+	DefFile string `json:"deffile"`
+
+	// ExecDir is the directory from where the build command must be executed
+	ExecDir string `json:"exec_dir"`
+
+	// InstallDir is the directory where the build manifest is stored
+	InstallDir string `json:"install_dir"`
+
+	// BinPath is the path to the binary of the build command
+	BinPath string `json:"bin"`
+
+	// CmdArgs are the arguments of the build command
+	CmdArgs []string `json:"args"`
+
+	// SingularityVersion is the version of Singularity that was used to prepare the bundle
+	SingularityVersion string `json:"singularity_version"`
+
+	// BuildMode is how the image is built: sy.BuildModeDirect, sy.BuildModeFakeroot, sy.BuildModeSudo or
+	// sy.BuildModeRemote
+	BuildMode string `json:"build_mode,omitempty"`
+
+	// Labels are the labels that the image is expected to have
+	Labels map[string]string `json:"labels"`
+
+	// Environment is the environment that the image is expected to have
+	Environment []string `json:"environment"`
+
+	// Dependencies are the packages installed in the image
+	Dependencies []string `json:"dependencies"`
+}
+
+// getBundleDir returns the directory where the build bundle of a container is created
+func getBundleDir(container *Config) string {
+	if container.BundleDir != "" {
+		return container.BundleDir
+	}
+	return filepath.Join(container.BuildDir, "bundle")
+}
+
+// prepareBundle creates a bundle with everything required to build the container
+// at a later time, without actually building it
+func prepareBundle(container *Config, sysCfg *sys.Config, singularityVersion string) (string, error) {
+	bundleDir := getBundleDir(container)
+	if util.PathExists(bundleDir) {
+		return "", fmt.Errorf("bundle directory %s already exists", bundleDir)
+	}
+	err := util.DirInit(bundleDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %s", bundleDir, err)
+	}
+
+	content, err := ioutil.ReadFile(container.DefFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", container.DefFile, err)
+	}
+	defFile := filepath.Join(bundleDir, BundleDefFile)
+	err = ioutil.WriteFile(defFile, content, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s: %s", defFile, err)
+	}
+
+	// The planned command is the one the build would execute, with the build mode detected on the host
+	mode, reason := getBuildMode(container, sysCfg)
+	log.Printf("-> Image to be built in %s mode: %s", mode, reason)
+	cmd := getBuildCmdForMode(container, sysCfg, defFile, mode)
+
+	var summary BundleSummary
+	summary.Image = container.Path
+	summary.SchemaVersion = BundleSchemaVersion
+	summary.DefFile = defFile
+	summary.ExecDir = cmd.ExecDir
+	summary.InstallDir = container.InstallDir
+	summary.BinPath = cmd.BinPath
+	summary.CmdArgs = cmd.CmdArgs
+	summary.SingularityVersion = singularityVersion
+	summary.BuildMode = mode
+	if container.Content != nil {
+		summary.Labels = container.Content.Labels
+		summary.Environment = container.Content.Environment
+		summary.Dependencies = container.Content.Dependencies
+	}
+
+	commandsFile := filepath.Join(bundleDir, BundleCommandsFile)
+	err = ioutil.WriteFile(commandsFile, []byte(FormatShellCommand(append([]string{cmd.BinPath}, cmd.CmdArgs...), nil)+"\n"), 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s: %s", commandsFile, err)
+	}
+
+	depsFile := filepath.Join(bundleDir, BundleDependenciesFile)
+	err = ioutil.WriteFile(depsFile, []byte(strings.Join(summary.Dependencies, "\n")+"\n"), 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s: %s", depsFile, err)
+	}
+
+	summaryData, err := json.MarshalIndent(summary, "", "\t")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the bundle summary: %s", err)
+	}
+	summaryFile := filepath.Join(bundleDir, BundleSummaryFile)
+	err = ioutil.WriteFile(summaryFile, summaryData, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s: %s", summaryFile, err)
+	}
+
+	hashes := manifest.HashFiles([]string{defFile, commandsFile, depsFile, summaryFile})
+	err = manifest.Create(getBundleManifestPath(bundleDir), hashes)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the bundle's manifest: %s", err)
+	}
+
+	return bundleDir, nil
+}
+
+// getBundleManifestPath returns the path to the manifest of a bundle
+func getBundleManifestPath(bundleDir string) string {
+	return filepath.Join(bundleDir, BundleManifestName+".MANIFEST")
+}
+
+// GetBundleDigest returns the digest of a bundle, i.e., the SHA256 of its manifest. Since the manifest records
+// the hashes of all the files of the bundle, the digest identifies the content of the bundle that was reviewed.
+func GetBundleDigest(bundleDir string) (string, error) {
+	data, err := ioutil.ReadFile(getBundleManifestPath(bundleDir))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the manifest of bundle %s: %s", bundleDir, err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// LoadBundle checks the integrity of a bundle against its digest, as returned by GetBundleDigest when the bundle
+// was prepared, and loads its summary. The digest is recorded outside of the bundle, the manifest of the bundle
+// could otherwise be updated with the files it records.
+func LoadBundle(bundleDir string, digest string) (BundleSummary, error) {
+	var summary BundleSummary
+
+	if digest == "" {
+		return summary, fmt.Errorf("the digest of bundle %s is undefined", bundleDir)
+	}
+	manifestPath := getBundleManifestPath(bundleDir)
+	if !util.FileExists(manifestPath) {
+		return summary, fmt.Errorf("%s does not exist", manifestPath)
+	}
+	bundleDigest, err := GetBundleDigest(bundleDir)
+	if err != nil {
+		return summary, err
+	}
+	if bundleDigest != digest {
+		return summary, fmt.Errorf("digest of bundle %s is %s instead of %s", bundleDir, bundleDigest, digest)
+	}
+	err = manifest.Check(manifestPath)
+	if err != nil {
+		return summary, fmt.Errorf("bundle %s has been modified: %s", bundleDir, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(bundleDir, BundleSummaryFile))
+	if err != nil {
+		return summary, fmt.Errorf("failed to read the bundle summary: %s", err)
+	}
+	err = json.Unmarshal(data, &summary)
+	if err != nil {
+		return summary, fmt.Errorf("failed to parse the bundle summary: %s", err)
+	}
+	if summary.SchemaVersion == 0 {
+		summary.SchemaVersion = legacyBundleSchemaVersion
+	}
+	if summary.SchemaVersion > BundleSchemaVersion {
+		return summary, fmt.Errorf("unsupported bundle schema version: %d", summary.SchemaVersion)
+	}
+
+	return summary, nil
+}
+
+// ExecutePrepared builds a container from a bundle previously created in prepare-only mode, after checking the
+// bundle against its digest
+func ExecutePrepared(bundleDir string, digest string) error {
+	summary, err := LoadBundle(bundleDir, digest)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("- Creating image %s from bundle %s...", summary.Image, bundleDir)
+
+	var cmd syexec.SyCmd
+	cmd.ManifestName = "build"
+	cmd.ManifestData = []string{"Singularity version: " + summary.SingularityVersion, "Bundle: " + bundleDir, "Bundle digest: " + digest}
+	cmd.ManifestDir = summary.InstallDir
+	cmd.ManifestFileHash = []string{summary.DefFile, summary.Image}
+	cmd.ExecDir = summary.ExecDir
+	cmd.BinPath = summary.BinPath
+	cmd.CmdArgs = summary.CmdArgs
+	res := runner.Run(&cmd)
+	if res.Err != nil {
+		return fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	}
+
+	return setImageExecutable(summary.Image)
+}
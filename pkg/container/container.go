@@ -9,15 +9,18 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sympierr"
 	"github.com/sylabs/singularity-mpi/pkg/buildenv"
 	"github.com/sylabs/singularity-mpi/pkg/checker"
 	"github.com/sylabs/singularity-mpi/pkg/implem"
@@ -41,8 +44,52 @@ const (
 
 	// defaultExecArgs
 	defaultExecArgs = "--no-home"
+
+	// ibDevicesDir is the directory where the Infiniband devices are on the host
+	ibDevicesDir = "/dev/infiniband"
+
+	// CompilationStartMarker is the message that definition files display right before starting to compile software
+	CompilationStartMarker = "SYMPI: starting compilation"
+
+	// MinSquashfsBlockSize is the smallest squashfs block size accepted by mksquashfs
+	MinSquashfsBlockSize = 4096
+
+	// MaxSquashfsBlockSize is the largest squashfs block size accepted by mksquashfs
+	MaxSquashfsBlockSize = 1048576
 )
 
+// models is the list of MPI models supported for containers
+var models = []string{HybridModel, BindModel}
+
+// SupportedModels returns the list of MPI models supported for containers
+func SupportedModels() []string {
+	return append([]string{}, models...)
+}
+
+// IsSupportedModel checks whether a MPI model is supported
+func IsSupportedModel(model string) bool {
+	for _, m := range models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// runner is the component used to execute the Singularity commands
+var runner syexec.Runner = &syexec.DefaultRunner{}
+
+// SetRunner sets the component used to execute the Singularity commands and returns the previous one
+func SetRunner(r syexec.Runner) syexec.Runner {
+	previous := runner
+	runner = r
+	return previous
+}
+
+// sharedMemDevices is the list of optional devices used for intra-node communications
+// (knem, xpmem) that we bind-mount when exposing the Infiniband devices and they are available on the host
+var sharedMemDevices = []string{"/dev/knem", "/dev/xpmem"}
+
 // Config is a structure representing a container
 type Config struct {
 	// Name of the container
@@ -63,25 +110,120 @@ type Config struct {
 	// Distro is the ID of the Linux distribution to use in the container
 	Distro string
 
+	// DistroVersion is the version of the Linux distribution of the container, recorded in the Linux_version label
+	DistroVersion string
+
 	// URL is the URL of the container image to use when pulling the image from a registry
 	URL string
 
 	// Model specifies the model to follow for MPI inside the container
 	Model string
 
+	// AppName is the name of the application of the container, recorded in the Application label
+	AppName string
+
 	// AppExe is the command to start the application in the container
 	AppExe string
 
+	// AppArgs is the default set of arguments passed to the application
+	AppArgs []string
+
 	// MPIDir is the directory in the container where MPI is supposed to be installed or mounted
 	MPIDir string
 
 	// Binds is the set of bind options to use while starting the container
 	Binds []string
+
+	// ROCm specifies whether the container needs access to the AMD GPUs through ROCm
+	ROCm bool
+
+	// CUDA specifies whether the container needs access to the NVIDIA GPUs through CUDA
+	CUDA bool
+
+	// Interconnect is the interconnect the image was tuned for, recorded in the Interconnect label (optional)
+	Interconnect string
+
+	// Benchmarks is the directory of the MPI benchmarks installed in the image, recorded in the OSU_Benchmarks label (optional)
+	Benchmarks string
+
+	// LaunchCommand is the recommended command to launch the image, recorded in the Launch_command label (optional)
+	LaunchCommand string
+
+	// AppBuildGeneration is the number of times the application layer of the image was rebuilt on top of
+	// the original image, recorded in the App_build_generation label (0 for images built from scratch)
+	AppBuildGeneration int
+
+	// SharedMemTransports is the list of shared-memory transports (e.g., xpmem, knem) to setup in the image
+	SharedMemTransports []string
+
+	// User is the default user of the container (optional)
+	User string
+
+	// Group is the group of the default user of the container (optional)
+	Group string
+
+	// HealthCheck is the command checking that the container is ready, recorded in the HealthCheck label (optional)
+	HealthCheck string
+
+	// MPIWrapper specifies whether the application is started through a wrapper setting up the MPI environment
+	MPIWrapper bool
+
+	// BuildArgs are the values of the build arguments passed to Singularity when building the image (optional)
+	BuildArgs map[string]string
+
+	// BuildBinds are the directories of the host (src:dst) bound when building the image, e.g., to copy large
+	// directories without staging them (optional)
+	BuildBinds []string
+
+	// SquashfsBlockSize is the block size in bytes of the squashfs filesystem of the image; mksquashfs's default is used if not set
+	SquashfsBlockSize int
+
+	// Sandbox specifies whether the image is built as a writable sandbox, in which case Path is a directory
+	// instead of a SIF file; useful to debug the post section of definition files
+	Sandbox bool
+
+	// Remote specifies whether the image is built by a remote build service instead of on the host, e.g., when
+	// neither root nor fakeroot is available
+	Remote bool
+
+	// RemoteBuilderURL is the URL of the remote build service, the default one of Singularity if not set (optional)
+	RemoteBuilderURL string
+
+	// MetadataFormat is the version of the format of the image's metadata
+	MetadataFormat int
+
+	// Lenient specifies whether problems detected in the image after its creation are reported as warnings instead of errors
+	Lenient bool
+
+	// BundleDir is the directory where the build bundle is created in prepare-only mode
+	BundleDir string
+
+	// BundleDigest is the digest of the manifest of the build bundle created in prepare-only mode, to be passed to
+	// ExecutePrepared so that the bundle is checked against a digest recorded outside of it
+	BundleDigest string
+
+	// Content is the content of the image described by the definition file, reported in the build bundle (optional)
+	Content *ImageContent
+}
+
+// ImageContent is the content of an image as described by its definition file
+type ImageContent struct {
+	// Labels are the labels of the image
+	Labels map[string]string
+
+	// Environment is the environment of the image, as NAME=value
+	Environment []string
+
+	// Dependencies are the packages of the Linux distribution installed in the image
+	Dependencies []string
 }
 
-// Create builds a container based on a MPI configuration
-func Create(container *Config, sysCfg *sys.Config) error {
-	var err error
+// CreateWithOptions builds a container based on a MPI configuration
+func CreateWithOptions(container *Config, sysCfg *sys.Config, opts CreateOptions) error {
+	err := opts.validate(sysCfg)
+	if err != nil {
+		return fmt.Errorf("invalid options: %s", err)
+	}
 
 	// Some sanity checks
 	if container.BuildDir == "" {
@@ -95,25 +237,63 @@ func Create(container *Config, sysCfg *sys.Config) error {
 		}
 	}
 
-	// Check integrity of the installation of Singularity
-	err = sy.CheckIntegrity(sysCfg)
-	if err != nil {
-		return fmt.Errorf("Singularity installation has been compromised: %s", err)
+	// Check integrity of the installation of Singularity, which does not build the image with a remote build
+	if !container.Remote {
+		err = sy.CheckIntegrity(sysCfg)
+		if err != nil {
+			return fmt.Errorf("Singularity installation has been compromised: %s", err)
+		}
 	}
 
 	// Prepare the configuration of the container
 	if container.Name == "" {
 		container.Name = "singularity_mpi.sif"
+		if container.Sandbox {
+			container.Name = "singularity_mpi"
+		}
 	}
 
 	if container.Path == "" {
 		container.Path = filepath.Join(container.InstallDir, container.Name)
 	}
 
+	err = checkSquashfsBlockSize(container.SquashfsBlockSize)
+	if err != nil {
+		return err
+	}
+	err = checkSandbox(container, opts)
+	if err != nil {
+		return err
+	}
+	err = checkRemoteBuild(container)
+	if err != nil {
+		return err
+	}
+	if container.SquashfsBlockSize != 0 {
+		err = sy.CheckFeature(sy.FeatureMksquashfsArgs, sysCfg)
+		if err != nil {
+			return err
+		}
+	}
+	if len(container.BuildArgs) > 0 {
+		err = sy.CheckFeature(sy.FeatureBuildArgs, sysCfg)
+		if err != nil {
+			return err
+		}
+	}
+	if len(container.BuildBinds) > 0 {
+		err = sy.CheckFeature(sy.FeatureBuildBind, sysCfg)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Printf("- Creating image %s...", container.Path)
+	opts.progress("checking definition file " + container.DefFile)
 
-	// The definition file is ready so we simple build the container using the Singularity command
-	if sysCfg.Debug {
+	// The definition file is ready so we simple build the container using the Singularity command. It is always
+	// checked when preparing a bundle since the bundle is reviewed instead of the build.
+	if sysCfg.Debug || sysCfg.PrepareOnly || opts.PrepareOnly {
 		err = checker.CheckDefFile(container.DefFile)
 		if err != nil {
 			return fmt.Errorf("unable to check definition file: %s", err)
@@ -122,39 +302,303 @@ func Create(container *Config, sysCfg *sys.Config) error {
 
 	log.Printf("-> Using definition file %s", container.DefFile)
 
-	var cmd syexec.SyCmd
+	// Files that are missing on the host would only be detected late during the build
+	err = checker.CheckDefFileSources(container.DefFile, container.BuildDir)
+	if err != nil {
+		return err
+	}
+
 	singularityVersion := sy.GetVersion(sysCfg)
-	cmd.ManifestName = "build"
+	if sysCfg.PrepareOnly || opts.PrepareOnly {
+		opts.progress("preparing build bundle")
+		bundleDir, err := prepareBundle(container, sysCfg, singularityVersion)
+		if err != nil {
+			return fmt.Errorf("failed to prepare build bundle: %s", err)
+		}
+		container.BundleDir = bundleDir
+		container.BundleDigest, err = GetBundleDigest(bundleDir)
+		if err != nil {
+			return err
+		}
+		log.Printf("-> Build bundle ready in %s (digest: %s)", bundleDir, container.BundleDigest)
+		return nil
+	}
+
+	opts.progress("building image " + container.Path)
+	mode, reason := getBuildMode(container, sysCfg)
+	log.Printf("-> Building image in %s mode: %s", mode, reason)
+	cmd := getBuildCmdForMode(container, sysCfg, container.DefFile, mode)
 	cmd.ManifestData = []string{"Singularity version: " + singularityVersion}
+	if mode == sy.BuildModeRemote {
+		cmd.ManifestData = append(cmd.ManifestData, "Remote builder: "+getRemoteBuilder(container))
+	}
+	if opts.Parent != "" {
+		// The hash of the parent image is its digest, it identifies exactly what the image was built on
+		cmd.ManifestData = append(cmd.ManifestData, "Parent image: "+opts.Parent)
+		cmd.ManifestFileHash = append(cmd.ManifestFileHash, opts.Parent)
+	}
+	cmd.Timeout = opts.getCmdTimeout(cmd.Timeout)
+	res := runBuild(&cmd, sysCfg.RetryTransient)
+	if res.Err != nil {
+		return fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	}
+
+	err = setImageExecutable(container.Path)
+	if err != nil {
+		return err
+	}
+
+	opts.progress("checking image " + container.Path)
+	err = checkImage(container, sysCfg)
+	if err != nil {
+		return err
+	}
+
+	if opts.Sign {
+		opts.progress("signing image " + container.Path)
+		err = Sign(container, sysCfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sys.IsPersistent(sysCfg) {
+		err = saveDefFile(container, sysCfg)
+		if err != nil {
+			// This is not a fatal error, the image is available
+			log.Printf("failed to save the definition file of %s: %s", container.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// saveDefFile keeps a copy of the definition file used to build an image in the workspace
+func saveDefFile(container *Config, sysCfg *sys.Config) error {
+	defFilesDir := sys.GetWorkspaceDir(sysCfg.Persistent, sys.WorkspaceDefFilesDir)
+	if !util.PathExists(defFilesDir) {
+		return nil
+	}
+
+	target := filepath.Join(defFilesDir, strings.TrimSuffix(filepath.Base(container.Path), ".sif")+".def")
+	err := util.CopyFile(container.DefFile, target)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %s", container.DefFile, target, err)
+	}
+
+	return sys.UpdateWorkspaceIndex(sysCfg.Persistent)
+}
+
+// networkErrors is the list of messages that package managers (apt, yum, dnf, apk, zypper) and
+// download tools (curl, wget) print when a failure is due to the network
+var networkErrors = []string{
+	// apt
+	"Temporary failure resolving",
+	"Could not resolve",
+	"Could not connect to",
+	"Failed to fetch",
+	"Unable to connect to",
+	// yum/dnf
+	"Cannot find a valid baseurl",
+	"Curl error (6)",
+	"Curl error (7)",
+	"Curl error (28)",
+	"Cannot download repomd.xml",
+	"Failed to download metadata for repo",
+	"Errors during downloading metadata for repository",
+	// apk
+	"temporary error (try again later)",
+	"network error (check Internet connection and firewall)",
+	// zypper
+	"Download (curl) error",
+	"Valid metadata not found at specified URL",
+	// curl
+	"curl: (6)",
+	"curl: (7)",
+	"curl: (28)",
+	"curl: (35)",
+	"curl: (52)",
+	"curl: (56)",
+	// wget
+	"unable to resolve host address",
+	"failed: Connection refused",
+	"failed: Connection timed out",
+	"failed: Network is unreachable",
+	// generic
+	"Network is unreachable",
+	"Connection reset by peer",
+	"TLS handshake timeout",
+}
+
+// isTransientBuildFailure checks whether a build failed because of the network (e.g., failure to download MPI
+// or to install packages), based on the error messages of the package managers and download tools in the output
+func isTransientBuildFailure(res syexec.Result) bool {
+	if res.Err == nil {
+		return false
+	}
+	for _, msg := range networkErrors {
+		if strings.Contains(res.Stdout, msg) || strings.Contains(res.Stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// runBuild executes a build command and retries it up to retries times when it fails because of the network
+func runBuild(cmd *syexec.SyCmd, retries int) syexec.Result {
+	res := runner.Run(cmd)
+	for i := 0; i < retries && isTransientBuildFailure(res); i++ {
+		sylog.Warn("build failed because of the network, retrying (%d/%d): %s", i+1, retries, res.Err)
+		// A command cannot be executed twice so we make sure a new one is created
+		cmd.Cmd = nil
+		res = runner.Run(cmd)
+	}
+	return res
+}
+
+// getConfiguredBuildMode returns how images are built according to the configuration only
+func getConfiguredBuildMode(sysCfg *sys.Config) string {
+	if sysCfg.Nopriv {
+		return sy.BuildModeFakeroot
+	}
+	if sy.IsSudoCmd("build", sysCfg) {
+		return sy.BuildModeSudo
+	}
+	return sy.BuildModeDirect
+}
+
+// getBuildMode returns how an image is built and why: remote builds are requested by the configuration of the
+// container, the other modes depend on the host
+func getBuildMode(container *Config, sysCfg *sys.Config) (string, string) {
+	if container.Remote {
+		return sy.BuildModeRemote, "remote build is requested by the configuration of the image"
+	}
+	return sy.GetBuildMode(sysCfg)
+}
+
+// getBuildCmd returns the command to build a container from a given definition file, as specified by the configuration
+func getBuildCmd(container *Config, sysCfg *sys.Config, defFile string) syexec.SyCmd {
+	mode := getConfiguredBuildMode(sysCfg)
+	if container.Remote {
+		mode = sy.BuildModeRemote
+	}
+	return getBuildCmdForMode(container, sysCfg, defFile, mode)
+}
+
+// getBuildCmdForMode returns the command to build a container from a given definition file with a given build
+// mode (sy.BuildModeDirect, sy.BuildModeFakeroot, sy.BuildModeSudo or sy.BuildModeRemote)
+func getBuildCmdForMode(container *Config, sysCfg *sys.Config, defFile string, mode string) syexec.SyCmd {
+	var cmd syexec.SyCmd
+	cmd.ManifestName = "build"
 	cmd.ManifestDir = container.InstallDir
-	cmd.ManifestFileHash = []string{container.DefFile, container.Path}
+	cmd.ManifestFileHash = []string{defFile}
+	if !container.Sandbox {
+		// Sandboxes are directories, they cannot be hashed
+		cmd.ManifestFileHash = append(cmd.ManifestFileHash, container.Path)
+	}
 	cmd.ExecDir = container.BuildDir
-	if sysCfg.Nopriv {
+	var buildArgs []string
+	if container.Sandbox {
+		buildArgs = append(buildArgs, "--sandbox")
+	}
+	buildArgs = append(buildArgs, getBuildArgFlags(container)...)
+	buildArgs = append(buildArgs, getBuildBindFlags(container)...)
+	buildArgs = append(buildArgs, getSquashfsFlags(container)...)
+	buildArgs = append(buildArgs, container.Path, defFile)
+	switch mode {
+	case sy.BuildModeRemote:
 		cmd.BinPath = sysCfg.SingularityBin
-		cmd.CmdArgs = []string{"build", "--fakeroot", container.Path, container.DefFile}
-	} else if sy.IsSudoCmd("build", sysCfg) {
+		cmd.CmdArgs = getSyArgs("build", append(getRemoteBuildFlags(container), buildArgs...), sysCfg)
+	case sy.BuildModeFakeroot:
+		cmd.BinPath = sysCfg.SingularityBin
+		cmd.CmdArgs = getSyArgs("build", append([]string{"--fakeroot"}, buildArgs...), sysCfg)
+	case sy.BuildModeSudo:
 		cmd.BinPath = sysCfg.SudoBin
 		cmd.ManifestFileHash = append(cmd.ManifestFileHash, sysCfg.SingularityBin)
-		cmd.CmdArgs = []string{sysCfg.SingularityBin, "build", container.Path, container.DefFile}
-	} else {
+		cmd.CmdArgs = append([]string{sysCfg.SingularityBin}, getSyArgs("build", buildArgs, sysCfg)...)
+	default:
 		cmd.BinPath = sysCfg.SingularityBin
-		cmd.CmdArgs = []string{"build", container.Path, container.DefFile}
+		cmd.CmdArgs = getSyArgs("build", buildArgs, sysCfg)
 	}
-	res := cmd.Run()
-	if res.Err != nil {
-		return fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	return cmd
+}
+
+// getBuildArgFlags returns the --build-arg flags for the build arguments of a container, sorted by name
+func getBuildArgFlags(container *Config) []string {
+	var names []string
+	for name := range container.BuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var flags []string
+	for _, name := range names {
+		flags = append(flags, "--build-arg", name+"="+container.BuildArgs[name])
+	}
+	return flags
+}
+
+// getBuildBindFlags returns the --bind flags for the directories bound when building a container
+func getBuildBindFlags(container *Config) []string {
+	var flags []string
+	for _, bind := range container.BuildBinds {
+		flags = append(flags, "--bind", bind)
+	}
+	return flags
+}
+
+// checkSquashfsBlockSize checks that a squashfs block size is accepted by mksquashfs, i.e., a power of two
+// between MinSquashfsBlockSize and MaxSquashfsBlockSize; 0 means that the default block size is used
+func checkSquashfsBlockSize(size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < MinSquashfsBlockSize || size > MaxSquashfsBlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("invalid squashfs block size %d: must be a power of two between %d and %d", size, MinSquashfsBlockSize, MaxSquashfsBlockSize)
+	}
+	return nil
+}
+
+// checkSandbox checks that the options of a build are compatible with a sandbox: sandboxes are directories, they
+// can neither be signed nor use squashfs
+func checkSandbox(container *Config, opts CreateOptions) error {
+	if !container.Sandbox {
+		return nil
+	}
+	if opts.Sign {
+		return fmt.Errorf("sandbox %s cannot be signed", container.Path)
+	}
+	if container.SquashfsBlockSize != 0 {
+		return fmt.Errorf("squashfs options do not apply to sandbox %s", container.Path)
+	}
+	return nil
+}
+
+// getSquashfsFlags returns the flags passing the squashfs options of a container to mksquashfs
+func getSquashfsFlags(container *Config) []string {
+	if container.SquashfsBlockSize == 0 {
+		return nil
+	}
+	return []string{"--mksquashfs-args", "-b " + strconv.Itoa(container.SquashfsBlockSize)}
+}
+
+// setImageExecutable makes a SIF file executable, sandboxes are directories and are left untouched
+func setImageExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		return nil
 	}
 
 	// We make all SIF file executable to make it easier to integrate with other tools
 	// such as PRRTE.
-	f, err := os.Open(container.Path)
+	f, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to open %s", container.Path)
+		return fmt.Errorf("failed to open %s", path)
 	}
 	defer f.Close()
 	err = f.Chmod(0755)
 	if err != nil {
-		return fmt.Errorf("failed to change %s mode", container.Path)
+		return fmt.Errorf("failed to change %s mode", path)
 	}
 
 	return nil
@@ -187,18 +631,48 @@ func PullContainerImage(cfg *Config, mpiImplm *implem.Info, sysCfg *sys.Config,
 	log.Println("-> MPI version:", mpiImplm.Version)
 	log.Println("-> Image URL:", cfg.URL)
 
+	exists, err := remoteImageExists(cfg.URL, sysCfg)
+	if err != nil {
+		sylog.Warn("unable to check whether %s exists: %s", cfg.URL, err)
+	} else if !exists {
+		return fmt.Errorf("image not found at %s", cfg.URL)
+	}
+
 	err = Pull(cfg, sysCfg)
 	if err != nil {
 		return fmt.Errorf("failed to pull image: %s", err)
 	}
 
+	return checkPulledImage(cfg, mpiImplm, sysCfg)
+}
+
+// checkPulledImage makes sure that a pulled image provides the requested MPI, errors are only reported as
+// warnings in lenient mode
+func checkPulledImage(cfg *Config, mpiImplm *implem.Info, sysCfg *sys.Config) error {
+	metadata, imageMPI, err := inspectImage(cfg.Path, sysCfg)
+	if err == nil {
+		err = CheckMPI(&metadata, &imageMPI, mpiImplm)
+	} else {
+		err = fmt.Errorf("failed to get the metadata of %s: %s", cfg.Path, err)
+	}
+	if err != nil {
+		if !cfg.Lenient {
+			return err
+		}
+		sylog.Warn("%s", err)
+	}
 	return nil
 }
 
-// Pull retieves an image from the registry
-func Pull(containerInfo *Config, sysCfg *sys.Config) error {
+// PullWithOptions retieves an image from the registry
+func PullWithOptions(containerInfo *Config, sysCfg *sys.Config, opts PullOptions) error {
 	var stdout, stderr bytes.Buffer
 
+	err := opts.validate()
+	if err != nil {
+		return fmt.Errorf("invalid options: %s", err)
+	}
+
 	log.Printf("* Singularity binary: %s\n", sysCfg.SingularityBin)
 	log.Printf("* Container path: %s\n", containerInfo.Path)
 	log.Printf("* Image URL: %s\n", containerInfo.URL)
@@ -210,20 +684,25 @@ func Pull(containerInfo *Config, sysCfg *sys.Config) error {
 	}
 
 	// Check integrity of the installation of Singularity
-	err := sy.CheckIntegrity(sysCfg)
+	err = sy.CheckIntegrity(sysCfg)
 	if err != nil {
 		return fmt.Errorf("Singularity installation has been compromised: %s", err)
 	}
 
-	if sysCfg.Persistent != "" && util.PathExists(containerInfo.Path) {
+	if sysCfg.Persistent != "" && util.PathExists(containerInfo.Path) && !opts.Force {
 		log.Printf("* Persistent mode, %s already available, skipping...", containerInfo.Path)
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*2*time.Minute)
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = sys.CmdTimeout * 2 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, sysCfg.SingularityBin, "pull", containerInfo.Path, containerInfo.URL)
+	opts.progress("pulling image " + containerInfo.URL)
+	cmd := exec.CommandContext(ctx, sysCfg.SingularityBin, getPullArgs(containerInfo, sysCfg, opts)...)
 	cmd.Dir = containerInfo.BuildDir
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
@@ -235,10 +714,44 @@ func Pull(containerInfo *Config, sysCfg *sys.Config) error {
 	return nil
 }
 
+// getPullArgs returns the arguments of singularity to pull an image
+func getPullArgs(containerInfo *Config, sysCfg *sys.Config, opts PullOptions) []string {
+	var args []string
+	if opts.Force {
+		args = append(args, "--force")
+	}
+	args = append(args, containerInfo.Path, containerInfo.URL)
+	return getSyArgs("pull", args, sysCfg)
+}
+
+// DefaultSignTimeout is the maximum time the signature of an image can take when sys.Config.SignTimeout is not set
+var DefaultSignTimeout = sys.CmdTimeout * 2 * time.Minute
+
 // Sign signs a given image
 func Sign(container *Config, sysCfg *sys.Config) error {
-	var stdout, stderr bytes.Buffer
+	timeout := sysCfg.SignTimeout
+	if timeout == 0 {
+		timeout = DefaultSignTimeout
+	}
+	return SignWithTimeout(container, sysCfg, timeout)
+}
 
+// getPassphraseEnvVar returns the environment variable used by the installation of Singularity to get the
+// passphrase of the signing key, an empty string if the passphrase can only be provided on stdin
+func getPassphraseEnvVar(sysCfg *sys.Config) string {
+	caps, err := sy.ProbeSubcommands(sysCfg)
+	if err != nil {
+		log.Printf("-> Unable to detect how to provide the passphrase of the key non-interactively: %s", err)
+		return ""
+	}
+	return caps.GetEnvVar(sy.FeatureKeyPassphraseEnv)
+}
+
+// SignWithTimeout signs a given image, failing if the signature takes more than timeout.
+// The passphrase of the key is provided through the environment when the version of Singularity
+// supports it, otherwise on stdin; if Singularity asks for it again, the passphrase is wrong and
+// ErrBadPassphrase is returned right away.
+func SignWithTimeout(container *Config, sysCfg *sys.Config, timeout time.Duration) error {
 	// Check integrity of the installation of Singularity
 	err := sy.CheckIntegrity(sysCfg)
 	if err != nil {
@@ -246,7 +759,7 @@ func Sign(container *Config, sysCfg *sys.Config) error {
 	}
 
 	log.Printf("-> Signing container (%s)", container.Path)
-	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*2*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	indexIdx := "0"
@@ -254,32 +767,34 @@ func Sign(container *Config, sysCfg *sys.Config) error {
 		indexIdx = os.Getenv(KeyIndexEnvVar)
 	}
 
-	var cmd *exec.Cmd
-	if sy.IsSudoCmd("sign", sysCfg) {
-		cmd = exec.CommandContext(ctx, sysCfg.SudoBin, sysCfg.SingularityBin, "sign", "--keyidx", indexIdx, container.Path)
+	// The command is created here since the passphrase is provided on stdin and the output watched while it runs
+	cmd := getSyCmd("sign", []string{"--keyidx", indexIdx, container.Path}, sysCfg)
+	cmd.ExecDir = container.BuildDir
+	cmd.Cmd = exec.CommandContext(ctx, cmd.BinPath, cmd.CmdArgs...)
+
+	passphrase := os.Getenv(KeyPassphrase)
+	maxPrompts := 1
+	envVar := getPassphraseEnvVar(sysCfg)
+	if envVar != "" {
+		// stdin is left empty and any prompt means that the passphrase was rejected
+		cmd.Cmd.Env = append(os.Environ(), envVar+"="+passphrase)
+		maxPrompts = 0
 	} else {
-		cmd = exec.CommandContext(ctx, sysCfg.SingularityBin, "sign", "--keyidx", indexIdx, container.Path)
+		cmd.Cmd.Stdin = strings.NewReader(passphrase + "\n")
 	}
-
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Fatal(err)
+	watcher := newPromptWatcher(cancel, maxPrompts)
+	cmd.Cmd.Dir = container.BuildDir
+	cmd.Cmd.Stdout = watcher
+	cmd.Cmd.Stderr = watcher
+	err = runner.Run(&cmd).Err
+	if watcher.reprompted() {
+		return sympierr.ErrBadPassphrase
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("signature of %s timed out after %s - output: %s", container.Path, timeout, watcher.String())
 	}
-
-	go func() {
-		defer stdin.Close()
-		passphrase := os.Getenv(KeyPassphrase)
-		_, err := io.WriteString(stdin, passphrase)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-	cmd.Dir = container.BuildDir
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
 	if err != nil {
-		return fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", stdout.String(), stderr.String(), err)
+		return fmt.Errorf("failed to execute command - output: %s; err: %s", watcher.String(), err)
 	}
 
 	return nil
@@ -287,32 +802,58 @@ func Sign(container *Config, sysCfg *sys.Config) error {
 
 // Upload uploads an image to a registry
 func Upload(containerInfo *Config, sysCfg *sys.Config) error {
-	var stdout, stderr bytes.Buffer
-
 	err := sy.CheckIntegrity(sysCfg)
 	if err != nil {
 		return fmt.Errorf("Singularity installation has been compromised: %s", err)
 	}
 
 	log.Printf("-> Uploading container %s to %s", containerInfo.Path, sysCfg.Registry)
-	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*2*time.Minute)
-	defer cancel()
+	cmd := getSyCmd("push", []string{containerInfo.Path, sysCfg.Registry}, sysCfg)
+	cmd.ExecDir = containerInfo.BuildDir
+	cmd.Timeout = sys.CmdTimeout * 2
+	res := runner.Run(&cmd)
+	if res.Err != nil {
+		return fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	}
 
-	var cmd *exec.Cmd
-	if sy.IsSudoCmd("push", sysCfg) {
-		cmd = exec.CommandContext(ctx, sysCfg.SudoBin, sysCfg.SingularityBin, "push", containerInfo.Path, sysCfg.Registry)
-	} else {
-		cmd = exec.CommandContext(ctx, sysCfg.SingularityBin, "push", containerInfo.Path, sysCfg.Registry)
+	return nil
+}
+
+// ExecWithOptions executes the application of a container without a job manager and returns its output
+func ExecWithOptions(c *Config, hostMPI *implem.Info, hostEnv *buildenv.Info, sysCfg *sys.Config, opts ExecOptions) (string, error) {
+	if c.Path == "" || c.AppExe == "" {
+		return "", fmt.Errorf("undefined container image or application")
 	}
-	cmd.Dir = containerInfo.BuildDir
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+
+	err := opts.validate()
 	if err != nil {
-		return fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", stdout.String(), stderr.String(), err)
+		return "", fmt.Errorf("invalid options: %s", err)
+	}
+	err = checkBinds(hostEnv, c)
+	if err != nil {
+		return "", fmt.Errorf("invalid binds: %s", err)
+	}
+	err = CheckInterconnect(c, sysCfg)
+	if err != nil {
+		sylog.Warn("%s", err)
 	}
 
-	return nil
+	argv := BuildExecCommand(hostMPI, hostEnv, c, sysCfg)
+	var cmd syexec.SyCmd
+	cmd.BinPath = argv[0]
+	cmd.CmdArgs = append(argv[1:], opts.Args...)
+	cmd.ExecDir = c.BuildDir
+	if opts.WorkDir != "" {
+		cmd.ExecDir = opts.WorkDir
+	}
+	cmd.Timeout = opts.getCmdTimeout(cmd.Timeout)
+	opts.progress("executing " + c.AppExe + " from " + c.Path)
+	res := runner.Run(&cmd)
+	if res.Err != nil {
+		return "", fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	}
+
+	return res.Stdout, nil
 }
 
 // GetContainerDefaultName returns the default name for any container based on the configuration details
@@ -320,69 +861,157 @@ func GetContainerDefaultName(distro string, mpiID string, mpiVersion string, app
 	return strings.Replace(distro, ":", "-", -1) + "-" + mpiID + "-" + mpiVersion + "-" + appName + "-" + model
 }
 
-func parseInspectOutput(output string) (Config, implem.Info) {
-	var cfg Config
-	var mpiCfg implem.Info
+// GetMetadata inspects the container's image and gathers all the available metadata
+func GetMetadata(imgPath string, sysCfg *sys.Config) (Config, implem.Info, error) {
+	err := sy.CheckIntegrity(sysCfg)
+	if err != nil {
+		return Config{}, implem.Info{}, fmt.Errorf("Singularity installation has been compromised: %s", err)
+	}
 
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "MPI_Implementation: ") {
-			mpiCfg.ID = strings.Replace(line, "MPI_Implementation: ", "", -1)
-		}
-		if strings.Contains(line, "MPI_Version: ") {
-			mpiCfg.Version = strings.Replace(line, "MPI_Version: ", "", -1)
-		}
-		if strings.Contains(line, "Model: ") {
-			cfg.Model = strings.Replace(line, "Model: ", "", -1)
-		}
-		if strings.Contains(line, "Linux_version: ") {
-			cfg.Distro = strings.Replace(line, "Linux_version: ", "", -1)
-		}
-		if strings.Contains(line, "App_exe: ") {
-			cfg.AppExe = strings.Replace(line, "App_exe: ", "", -1)
-		}
-		if strings.Contains(line, "MPI_Directory: ") {
-			cfg.MPIDir = strings.Replace(line, "MPI_Directory: ", "", -1)
-		}
+	return inspectImage(imgPath, sysCfg)
+}
+
+// getSyArgs returns the arguments of singularity to execute a Singularity command: the global flags of the
+// configuration, which Singularity expects before the command, the command and its arguments
+func getSyArgs(syCmd string, args []string, sysCfg *sys.Config) []string {
+	syArgs := append([]string{}, sysCfg.GlobalSingularityFlags...)
+	syArgs = append(syArgs, syCmd)
+	return append(syArgs, args...)
+}
+
+// getSyCmd returns the command to execute a Singularity command, using sudo when required
+func getSyCmd(syCmd string, args []string, sysCfg *sys.Config) syexec.SyCmd {
+	var cmd syexec.SyCmd
+	if sy.IsSudoCmd(syCmd, sysCfg) {
+		cmd.BinPath = sysCfg.SudoBin
+		cmd.CmdArgs = append([]string{sysCfg.SingularityBin}, getSyArgs(syCmd, args, sysCfg)...)
+	} else {
+		cmd.BinPath = sysCfg.SingularityBin
+		cmd.CmdArgs = getSyArgs(syCmd, args, sysCfg)
+	}
+	return cmd
+}
+
+// runInspect runs 'singularity inspect' on an image and returns its output, in JSON format unless the
+// version of Singularity does not support it, in which case the free-text output is returned
+func runInspect(imgPath string, sysCfg *sys.Config) (string, error) {
+	args := []string{"--json", imgPath}
+	err := sy.CheckFeature(sy.FeatureInspectJSON, sysCfg)
+	if err != nil {
+		log.Printf("-> %s, inspecting %s in the text format", err, imgPath)
+		args = []string{imgPath}
+	}
+
+	cmd := getSyCmd("inspect", args, sysCfg)
+	cmd.Timeout = sys.CmdTimeout * 2
+	res := runner.Run(&cmd)
+	if res.Err != nil {
+		return "", fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	}
+	return res.Stdout, nil
+}
+
+// GetLabels returns all the labels of an image
+func GetLabels(imgPath string, sysCfg *sys.Config) (map[string]string, error) {
+	output, err := runInspect(imgPath, sysCfg)
+	if err != nil {
+		return nil, err
 	}
 
-	return cfg, mpiCfg
+	labels, err := parseLabels(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the labels of %s: %s", imgPath, err)
+	}
+	return labels, nil
 }
 
-// GetMetadata inspects the container's image and gathers all the available metadata
-func GetMetadata(imgPath string, sysCfg *sys.Config) (Config, implem.Info, error) {
-	var metadata Config
-	var mpiCfg implem.Info
+// Verify checks the signature of an image
+func Verify(imgPath string, sysCfg *sys.Config) error {
+	return VerifyWithOptions(imgPath, sysCfg, VerifyOptions{})
+}
 
-	err := sy.CheckIntegrity(sysCfg)
+// VerifyWithOptions checks the signature of an image and, if a fingerprint is given, that the image is signed by
+// the corresponding key of the local keyring.
+func VerifyWithOptions(imgPath string, sysCfg *sys.Config, opts VerifyOptions) error {
+	err := opts.validate()
 	if err != nil {
-		return metadata, mpiCfg, fmt.Errorf("Singularity installation has been compromised: %s", err)
+		return fmt.Errorf("invalid options: %s", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*2*time.Minute)
-	defer cancel()
+	var args []string
+	if opts.Fingerprint != "" {
+		args = append(args, "--local")
+	}
+	args = append(args, imgPath)
+	cmd := getSyCmd("verify", args, sysCfg)
+	cmd.Timeout = sys.CmdTimeout * 2
+	res := runner.Run(&cmd)
+	if res.Err != nil {
+		if isUnsigned(res.Stdout + res.Stderr) {
+			return fmt.Errorf("%s is not signed - stderr: %s", imgPath, res.Stderr)
+		}
+		return fmt.Errorf("failed to verify %s - stdout: %s; stderr: %s; err: %s", imgPath, res.Stdout, res.Stderr, res.Err)
+	}
 
-	var stdout, stderr bytes.Buffer
-	var cmd *exec.Cmd
-	if sy.IsSudoCmd("inspect", sysCfg) {
-		log.Printf("Executing %s %s inspect %s\n", sysCfg.SudoBin, sysCfg.SingularityBin, imgPath)
-		cmd = exec.CommandContext(ctx, sysCfg.SudoBin, sysCfg.SingularityBin, "inspect", imgPath)
-	} else {
-		log.Printf("Executing %s inspect %s\n", sysCfg.SingularityBin, imgPath)
-		cmd = exec.CommandContext(ctx, sysCfg.SingularityBin, "inspect", imgPath)
+	if opts.Fingerprint != "" && !isSignedBy(res.Stdout+res.Stderr, opts.Fingerprint) {
+		return fmt.Errorf("%s is not signed by the key %s - stdout: %s; stderr: %s", imgPath, opts.Fingerprint, res.Stdout, res.Stderr)
 	}
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+	return nil
+}
+
+// inspectImage gathers the metadata of an image using 'singularity inspect'
+func inspectImage(imgPath string, sysCfg *sys.Config) (Config, implem.Info, error) {
+	output, err := runInspect(imgPath, sysCfg)
 	if err != nil {
-		return metadata, mpiCfg, fmt.Errorf("failed to execute command - stdout: %s; stderr: %s; err: %s", stdout.String(), stderr.String(), err)
+		return Config{}, implem.Info{}, err
 	}
 
-	metadata, mpiCfg = parseInspectOutput(stdout.String())
+	metadata, mpiCfg, err := parseInspectOutput(output)
+	if err != nil {
+		return Config{}, implem.Info{}, fmt.Errorf("failed to parse the metadata of %s: %s", imgPath, err)
+	}
 	metadata.Path = imgPath
 	return metadata, mpiCfg, nil
 }
 
+// checkAppExe checks that the executable specified by the App_exe label of an image is actually in the image
+func checkAppExe(imgPath string, sysCfg *sys.Config) error {
+	metadata, _, err := inspectImage(imgPath, sysCfg)
+	if err != nil {
+		return fmt.Errorf("failed to get the metadata of %s: %s", imgPath, err)
+	}
+	if metadata.AppExe == "" {
+		// The image does not include any application
+		return nil
+	}
+
+	var execArgs []string
+	if sysCfg.Nopriv {
+		execArgs = append(execArgs, "-u")
+	}
+	cmd := getSyCmd("exec", append(execArgs, imgPath, "test", "-x", metadata.AppExe), sysCfg)
+	res := runner.Run(&cmd)
+	if res.Err == nil {
+		return nil
+	}
+
+	lsCmd := getSyCmd("exec", append(execArgs, imgPath, "ls", "-l", "/opt"), sysCfg)
+	lsRes := runner.Run(&lsCmd)
+	return fmt.Errorf("%s is not an executable in %s; content of /opt:\n%s", metadata.AppExe, imgPath, lsRes.Stdout)
+}
+
+// checkImage makes sure that a newly created image can be used, errors are only reported as warnings in lenient mode
+func checkImage(container *Config, sysCfg *sys.Config) error {
+	err := checkAppExe(container.Path, sysCfg)
+	if err != nil {
+		if !container.Lenient {
+			return err
+		}
+		sylog.Warn("%s", err)
+	}
+	return nil
+}
+
 func getDefaultExecArgs() []string {
 	args := []string{"exec"}
 	args = append(args, strings.Split(defaultExecArgs, " ")...)
@@ -395,12 +1024,84 @@ func getMPIBindArguments(hostMPI *implem.Info, hostBuildenv *buildenv.Info, c *C
 
 	if c.Model == BindModel {
 		if c.MPIDir == "" {
-			log.Println("[WARN] the path to mount MPI in the container is undefined")
+			sylog.Warn("the path to mount MPI in the container is undefined")
 		}
 		bindStr := hostBuildenv.InstallDir + ":" + c.MPIDir
 		bindArgs = append(bindArgs, bindStr)
 	}
 
+	if hostBuildenv != nil {
+		for _, b := range hostBuildenv.Binds {
+			bindArgs = append(bindArgs, b.String())
+		}
+	}
+
+	return bindArgs
+}
+
+// checkBinds checks that the additional binds of the host environment are valid and do not target the same directory
+func checkBinds(hostBuildenv *buildenv.Info, c *Config) error {
+	if hostBuildenv == nil {
+		return nil
+	}
+
+	targets := make(map[string]bool)
+	if c.Model == BindModel && c.MPIDir != "" {
+		targets[filepath.Clean(c.MPIDir)] = true
+	}
+	for _, b := range hostBuildenv.Binds {
+		if b.Source == "" {
+			return fmt.Errorf("bind without source directory")
+		}
+		target := filepath.Clean(b.GetTarget())
+		if !filepath.IsAbs(target) {
+			return fmt.Errorf("invalid bind target %s: must be an absolute path", target)
+		}
+		if targets[target] {
+			return fmt.Errorf("%s is the target of multiple binds", target)
+		}
+		targets[target] = true
+	}
+	return nil
+}
+
+// GetBindEnv returns the environment variables (KEY=value) setting PATH and LD_LIBRARY_PATH in the container for
+// the additional binds of the host environment, in the order of the binds. The MPI directory of the image keeps
+// precedence since the environment of the image is set after the variables passed by Singularity.
+func GetBindEnv(hostBuildenv *buildenv.Info) []string {
+	if hostBuildenv == nil {
+		return nil
+	}
+
+	var paths, libPaths []string
+	for _, b := range hostBuildenv.Binds {
+		if !b.Paths {
+			continue
+		}
+		paths = append(paths, filepath.Join(b.GetTarget(), "bin"))
+		libPaths = append(libPaths, filepath.Join(b.GetTarget(), "lib"))
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return []string{
+		"SINGULARITYENV_PREPEND_PATH=" + strings.Join(paths, ":"),
+		"SINGULARITYENV_LD_LIBRARY_PATH=" + strings.Join(libPaths, ":"),
+	}
+}
+
+func getDeviceBindArguments(sysCfg *sys.Config) []string {
+	var bindArgs []string
+
+	if sysCfg.ExposeIBDevices {
+		bindArgs = append(bindArgs, ibDevicesDir)
+		for _, dev := range sharedMemDevices {
+			if util.PathExists(dev) {
+				bindArgs = append(bindArgs, dev)
+			}
+		}
+	}
+
 	return bindArgs
 }
 
@@ -410,15 +1111,42 @@ func GetMPIExecCfg(myHostMPICfg *implem.Info, hostBuildEnv *buildenv.Info, syCon
 	if sysCfg.Nopriv {
 		args = append(args, "-u")
 	}
+	if syContainer.ROCm {
+		args = append(args, "--rocm")
+	}
+	err := checkBinds(hostBuildEnv, syContainer)
+	if err != nil {
+		sylog.Warn("invalid binds: %s", err)
+	}
 	bindArgs := getMPIBindArguments(myHostMPICfg, hostBuildEnv, syContainer)
+	bindArgs = append(bindArgs, getDeviceBindArguments(sysCfg)...)
 	if len(bindArgs) > 0 {
-		args = append(args, "--bind")
-		args = append(args, bindArgs...)
+		args = append(args, "--bind", strings.Join(bindArgs, ","))
 	}
 	log.Printf("-> Exec args to use: %s\n", strings.Join(args, " "))
 	return args
 }
 
+// BuildExecCommand returns the complete command (binary and arguments) to execute the application of a container
+func BuildExecCommand(myHostMPICfg *implem.Info, hostBuildEnv *buildenv.Info, syContainer *Config, sysCfg *sys.Config) []string {
+	singularityBin := sysCfg.SingularityBin
+	if singularityBin == "" {
+		singularityBin = "singularity"
+	}
+
+	var cmd []string
+	if sy.IsSudoCmd("exec", sysCfg) {
+		cmd = append(cmd, sysCfg.SudoBin)
+	}
+	cmd = append(cmd, singularityBin)
+	cmd = append(cmd, sysCfg.GlobalSingularityFlags...)
+	cmd = append(cmd, GetMPIExecCfg(myHostMPICfg, hostBuildEnv, syContainer, sysCfg)...)
+	cmd = append(cmd, syContainer.Path, syContainer.AppExe)
+	cmd = append(cmd, syContainer.AppArgs...)
+
+	return cmd
+}
+
 // GetDefaultExecCfg returns the default way to run a container
 func GetDefaultExecCfg() []string {
 	args := getDefaultExecArgs()
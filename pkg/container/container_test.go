@@ -0,0 +1,1356 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sympierr"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/manifest"
+	"github.com/sylabs/singularity-mpi/pkg/sy"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+func TestGetMPIExecCfgIBDevices(t *testing.T) {
+	var sysCfg sys.Config
+	var hostMPI implem.Info
+	var hostEnv buildenv.Info
+	var c Config
+
+	c.Model = HybridModel
+
+	args := GetMPIExecCfg(&hostMPI, &hostEnv, &c, &sysCfg)
+	if strings.Contains(strings.Join(args, " "), ibDevicesDir) {
+		t.Fatalf("Infiniband devices are bound while not requested: %s", strings.Join(args, " "))
+	}
+
+	sysCfg.ExposeIBDevices = true
+	args = GetMPIExecCfg(&hostMPI, &hostEnv, &c, &sysCfg)
+	if len(args) < 2 || args[len(args)-2] != "--bind" || !strings.HasPrefix(args[len(args)-1], ibDevicesDir) {
+		t.Fatalf("Infiniband devices are not bound: %s", strings.Join(args, " "))
+	}
+}
+
+func TestPrepareBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var c Config
+	c.BuildDir = dir
+	c.InstallDir = dir
+	c.Path = filepath.Join(dir, "test.sif")
+	c.DefFile = filepath.Join(dir, "test.def")
+	c.Content = &ImageContent{
+		Labels:       map[string]string{"MPI_Implementation": "openmpi", "MPI_Version": "3.1.4"},
+		Environment:  []string{"MPI_DIR=/opt/mpi"},
+		Dependencies: []string{"wget", "gcc"},
+	}
+	defContent := "Bootstrap: docker\nFrom: ubuntu:disco\n\n%post\n\tapt-get update && apt-get install -y wget gcc\n"
+	err = ioutil.WriteFile(c.DefFile, []byte(defContent), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", c.DefFile, err)
+	}
+
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = "/usr/bin/singularity"
+	bundleDir, err := prepareBundle(&c, &sysCfg, "3.5.0")
+	if err != nil {
+		t.Fatalf("failed to prepare bundle: %s", err)
+	}
+	if filepath.Dir(bundleDir) != dir {
+		t.Fatalf("unexpected bundle directory: %s", bundleDir)
+	}
+	digest, err := GetBundleDigest(bundleDir)
+	if err != nil {
+		t.Fatalf("failed to get the digest of the bundle: %s", err)
+	}
+
+	summary, err := LoadBundle(bundleDir, digest)
+	if err != nil {
+		t.Fatalf("failed to load bundle: %s", err)
+	}
+	if summary.Labels["MPI_Version"] != "3.1.4" {
+		t.Fatalf("invalid labels: %v", summary.Labels)
+	}
+	if strings.Join(summary.Environment, " ") != "MPI_DIR=/opt/mpi" {
+		t.Fatalf("invalid environment: %v", summary.Environment)
+	}
+	if strings.Join(summary.Dependencies, " ") != "wget gcc" {
+		t.Fatalf("invalid dependencies: %v", summary.Dependencies)
+	}
+	if summary.BuildMode == "" {
+		t.Fatalf("build mode is not recorded")
+	}
+	if !strings.HasSuffix(strings.Join(summary.CmdArgs, " "), "build "+c.Path+" "+filepath.Join(bundleDir, BundleDefFile)) {
+		t.Fatalf("invalid build command: %s", strings.Join(summary.CmdArgs, " "))
+	}
+
+	_, err = LoadBundle(bundleDir, "")
+	if err == nil {
+		t.Fatalf("bundle was successfully loaded without digest")
+	}
+
+	// The manifest of the bundle is consistent with the modified bundle, only the digest detects the change
+	modifiedDefFile := filepath.Join(bundleDir, BundleDefFile)
+	err = ioutil.WriteFile(modifiedDefFile, []byte(defContent+"\tapt-get install -y curl\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to modify the bundle: %s", err)
+	}
+	err = manifest.Create(getBundleManifestPath(bundleDir), manifest.HashFiles([]string{modifiedDefFile}))
+	if err != nil {
+		t.Fatalf("failed to update the manifest of the bundle: %s", err)
+	}
+	_, err = LoadBundle(bundleDir, digest)
+	if err == nil {
+		t.Fatalf("modified bundle was successfully loaded")
+	}
+}
+
+func TestRunBuildRetryTransient(t *testing.T) {
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+
+	networkFailure := syexec.Result{Err: fmt.Errorf("exit status 255"), Stdout: "wget: unable to resolve host address"}
+	compileFailure := syexec.Result{Err: fmt.Errorf("exit status 2"), Stdout: CompilationStartMarker + "\nmake: *** [all] Error 1"}
+	// Bind-model builds never print the compilation marker, only the package installation output
+	bindFailure := syexec.Result{Err: fmt.Errorf("exit status 255"), Stdout: "Reading package lists...\nE: Unable to locate package libibverbs-dev", Stderr: "FATAL:   While performing build: while running engine: exit status 100"}
+	// Shared memory packages are installed after the compilation marker in hybrid builds
+	aptFailure := syexec.Result{Err: fmt.Errorf("exit status 255"), Stdout: CompilationStartMarker + "\nErr:1 http://archive.ubuntu.com/ubuntu bionic InRelease\n  Temporary failure resolving 'archive.ubuntu.com'"}
+	yumFailure := syexec.Result{Err: fmt.Errorf("exit status 255"), Stderr: "Cannot find a valid baseurl for repo: base/7/x86_64"}
+	curlFailure := syexec.Result{Err: fmt.Errorf("exit status 255"), Stderr: "curl: (28) Connection timed out after 300000 milliseconds"}
+
+	tests := []struct {
+		name    string
+		results []syexec.Result
+		retries int
+		runs    int
+		fails   bool
+	}{
+		{name: "wget network failure", results: []syexec.Result{networkFailure, {}}, retries: 2, runs: 2},
+		{name: "retries disabled", results: []syexec.Result{networkFailure, {}}, retries: 0, runs: 1, fails: true},
+		{name: "compilation failure", results: []syexec.Result{compileFailure, {}}, retries: 2, runs: 1, fails: true},
+		{name: "bind build failure", results: []syexec.Result{bindFailure, {}}, retries: 2, runs: 1, fails: true},
+		{name: "apt failure after compilation started", results: []syexec.Result{aptFailure, {}}, retries: 2, runs: 2},
+		{name: "yum failure", results: []syexec.Result{yumFailure, {}}, retries: 2, runs: 2},
+		{name: "curl failure", results: []syexec.Result{curlFailure, {}}, retries: 2, runs: 2},
+		{name: "retries exhausted", results: []syexec.Result{networkFailure, networkFailure, networkFailure, {}}, retries: 2, runs: 3, fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRunner := &syexec.FakeRunner{Results: tt.results}
+			runner = fakeRunner
+			var cmd syexec.SyCmd
+			res := runBuild(&cmd, tt.retries)
+			if len(fakeRunner.Cmds) != tt.runs {
+				t.Fatalf("build was executed %d time(s) instead of %d", len(fakeRunner.Cmds), tt.runs)
+			}
+			if tt.fails && res.Err == nil {
+				t.Fatalf("build succeeded while expected to fail")
+			}
+			if !tt.fails && res.Err != nil {
+				t.Fatalf("build failed: %s", res.Err)
+			}
+		})
+	}
+}
+
+func TestGetMPIExecCfgROCm(t *testing.T) {
+	var sysCfg sys.Config
+	var hostMPI implem.Info
+	var hostEnv buildenv.Info
+
+	c, mpi, err := parseInspectOutput("MPI_Implementation: openmpi\nMPI_Version: 4.0.2\nModel: hybrid\nROCm: true\n")
+	if err != nil {
+		t.Fatalf("failed to parse metadata: %s", err)
+	}
+	if !c.ROCm || !mpi.WithROCm {
+		t.Fatalf("ROCm label was not detected")
+	}
+
+	args := GetMPIExecCfg(&hostMPI, &hostEnv, &c, &sysCfg)
+	if !strings.Contains(strings.Join(args, " "), "--rocm") {
+		t.Fatalf("--rocm is not used with a ROCm container: %s", strings.Join(args, " "))
+	}
+
+	c.ROCm = false
+	args = GetMPIExecCfg(&hostMPI, &hostEnv, &c, &sysCfg)
+	if strings.Contains(strings.Join(args, " "), "--rocm") {
+		t.Fatalf("--rocm is used with a container without ROCm: %s", strings.Join(args, " "))
+	}
+}
+
+func TestBuildExecCommand(t *testing.T) {
+	var sysCfg sys.Config
+	var hostMPI implem.Info
+	var hostEnv buildenv.Info
+	var c Config
+
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	sysCfg.Nopriv = true
+	hostEnv.InstallDir = "/home/user/mpi"
+	c.Model = BindModel
+	c.MPIDir = "/opt/mpi"
+	c.ROCm = true
+	c.Path = "/home/user/app.sif"
+	c.AppExe = "/opt/app"
+	c.AppArgs = []string{"-n", "10"}
+
+	expected := "/usr/local/bin/singularity exec --no-home -u --rocm --bind /home/user/mpi:/opt/mpi /home/user/app.sif /opt/app -n 10"
+	cmd := BuildExecCommand(&hostMPI, &hostEnv, &c, &sysCfg)
+	if strings.Join(cmd, " ") != expected {
+		t.Fatalf("invalid command: %s (expected: %s)", strings.Join(cmd, " "), expected)
+	}
+
+	sysCfg.Nopriv = false
+	sysCfg.SudoBin = "/usr/bin/sudo"
+	sysCfg.SudoSyCmds = []string{"exec"}
+	expected = "/usr/bin/sudo /usr/local/bin/singularity exec --no-home --rocm --bind /home/user/mpi:/opt/mpi /home/user/app.sif /opt/app -n 10"
+	cmd = BuildExecCommand(&hostMPI, &hostEnv, &c, &sysCfg)
+	if strings.Join(cmd, " ") != expected {
+		t.Fatalf("invalid command: %s (expected: %s)", strings.Join(cmd, " "), expected)
+	}
+}
+
+func TestCheckImageAppExe(t *testing.T) {
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	var c Config
+	c.Path = "/tmp/app.sif"
+
+	inspectRes := syexec.Result{Stdout: "Model: bind\nApp_exe: /opt/NPmpi\n"}
+	missingRes := syexec.Result{Err: fmt.Errorf("exit status 1")}
+	lsRes := syexec.Result{Stdout: "drwxr-xr-x 2 root root 4096 NetPIPE-5.1.4\n"}
+
+	fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{inspectRes, {}}}
+	runner = fakeRunner
+	err := checkImage(&c, &sysCfg)
+	if err != nil {
+		t.Fatalf("check failed while the executable is present: %s", err)
+	}
+	if len(fakeRunner.Cmds) != 2 || strings.Join(fakeRunner.Cmds[1].CmdArgs, " ") != "exec /tmp/app.sif test -x /opt/NPmpi" {
+		t.Fatalf("invalid commands: %v", fakeRunner.Cmds)
+	}
+
+	fakeRunner = &syexec.FakeRunner{Results: []syexec.Result{inspectRes, missingRes, lsRes}}
+	runner = fakeRunner
+	err = checkImage(&c, &sysCfg)
+	if err == nil {
+		t.Fatalf("check succeeded while the executable is missing")
+	}
+	if !strings.Contains(err.Error(), "/opt/NPmpi") || !strings.Contains(err.Error(), "NetPIPE-5.1.4") {
+		t.Fatalf("diagnostic does not include the content of /opt: %s", err)
+	}
+
+	c.Lenient = true
+	runner = &syexec.FakeRunner{Results: []syexec.Result{inspectRes, missingRes, lsRes}}
+	err = checkImage(&c, &sysCfg)
+	if err != nil {
+		t.Fatalf("check failed in lenient mode: %s", err)
+	}
+}
+
+func TestParseMetadataFormats(t *testing.T) {
+	tests := []struct {
+		fixture string
+		format  int
+		mpiID   string
+		version string
+		model   string
+	}{
+		{fixture: "inspect-legacy.txt", format: LegacyMetadataFormat, mpiID: "openmpi", version: "3.1.4", model: HybridModel},
+		{fixture: "inspect-v2.json", format: MetadataFormat, mpiID: "mpich", version: "3.3", model: BindModel},
+	}
+
+	for _, tt := range tests {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", tt.fixture))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", tt.fixture, err)
+		}
+		c, mpi, err := parseInspectOutput(string(data))
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", tt.fixture, err)
+		}
+		if c.MetadataFormat != tt.format || mpi.ID != tt.mpiID || mpi.Version != tt.version || c.Model != tt.model || c.AppExe != "/opt/mpitest" || c.MPIDir != "/opt/mpi" {
+			t.Fatalf("invalid metadata for %s: %+v %+v", tt.fixture, c, mpi)
+		}
+	}
+
+	_, _, err := parseInspectOutput(`{"Metadata_format": "3"}`)
+	if err == nil {
+		t.Fatalf("metadata from a newer format was accepted")
+	}
+}
+
+func TestParseInspectOutputLabels(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "inspect-full.txt"))
+	if err != nil {
+		t.Fatalf("failed to read inspect-full.txt: %s", err)
+	}
+	c, mpi, err := parseInspectOutput(string(data))
+	if err != nil {
+		t.Fatalf("failed to parse inspect-full.txt: %s", err)
+	}
+
+	expectedCfg := Config{
+		Distro:             "ubuntu",
+		DistroVersion:      "20.04",
+		Model:              BindModel,
+		AppName:            "netpipe",
+		AppExe:             "/opt/NPmpi",
+		MPIDir:             "/opt/mpi",
+		ROCm:               true,
+		CUDA:               true,
+		Interconnect:       "infiniband",
+		Benchmarks:         "/opt/extras/osu-micro-benchmarks/libexec/osu-micro-benchmarks/mpi",
+		LaunchCommand:      "srun -n <NP> singularity exec --bind <HOST_MPI_DIR>:/opt/mpi <IMAGE> /opt/NPmpi",
+		AppBuildGeneration: 2,
+		HealthCheck:        "/opt/NPmpi -h",
+		MetadataFormat:     MetadataFormat,
+	}
+	if !reflect.DeepEqual(c, expectedCfg) {
+		t.Fatalf("invalid metadata: %+v instead of %+v", c, expectedCfg)
+	}
+	expectedMPI := implem.Info{ID: implem.MPICH, Version: "3.3.2", WithROCm: true, Device: "ch3:sock"}
+	if !reflect.DeepEqual(mpi, expectedMPI) {
+		t.Fatalf("invalid MPI: %+v instead of %+v", mpi, expectedMPI)
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	var sysCfg sys.Config
+	var hostMPI implem.Info
+	var hostEnv buildenv.Info
+	var c Config
+	c.Path = "/tmp/test.sif"
+	c.AppExe = "/opt/mpitest"
+	c.Model = BindModel
+	c.MPIDir = "/opt/mpi"
+	hostEnv.InstallDir = "/home/user/mpi"
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+
+	opts := ExecOptions{
+		Env:     []string{"PATH=/home/user/mpi/bin:/usr/bin", "SY_KEY_PASSPHRASE=mysecret"},
+		WorkDir: "/scratch/job 1",
+	}
+	argv, env, err := ShellCommand(&c, opts, &hostMPI, &hostEnv, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to get the shell command: %s", err)
+	}
+	execArgs := GetMPIExecCfg(&hostMPI, &hostEnv, &c, &sysCfg)
+	expected := append([]string{"/usr/local/bin/singularity", "shell"}, execArgs...)
+	expected = append(expected, "--pwd", "/scratch/job 1", "/tmp/test.sif")
+	if strings.Join(argv, " ") != strings.Join(expected, " ") {
+		t.Fatalf("invalid shell command: %s (expected: %s)", strings.Join(argv, " "), strings.Join(expected, " "))
+	}
+	if len(env) != 2 {
+		t.Fatalf("invalid environment: %v", env)
+	}
+
+	cmdline := FormatShellCommand(argv, env)
+	if strings.Contains(cmdline, "mysecret") || !strings.Contains(cmdline, "SY_KEY_PASSPHRASE=<redacted>") {
+		t.Fatalf("secret was not redacted: %s", cmdline)
+	}
+	if !strings.Contains(cmdline, "--pwd '/scratch/job 1'") || !strings.Contains(cmdline, "PATH=/home/user/mpi/bin:/usr/bin ") {
+		t.Fatalf("invalid quoting: %s", cmdline)
+	}
+
+	_, _, err = ShellCommand(&Config{}, opts, &hostMPI, &hostEnv, &sysCfg)
+	if err == nil {
+		t.Fatalf("shell command for an undefined image was generated")
+	}
+}
+
+// createFakeSignBin creates a fake singularity binary reporting a given version and asking for the passphrase
+// again when it is wrong. The passphrase is read from envVar when set, otherwise from stdin.
+func createFakeSignBin(t *testing.T, dir string, version string, envVar string) string {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", dir, err)
+	}
+	script := "#!/bin/sh\ncase \"$1\" in\nversion)\n\techo '" + version + "'\n\texit 0\n\t;;\nhelp)\n\texit 1\n\t;;\nesac\n"
+	if envVar != "" {
+		script += "pass=\"$" + envVar + "\"\nif [ -z \"$pass\" ]; then\n\techo 'Enter key passphrase : ' >&2\n\tread pass\nfi\n"
+	} else {
+		script += "echo 'Enter key passphrase : ' >&2\nread pass\n"
+	}
+	script += "if [ \"$pass\" != \"good\" ]; then\n\techo 'Enter key passphrase : ' >&2\n\texec sleep 60\nfi\necho 'Signature created and applied to image'\n"
+	bin := filepath.Join(dir, "singularity")
+	err = ioutil.WriteFile(bin, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", bin, err)
+	}
+	return bin
+}
+
+func TestSignBadPassphrase(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name    string
+		version string
+		envVar  string
+	}{
+		{name: "stdin", version: "singularity version 3.5.3"},
+		{name: "environment", version: "singularity version 3.8.0", envVar: "SINGULARITY_KEY_PASSPHRASE"},
+	}
+
+	defer os.Setenv(KeyPassphrase, os.Getenv(KeyPassphrase))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sysCfg sys.Config
+			sysCfg.SingularityBin = createFakeSignBin(t, filepath.Join(tempDir, tt.name, "bin"), tt.version, tt.envVar)
+			var c Config
+			c.Path = filepath.Join(tempDir, "test.sif")
+			c.BuildDir = tempDir
+
+			os.Setenv(KeyPassphrase, "wrong")
+			start := time.Now()
+			err := SignWithTimeout(&c, &sysCfg, time.Minute)
+			if err != sympierr.ErrBadPassphrase {
+				t.Fatalf("invalid error for a bad passphrase: %v", err)
+			}
+			if time.Since(start) > 30*time.Second {
+				t.Fatalf("command was not killed when the passphrase was requested again")
+			}
+
+			os.Setenv(KeyPassphrase, "good")
+			err = SignWithTimeout(&c, &sysCfg, time.Minute)
+			if err != nil {
+				t.Fatalf("failed to sign with a valid passphrase: %s", err)
+			}
+		})
+	}
+}
+
+func TestSignPassphrase(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+	defer os.Setenv(KeyPassphrase, os.Getenv(KeyPassphrase))
+	os.Setenv(KeyPassphrase, "secret")
+
+	tests := []struct {
+		name    string
+		version string
+		envVar  string
+	}{
+		{name: "singularity 3.5", version: "singularity version 3.5.3"},
+		{name: "singularity 3.8", version: "singularity version 3.8.0", envVar: "SINGULARITY_KEY_PASSPHRASE"},
+		{name: "apptainer 1.0", version: "apptainer version 1.0.3"},
+		{name: "apptainer 1.1", version: "apptainer version 1.1.9", envVar: "APPTAINER_KEY_PASSPHRASE"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sysCfg sys.Config
+			sysCfg.SingularityBin = createFakeSignBin(t, filepath.Join(tempDir, fmt.Sprintf("%d", i), "bin"), tt.version, "")
+			var c Config
+			c.Path = filepath.Join(tempDir, "test.sif")
+			c.BuildDir = tempDir
+
+			fakeRunner := &syexec.FakeRunner{}
+			runner = fakeRunner
+			err := SignWithTimeout(&c, &sysCfg, time.Minute)
+			if err != nil {
+				t.Fatalf("failed to sign image: %s", err)
+			}
+			if len(fakeRunner.Cmds) != 1 {
+				t.Fatalf("%d command(s) executed instead of 1", len(fakeRunner.Cmds))
+			}
+			cmd := fakeRunner.Cmds[0].Cmd
+
+			if tt.envVar == "" {
+				if cmd.Stdin == nil {
+					t.Fatalf("passphrase is not provided on stdin")
+				}
+				stdin, err := ioutil.ReadAll(cmd.Stdin)
+				if err != nil {
+					t.Fatalf("failed to read stdin: %s", err)
+				}
+				if string(stdin) != "secret\n" {
+					t.Fatalf("invalid input: %q", string(stdin))
+				}
+				for _, e := range cmd.Env {
+					if strings.HasSuffix(e, "_KEY_PASSPHRASE=secret") {
+						t.Fatalf("passphrase is provided through the environment: %s", e)
+					}
+				}
+				return
+			}
+
+			if cmd.Stdin != nil {
+				t.Fatalf("passphrase is provided on stdin while %s is supported", tt.envVar)
+			}
+			found := false
+			for _, e := range cmd.Env {
+				if e == tt.envVar+"=secret" {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("%s is not set in the environment of the command", tt.envVar)
+			}
+		})
+	}
+}
+
+func TestSignDefaultTimeout(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+	runner = &syexec.FakeRunner{}
+	defaultTimeout := DefaultSignTimeout
+	defer func() { DefaultSignTimeout = defaultTimeout }()
+
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = createFakeSignBin(t, filepath.Join(tempDir, "bin"), "singularity version 3.5.3", "")
+	var c Config
+	c.Path = filepath.Join(tempDir, "test.sif")
+	c.BuildDir = tempDir
+
+	// The deadline is already exceeded when the fake command returns
+	DefaultSignTimeout = time.Nanosecond
+	err = Sign(&c, &sysCfg)
+	if err == nil || !strings.Contains(err.Error(), "timed out after "+time.Nanosecond.String()) {
+		t.Fatalf("default timeout is not used: %v", err)
+	}
+
+	// The timeout of the configuration has precedence over the default one
+	sysCfg.SignTimeout = time.Minute
+	err = Sign(&c, &sysCfg)
+	if err != nil {
+		t.Fatalf("timeout of the configuration is not used: %s", err)
+	}
+}
+
+func TestGetBuildCmdBuildArgs(t *testing.T) {
+	var sysCfg sys.Config
+	var c Config
+
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	sysCfg.Nopriv = true
+	c.Path = "/home/user/app.sif"
+
+	cmd := getBuildCmd(&c, &sysCfg, "/home/user/app.def")
+	expected := "build --fakeroot /home/user/app.sif /home/user/app.def"
+	if strings.Join(cmd.CmdArgs, " ") != expected {
+		t.Fatalf("invalid command: %s (expected: %s)", strings.Join(cmd.CmdArgs, " "), expected)
+	}
+
+	c.BuildArgs = map[string]string{"MPI_VERSION": "4.0.3", "APP_SOURCE": "https://example.com/app.tar.gz"}
+	cmd = getBuildCmd(&c, &sysCfg, "/home/user/app.def")
+	expected = "build --fakeroot --build-arg APP_SOURCE=https://example.com/app.tar.gz --build-arg MPI_VERSION=4.0.3 /home/user/app.sif /home/user/app.def"
+	if strings.Join(cmd.CmdArgs, " ") != expected {
+		t.Fatalf("invalid command: %s (expected: %s)", strings.Join(cmd.CmdArgs, " "), expected)
+	}
+
+	c.BuildArgs = nil
+	c.BuildBinds = []string{"/data/input:/.sympi-stage/0"}
+	cmd = getBuildCmd(&c, &sysCfg, "/home/user/app.def")
+	expected = "build --fakeroot --bind /data/input:/.sympi-stage/0 /home/user/app.sif /home/user/app.def"
+	if strings.Join(cmd.CmdArgs, " ") != expected {
+		t.Fatalf("invalid command: %s (expected: %s)", strings.Join(cmd.CmdArgs, " "), expected)
+	}
+}
+
+func TestSquashfsBlockSize(t *testing.T) {
+	for _, size := range []int{0, MinSquashfsBlockSize, 131072, MaxSquashfsBlockSize} {
+		err := checkSquashfsBlockSize(size)
+		if err != nil {
+			t.Fatalf("valid block size %d is rejected: %s", size, err)
+		}
+	}
+	for _, size := range []int{-4096, 1024, 100000, 2 * MaxSquashfsBlockSize} {
+		err := checkSquashfsBlockSize(size)
+		if err == nil {
+			t.Fatalf("invalid block size %d is accepted", size)
+		}
+	}
+
+	var sysCfg sys.Config
+	var c Config
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	sysCfg.Nopriv = true
+	c.Path = "/home/user/app.sif"
+	c.SquashfsBlockSize = 131072
+
+	cmd := getBuildCmd(&c, &sysCfg, "/home/user/app.def")
+	expected := []string{"build", "--fakeroot", "--mksquashfs-args", "-b 131072", "/home/user/app.sif", "/home/user/app.def"}
+	if !reflect.DeepEqual(cmd.CmdArgs, expected) {
+		t.Fatalf("invalid command: %v (expected: %v)", cmd.CmdArgs, expected)
+	}
+}
+
+func TestDefFileDrift(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	embedded := "Bootstrap: library\nFrom: ubuntu:19.04\n\n%labels\n\tMPI_Implementation openmpi\n\tMPI_Version 3.1.4\n\tModel hybrid\n\n%post\n\tapt-get update\n\tapt-get install -y gcc make wget\n\tcd /opt\n\tmake\n\tmake install\n\techo done\n"
+	current := strings.Replace(embedded, "MPI_Version 3.1.4", "MPI_Version 4.0.2", 1)
+	current = strings.Replace(current, "\techo done\n", "\techo done\n\trm -rf /opt/build\n", 1)
+	defFile := filepath.Join(tempDir, "app.def")
+	err = ioutil.WriteFile(defFile, []byte(current), 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", defFile, err)
+	}
+
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{{Stdout: embedded}}}
+	runner = fakeRunner
+	drift, diff, err := DefFileDrift("/home/user/app.sif", defFile, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to compare definition files: %s", err)
+	}
+	if strings.Join(fakeRunner.Cmds[0].CmdArgs, " ") != "inspect --deffile /home/user/app.sif" {
+		t.Fatalf("invalid command: %s", strings.Join(fakeRunner.Cmds[0].CmdArgs, " "))
+	}
+	expected := "--- /home/user/app.sif\n+++ " + defFile + "\n" +
+		"@@ -3,7 +3,7 @@\n" +
+		" \n" +
+		" %labels\n" +
+		" \tMPI_Implementation openmpi\n" +
+		"-\tMPI_Version 3.1.4\n" +
+		"+\tMPI_Version 4.0.2\n" +
+		" \tModel hybrid\n" +
+		" \n" +
+		" %post\n" +
+		"@@ -13,3 +13,4 @@\n" +
+		" \tmake\n" +
+		" \tmake install\n" +
+		" \techo done\n" +
+		"+\trm -rf /opt/build\n"
+	if !drift || diff != expected {
+		t.Fatalf("invalid drift report (drift: %t):\n%s\nexpected:\n%s", drift, diff, expected)
+	}
+
+	// Trailing newlines added when embedding the definition file are not reported
+	runner = &syexec.FakeRunner{Results: []syexec.Result{{Stdout: current + "\n\n"}}}
+	drift, diff, err = DefFileDrift("/home/user/app.sif", defFile, &sysCfg)
+	if err != nil || drift || diff != "" {
+		t.Fatalf("identical definition files are reported as drifting (err: %v):\n%s", err, diff)
+	}
+
+	runner = &syexec.FakeRunner{Results: []syexec.Result{{Err: fmt.Errorf("exit status 255")}}}
+	_, _, err = DefFileDrift("/home/user/app.sif", defFile, &sysCfg)
+	if err == nil {
+		t.Fatalf("comparison succeeded while the image cannot be inspected")
+	}
+}
+
+// getFieldNames returns the names of the fields of a structure, in order
+func getFieldNames(v interface{}) []string {
+	var names []string
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		names = append(names, typ.Field(i).Name)
+	}
+	return names
+}
+
+func TestOptions(t *testing.T) {
+	// The options are part of the API, they must not be renamed or removed
+	tests := []struct {
+		opts     interface{}
+		expected []string
+	}{
+		{opts: CreateOptions{}, expected: []string{"PrepareOnly", "Sign", "Timeout", "Progress", "Parent"}},
+		{opts: PullOptions{}, expected: []string{"Force", "Timeout", "Progress"}},
+		{opts: ExecOptions{}, expected: []string{"Env", "WorkDir", "Args", "Timeout", "Progress"}},
+	}
+	for _, tt := range tests {
+		names := getFieldNames(tt.opts)
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Fatalf("%T options are %s instead of %s", tt.opts, strings.Join(names, ", "), strings.Join(tt.expected, ", "))
+		}
+	}
+
+	var sysCfg sys.Config
+	opts := CreateOptions{Sign: true, PrepareOnly: true}
+	if opts.validate(&sysCfg) == nil {
+		t.Fatalf("signing an image that is only prepared is accepted")
+	}
+	opts = CreateOptions{Sign: true}
+	sysCfg.PrepareOnly = true
+	if opts.validate(&sysCfg) == nil {
+		t.Fatalf("signing an image that is only prepared is accepted")
+	}
+	opts = CreateOptions{Timeout: time.Second}
+	if opts.validate(&sys.Config{}) == nil {
+		t.Fatalf("timeout shorter than a minute accepted")
+	}
+	opts = CreateOptions{Timeout: 2 * time.Hour}
+	if opts.validate(&sys.Config{}) != nil || opts.getCmdTimeout(sys.CmdTimeout) != 120 {
+		t.Fatalf("invalid build timeout: %d", opts.getCmdTimeout(sys.CmdTimeout))
+	}
+	opts = CreateOptions{Parent: "/a/path/that/does/not/exist.sif"}
+	if opts.validate(&sys.Config{}) == nil {
+		t.Fatalf("missing parent image accepted")
+	}
+
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+	fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{{Stdout: "hello"}}}
+	runner = fakeRunner
+
+	c := Config{Path: "/tmp/test.sif", AppExe: "/opt/app", BuildDir: "/tmp"}
+	sysCfg = sys.Config{SingularityBin: "/usr/local/bin/singularity"}
+	var steps []string
+	execOpts := ExecOptions{
+		Args:     []string{"-v"},
+		WorkDir:  "/scratch",
+		Progress: func(step string) { steps = append(steps, step) },
+	}
+	output, err := ExecWithOptions(&c, &implem.Info{}, &buildenv.Info{}, &sysCfg, execOpts)
+	if err != nil || output != "hello" {
+		t.Fatalf("execution failed: %s (output: %s)", err, output)
+	}
+	cmd := fakeRunner.Cmds[0]
+	if cmd.CmdArgs[len(cmd.CmdArgs)-1] != "-v" || cmd.ExecDir != "/scratch" || cmd.Timeout != 0 || len(steps) != 1 {
+		t.Fatalf("options not applied to %s %s from %s", cmd.BinPath, strings.Join(cmd.CmdArgs, " "), cmd.ExecDir)
+	}
+}
+
+func TestGetRuntimeRequirements(t *testing.T) {
+	output := "Metadata_format: 2\nMPI_Implementation: mpich\nMPI_Version: 3.3.2\n" + MPIDeviceLabel + ": ch4:ucx\n" + CUDALabel + ": true\n"
+	c, mpi, err := parseInspectOutput(output)
+	if err != nil {
+		t.Fatalf("failed to parse metadata: %s", err)
+	}
+
+	sysCfg := sys.Config{Nopriv: true}
+	req := GetRuntimeRequirements(&c, &mpi, &sysCfg)
+	expected := sys.Requirements{
+		NvidiaDevices:     true,
+		InfinibandDevices: true,
+		UserNamespaces:    true,
+		MinSharedMemSize:  MinMPICHSharedMemSize,
+	}
+	if req != expected {
+		t.Fatalf("requirements are %+v instead of %+v", req, expected)
+	}
+
+	c, mpi, err = parseInspectOutput("Metadata_format: 2\nMPI_Implementation: openmpi\nMPI_Version: 4.0.2\n")
+	if err != nil {
+		t.Fatalf("failed to parse metadata: %s", err)
+	}
+	req = GetRuntimeRequirements(&c, &mpi, &sys.Config{})
+	if req != (sys.Requirements{}) {
+		t.Fatalf("unexpected requirements: %+v", req)
+	}
+}
+
+func TestGetMPIExecCfgBinds(t *testing.T) {
+	var sysCfg sys.Config
+	var hostMPI implem.Info
+	c := Config{Model: BindModel, MPIDir: "/opt/mpi"}
+	hostEnv := buildenv.Info{
+		InstallDir: "/home/user/openmpi",
+		Binds: []buildenv.Bind{
+			{Source: "/opt/pmix-4.2", Target: "/opt/pmix", ReadOnly: true, Paths: true},
+			{Source: "/usr/lib64/ucx", Paths: true},
+		},
+	}
+
+	args := GetMPIExecCfg(&hostMPI, &hostEnv, &c, &sysCfg)
+	expected := "/home/user/openmpi:/opt/mpi,/opt/pmix-4.2:/opt/pmix:ro,/usr/lib64/ucx:/usr/lib64/ucx"
+	if len(args) < 2 || args[len(args)-2] != "--bind" || args[len(args)-1] != expected {
+		t.Fatalf("invalid binds: %s", strings.Join(args, " "))
+	}
+
+	env := GetBindEnv(&hostEnv)
+	expectedEnv := []string{
+		"SINGULARITYENV_PREPEND_PATH=/opt/pmix/bin:/usr/lib64/ucx/bin",
+		"SINGULARITYENV_LD_LIBRARY_PATH=/opt/pmix/lib:/usr/lib64/ucx/lib",
+	}
+	if !reflect.DeepEqual(env, expectedEnv) {
+		t.Fatalf("invalid environment: %s", strings.Join(env, " "))
+	}
+
+	// Binds cannot target the same directory
+	hostEnv.Binds = append(hostEnv.Binds, buildenv.Bind{Source: "/opt/pmix-3.2", Target: "/opt/pmix/"})
+	if checkBinds(&hostEnv, &c) == nil {
+		t.Fatalf("binds with the same target accepted")
+	}
+	hostEnv.Binds = []buildenv.Bind{{Source: "/opt/pmix", Target: "/opt/mpi"}}
+	if checkBinds(&hostEnv, &c) == nil {
+		t.Fatalf("bind targeting the MPI directory accepted")
+	}
+}
+
+func TestInterconnectMismatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		image        string
+		cluster      string
+		expectedWarn bool
+	}{
+		{name: "no interconnect"},
+		{name: "image without interconnect", cluster: InterconnectInfiniband},
+		{name: "cluster without interconnect", image: InterconnectInfiniband},
+		{name: "same interconnect", image: InterconnectInfiniband, cluster: "InfiniBand"},
+		{name: "different interconnect", image: InterconnectInfiniband, cluster: InterconnectEthernet, expectedWarn: true},
+	}
+
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for i, tt := range tests {
+		runner = &syexec.FakeRunner{}
+		buf.Reset()
+		c := Config{Path: fmt.Sprintf("/tmp/test-%d.sif", i), AppExe: "/opt/app", Interconnect: tt.image}
+		sysCfg := sys.Config{SingularityBin: "singularity", Interconnect: tt.cluster}
+		_, err := ExecWithOptions(&c, &implem.Info{}, &buildenv.Info{}, &sysCfg, ExecOptions{})
+		if err != nil {
+			t.Fatalf("%s: execution failed: %s", tt.name, err)
+		}
+		warned := strings.Contains(buf.String(), c.Path+" was tuned for "+tt.image)
+		if warned != tt.expectedWarn {
+			t.Fatalf("%s: warning displayed is %t instead of %t: %s", tt.name, warned, tt.expectedWarn, buf.String())
+		}
+	}
+}
+
+func TestValidateEnvForOperation(t *testing.T) {
+	defer os.Setenv(KeyPassphrase, os.Getenv(KeyPassphrase))
+	defer os.Setenv(KeyIndexEnvVar, os.Getenv(KeyIndexEnvVar))
+	os.Unsetenv(KeyIndexEnvVar)
+
+	// Signing requires the passphrase of the key
+	os.Unsetenv(KeyPassphrase)
+	err := ValidateEnvForOperation(OperationSign, &sys.Config{})
+	if err == nil || !strings.Contains(err.Error(), KeyPassphrase) {
+		t.Fatalf("signature without passphrase accepted: %v", err)
+	}
+	os.Setenv(KeyPassphrase, "passphrase")
+	err = ValidateEnvForOperation(OperationSign, &sys.Config{})
+	if err != nil {
+		t.Fatalf("signature with passphrase refused: %s", err)
+	}
+	os.Setenv(KeyIndexEnvVar, "first")
+	if ValidateEnvForOperation(OperationSign, &sys.Config{}) == nil {
+		t.Fatalf("invalid key index accepted")
+	}
+
+	// Uploading requires a registry
+	err = ValidateEnvForOperation(OperationUpload, &sys.Config{})
+	if err == nil || !strings.Contains(err.Error(), "registry") {
+		t.Fatalf("upload without registry accepted: %v", err)
+	}
+	if ValidateEnvForOperation(OperationUpload, &sys.Config{Registry: "helloworld:latest"}) == nil {
+		t.Fatalf("upload to an invalid registry accepted")
+	}
+	err = ValidateEnvForOperation(OperationUpload, &sys.Config{Registry: "library://sympi/test/helloworld:latest"})
+	if err != nil {
+		t.Fatalf("upload with registry refused: %s", err)
+	}
+
+	if ValidateEnvForOperation("delete", &sys.Config{}) == nil {
+		t.Fatalf("unknown operation accepted")
+	}
+}
+
+func TestGlobalSingularityFlags(t *testing.T) {
+	var sysCfg sys.Config
+	var c Config
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	sysCfg.SudoBin = "/usr/bin/sudo"
+	sysCfg.GlobalSingularityFlags = []string{"--debug", "-c", "/etc/singularity/site.conf"}
+	c.Path = "/home/user/app.sif"
+	c.URL = "library://user/collection/app:latest"
+	globals := "--debug -c /etc/singularity/site.conf "
+
+	tests := []struct {
+		name     string
+		cmd      syexec.SyCmd
+		expected string
+	}{
+		{name: "build", cmd: getBuildCmdForMode(&c, &sysCfg, "/home/user/app.def", sy.BuildModeDirect), expected: globals + "build /home/user/app.sif /home/user/app.def"},
+		{name: "build with fakeroot", cmd: getBuildCmdForMode(&c, &sysCfg, "/home/user/app.def", sy.BuildModeFakeroot), expected: globals + "build --fakeroot /home/user/app.sif /home/user/app.def"},
+		{name: "build with sudo", cmd: getBuildCmdForMode(&c, &sysCfg, "/home/user/app.def", sy.BuildModeSudo), expected: sysCfg.SingularityBin + " " + globals + "build /home/user/app.sif /home/user/app.def"},
+		{name: "sign", cmd: getSyCmd("sign", []string{"--keyidx", "0", c.Path}, &sysCfg), expected: globals + "sign --keyidx 0 /home/user/app.sif"},
+		{name: "upload", cmd: getSyCmd("push", []string{c.Path, "library://user/collection/app:latest"}, &sysCfg), expected: globals + "push /home/user/app.sif library://user/collection/app:latest"},
+		{name: "inspect", cmd: getSyCmd("inspect", []string{c.Path}, &sysCfg), expected: globals + "inspect /home/user/app.sif"},
+	}
+	for _, tt := range tests {
+		if strings.Join(tt.cmd.CmdArgs, " ") != tt.expected {
+			t.Fatalf("%s: invalid command: %s (expected: %s)", tt.name, strings.Join(tt.cmd.CmdArgs, " "), tt.expected)
+		}
+	}
+
+	args := getPullArgs(&c, &sysCfg, PullOptions{Force: true})
+	expected := globals + "pull --force /home/user/app.sif library://user/collection/app:latest"
+	if strings.Join(args, " ") != expected {
+		t.Fatalf("pull: invalid command: %s (expected: %s)", strings.Join(args, " "), expected)
+	}
+
+	c.AppExe = "/opt/app"
+	argv := BuildExecCommand(&implem.Info{}, &buildenv.Info{}, &c, &sysCfg)
+	if strings.Join(argv[:5], " ") != sysCfg.SingularityBin+" "+globals+"exec" {
+		t.Fatalf("exec: global flags are not before the command: %v", argv)
+	}
+}
+
+func TestCheckPulledImage(t *testing.T) {
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+
+	sysCfg := sys.Config{SingularityBin: "/usr/local/bin/singularity"}
+	inspectRes := syexec.Result{Stdout: "MPI_Implementation: openmpi\nMPI_Version: 4.0.2\nModel: hybrid\n"}
+
+	tests := []struct {
+		name     string
+		inspect  syexec.Result
+		mpi      implem.Info
+		expected string
+	}{
+		{name: "same MPI", inspect: inspectRes, mpi: implem.Info{ID: implem.OMPI, Version: "4.0.2"}},
+		{name: "any version", inspect: inspectRes, mpi: implem.Info{ID: implem.OMPI}},
+		{name: "different version", inspect: inspectRes, mpi: implem.Info{ID: implem.OMPI, Version: "3.1.4"}, expected: "provides openmpi 4.0.2 while openmpi 3.1.4 was requested"},
+		{name: "different implementation", inspect: inspectRes, mpi: implem.Info{ID: implem.MPICH, Version: "3.3"}, expected: "provides openmpi 4.0.2 while mpich 3.3 was requested"},
+		{name: "no MPI metadata", inspect: syexec.Result{Stdout: "Model: hybrid\n"}, mpi: implem.Info{ID: implem.OMPI, Version: "4.0.2"}, expected: "does not record its MPI implementation"},
+		{name: "inspect failure", inspect: syexec.Result{Err: fmt.Errorf("exit status 255")}, mpi: implem.Info{ID: implem.OMPI, Version: "4.0.2"}, expected: "failed to get the metadata"},
+	}
+
+	for _, tt := range tests {
+		c := Config{Path: "/tmp/pulled.sif"}
+		fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{tt.inspect, tt.inspect}}
+		runner = fakeRunner
+		err := checkPulledImage(&c, &tt.mpi, &sysCfg)
+		if len(fakeRunner.Cmds) == 0 || strings.Join(fakeRunner.Cmds[0].CmdArgs, " ") != "inspect --json /tmp/pulled.sif" {
+			t.Fatalf("%s: invalid commands: %v", tt.name, fakeRunner.Cmds)
+		}
+		if tt.expected == "" {
+			if err != nil {
+				t.Fatalf("%s: check failed: %s", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Fatalf("%s: error is %v instead of %q", tt.name, err, tt.expected)
+		}
+
+		// Mismatches are only reported as warnings in lenient mode
+		c.Lenient = true
+		runner = &syexec.FakeRunner{Results: []syexec.Result{tt.inspect, tt.inspect}}
+		err = checkPulledImage(&c, &tt.mpi, &sysCfg)
+		if err != nil {
+			t.Fatalf("%s: check failed in lenient mode: %s", tt.name, err)
+		}
+	}
+}
+
+func TestInspectJSON(t *testing.T) {
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Singularity 2.6 does not support 'inspect --json'
+	legacyBin := filepath.Join(tempDir, "singularity")
+	err = ioutil.WriteFile(legacyBin, []byte("#!/bin/sh\nif [ \"$1\" = \"version\" ]; then\n\techo 2.6.1-dist\n\texit 0\nfi\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", legacyBin, err)
+	}
+
+	jsonOutput, err := ioutil.ReadFile(filepath.Join("testdata", "inspect-v2.json"))
+	if err != nil {
+		t.Fatalf("failed to read inspect-v2.json: %s", err)
+	}
+	textOutput, err := ioutil.ReadFile(filepath.Join("testdata", "inspect-legacy.txt"))
+	if err != nil {
+		t.Fatalf("failed to read inspect-legacy.txt: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		bin     string
+		results []syexec.Result
+		cmds    []string
+		mpiID   string
+		model   string
+		fails   bool
+	}{
+		{
+			name:    "json",
+			bin:     "/usr/local/bin/singularity",
+			results: []syexec.Result{{Stdout: string(jsonOutput)}},
+			cmds:    []string{"inspect --json /tmp/app.sif"},
+			mpiID:   "mpich",
+			model:   BindModel,
+		},
+		{
+			name:    "legacy singularity",
+			bin:     legacyBin,
+			results: []syexec.Result{{Stdout: string(textOutput)}},
+			cmds:    []string{"inspect /tmp/app.sif"},
+			mpiID:   "openmpi",
+			model:   HybridModel,
+		},
+		{
+			name:    "failure",
+			bin:     "/usr/local/bin/singularity",
+			results: []syexec.Result{{Err: fmt.Errorf("exit status 255")}, {Stdout: string(textOutput)}},
+			cmds:    []string{"inspect --json /tmp/app.sif"},
+			fails:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		fakeRunner := &syexec.FakeRunner{Results: tt.results}
+		runner = fakeRunner
+		sysCfg := sys.Config{SingularityBin: tt.bin}
+		c, mpi, err := inspectImage("/tmp/app.sif", &sysCfg)
+		if len(fakeRunner.Cmds) != len(tt.cmds) {
+			t.Fatalf("%s: %d commands executed instead of %d: %v", tt.name, len(fakeRunner.Cmds), len(tt.cmds), fakeRunner.Cmds)
+		}
+		for i, cmd := range tt.cmds {
+			if strings.Join(fakeRunner.Cmds[i].CmdArgs, " ") != cmd {
+				t.Fatalf("%s: command #%d is %v instead of %s", tt.name, i, fakeRunner.Cmds[i].CmdArgs, cmd)
+			}
+		}
+		if tt.fails {
+			if err == nil {
+				t.Fatalf("%s: inspection succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: inspection failed: %s", tt.name, err)
+		}
+		if mpi.ID != tt.mpiID || c.Model != tt.model || c.AppExe != "/opt/mpitest" || c.Path != "/tmp/app.sif" {
+			t.Fatalf("%s: invalid metadata: %+v %+v", tt.name, c, mpi)
+		}
+	}
+}
+
+func TestRemoteImageExists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/app.sif":
+		case "/denied.sif":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	searchOutput := "Found 1 containers for 'openmpi'\n\tlibrary://user/mpi/openmpi\n\t\tTags: 4.0.2 latest\n"
+
+	tests := []struct {
+		url    string
+		search *syexec.Result
+		cmd    string
+		exists bool
+		err    bool
+	}{
+		{url: server.URL + "/app.sif", exists: true},
+		{url: server.URL + "/missing.sif", exists: false},
+		{url: server.URL + "/denied.sif", err: true},
+		{url: "library://user/mpi/openmpi:4.0.2", search: &syexec.Result{Stdout: searchOutput}, cmd: "search openmpi", exists: true},
+		{url: "library://user/mpi/mpich:3.3", search: &syexec.Result{Stdout: "No container found\n"}, cmd: "search mpich", exists: true},
+		{url: "library://user/mpi/openmpi", search: &syexec.Result{Err: fmt.Errorf("exit status 255")}, err: true},
+		{url: "docker://ubuntu:19.04", exists: true},
+	}
+
+	for _, tt := range tests {
+		fakeRunner := &syexec.FakeRunner{}
+		if tt.search != nil {
+			fakeRunner.Results = []syexec.Result{*tt.search}
+		}
+		runner = fakeRunner
+
+		exists, err := RemoteImageExists(tt.url, &sysCfg)
+		if tt.err {
+			if err == nil {
+				t.Fatalf("%s: checking the image succeeded instead of failing", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to check the image: %s", tt.url, err)
+		}
+		if exists != tt.exists {
+			t.Fatalf("%s: exists is %t instead of %t", tt.url, exists, tt.exists)
+		}
+		if tt.cmd != "" && strings.Join(fakeRunner.Cmds[0].CmdArgs, " ") != tt.cmd {
+			t.Fatalf("%s: invalid command: %s", tt.url, strings.Join(fakeRunner.Cmds[0].CmdArgs, " "))
+		}
+	}
+}
+
+func TestPullMissingRemoteImage(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Fake singularity recording that it was started
+	marker := filepath.Join(tempDir, "pulled")
+	sysCfg := sys.Config{SingularityBin: filepath.Join(tempDir, "singularity")}
+	err = ioutil.WriteFile(sysCfg.SingularityBin, []byte("#!/bin/sh\ntouch "+marker+"\n"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", sysCfg.SingularityBin, err)
+	}
+
+	defaultChecker := remoteImageExists
+	defer func() { remoteImageExists = defaultChecker }()
+	var checked string
+	remoteImageExists = func(url string, sysCfg *sys.Config) (bool, error) {
+		checked = url
+		return false, nil
+	}
+
+	cfg := Config{URL: "https://example.com/mpi/openmpi-4.0.2.sif", Path: filepath.Join(tempDir, "openmpi.sif"), BuildDir: tempDir}
+	mpiImplm := implem.Info{ID: implem.OMPI, Version: "4.0.2"}
+	err = PullContainerImage(&cfg, &mpiImplm, &sysCfg, nil)
+	if err == nil || err.Error() != "image not found at "+cfg.URL {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checked != cfg.URL {
+		t.Fatalf("%s was checked instead of %s", checked, cfg.URL)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatalf("the image was pulled")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	defaultRunner := runner
+	defer func() { runner = defaultRunner }()
+
+	fingerprint := "8883491F4268F173C6E5DC49EDECE4F3F38D871E"
+	signed := "Verifying image: /home/user/app.sif\nData integrity checked, authentic and signed by:\n\tuser <user@example.com>, Fingerprint " + fingerprint + "\n"
+	signedKeyID := "Verifying image: /home/user/app.sif\nData integrity checked, authentic and signed by:\n\tuser <user@example.com>, KeyID EDECE4F3F38D871E\n"
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		sudo        bool
+		result      syexec.Result
+		cmd         string
+		err         string
+	}{
+		{name: "signed", result: syexec.Result{Stdout: signed}, cmd: "/usr/local/bin/singularity verify /home/user/app.sif"},
+		{name: "sudo", sudo: true, result: syexec.Result{Stdout: signed}, cmd: "/usr/bin/sudo /usr/local/bin/singularity verify /home/user/app.sif"},
+		{name: "unsigned", result: syexec.Result{Stderr: "FATAL:   no signatures found for system partition\n", Err: fmt.Errorf("exit status 255")}, err: "/home/user/app.sif is not signed"},
+		{name: "invalid", result: syexec.Result{Stderr: "FATAL:   signature verification failed\n", Err: fmt.Errorf("exit status 255")}, err: "signature verification failed"},
+		{name: "fingerprint", fingerprint: fingerprint, result: syexec.Result{Stdout: signed}, cmd: "/usr/local/bin/singularity verify --local /home/user/app.sif"},
+		{name: "key ID", fingerprint: "8883 491F 4268 F173 C6E5  DC49 EDEC E4F3 F38D 871E", result: syexec.Result{Stdout: signedKeyID}},
+		{name: "other key", fingerprint: "0x1234567890ABCDEF1234567890ABCDEF12345678", result: syexec.Result{Stdout: signed}, err: "is not signed by the key"},
+		{name: "bad fingerprint", fingerprint: "1234", err: "invalid key fingerprint"},
+	}
+
+	for _, tt := range tests {
+		var sysCfg sys.Config
+		sysCfg.SingularityBin = "/usr/local/bin/singularity"
+		if tt.sudo {
+			sysCfg.SudoBin = "/usr/bin/sudo"
+			sysCfg.SudoSyCmds = []string{"verify"}
+		}
+		fakeRunner := &syexec.FakeRunner{Results: []syexec.Result{tt.result}}
+		runner = fakeRunner
+
+		err := VerifyWithOptions("/home/user/app.sif", &sysCfg, VerifyOptions{Fingerprint: tt.fingerprint})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("%s: expected error %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to verify image: %s", tt.name, err)
+		}
+		if tt.cmd != "" {
+			cmd := fakeRunner.Cmds[0].BinPath + " " + strings.Join(fakeRunner.Cmds[0].CmdArgs, " ")
+			if cmd != tt.cmd {
+				t.Fatalf("%s: invalid command: %s", tt.name, cmd)
+			}
+		}
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	sysCfg.SudoBin = "/usr/bin/sudo"
+	var c Config
+	c.Path = filepath.Join(tempDir, "app")
+	c.Sandbox = true
+
+	expected := map[string]string{
+		sy.BuildModeDirect:   "/usr/local/bin/singularity build --sandbox " + c.Path + " /home/user/app.def",
+		sy.BuildModeFakeroot: "/usr/local/bin/singularity build --fakeroot --sandbox " + c.Path + " /home/user/app.def",
+		sy.BuildModeSudo:     "/usr/bin/sudo /usr/local/bin/singularity build --sandbox " + c.Path + " /home/user/app.def",
+	}
+	for mode, e := range expected {
+		cmd := getBuildCmdForMode(&c, &sysCfg, "/home/user/app.def", mode)
+		cmdLine := cmd.BinPath + " " + strings.Join(cmd.CmdArgs, " ")
+		if cmdLine != e {
+			t.Fatalf("invalid %s build command: %s instead of %s", mode, cmdLine, e)
+		}
+		for _, file := range cmd.ManifestFileHash {
+			if file == c.Path {
+				t.Fatalf("the sandbox is hashed in the manifest of the %s build", mode)
+			}
+		}
+	}
+
+	// The sandbox is a directory, it is not made executable
+	err = os.Mkdir(c.Path, 0700)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", c.Path, err)
+	}
+	err = setImageExecutable(c.Path)
+	if err != nil {
+		t.Fatalf("failed to set the mode of the sandbox: %s", err)
+	}
+	fi, err := os.Stat(c.Path)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", c.Path, err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Fatalf("the mode of the sandbox was changed to %o", fi.Mode().Perm())
+	}
+
+	// Options that only apply to SIF files are rejected
+	err = checkSandbox(&c, CreateOptions{Sign: true})
+	if err == nil {
+		t.Fatalf("signing a sandbox was accepted")
+	}
+	c.SquashfsBlockSize = 4096
+	err = checkSandbox(&c, CreateOptions{})
+	if err == nil {
+		t.Fatalf("squashfs options were accepted for a sandbox")
+	}
+}
+
+func TestRemoteBuild(t *testing.T) {
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = "/usr/local/bin/singularity"
+	sysCfg.SudoBin = "/usr/bin/sudo"
+	sysCfg.SudoSyCmds = []string{"build"}
+	sysCfg.Nopriv = true
+	var c Config
+	c.Path = "/home/user/app.sif"
+	c.Remote = true
+
+	tests := []struct {
+		builder  string
+		expected []string
+	}{
+		{expected: []string{"build", "--remote", c.Path, "/home/user/app.def"}},
+		{builder: "https://build.example.com", expected: []string{"build", "--remote", "--builder", "https://build.example.com", c.Path, "/home/user/app.def"}},
+	}
+	for _, tt := range tests {
+		c.RemoteBuilderURL = tt.builder
+		mode, _ := getBuildMode(&c, &sysCfg)
+		if mode != sy.BuildModeRemote {
+			t.Fatalf("image is built in %s mode instead of %s", mode, sy.BuildModeRemote)
+		}
+		cmd := getBuildCmd(&c, &sysCfg, "/home/user/app.def")
+		if cmd.BinPath != sysCfg.SingularityBin {
+			t.Fatalf("remote build is executed with %s instead of %s", cmd.BinPath, sysCfg.SingularityBin)
+		}
+		if !reflect.DeepEqual(cmd.CmdArgs, tt.expected) {
+			t.Fatalf("invalid remote build arguments: %v instead of %v", cmd.CmdArgs, tt.expected)
+		}
+		err := checkRemoteBuild(&c)
+		if err != nil {
+			t.Fatalf("remote build with builder %q was rejected: %s", tt.builder, err)
+		}
+	}
+
+	// Options that only apply to local builds are rejected
+	c.RemoteBuilderURL = "build.example.com"
+	err := checkRemoteBuild(&c)
+	if err == nil {
+		t.Fatalf("invalid remote builder URL was accepted")
+	}
+	c.RemoteBuilderURL = ""
+	c.Sandbox = true
+	err = checkRemoteBuild(&c)
+	if err == nil {
+		t.Fatalf("remote build of a sandbox was accepted")
+	}
+	c.Sandbox = false
+	c.BuildBinds = []string{"/data:/data"}
+	err = checkRemoteBuild(&c)
+	if err == nil {
+		t.Fatalf("bound directories were accepted for a remote build")
+	}
+	c.BuildBinds = nil
+	c.Remote = false
+	c.RemoteBuilderURL = "https://build.example.com"
+	err = checkRemoteBuild(&c)
+	if err == nil {
+		t.Fatalf("remote builder was accepted for a local build")
+	}
+}
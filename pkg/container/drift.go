@@ -0,0 +1,175 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/sy"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// diffContext is the number of unchanged lines displayed around changes in a unified diff
+const diffContext = 3
+
+// diffOp is an operation of an edit script transforming a list of lines into another one
+type diffOp struct {
+	// kind is ' ' for an unchanged line, '-' for a removed line and '+' for an added line
+	kind byte
+
+	// line is the line the operation applies to
+	line string
+
+	// oldIdx and newIdx are the indexes of the line in the old and new lists, i.e., the number of lines before the operation
+	oldIdx int
+	newIdx int
+}
+
+// splitLines splits a text into lines, ignoring the trailing newlines
+func splitLines(text string) []string {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// getEditScript returns the edit script transforming a into b, based on their longest common subsequence
+func getEditScript(a []string, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i], oldIdx: i, newIdx: j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{kind: '-', line: a[i], oldIdx: i, newIdx: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: b[j], oldIdx: i, newIdx: j})
+			j++
+		}
+	}
+	return ops
+}
+
+// hunkRange returns the range of a hunk in the format of unified diffs, i.e., start,length
+func hunkRange(start int, length int) string {
+	if length == 0 {
+		// An empty range refers to the line before it
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// unifiedDiff returns the unified diff between two texts, an empty string if they are identical
+func unifiedDiff(oldName string, newName string, oldText string, newText string) string {
+	ops := getEditScript(splitLines(oldText), splitLines(newText))
+
+	var hunks []string
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Extend the hunk as long as changes are separated by less than twice the context
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		var oldLen, newLen int
+		var lines []string
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				oldLen++
+			}
+			if op.kind != '-' {
+				newLen++
+			}
+			lines = append(lines, string(op.kind)+op.line)
+		}
+		header := "@@ -" + hunkRange(ops[start].oldIdx, oldLen) + " +" + hunkRange(ops[start].newIdx, newLen) + " @@"
+		hunks = append(hunks, header+"\n"+strings.Join(lines, "\n")+"\n")
+		i = stop
+	}
+
+	if len(hunks) == 0 {
+		return ""
+	}
+	return "--- " + oldName + "\n+++ " + newName + "\n" + strings.Join(hunks, "")
+}
+
+// DefFileDrift compares the definition file embedded in an image to a definition file and returns whether
+// they differ and their unified diff
+func DefFileDrift(imgPath string, currentDefFile string, sysCfg *sys.Config) (bool, string, error) {
+	current, err := ioutil.ReadFile(currentDefFile)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read %s: %s", currentDefFile, err)
+	}
+
+	err = sy.CheckFeature(sy.FeatureInspectDefFile, sysCfg)
+	if err != nil {
+		return false, "", err
+	}
+
+	cmd := getSyCmd("inspect", []string{"--deffile", imgPath}, sysCfg)
+	cmd.Timeout = sys.CmdTimeout * 2
+	res := runner.Run(&cmd)
+	if res.Err != nil {
+		return false, "", fmt.Errorf("failed to get the definition file of %s - stdout: %s; stderr: %s; err: %s", imgPath, res.Stdout, res.Stderr, res.Err)
+	}
+	if strings.TrimSpace(res.Stdout) == "" {
+		return false, "", fmt.Errorf("%s does not embed a definition file", imgPath)
+	}
+
+	diff := unifiedDiff(imgPath, currentDefFile, res.Stdout, string(current))
+	return diff != "", diff, nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// OperationSign is the identifier of the signature of an image
+	OperationSign = "sign"
+
+	// OperationUpload is the identifier of the upload of an image to a registry
+	OperationUpload = "upload"
+)
+
+// getSignEnvErrors returns what is missing from the environment to sign an image
+func getSignEnvErrors() []string {
+	var missing []string
+	if os.Getenv(KeyPassphrase) == "" {
+		missing = append(missing, KeyPassphrase+" is not set, the passphrase of the key is required to sign images")
+	}
+	if idx := os.Getenv(KeyIndexEnvVar); idx != "" {
+		n, err := strconv.Atoi(idx)
+		if err != nil || n < 0 {
+			missing = append(missing, KeyIndexEnvVar+" is not a valid key index: "+idx)
+		}
+	}
+	return missing
+}
+
+// getUploadEnvErrors returns what is missing from the configuration to upload an image
+func getUploadEnvErrors(sysCfg *sys.Config) []string {
+	if sysCfg.Registry == "" {
+		return []string{"the registry where images are uploaded is not configured"}
+	}
+	if !strings.Contains(sysCfg.Registry, "://") {
+		return []string{"the registry " + sysCfg.Registry + " is not a valid URI, e.g., library://user/collection/image:tag"}
+	}
+	return nil
+}
+
+// ValidateEnvForOperation checks that the environment variables and the configuration required by an operation
+// (OperationSign or OperationUpload) are set, so that the operation does not fail midway. The returned error
+// lists everything that is missing.
+func ValidateEnvForOperation(op string, sysCfg *sys.Config) error {
+	var missing []string
+	switch op {
+	case OperationSign:
+		missing = getSignEnvErrors()
+	case OperationUpload:
+		missing = getUploadEnvErrors(sysCfg)
+	default:
+		return fmt.Errorf("unknown operation: %s", op)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot %s image: %s", op, strings.Join(missing, "; "))
+	}
+	return nil
+}
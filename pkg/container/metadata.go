@@ -0,0 +1,229 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// MetadataFormatLabel is the label recording the version of the format of an image's metadata
+	MetadataFormatLabel = "Metadata_format"
+
+	// MetadataFormat is the version of the format of the metadata of the images we create
+	MetadataFormat = 2
+
+	// LegacyMetadataFormat is the version assigned to images created before the introduction of MetadataFormatLabel
+	LegacyMetadataFormat = 1
+
+	// HealthCheckLabel is the label recording the command schedulers can run to check that a container is ready
+	HealthCheckLabel = "HealthCheck"
+
+	// DefaultHealthCheck is the health-check command used when none is specified
+	DefaultHealthCheck = "mpirun -n 1 true"
+
+	// CUDALabel is the label specifying that the image relies on CUDA (NVIDIA GPUs)
+	CUDALabel = "CUDA"
+
+	// MPIDeviceLabel is the label recording the device MPI was built with, e.g., ch4:ucx for MPICH
+	MPIDeviceLabel = "MPI_Device"
+
+	// AppBuildGenerationLabel is the label recording how many times the application layer of an image was
+	// rebuilt on top of the original image
+	AppBuildGenerationLabel = "App_build_generation"
+
+	// BenchmarksLabel is the label recording the directory of the MPI benchmarks (OSU micro-benchmarks) installed in an image
+	BenchmarksLabel = "OSU_Benchmarks"
+
+	// BuildHostOSLabel is the label recording the Linux distribution of the host where an image was built
+	BuildHostOSLabel = "Build_host_OS"
+
+	// BuildHostKernelLabel is the label recording the kernel of the host where an image was built
+	BuildHostKernelLabel = "Build_host_kernel"
+
+	// GCCVersionLabel is the label recording the version of gcc installed in an image
+	GCCVersionLabel = "GCC_version"
+
+	// GFortranVersionLabel is the label recording the version of gfortran installed in an image
+	GFortranVersionLabel = "GFortran_version"
+
+	// InterconnectLabel is the label recording the interconnect an image was tuned for
+	InterconnectLabel = "Interconnect"
+
+	// LaunchCommandLabel is the label recording the recommended command to launch an image
+	LaunchCommandLabel = "Launch_command"
+
+	// InterconnectInfiniband is the identifier of Infiniband networks
+	InterconnectInfiniband = "infiniband"
+
+	// InterconnectRoCE is the identifier of RDMA over Converged Ethernet networks
+	InterconnectRoCE = "roce"
+
+	// InterconnectEthernet is the identifier of Ethernet networks
+	InterconnectEthernet = "ethernet"
+
+	// InterconnectOmniPath is the identifier of Omni-Path networks
+	InterconnectOmniPath = "omnipath"
+)
+
+// SupportedInterconnects returns the list of the interconnects images can be tuned for
+func SupportedInterconnects() []string {
+	return []string{InterconnectInfiniband, InterconnectRoCE, InterconnectEthernet, InterconnectOmniPath}
+}
+
+// IsSupportedInterconnect checks whether an interconnect is supported; the check is case-insensitive
+func IsSupportedInterconnect(interconnect string) bool {
+	for _, i := range SupportedInterconnects() {
+		if strings.EqualFold(i, interconnect) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckInterconnect returns an error when a container was tuned for an interconnect that is not the one of
+// the cluster. Images without interconnect and clusters without configured interconnect always match.
+func CheckInterconnect(c *Config, sysCfg *sys.Config) error {
+	if c.Interconnect == "" || sysCfg.Interconnect == "" || strings.EqualFold(c.Interconnect, sysCfg.Interconnect) {
+		return nil
+	}
+	return fmt.Errorf("%s was tuned for %s but the cluster interconnect is %s, performance may be degraded", c.Path, c.Interconnect, sysCfg.Interconnect)
+}
+
+// CheckMPI returns an error when the MPI of an image, as recorded in its labels, is not the requested one.
+// The version is only compared when requested.
+func CheckMPI(c *Config, imageMPI *implem.Info, requested *implem.Info) error {
+	if requested == nil || requested.ID == "" {
+		return nil
+	}
+	if imageMPI.ID == "" {
+		return fmt.Errorf("%s does not record its MPI implementation, %s %s was requested", c.Path, requested.ID, requested.Version)
+	}
+	if imageMPI.ID != requested.ID || (requested.Version != "" && imageMPI.Version != requested.Version) {
+		return fmt.Errorf("%s provides %s %s while %s %s was requested", c.Path, imageMPI.ID, imageMPI.Version, requested.ID, requested.Version)
+	}
+	return nil
+}
+
+// inspectJSON is the part of the JSON output of 'singularity inspect --json' that we care about
+type inspectJSON struct {
+	Data struct {
+		Attributes struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// parseTextLabels parses the labels from the free-text output of 'singularity inspect', one "key: value" per line
+func parseTextLabels(output string) map[string]string {
+	labels := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		tokens := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		labels[tokens[0]] = strings.TrimSpace(tokens[1])
+	}
+	return labels
+}
+
+// parseJSONLabels parses the labels from the JSON output of 'singularity inspect', either the full
+// document or a plain set of labels
+func parseJSONLabels(output string) (map[string]string, error) {
+	var doc inspectJSON
+	err := json.Unmarshal([]byte(output), &doc)
+	if err == nil && doc.Data.Attributes.Labels != nil {
+		return doc.Data.Attributes.Labels, nil
+	}
+
+	labels := make(map[string]string)
+	err = json.Unmarshal([]byte(output), &labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse labels: %s", err)
+	}
+	return labels, nil
+}
+
+// parseLabels parses the labels from the output of 'singularity inspect', in free-text or JSON format
+func parseLabels(output string) (map[string]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(output), "{") {
+		return parseJSONLabels(output)
+	}
+	return parseTextLabels(output), nil
+}
+
+// getMetadataFormat returns the version of the format of an image's metadata based on its labels
+func getMetadataFormat(labels map[string]string) (int, error) {
+	value, ok := labels[MetadataFormatLabel]
+	if !ok {
+		return LegacyMetadataFormat, nil
+	}
+	format, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s label: %s", MetadataFormatLabel, value)
+	}
+	if format > MetadataFormat {
+		return 0, fmt.Errorf("unsupported metadata format: %d", format)
+	}
+	return format, nil
+}
+
+// GetAppBuildGeneration returns the generation of the application layer of an image based on its labels,
+// 0 for images whose application was never rebuilt
+func GetAppBuildGeneration(labels map[string]string) (int, error) {
+	value, ok := labels[AppBuildGenerationLabel]
+	if !ok {
+		return 0, nil
+	}
+	generation, err := strconv.Atoi(value)
+	if err != nil || generation < 0 {
+		return 0, fmt.Errorf("invalid %s label: %s", AppBuildGenerationLabel, value)
+	}
+	return generation, nil
+}
+
+func parseInspectOutput(output string) (Config, implem.Info, error) {
+	var cfg Config
+	var mpiCfg implem.Info
+
+	labels, err := parseLabels(output)
+	if err != nil {
+		return cfg, mpiCfg, err
+	}
+	cfg.MetadataFormat, err = getMetadataFormat(labels)
+	if err != nil {
+		return cfg, mpiCfg, err
+	}
+
+	mpiCfg.ID = labels["MPI_Implementation"]
+	mpiCfg.Version = labels["MPI_Version"]
+	cfg.Model = labels["Model"]
+	cfg.Distro = labels["Linux_distribution"]
+	cfg.DistroVersion = labels["Linux_version"]
+	cfg.AppName = labels["Application"]
+	cfg.AppExe = labels["App_exe"]
+	cfg.MPIDir = labels["MPI_Directory"]
+	cfg.ROCm = labels["ROCm"] == "true"
+	cfg.HealthCheck = labels[HealthCheckLabel]
+	cfg.CUDA = labels[CUDALabel] == "true"
+	cfg.Interconnect = labels[InterconnectLabel]
+	cfg.Benchmarks = labels[BenchmarksLabel]
+	cfg.LaunchCommand = labels[LaunchCommandLabel]
+	cfg.AppBuildGeneration, err = GetAppBuildGeneration(labels)
+	if err != nil {
+		return cfg, mpiCfg, err
+	}
+	mpiCfg.WithROCm = cfg.ROCm
+	mpiCfg.Device = labels[MPIDeviceLabel]
+
+	return cfg, mpiCfg, nil
+}
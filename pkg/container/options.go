@@ -0,0 +1,179 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// ProgressFunc is called with a short description of each step of an operation
+type ProgressFunc func(step string)
+
+// CreateOptions are the options used to build an image. New capabilities are added as new fields so
+// the signature of CreateWithOptions does not change; the zero value builds the image the same way than Create.
+type CreateOptions struct {
+	// PrepareOnly specifies whether a build bundle is created instead of building the image, as sysCfg.PrepareOnly
+	PrepareOnly bool
+
+	// Sign specifies whether the image is signed once built
+	Sign bool
+
+	// Timeout is the maximum duration of the build, rounded down to the minute; the default timeout is used if not set
+	Timeout time.Duration
+
+	// Progress is called before each step of the build (optional)
+	Progress ProgressFunc
+
+	// Parent is the path to the image the definition file bootstraps from, if any; its digest is recorded in
+	// the manifest of the build for provenance
+	Parent string
+}
+
+// PullOptions are the options used to pull an image; the zero value pulls the image the same way than Pull
+type PullOptions struct {
+	// Force specifies whether the image is pulled again when it is already available in persistent mode
+	Force bool
+
+	// Timeout is the maximum duration of the pull; the default timeout is used if not set
+	Timeout time.Duration
+
+	// Progress is called before each step of the pull (optional)
+	Progress ProgressFunc
+}
+
+// ExecOptions gathers the runtime options of the execution of a container; the zero value executes the
+// application the same way than Exec
+type ExecOptions struct {
+	// Env is the environment of the shell started by Shell (KEY=value); the environment of the caller is used if empty
+	Env []string
+
+	// WorkDir is the directory from where the container is executed
+	WorkDir string
+
+	// Args are arguments passed to the application in addition to the ones of the image's configuration
+	Args []string
+
+	// Timeout is the maximum duration of the execution, rounded down to the minute; the default timeout is used if not set
+	Timeout time.Duration
+
+	// Progress is called before each step of the execution (optional)
+	Progress ProgressFunc
+}
+
+// VerifyOptions are the options used to verify the signature of an image; the zero value verifies the image
+// the same way than Verify
+type VerifyOptions struct {
+	// Fingerprint is the fingerprint of the key expected to have signed the image (optional). When set, the
+	// image is verified with the local keyring only and must be signed by this key.
+	Fingerprint string
+}
+
+// checkCmdTimeout checks the timeout of an operation executing a command whose timeout is expressed in minutes
+func checkCmdTimeout(timeout time.Duration) error {
+	if timeout != 0 && timeout < time.Minute {
+		return fmt.Errorf("invalid timeout %s, it must be at least one minute", timeout)
+	}
+	return nil
+}
+
+// getCmdTimeout returns the timeout of a command in minutes, as expected by syexec.SyCmd, def if no timeout is set
+func getCmdTimeout(timeout time.Duration, def time.Duration) time.Duration {
+	if timeout == 0 {
+		return def
+	}
+	return timeout / time.Minute
+}
+
+// validate checks that the options are consistent with each other and with the configuration
+func (o *CreateOptions) validate(sysCfg *sys.Config) error {
+	if o.Sign && (o.PrepareOnly || sysCfg.PrepareOnly) {
+		return fmt.Errorf("an image cannot be signed when only the build bundle is prepared")
+	}
+	if o.Parent != "" && !util.PathExists(o.Parent) {
+		return fmt.Errorf("parent image %s does not exist", o.Parent)
+	}
+	return checkCmdTimeout(o.Timeout)
+}
+
+// getCmdTimeout returns the timeout of the build command, def if no timeout is set
+func (o *CreateOptions) getCmdTimeout(def time.Duration) time.Duration {
+	return getCmdTimeout(o.Timeout, def)
+}
+
+// progress reports a step of the build
+func (o *CreateOptions) progress(step string) {
+	if o.Progress != nil {
+		o.Progress(step)
+	}
+}
+
+// validate checks that the options are valid
+func (o *PullOptions) validate() error {
+	if o.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: %s", o.Timeout)
+	}
+	return nil
+}
+
+// progress reports a step of the pull
+func (o *PullOptions) progress(step string) {
+	if o.Progress != nil {
+		o.Progress(step)
+	}
+}
+
+// validate checks that the options are valid
+func (o *ExecOptions) validate() error {
+	return checkCmdTimeout(o.Timeout)
+}
+
+// getCmdTimeout returns the timeout of the execution command, def if no timeout is set
+func (o *ExecOptions) getCmdTimeout(def time.Duration) time.Duration {
+	return getCmdTimeout(o.Timeout, def)
+}
+
+// progress reports a step of the execution
+func (o *ExecOptions) progress(step string) {
+	if o.Progress != nil {
+		o.Progress(step)
+	}
+}
+
+// validate checks that the options are valid
+func (o *VerifyOptions) validate() error {
+	fingerprint := normalizeFingerprint(o.Fingerprint)
+	if o.Fingerprint != "" && !fingerprintRegexp.MatchString(fingerprint) {
+		return fmt.Errorf("invalid key fingerprint: %s", o.Fingerprint)
+	}
+	return nil
+}
+
+// Create builds a container based on a MPI configuration
+//
+// Deprecated: use CreateWithOptions.
+func Create(container *Config, sysCfg *sys.Config) error {
+	return CreateWithOptions(container, sysCfg, CreateOptions{})
+}
+
+// Pull retieves an image from the registry
+//
+// Deprecated: use PullWithOptions.
+func Pull(containerInfo *Config, sysCfg *sys.Config) error {
+	return PullWithOptions(containerInfo, sysCfg, PullOptions{})
+}
+
+// Exec executes the application of a container without a job manager and returns its output
+//
+// Deprecated: use ExecWithOptions.
+func Exec(c *Config, hostMPI *implem.Info, hostEnv *buildenv.Info, sysCfg *sys.Config) (string, error) {
+	return ExecWithOptions(c, hostMPI, hostEnv, sysCfg, ExecOptions{})
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"sync"
+)
+
+// passphrasePromptRegexp matches the prompt Singularity displays to get the passphrase of a key
+var passphrasePromptRegexp = regexp.MustCompile(`(?i)enter key passphrase`)
+
+// promptWatcher gathers the output of a command and cancels it as soon as the passphrase is requested more often
+// than expected, i.e., when the passphrase we provided was rejected
+type promptWatcher struct {
+	mutex  sync.Mutex
+	buf    bytes.Buffer
+	cancel context.CancelFunc
+	killed bool
+
+	// maxPrompts is the number of times the passphrase can be requested, 0 when it is provided through the environment
+	maxPrompts int
+}
+
+func newPromptWatcher(cancel context.CancelFunc, maxPrompts int) *promptWatcher {
+	return &promptWatcher{cancel: cancel, maxPrompts: maxPrompts}
+}
+
+// Write implements io.Writer; it is safe to use the same watcher for both stdout and stderr
+func (w *promptWatcher) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	n, err := w.buf.Write(p)
+	if !w.killed && len(passphrasePromptRegexp.FindAllIndex(w.buf.Bytes(), w.maxPrompts+1)) > w.maxPrompts {
+		w.killed = true
+		w.cancel()
+	}
+	return n, err
+}
+
+// reprompted checks whether the passphrase was requested more often than expected
+func (w *promptWatcher) reprompted() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.killed
+}
+
+// String returns the output gathered so far
+func (w *promptWatcher) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buf.String()
+}
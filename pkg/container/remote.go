@@ -0,0 +1,124 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// libraryScheme is the scheme of the URLs of images in a library
+	libraryScheme = "library://"
+
+	// remoteCheckTimeout is the timeout of the requests checking whether a remote image exists
+	remoteCheckTimeout = 30 * time.Second
+)
+
+// remoteImageExists checks whether a remote image exists before pulling it, it can be replaced for testing
+var remoteImageExists = RemoteImageExists
+
+// httpImageExists checks with a HEAD request whether an image available over HTTP(S) exists
+func httpImageExists(url string) (bool, error) {
+	client := http.Client{Timeout: remoteCheckTimeout}
+	resp, err := client.Head(url)
+	if err != nil {
+		return false, fmt.Errorf("failed to query %s: %s", url, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 400:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status when querying %s: %s", url, resp.Status)
+}
+
+// libraryImageExists checks with 'singularity search' whether an image of a library exists, the tag of the
+// image is not checked. The search only reports the public images it indexed, e.g., private images are not
+// found, so an image that is not found is assumed to exist and pulling it reports the error if any.
+func libraryImageExists(url string, sysCfg *sys.Config) (bool, error) {
+	ref := strings.TrimPrefix(url, libraryScheme)
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		ref = ref[:idx]
+	}
+	if ref == "" {
+		return false, fmt.Errorf("invalid library URL: %s", url)
+	}
+
+	cmd := getSyCmd("search", []string{path.Base(ref)}, sysCfg)
+	cmd.Timeout = sys.CmdTimeout
+	res := runner.Run(&cmd)
+	if res.Err != nil {
+		return false, fmt.Errorf("failed to search %s - stdout: %s; stderr: %s; err: %s", ref, res.Stdout, res.Stderr, res.Err)
+	}
+	if !strings.Contains(res.Stdout, ref) {
+		log.Printf("-> %s not found by the search of the library, assuming it exists", url)
+	}
+	return true, nil
+}
+
+// RemoteImageExists checks whether a remote image exists: images of a library are searched with 'singularity
+// search' and images available over HTTP(S) are checked with a HEAD request. Images that are not found by the
+// search of the library and the images of other registries cannot be checked so they are assumed to exist,
+// pulling them reports the error if any.
+func RemoteImageExists(url string, sysCfg *sys.Config) (bool, error) {
+	switch {
+	case strings.HasPrefix(url, libraryScheme):
+		return libraryImageExists(url, sysCfg)
+	case strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://"):
+		return httpImageExists(url)
+	}
+
+	log.Printf("-> Unable to check whether %s exists, assuming it does", url)
+	return true, nil
+}
+
+// getRemoteBuilder returns the URL of the remote build service used to build an image
+func getRemoteBuilder(container *Config) string {
+	if container.RemoteBuilderURL == "" {
+		return "default"
+	}
+	return container.RemoteBuilderURL
+}
+
+// getRemoteBuildFlags returns the flags of 'singularity build' building an image with a remote build service
+func getRemoteBuildFlags(container *Config) []string {
+	flags := []string{"--remote"}
+	if container.RemoteBuilderURL != "" {
+		flags = append(flags, "--builder", container.RemoteBuilderURL)
+	}
+	return flags
+}
+
+// checkRemoteBuild checks that the configuration of a container is compatible with a remote build: the
+// directories of the host cannot be bound in the build service and the service only creates SIF files
+func checkRemoteBuild(container *Config) error {
+	if !container.Remote {
+		if container.RemoteBuilderURL != "" {
+			return fmt.Errorf("remote builder %s is set but the remote build of %s is not requested", container.RemoteBuilderURL, container.Path)
+		}
+		return nil
+	}
+	if container.RemoteBuilderURL != "" && !strings.HasPrefix(container.RemoteBuilderURL, "http://") && !strings.HasPrefix(container.RemoteBuilderURL, "https://") {
+		return fmt.Errorf("invalid remote builder URL: %s", container.RemoteBuilderURL)
+	}
+	if container.Sandbox {
+		return fmt.Errorf("sandbox %s cannot be built remotely", container.Path)
+	}
+	if len(container.BuildBinds) > 0 {
+		return fmt.Errorf("directories of the host cannot be bound in the remote build of %s", container.Path)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// MinMPICHSharedMemSize is the minimum size of /dev/shm for the shared-memory segments of MPICH
+const MinMPICHSharedMemSize = 256 << 20
+
+// GetRuntimeRequirements returns the requirements on the host of the execution of a container, based on the
+// metadata of its image (see GetMetadata) and the configuration
+func GetRuntimeRequirements(c *Config, mpiCfg *implem.Info, sysCfg *sys.Config) sys.Requirements {
+	var req sys.Requirements
+	req.NvidiaDevices = c.CUDA
+	req.AMDDevices = c.ROCm || mpiCfg.WithROCm
+	req.InfinibandDevices = sysCfg.ExposeIBDevices || strings.Contains(strings.ToLower(mpiCfg.Device), "ucx")
+	req.UserNamespaces = sysCfg.Nopriv
+	if mpiCfg.ID == implem.MPICH {
+		req.MinSharedMemSize = MinMPICHSharedMemSize
+	}
+	return req
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/sylabs/singularity-mpi/pkg/checker"
+	"github.com/sylabs/singularity-mpi/pkg/sy"
+	"github.com/sylabs/singularity-mpi/pkg/syexec"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// sandboxDirName is the name of the sandbox in the temporary directory created for a smoke test
+const sandboxDirName = "rootfs"
+
+// getSandboxBuildCmd returns the command to build a sandbox from a given definition file
+func getSandboxBuildCmd(sandbox *Config, sysCfg *sys.Config) syexec.SyCmd {
+	cmd := getBuildCmd(sandbox, sysCfg, sandbox.DefFile)
+
+	// A sandbox is thrown away, there is nothing to record
+	cmd.ManifestDir = ""
+	cmd.ManifestFileHash = nil
+
+	for i, arg := range cmd.CmdArgs {
+		if arg == "build" {
+			cmd.CmdArgs = append(cmd.CmdArgs[:i+1], append([]string{"--sandbox"}, cmd.CmdArgs[i+1:]...)...)
+			break
+		}
+	}
+	return cmd
+}
+
+// removeSandbox deletes the temporary directory of a sandbox. A sandbox built with sudo belongs to root
+// so it is deleted with sudo as well.
+func removeSandbox(dir string, sysCfg *sys.Config) {
+	if sy.IsSudoCmd("build", sysCfg) && !sysCfg.Nopriv {
+		var cmd syexec.SyCmd
+		cmd.BinPath = sysCfg.SudoBin
+		cmd.CmdArgs = []string{"rm", "-rf", dir}
+		res := runner.Run(&cmd)
+		if res.Err != nil {
+			log.Printf("failed to remove %s - stdout: %s; stderr: %s; err: %s", dir, res.Stdout, res.Stderr, res.Err)
+		}
+	}
+
+	err := os.RemoveAll(dir)
+	if err != nil {
+		log.Printf("failed to remove %s: %s", dir, err)
+	}
+}
+
+// SmokeTest builds the definition file of a container into a temporary sandbox, runs the %test section of
+// the sandbox and deletes it. It validates that a definition file builds without creating an image.
+func SmokeTest(container *Config, sysCfg *sys.Config) error {
+	var err error
+
+	// Some sanity checks
+	if container.DefFile == "" || container.BuildDir == "" {
+		return fmt.Errorf("definition file or build directory is undefined")
+	}
+
+	if sysCfg.SingularityBin == "" {
+		sysCfg.SingularityBin, err = exec.LookPath("singularity")
+		if err != nil {
+			return fmt.Errorf("singularity not available: %s", err)
+		}
+	}
+
+	err = sy.CheckIntegrity(sysCfg)
+	if err != nil {
+		return fmt.Errorf("Singularity installation has been compromised: %s", err)
+	}
+
+	err = checker.CheckDefFileSources(container.DefFile, container.BuildDir)
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := ioutil.TempDir(container.BuildDir, "smoketest-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	defer removeSandbox(tempDir, sysCfg)
+
+	sandbox := *container
+	sandbox.Path = filepath.Join(tempDir, sandboxDirName)
+	sandbox.SquashfsBlockSize = 0
+
+	log.Printf("- Building sandbox %s from %s...", sandbox.Path, sandbox.DefFile)
+	cmd := getSandboxBuildCmd(&sandbox, sysCfg)
+	res := runBuild(&cmd, sysCfg.RetryTransient)
+	if res.Err != nil {
+		return fmt.Errorf("failed to build sandbox - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	}
+
+	log.Printf("- Testing sandbox %s...", sandbox.Path)
+	cmd = getSyCmd("test", []string{sandbox.Path}, sysCfg)
+	cmd.ExecDir = sandbox.BuildDir
+	res = runner.Run(&cmd)
+	if res.Err != nil {
+		return fmt.Errorf("test of sandbox failed - stdout: %s; stderr: %s; err: %s", res.Stdout, res.Stderr, res.Err)
+	}
+
+	return nil
+}
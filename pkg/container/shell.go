@@ -0,0 +1,123 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/implem"
+	"github.com/sylabs/singularity-mpi/pkg/sy"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// secretEnvKeywords are the keywords identifying environment variables whose value must not be displayed
+var secretEnvKeywords = []string{"PASSPHRASE", "PASSWORD", "SECRET", "TOKEN", "KEY"}
+
+// ShellCommand returns the command and environment to start a shell in a container with the exact runtime
+// configuration (binds, environment, working directory) used to execute the container's application
+func ShellCommand(c *Config, opts ExecOptions, hostMPI *implem.Info, hostEnv *buildenv.Info, sysCfg *sys.Config) ([]string, []string, error) {
+	if c == nil || c.Path == "" {
+		return nil, nil, fmt.Errorf("undefined container image")
+	}
+	if hostMPI == nil {
+		hostMPI = new(implem.Info)
+	}
+	if hostEnv == nil {
+		hostEnv = new(buildenv.Info)
+	}
+	err := checkBinds(hostEnv, c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid binds: %s", err)
+	}
+
+	singularityBin := sysCfg.SingularityBin
+	if singularityBin == "" {
+		singularityBin = "singularity"
+	}
+
+	var argv []string
+	if sy.IsSudoCmd("exec", sysCfg) {
+		argv = append(argv, sysCfg.SudoBin)
+	}
+	argv = append(argv, singularityBin)
+	argv = append(argv, sysCfg.GlobalSingularityFlags...)
+	argv = append(argv, "shell")
+	argv = append(argv, GetMPIExecCfg(hostMPI, hostEnv, c, sysCfg)...)
+	if opts.WorkDir != "" {
+		argv = append(argv, "--pwd", opts.WorkDir)
+	}
+	argv = append(argv, c.Path)
+
+	env := opts.Env
+	bindEnv := GetBindEnv(hostEnv)
+	if len(bindEnv) > 0 {
+		if len(env) == 0 {
+			env = os.Environ()
+		}
+		env = append(env, bindEnv...)
+	}
+
+	return argv, env, nil
+}
+
+// Shell starts a shell in a container, attached to the caller's terminal, with the exact runtime
+// configuration used to execute the container's application
+func Shell(c *Config, opts ExecOptions, hostMPI *implem.Info, hostEnv *buildenv.Info, sysCfg *sys.Config) error {
+	argv, env, err := ShellCommand(c, opts, hostMPI, hostEnv, sysCfg)
+	if err != nil {
+		return err
+	}
+
+	// No timeout and no buffering, this is an interactive session
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = opts.WorkDir
+	if len(env) > 0 {
+		cmd.Env = env
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// isSecretEnv checks whether an environment variable (KEY=value) may hold a secret
+func isSecretEnv(envVar string) bool {
+	key := strings.ToUpper(strings.SplitN(envVar, "=", 2)[0])
+	for _, keyword := range secretEnvKeywords {
+		if strings.Contains(key, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// shellQuote quotes a string so it can safely be pasted in a shell
+func shellQuote(str string) string {
+	if str != "" && strings.Trim(str, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=/.,:@%") == "" {
+		return str
+	}
+	return "'" + strings.Replace(str, "'", `'"'"'`, -1) + "'"
+}
+
+// FormatShellCommand returns a ready-to-paste command line from a command and its environment, with the value
+// of the environment variables that may hold a secret redacted
+func FormatShellCommand(argv []string, env []string) string {
+	var tokens []string
+	for _, envVar := range env {
+		if isSecretEnv(envVar) {
+			envVar = strings.SplitN(envVar, "=", 2)[0] + "=<redacted>"
+		}
+		tokens = append(tokens, shellQuote(envVar))
+	}
+	for _, arg := range argv {
+		tokens = append(tokens, shellQuote(arg))
+	}
+	return strings.Join(tokens, " ")
+}
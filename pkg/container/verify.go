@@ -0,0 +1,40 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package container
+
+import (
+	"regexp"
+	"strings"
+)
+
+// keyIDLength is the number of hexadecimal digits of the key IDs, i.e., the end of the fingerprints, displayed
+// by older versions of Singularity
+const keyIDLength = 16
+
+// fingerprintRegexp is the format of the fingerprints of the keys, once normalized
+var fingerprintRegexp = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+// unsignedRegexp matches the messages of 'singularity verify' for images without any signature
+var unsignedRegexp = regexp.MustCompile(`(?i)(no signatures? found|signature not found|no digital signature)`)
+
+// normalizeFingerprint returns a fingerprint in uppercase, without spaces nor 0x prefix
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+	return strings.TrimPrefix(fingerprint, "0X")
+}
+
+// isUnsigned checks from the output of 'singularity verify' whether the image has no signature
+func isUnsigned(output string) bool {
+	return unsignedRegexp.MatchString(output)
+}
+
+// isSignedBy checks from the output of 'singularity verify' whether the image is signed by the key with the
+// given fingerprint; the full fingerprint or the key ID is displayed depending on the version of Singularity
+func isSignedBy(output string, fingerprint string) bool {
+	fingerprint = normalizeFingerprint(fingerprint)
+	output = strings.ToUpper(output)
+	return strings.Contains(output, fingerprint) || strings.Contains(output, fingerprint[len(fingerprint)-keyIDLength:])
+}
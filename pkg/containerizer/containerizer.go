@@ -11,23 +11,150 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gvallee/go_util/pkg/util"
 	"github.com/gvallee/kv/pkg/kv"
 	"github.com/sylabs/singularity-mpi/internal/pkg/deffile"
 	"github.com/sylabs/singularity-mpi/internal/pkg/distro"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/pkg/app"
 	"github.com/sylabs/singularity-mpi/pkg/buildenv"
 	"github.com/sylabs/singularity-mpi/pkg/builder"
+	"github.com/sylabs/singularity-mpi/pkg/checker"
 	"github.com/sylabs/singularity-mpi/pkg/container"
 	"github.com/sylabs/singularity-mpi/pkg/implem"
 	"github.com/sylabs/singularity-mpi/pkg/mpi"
+	"github.com/sylabs/singularity-mpi/pkg/sy"
 	"github.com/sylabs/singularity-mpi/pkg/sys"
 )
 
 const (
 	mpiModelKey = "mpi_model"
+
+	// mpiDeviceKey is the key used to specify the device to use when building MPI, e.g., "ch4:ucx" for MPICH
+	mpiDeviceKey = "mpi_device"
+
+	// mpiConfigureArgsKey is the key used to specify the space-separated additional arguments passed to configure when building MPI
+	mpiConfigureArgsKey = "mpi_configure_args"
+
+	// appCompilerKey is the key used to specify the compiler to use for the application (c, cxx, fortran or auto)
+	appCompilerKey = "app_compiler"
+
+	// appBuildSystemKey is the key used to specify the build system of the application when compiled on the host (make, cmake, mpicc or auto)
+	appBuildSystemKey = "app_build_system"
+
+	// appSourceDirKey is the key used to specify the directory of the application's sources when it is not the name of the tarball or of the Git repository
+	appSourceDirKey = "app_source_dir"
+
+	// appCMakeArgsKey is the key used to specify the space-separated additional arguments of cmake when the application is built with CMake
+	appCMakeArgsKey = "app_cmake_args"
+
+	// appTestCmdKey is the key used to specify the command running the test suite of the application at build time
+	appTestCmdKey = "app_test_cmd"
+
+	// appTestRanksKey is the key used to specify the number of ranks of the MPI job running the test suite of the application
+	appTestRanksKey = "app_test_ranks"
+
+	// appBuildEnvPrefix is the prefix of the keys used to specify the environment variables set before compiling the application, e.g., app_build_env_CFLAGS
+	appBuildEnvPrefix = "app_build_env_"
+
+	// mpiCCKey, mpiCXXKey and mpiFCKey are the keys used to specify the C, C++ and Fortran compilers to use to configure MPI
+	mpiCCKey  = "mpi_cc"
+	mpiCXXKey = "mpi_cxx"
+	mpiFCKey  = "mpi_fc"
+
+	// userKey is the key used to specify the default user of the container
+	userKey = "container_user"
+
+	// groupKey is the key used to specify the group of the default user of the container
+	groupKey = "container_group"
+
+	// mpiWrapperKey is the key used to specify whether the application is started through a wrapper setting up the MPI environment
+	mpiWrapperKey = "mpi_wrapper"
+
+	// healthCheckKey is the key used to specify the health-check command recorded in the labels of the image, or true to use the default one
+	healthCheckKey = "health_check"
+
+	// interconnectKey is the key used to specify the interconnect the image is tuned for
+	interconnectKey = "interconnect"
+
+	// benchmarksKey is the key used to specify whether the MPI benchmarks are installed in the image
+	benchmarksKey = "benchmarks"
+
+	// lenientKey is the key used to specify whether problems detected in a newly created image are only reported as warnings
+	lenientKey = "lenient"
+
+	// squashfsBlockSizeKey is the key used to specify the block size in bytes of the squashfs filesystem of the image
+	squashfsBlockSizeKey = "squashfs_block_size"
+
+	// rocmKey is the key used to specify whether MPI needs to be built with ROCm support
+	rocmKey = "rocm"
+
+	// buildArgsKey is the key used to specify whether the definition file uses build arguments when supported by Singularity
+	buildArgsKey = "build_args"
+
+	// buildArgPrefix is the prefix of the keys used to override the default value of build arguments, e.g., build_arg_MPI_VERSION
+	buildArgPrefix = "build_arg_"
+
+	// baseImageKey is the key used to specify a local image to layer the new image onto
+	baseImageKey = "base_image"
+
+	// baseImageMPIDirKey is the key used to specify the directory of the MPI installation of the base image, removed before installing MPI
+	baseImageMPIDirKey = "base_image_mpi_dir"
+
+	// appLicenseKey is the key used to specify the path to the license of the application, copied into the image
+	appLicenseKey = "app_license"
+
+	// appReadmeKey is the key used to specify the path to the README of the application, copied into the image
+	appReadmeKey = "app_readme"
+
+	// sharedMemKey is the key used to specify the shared-memory transports to setup in the image, e.g., "xpmem,knem"
+	sharedMemKey = "shared_mem"
+
+	// stageLargeFilesKey is the key used to specify whether large directories are bound at build time instead of being staged
+	stageLargeFilesKey = "stage_large_files"
+
+	// stageIncludeKey is the key used to specify the comma-separated patterns of the files copied from the staged directories
+	stageIncludeKey = "stage_include"
+
+	// buildJobsKey is the key used to specify the number of parallel jobs used to compile MPI in the image
+	buildJobsKey = "build_jobs"
+
+	// mirrorsKey is the key used to specify the comma-separated mirrors of the Linux distribution, in order of preference
+	mirrorsKey = "mirrors"
+
+	// provenanceKey is the key used to specify whether the build host and the versions of the compilers are recorded in the labels of the image
+	provenanceKey = "provenance"
+
+	// appRefKey is the key used to specify the branch, tag or commit of the Git repository of the application
+	appRefKey = "app_ref"
+
+	// appDepthKey is the key used to specify the depth of the clone of the Git repository of the application
+	appDepthKey = "app_depth"
+
+	// appChecksumKey is the key used to specify the SHA-256 checksum of the tarball of the application
+	appChecksumKey = "app_checksum"
+
+	// extraPackagesKey is the key used to specify the comma-separated extra packages of the Linux distribution installed in the image
+	extraPackagesKey = "extra_packages"
+
+	// mpiMountPointKey is the key used to specify whether hybrid images can later be executed with the MPI of the host bound over the MPI of the image
+	mpiMountPointKey = "mpi_mount_point"
+
+	// appSymlinkKey is the key used to specify whether the symlink to the application's binary is created in the application directory (true by default)
+	appSymlinkKey = "app_symlink"
+
+	// archKey is the key used to specify the target architecture of the image, e.g., x86_64 or aarch64
+	archKey = "arch"
+
+	// launchInfoKey is the key used to specify whether MPI images record the recommended command to launch them
+	launchInfoKey = "launch_info"
+
+	// buildTestKey is the key used to specify whether the installation of MPI and the application are checked at build time
+	buildTestKey = "build_test"
 )
 
 type appConfig struct {
@@ -40,6 +167,48 @@ type appConfig struct {
 	// envScript is the path to the script that the user will be
 	// able to use to set all the environment variables necessary to use the MPI installed on the host
 	envScript string
+
+	// buildArgs specifies whether the definition file uses build arguments when supported by Singularity
+	buildArgs bool
+
+	// baseImage is the path to a local image the new image is layered onto
+	baseImage string
+
+	// oldMPIDir is the directory of the MPI installation of the base image
+	oldMPIDir string
+
+	// stageLargeFiles specifies whether large directories are bound at build time instead of being staged
+	stageLargeFiles bool
+
+	// stageInclude are the patterns of the files copied from the staged directories
+	stageInclude []string
+
+	// buildJobs is the number of parallel jobs used to compile MPI in the image
+	buildJobs int
+
+	// mirrors are the mirrors of the Linux distribution, in order of preference
+	mirrors []string
+
+	// provenance specifies whether the build host and the versions of the compilers are recorded in the labels of the image
+	provenance bool
+
+	// buildTest specifies whether the installation of MPI and the application are checked at build time
+	buildTest bool
+
+	// launchInfo specifies whether the recommended command to launch the image is recorded in the image
+	launchInfo bool
+
+	// extraPkgs are the extra packages of the Linux distribution installed in the image
+	extraPkgs []string
+
+	// mpiMountPoint specifies whether the directory of MPI is created before installing MPI in hybrid images
+	mpiMountPoint bool
+
+	// noAppSymlink specifies whether the symlink to the application's binary is not created in the application directory
+	noAppSymlink bool
+
+	// arch is the target architecture of the image, the architecture of the host if empty
+	arch string
 }
 
 func getMPIURL(mpi string, version string, sysCfg *sys.Config) string {
@@ -47,7 +216,7 @@ func getMPIURL(mpi string, version string, sysCfg *sys.Config) string {
 	path := filepath.Join(sysCfg.EtcDir, mpiCfgFile)
 	kvs, err := kv.LoadKeyValueConfig(path)
 	if err != nil {
-		log.Printf("[WARN] Cannot load configuration from %s: %s", path, err)
+		sylog.Warn("Cannot load configuration from %s: %s", path, err)
 		return ""
 	}
 	for _, kv := range kvs {
@@ -104,16 +273,26 @@ func generateStandardDeffile(app *appConfig, container *container.Config, sysCfg
 	deffileCfg := deffile.DefFileData{
 		Path:     container.DefFile,
 		DistroID: distro.ParseDescr(container.Distro),
+		User:     container.User,
+		Group:    container.Group,
 	}
 
 	// Sanity checks
 	if app == nil || container == nil || sysCfg == nil || container.DefFile == "" {
 		return deffileCfg, fmt.Errorf("invalid parameter(s)")
 	}
+	deffileCfg.Mirrors = app.mirrors
+	deffileCfg.Provenance = app.provenance
+	deffileCfg.EnableTest = app.buildTest
+	deffileCfg.AppTest = app.info.TestCmd != ""
+	deffileCfg.Arch = app.arch
+	deffileCfg.ExtraPkgs = app.extraPkgs
+	deffileCfg.NoAppSymlink = app.noAppSymlink
+	setStaging(app, &deffileCfg, sysCfg)
 
 	log.Printf("-> Create definition file %s\n", container.DefFile)
 
-	err := deffile.CreateBasicDefFile(&app.info, &deffileCfg, sysCfg)
+	err := deffile.Create(&app.info, &deffileCfg, sysCfg, deffile.CreateOptions{})
 	if err != nil {
 		return deffileCfg, fmt.Errorf("unable to create container: %s", err)
 	}
@@ -121,6 +300,51 @@ func generateStandardDeffile(app *appConfig, container *container.Config, sysCfg
 	return deffileCfg, nil
 }
 
+// setStaging sets the options of a definition file to bind large directories at build time, when requested
+func setStaging(app *appConfig, data *deffile.DefFileData, sysCfg *sys.Config) {
+	if !app.stageLargeFiles {
+		return
+	}
+	data.StageLargeFiles = true
+	data.StageInclude = app.stageInclude
+	if data.TargetSingularityVersion == "" {
+		data.TargetSingularityVersion = sy.ParseVersion(sy.GetVersion(sysCfg))
+	}
+}
+
+// getMPIDeffileData returns the description of the definition file of an image with MPI, as specified by the
+// configuration file
+func getMPIDeffileData(app *appConfig, mpiCfg *mpi.Config, sysCfg *sys.Config) deffile.DefFileData {
+	deffileCfg := deffile.DefFileData{
+		Path:     mpiCfg.Container.DefFile,
+		DistroID: distro.ParseDescr(mpiCfg.Container.Distro),
+	}
+	deffileCfg.MpiImplm = &mpiCfg.Implem
+	deffileCfg.InternalEnv = &mpiCfg.Buildenv
+	deffileCfg.InternalEnv.InstallDir = filepath.Join(sysCfg.Persistent, sys.MPIInstallDirPrefix+mpiCfg.Implem.ID+"-"+mpiCfg.Implem.Version)
+	deffileCfg.Model = mpiCfg.Container.Model
+	deffileCfg.SharedMemTransports = mpiCfg.Container.SharedMemTransports
+	deffileCfg.User = mpiCfg.Container.User
+	deffileCfg.Group = mpiCfg.Container.Group
+	deffileCfg.MPIWrapper = mpiCfg.Container.MPIWrapper
+	deffileCfg.HealthCheck = mpiCfg.Container.HealthCheck
+	deffileCfg.Interconnect = mpiCfg.Container.Interconnect
+	deffileCfg.BaseImage = app.baseImage
+	deffileCfg.OldMPIDir = app.oldMPIDir
+	deffileCfg.BuildJobs = app.buildJobs
+	deffileCfg.Mirrors = app.mirrors
+	deffileCfg.Provenance = app.provenance
+	deffileCfg.EnableTest = app.buildTest
+	deffileCfg.AppTest = app.info.TestCmd != ""
+	deffileCfg.Arch = app.arch
+	deffileCfg.ExtraPkgs = app.extraPkgs
+	deffileCfg.NoAppSymlink = app.noAppSymlink
+	deffileCfg.MPIMountPoint = app.mpiMountPoint
+	deffileCfg.LaunchInfo = app.launchInfo
+	deffileCfg.BuildArgs = app.buildArgs
+	return deffileCfg
+}
+
 func generateMPIDeffile(app *appConfig, mpiCfg *mpi.Config, sysCfg *sys.Config) (deffile.DefFileData, error) {
 	deffileCfg := deffile.DefFileData{
 		Path:     mpiCfg.Container.DefFile,
@@ -133,17 +357,21 @@ func generateMPIDeffile(app *appConfig, mpiCfg *mpi.Config, sysCfg *sys.Config)
 	}
 
 	log.Printf("-> Creating definition file %s for application %s\n", mpiCfg.Container.DefFile, app.info.Name)
+	for _, warning := range checker.CheckCombination(&mpiCfg.Implem, deffileCfg.DistroID) {
+		sylog.Warn("%s", warning)
+	}
 
-	deffileCfg.MpiImplm = &mpiCfg.Implem
-	deffileCfg.InternalEnv = &mpiCfg.Buildenv
-	deffileCfg.InternalEnv.InstallDir = filepath.Join(sysCfg.Persistent, sys.MPIInstallDirPrefix+mpiCfg.Implem.ID+"-"+mpiCfg.Implem.Version)
+	deffileCfg = getMPIDeffileData(app, mpiCfg, sysCfg)
 	log.Printf("-> Installing MPI in container in %s\n", deffileCfg.InternalEnv.InstallDir)
-	deffileCfg.Model = mpiCfg.Container.Model
+	if app.buildArgs {
+		deffileCfg.TargetSingularityVersion = sy.ParseVersion(sy.GetVersion(sysCfg))
+	}
+	setStaging(app, &deffileCfg, sysCfg)
 
 	switch mpiCfg.Container.Model {
 	case container.HybridModel:
 		// todo: should call the builder and not directly that function
-		err := deffile.CreateHybridDefFile(&app.info, &deffileCfg, sysCfg)
+		err := deffile.Create(&app.info, &deffileCfg, sysCfg, deffile.CreateOptions{})
 		if err != nil {
 			return deffileCfg, fmt.Errorf("unable to create container: %s", err)
 		}
@@ -155,14 +383,14 @@ func generateMPIDeffile(app *appConfig, mpiCfg *mpi.Config, sysCfg *sys.Config)
 
 		var hostAppBuildEnv buildenv.Info
 		log.Println("Bind mode: compiling application on the host...")
-		err = b.CompileMPIAppOnHost(&app.info, mpiCfg, &hostAppBuildEnv, sysCfg)
+		hostBuild, err := b.CompileMPIAppOnHost(&app.info, mpiCfg, &hostAppBuildEnv, sysCfg)
 		if err != nil {
 			return deffileCfg, fmt.Errorf("failed to compile the application on the host: %s", err)
 		}
 
 		// todo: should call the builder and not directly that function
 		deffileCfg.InternalEnv.InstallDir = mpiCfg.Buildenv.InstallDir
-		err = deffile.CreateBindDefFile(&app.info, &deffileCfg, sysCfg)
+		err = deffile.Create(&app.info, &deffileCfg, sysCfg, deffile.CreateOptions{HostBuild: &hostBuild})
 		if err != nil {
 			return deffileCfg, fmt.Errorf("unable to create container: %s", err)
 		}
@@ -171,6 +399,142 @@ func generateMPIDeffile(app *appConfig, mpiCfg *mpi.Config, sysCfg *sys.Config)
 	return deffileCfg, nil
 }
 
+// loadContainerOptions loads the options of the image and of its MPI implementation from the configuration file
+func loadContainerOptions(kvs []kv.KV, containerMPI *mpi.Config) error {
+	var err error
+	containerMPI.Buildenv.Compilers.CC = kv.GetValue(kvs, mpiCCKey)
+	containerMPI.Buildenv.Compilers.CXX = kv.GetValue(kvs, mpiCXXKey)
+	containerMPI.Buildenv.Compilers.FC = kv.GetValue(kvs, mpiFCKey)
+	containerMPI.Buildenv.InstallBenchmarks = kv.GetValue(kvs, benchmarksKey) == "true"
+	containerMPI.Container.Lenient = kv.GetValue(kvs, lenientKey) == "true"
+	containerMPI.Container.User = kv.GetValue(kvs, userKey)
+	containerMPI.Container.Group = kv.GetValue(kvs, groupKey)
+	containerMPI.Container.MPIWrapper = kv.GetValue(kvs, mpiWrapperKey) == "true"
+	containerMPI.Container.HealthCheck = kv.GetValue(kvs, healthCheckKey)
+	if containerMPI.Container.HealthCheck == "true" {
+		containerMPI.Container.HealthCheck = container.DefaultHealthCheck
+	}
+	containerMPI.Container.Interconnect = strings.ToLower(kv.GetValue(kvs, interconnectKey))
+	if containerMPI.Container.Interconnect != "" && !container.IsSupportedInterconnect(containerMPI.Container.Interconnect) {
+		return fmt.Errorf("unsupported interconnect %s, supported interconnects: %s", containerMPI.Container.Interconnect, strings.Join(container.SupportedInterconnects(), ", "))
+	}
+	containerMPI.Implem.Device = kv.GetValue(kvs, mpiDeviceKey)
+	containerMPI.Implem.ConfigureArgs = strings.Fields(kv.GetValue(kvs, mpiConfigureArgsKey))
+	if kv.GetValue(kvs, squashfsBlockSizeKey) != "" {
+		containerMPI.Container.SquashfsBlockSize, err = strconv.Atoi(kv.GetValue(kvs, squashfsBlockSizeKey))
+		if err != nil {
+			return fmt.Errorf("invalid squashfs block size: %s", err)
+		}
+	}
+	if kv.GetValue(kvs, rocmKey) == "true" {
+		containerMPI.Implem.WithROCm = true
+		containerMPI.Container.ROCm = true
+	}
+	if kv.GetValue(kvs, sharedMemKey) != "" {
+		for _, transport := range strings.Split(kv.GetValue(kvs, sharedMemKey), ",") {
+			containerMPI.Container.SharedMemTransports = append(containerMPI.Container.SharedMemTransports, strings.TrimSpace(transport))
+		}
+	}
+
+	return nil
+}
+
+// loadAppConfig loads the description of the application from the configuration file
+func loadAppConfig(kvs []kv.KV) (appConfig, error) {
+	var app appConfig
+	var err error
+	app.info.Name = kv.GetValue(kvs, "app_name")
+	app.info.Source = kv.GetValue(kvs, "app_url")
+	app.info.SourceChecksum = kv.GetValue(kvs, appChecksumKey)
+	app.info.Ref = kv.GetValue(kvs, appRefKey)
+	if kv.GetValue(kvs, appDepthKey) != "" {
+		app.info.Depth, err = strconv.Atoi(kv.GetValue(kvs, appDepthKey))
+		if err != nil || app.info.Depth < 0 {
+			return app, fmt.Errorf("invalid depth of the Git clone: %s", kv.GetValue(kvs, appDepthKey))
+		}
+	}
+	app.tarball = path.Base(app.info.Source)
+	app.info.BinName = kv.GetValue(kvs, "app_exe")
+	app.info.InstallCmd = kv.GetValue(kvs, "app_compile_cmd")
+	app.info.Compiler = kv.GetValue(kvs, appCompilerKey)
+	app.info.BuildSystem = kv.GetValue(kvs, appBuildSystemKey)
+	app.info.CMakeArgs = strings.Fields(kv.GetValue(kvs, appCMakeArgsKey))
+	app.info.SourceDir = kv.GetValue(kvs, appSourceDirKey)
+	app.info.TestCmd = kv.GetValue(kvs, appTestCmdKey)
+	if kv.GetValue(kvs, appTestRanksKey) != "" {
+		app.info.TestRanks, err = strconv.Atoi(kv.GetValue(kvs, appTestRanksKey))
+		if err != nil {
+			return app, fmt.Errorf("invalid number of ranks for the tests of the application: %s", err)
+		}
+	}
+	app.info.LicenseFile = kv.GetValue(kvs, appLicenseKey)
+	app.info.ReadmeFile = kv.GetValue(kvs, appReadmeKey)
+	app.buildArgs = kv.GetValue(kvs, buildArgsKey) == "true"
+	app.stageLargeFiles = kv.GetValue(kvs, stageLargeFilesKey) == "true"
+	if kv.GetValue(kvs, stageIncludeKey) != "" {
+		for _, pattern := range strings.Split(kv.GetValue(kvs, stageIncludeKey), ",") {
+			app.stageInclude = append(app.stageInclude, strings.TrimSpace(pattern))
+		}
+	}
+	if kv.GetValue(kvs, buildJobsKey) != "" {
+		app.buildJobs, err = strconv.Atoi(kv.GetValue(kvs, buildJobsKey))
+		if err != nil {
+			return app, fmt.Errorf("invalid number of build jobs: %s", err)
+		}
+		if app.buildJobs < 0 && app.buildJobs != deffile.BuildJobsAuto {
+			return app, fmt.Errorf("invalid number of build jobs: %d, must be positive or %d to use the number of CPUs", app.buildJobs, deffile.BuildJobsAuto)
+		}
+	}
+	app.provenance = kv.GetValue(kvs, provenanceKey) == "true"
+	app.buildTest = kv.GetValue(kvs, buildTestKey) == "true"
+	app.arch = kv.GetValue(kvs, archKey)
+	app.noAppSymlink = kv.GetValue(kvs, appSymlinkKey) == "false"
+	app.mpiMountPoint = kv.GetValue(kvs, mpiMountPointKey) == "true"
+	app.launchInfo = kv.GetValue(kvs, launchInfoKey) == "true"
+	if kv.GetValue(kvs, extraPackagesKey) != "" {
+		for _, pkg := range strings.Split(kv.GetValue(kvs, extraPackagesKey), ",") {
+			app.extraPkgs = append(app.extraPkgs, strings.TrimSpace(pkg))
+		}
+	}
+	if kv.GetValue(kvs, mirrorsKey) != "" {
+		for _, mirror := range strings.Split(kv.GetValue(kvs, mirrorsKey), ",") {
+			app.mirrors = append(app.mirrors, strings.TrimSpace(mirror))
+		}
+	}
+	app.baseImage = kv.GetValue(kvs, baseImageKey)
+	app.oldMPIDir = kv.GetValue(kvs, baseImageMPIDirKey)
+	if app.oldMPIDir != "" && app.baseImage == "" {
+		sylog.Warn("%s is set without %s, ignoring it", baseImageMPIDirKey, baseImageKey)
+	}
+	for _, entry := range kvs {
+		if strings.HasPrefix(entry.Key, appBuildEnvPrefix) {
+			if app.info.BuildEnv == nil {
+				app.info.BuildEnv = make(map[string]string)
+			}
+			app.info.BuildEnv[strings.TrimPrefix(entry.Key, appBuildEnvPrefix)] = entry.Value
+		}
+	}
+	if app.info.Source == "" {
+		return app, fmt.Errorf("application's URL is not defined")
+	}
+	if app.tarball == "" {
+		return app, fmt.Errorf("application's package is not defined")
+	}
+
+	return app, nil
+}
+
+// getBuildArgValues returns the values of the build arguments overridden by the configuration file
+func getBuildArgValues(kvs []kv.KV) map[string]string {
+	buildArgs := make(map[string]string)
+	for _, entry := range kvs {
+		if strings.HasPrefix(entry.Key, buildArgPrefix) {
+			buildArgs[strings.TrimPrefix(entry.Key, buildArgPrefix)] = entry.Value
+		}
+	}
+	return buildArgs
+}
+
 // ContainerizeApp will parse the configuration file specific to an app, install
 // the appropriate MPI on the host, as well as create the container.
 func ContainerizeApp(sysCfg *sys.Config) (container.Config, error) {
@@ -222,6 +586,10 @@ func ContainerizeApp(sysCfg *sys.Config) (container.Config, error) {
 	}
 
 	containerMPI.Buildenv = containerBuildEnv
+	err = loadContainerOptions(kvs, &containerMPI)
+	if err != nil {
+		return containerMPI.Container, err
+	}
 
 	// Load some generic data
 	curTime := time.Now()
@@ -231,18 +599,20 @@ func ContainerizeApp(sysCfg *sys.Config) (container.Config, error) {
 	}
 	sysCfg.Registry = url + kv.GetValue(kvs, "app_name") + ":" + curTime.Format("20060102")
 
-	// Load the app configuration
-	var app appConfig
-	app.info.Name = kv.GetValue(kvs, "app_name")
-	app.info.Source = kv.GetValue(kvs, "app_url")
-	app.tarball = path.Base(app.info.Source)
-	app.info.BinName = kv.GetValue(kvs, "app_exe")
-	app.info.InstallCmd = kv.GetValue(kvs, "app_compile_cmd")
-	if app.info.Source == "" {
-		return containerMPI.Container, fmt.Errorf("application's URL is not defined")
+	// The image is signed and uploaded once built, which can take a long time, so we make sure it is possible first
+	if sysCfg.Upload {
+		for _, op := range []string{container.OperationSign, container.OperationUpload} {
+			err = container.ValidateEnvForOperation(op, sysCfg)
+			if err != nil {
+				return containerMPI.Container, err
+			}
+		}
 	}
-	if app.tarball == "" {
-		return containerMPI.Container, fmt.Errorf("application's package is not defined")
+
+	// Load the app configuration
+	app, err := loadAppConfig(kvs)
+	if err != nil {
+		return containerMPI.Container, err
 	}
 	if app.info.InstallCmd == "" {
 		log.Println("-> Application does not need the execution of an install command")
@@ -290,6 +660,20 @@ func ContainerizeApp(sysCfg *sys.Config) (container.Config, error) {
 		}
 	}
 
+	// Build arguments can only be overridden when the definition file uses them
+	buildArgs := getBuildArgValues(kvs)
+	if len(buildArgs) > 0 {
+		if deffile.BuildArgs(&app.info, &deffileData) != nil {
+			containerMPI.Container.BuildArgs = buildArgs
+		} else {
+			sylog.Warn("the definition file does not use build arguments, ignoring overrides")
+		}
+	}
+
+	containerMPI.Container.BuildBinds = deffile.BuildBinds(&app.info, &deffileData)
+	content := deffile.GetImageContent(&app.info, &deffileData)
+	containerMPI.Container.Content = &content
+
 	// Backup the definition file when in debug mode
 	if sysCfg.Debug {
 		// We do not track failure while backing up definition file
@@ -298,17 +682,19 @@ func ContainerizeApp(sysCfg *sys.Config) (container.Config, error) {
 
 	// Create container
 	log.Println("* Creating container image...")
-	err = container.Create(&containerMPI.Container, sysCfg)
+	err = container.CreateWithOptions(&containerMPI.Container, sysCfg, container.CreateOptions{})
 	if err != nil {
 		return containerMPI.Container, fmt.Errorf("failed to create container: %s", err)
 	}
 
+	if sysCfg.PrepareOnly {
+		log.Printf("Build bundle path: %s\n", containerMPI.Container.BundleDir)
+		log.Printf("Build bundle digest: %s\n", containerMPI.Container.BundleDigest)
+		return containerMPI.Container, nil
+	}
+
 	// todo: Upload image if necessary
 	if sysCfg.Upload {
-		if os.Getenv(container.KeyPassphrase) == "" {
-			log.Println("WARN: passphrase for key is not defined")
-		}
-
 		err = container.Sign(&containerMPI.Container, sysCfg)
 		if err != nil {
 			return containerMPI.Container, fmt.Errorf("failed to sign image: %s", err)
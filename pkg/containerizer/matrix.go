@@ -0,0 +1,140 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package containerizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/gvallee/go_util/pkg/util"
+	"github.com/gvallee/kv/pkg/kv"
+	"github.com/sylabs/singularity-mpi/pkg/config"
+	"github.com/sylabs/singularity-mpi/pkg/mpi"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// buildState is the content of the state file of a resumable set of builds
+type buildState struct {
+	// Completed maps the fingerprint of the configurations that were successfully built to their path
+	Completed map[string]string `json:"completed"`
+}
+
+// containerizeFn is the function used to build a configuration, it is only overwritten for testing
+var containerizeFn = ContainerizeApp
+
+// fingerprintConfig returns the fingerprint identifying the image described by a configuration file, so that a
+// configuration is only built again when the image changes, not when the file is merely reformatted
+func fingerprintConfig(configFile string, sysCfg *sys.Config) (string, error) {
+	kvs, err := kv.LoadKeyValueConfig(configFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to load %s: %s", configFile, err)
+	}
+
+	app, err := loadAppConfig(kvs)
+	if err != nil {
+		return "", fmt.Errorf("invalid configuration %s: %s", configFile, err)
+	}
+
+	var containerMPI mpi.Config
+	containerMPI.Container.Distro = kv.GetValue(kvs, "distro")
+	containerMPI.Container.Model = kv.GetValue(kvs, mpiModelKey)
+	if kv.GetValue(kvs, "mpi") != "" {
+		containerMPI.Implem.ID, containerMPI.Implem.Version = sys.ParseDistroID(kv.GetValue(kvs, "mpi"))
+		containerMPI.Implem.URL = getMPIURL(containerMPI.Implem.ID, containerMPI.Implem.Version, sysCfg)
+	}
+	err = loadContainerOptions(kvs, &containerMPI)
+	if err != nil {
+		return "", fmt.Errorf("invalid configuration %s: %s", configFile, err)
+	}
+	containerMPI.Container.BuildArgs = getBuildArgValues(kvs)
+
+	data := getMPIDeffileData(&app, &containerMPI, sysCfg)
+	if kv.GetValue(kvs, "mpi") == "" {
+		data.MpiImplm = nil
+	}
+	fingerprint, _, err := config.Fingerprint(&app.info, &data, &containerMPI.Container, sysCfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute the fingerprint of %s: %s", configFile, err)
+	}
+	return fingerprint, nil
+}
+
+func loadBuildState(stateFile string) (*buildState, error) {
+	state := &buildState{Completed: make(map[string]string)}
+	if !util.FileExists(stateFile) {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", stateFile, err)
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", stateFile, err)
+	}
+	if state.Completed == nil {
+		state.Completed = make(map[string]string)
+	}
+	return state, nil
+}
+
+// saveBuildState writes the state file, making sure a crash never leaves a partially written file
+func saveBuildState(stateFile string, state *buildState) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode the build state: %s", err)
+	}
+	tmpFile := stateFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", tmpFile, err)
+	}
+	err = os.Rename(tmpFile, stateFile)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s: %s", tmpFile, err)
+	}
+	return nil
+}
+
+// BuildAllResumable creates the containers for a list of configuration files, recording the configurations that
+// were successfully built in a state file so that they are skipped when the function is executed again
+func BuildAllResumable(configs []string, stateFile string, sysCfg *sys.Config) error {
+	state, err := loadBuildState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	for _, config := range configs {
+		fingerprint, err := fingerprintConfig(config, sysCfg)
+		if err != nil {
+			return err
+		}
+		if _, ok := state.Completed[fingerprint]; ok {
+			log.Printf("-> %s was already built, skipping...", config)
+			continue
+		}
+
+		log.Printf("* Creating container for %s...", config)
+		cfg := *sysCfg
+		cfg.AppContainizer = config
+		_, err = containerizeFn(&cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create container for %s: %s", config, err)
+		}
+
+		state.Completed[fingerprint] = config
+		err = saveBuildState(stateFile, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package containerizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/container"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// testConfigHeader describes the application of the test configuration files
+const testConfigHeader = "app_name = test\napp_url = https://example.com/test.tar.gz\napp_exe = test\n"
+
+func TestBuildAllResumable(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var configs []string
+	for _, distro := range []string{"ubuntu:disco", "centos:7", "centos:6"} {
+		config := filepath.Join(tempDir, fmt.Sprintf("config%d.conf", len(configs)))
+		err = ioutil.WriteFile(config, []byte(testConfigHeader+"distro = "+distro+"\n"), 0644)
+		if err != nil {
+			t.Fatalf("failed to create %s: %s", config, err)
+		}
+		configs = append(configs, config)
+	}
+
+	var built []string
+	failOn := configs[1]
+	containerizeFn = func(sysCfg *sys.Config) (container.Config, error) {
+		if sysCfg.AppContainizer == failOn {
+			return container.Config{}, fmt.Errorf("simulated failure")
+		}
+		built = append(built, sysCfg.AppContainizer)
+		return container.Config{}, nil
+	}
+	defer func() {
+		containerizeFn = ContainerizeApp
+	}()
+
+	var sysCfg sys.Config
+	stateFile := filepath.Join(tempDir, "state.json")
+	err = BuildAllResumable(configs, stateFile, &sysCfg)
+	if err == nil {
+		t.Fatalf("failure of a build was not reported")
+	}
+	if len(built) != 1 || built[0] != configs[0] {
+		t.Fatalf("invalid list of built configurations: %v", built)
+	}
+
+	built = nil
+	failOn = ""
+	err = BuildAllResumable(configs, stateFile, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to resume builds: %s", err)
+	}
+	if len(built) != 2 || built[0] != configs[1] || built[1] != configs[2] {
+		t.Fatalf("completed configurations were not skipped: %v", built)
+	}
+
+	// A modified configuration is built again
+	built = nil
+	err = ioutil.WriteFile(configs[2], []byte(testConfigHeader+"distro = centos:8\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to modify %s: %s", configs[2], err)
+	}
+	err = BuildAllResumable(configs, stateFile, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to resume builds: %s", err)
+	}
+	if len(built) != 1 || built[0] != configs[2] {
+		t.Fatalf("invalid list of built configurations: %v", built)
+	}
+
+	// Reformatting a configuration does not change the image, changing the compilers of MPI does
+	built = nil
+	err = ioutil.WriteFile(configs[2], []byte("distro   =   centos:8\n\napp_exe = test\napp_url = https://example.com/test.tar.gz\napp_name = test\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to modify %s: %s", configs[2], err)
+	}
+	err = BuildAllResumable(configs, stateFile, &sysCfg)
+	if err != nil {
+		t.Fatalf("failed to resume builds: %s", err)
+	}
+	if len(built) != 0 {
+		t.Fatalf("reformatted configurations were built again: %v", built)
+	}
+	for _, mpiCfg := range []string{"mpi = openmpi:4.0.2\n", "mpi = openmpi:4.0.2\nmpi_cc = clang\n"} {
+		built = nil
+		err = ioutil.WriteFile(configs[2], []byte(testConfigHeader+"distro = centos:8\n"+mpiCfg), 0644)
+		if err != nil {
+			t.Fatalf("failed to modify %s: %s", configs[2], err)
+		}
+		err = BuildAllResumable(configs, stateFile, &sysCfg)
+		if err != nil {
+			t.Fatalf("failed to resume builds: %s", err)
+		}
+		if len(built) != 1 || built[0] != configs[2] {
+			t.Fatalf("%q: invalid list of built configurations: %v", mpiCfg, built)
+		}
+	}
+}
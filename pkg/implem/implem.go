@@ -32,12 +32,63 @@ type Info struct {
 
 	// Tarball is the name of the tarball of the MPI implementation
 	Tarball string
+
+	// Checksum is the optional SHA-256 checksum of the tarball of the MPI implementation
+	Checksum string
+
+	// TarballSize is the optional expected size in bytes of the tarball of the MPI implementation, a quick sanity check of the download
+	TarballSize int64
+
+	// WithROCm specifies whether the MPI implementation needs to be built with ROCm (AMD GPUs) support
+	WithROCm bool
+
+	// Device is the device to use when building the MPI implementation, e.g., ch4:ofi for MPICH (optional)
+	Device string
+
+	// ConfigureArgs are additional arguments passed to configure when building the MPI implementation, e.g., --with-pmix (optional)
+	ConfigureArgs []string
+}
+
+// Descriptor describes a MPI implementation supported by the tool
+type Descriptor struct {
+	// ID is the string identifying the MPI implementation
+	ID string
+
+	// Name is the display name of the MPI implementation
+	Name string
+
+	// SourceInstall specifies whether the MPI implementation can be compiled from source
+	SourceInstall bool
+
+	// PackageInstall specifies whether the MPI implementation is installed from a binary package
+	PackageInstall bool
+
+	// URLTemplate specifies whether the tool ships the list of download URLs of the MPI implementation
+	URLTemplate bool
+}
+
+// implementations is the list of MPI implementations supported by the tool
+var implementations = []Descriptor{
+	{ID: OMPI, Name: "Open MPI", SourceInstall: true, URLTemplate: true},
+	{ID: MPICH, Name: "MPICH", SourceInstall: true, URLTemplate: true},
+	{ID: IMPI, Name: "Intel MPI", PackageInstall: true},
+}
+
+// SupportedImplementations returns the list of MPI implementations supported by the tool
+func SupportedImplementations() []Descriptor {
+	return append([]Descriptor{}, implementations...)
 }
 
 // IsMPI checks if information passed in is an MPI implementation
 func IsMPI(i *Info) bool {
-	if i != nil && (i.ID == OMPI || i.ID == MPICH || i.ID == IMPI) {
-		return true
+	if i == nil {
+		return false
+	}
+
+	for _, d := range implementations {
+		if d.ID == i.ID {
+			return true
+		}
 	}
 
 	return false
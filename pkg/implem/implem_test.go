@@ -0,0 +1,72 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package implem
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestURLVariants(t *testing.T) {
+	tests := []struct {
+		url      string
+		variants []string
+	}{
+		{
+			url:      "https://example.com/openmpi-4.0.2.tar.bz2",
+			variants: []string{"https://example.com/openmpi-4.0.2.tar.bz2", "https://example.com/openmpi-4.0.2.tar.gz", "https://example.com/openmpi-4.0.2.tar.xz"},
+		},
+		{
+			url:      "https://example.com/mpich-3.3.tar.lz",
+			variants: []string{"https://example.com/mpich-3.3.tar.gz", "https://example.com/mpich-3.3.tar.bz2", "https://example.com/mpich-3.3.tar.xz"},
+		},
+		{
+			url:      "https://example.com/mpi.git",
+			variants: []string{"https://example.com/mpi.git"},
+		},
+	}
+
+	for _, tt := range tests {
+		variants := URLVariants(tt.url)
+		if strings.Join(variants, " ") != strings.Join(tt.variants, " ") {
+			t.Fatalf("invalid variants of %s: %v instead of %v", tt.url, variants, tt.variants)
+		}
+	}
+}
+
+func TestSelectURLVariant(t *testing.T) {
+	// Only the gzip variant of the release is published
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openmpi-4.0.2.tar.gz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	mpi := Info{ID: OMPI, Version: "4.0.2", URL: server.URL + "/openmpi-4.0.2.tar.bz2", Tarball: "openmpi-4.0.2.tar.bz2"}
+	err := mpi.SelectURLVariant(URLExists)
+	if err != nil {
+		t.Fatalf("failed to select a variant of the URL: %s", err)
+	}
+	if mpi.URL != server.URL+"/openmpi-4.0.2.tar.gz" || mpi.Tarball != "openmpi-4.0.2.tar.gz" {
+		t.Fatalf("invalid variant: %s (%s)", mpi.URL, mpi.Tarball)
+	}
+
+	// The checksum only applies to the configured tarball
+	mpi = Info{ID: OMPI, Version: "4.0.2", URL: server.URL + "/openmpi-4.0.2.tar.bz2", Checksum: "1234"}
+	err = mpi.SelectURLVariant(URLExists)
+	if err == nil {
+		t.Fatalf("a variant of a URL with a checksum was selected: %s", mpi.URL)
+	}
+
+	mpi = Info{ID: OMPI, Version: "4.0.3", URL: server.URL + "/openmpi-4.0.3.tar.bz2"}
+	err = mpi.SelectURLVariant(URLExists)
+	if err == nil || !strings.Contains(err.Error(), "openmpi 4.0.3 is not available") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package implem
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// urlCheckTimeout is the timeout of the requests checking whether a tarball is available
+const urlCheckTimeout = 30 * time.Second
+
+// tarballExtensions are the extensions of the compressed tarballs we can extract, in order of preference
+var tarballExtensions = []string{".tar.gz", ".tar.bz2", ".tar.xz"}
+
+// otherTarballExtensions are the extensions of the tarballs published by some projects that we cannot extract
+var otherTarballExtensions = []string{".tar.lz", ".tar.zst", ".zip"}
+
+// URLChecker checks whether a file is available at a URL
+type URLChecker func(url string) (bool, error)
+
+// URLExists checks with a HEAD request whether a file is available at a HTTP(S) URL
+func URLExists(url string) (bool, error) {
+	client := http.Client{Timeout: urlCheckTimeout}
+	resp, err := client.Head(url)
+	if err != nil {
+		return false, fmt.Errorf("failed to query %s: %s", url, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 400:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status when querying %s: %s", url, resp.Status)
+}
+
+// splitTarballURL returns the URL of a tarball without its extension and whether the extension is supported,
+// the URL is returned unchanged if it is not the URL of a known tarball format
+func splitTarballURL(url string) (string, bool) {
+	for _, ext := range tarballExtensions {
+		if strings.HasSuffix(url, ext) {
+			return strings.TrimSuffix(url, ext), true
+		}
+	}
+	for _, ext := range otherTarballExtensions {
+		if strings.HasSuffix(url, ext) {
+			return strings.TrimSuffix(url, ext), false
+		}
+	}
+	return url, false
+}
+
+// URLVariants returns the URLs of the same release compressed with the formats we support: the URL itself when
+// its format is supported, followed by the other variants in order of preference. Only the URL itself is returned
+// if it is not the URL of a tarball.
+func URLVariants(url string) []string {
+	base, supported := splitTarballURL(url)
+	if base == url {
+		return []string{url}
+	}
+
+	var variants []string
+	if supported {
+		variants = append(variants, url)
+	}
+	for _, ext := range tarballExtensions {
+		if base+ext != url {
+			variants = append(variants, base+ext)
+		}
+	}
+	return variants
+}
+
+// SelectURLVariant makes sure that the tarball of the MPI implementation is available, falling back to a
+// variant of the URL with another compression when it is not or when its format is not supported. URL and
+// Tarball are updated with the selected variant. Since the checksum and the size of the tarball only apply
+// to the configured URL, the URL is never changed when they are set.
+func (i *Info) SelectURLVariant(exists URLChecker) error {
+	if i.URL == "" {
+		return fmt.Errorf("undefined URL")
+	}
+
+	variants := URLVariants(i.URL)
+	if i.Checksum != "" || i.TarballSize != 0 {
+		variants = []string{i.URL}
+	}
+
+	for _, url := range variants {
+		ok, err := exists(url)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if url != i.URL {
+				log.Printf("-> %s is not available, using %s instead", i.URL, url)
+				i.URL = url
+				i.Tarball = path.Base(url)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s %s is not available at %s", i.ID, i.Version, strings.Join(variants, ", "))
+}
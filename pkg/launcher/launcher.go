@@ -23,8 +23,10 @@ import (
 	"github.com/sylabs/singularity-mpi/internal/pkg/job"
 	"github.com/sylabs/singularity-mpi/internal/pkg/network"
 	"github.com/sylabs/singularity-mpi/internal/pkg/slurm"
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 	"github.com/sylabs/singularity-mpi/pkg/app"
 	"github.com/sylabs/singularity-mpi/pkg/buildenv"
+	"github.com/sylabs/singularity-mpi/pkg/container"
 	"github.com/sylabs/singularity-mpi/pkg/implem"
 	"github.com/sylabs/singularity-mpi/pkg/jm"
 	"github.com/sylabs/singularity-mpi/pkg/mpi"
@@ -130,6 +132,7 @@ func Load() (sys.Config, jm.JM, network.Info, error) {
 	if val != "" {
 		cfg.SudoSyCmds = strings.Split(val, " ")
 	}
+	cfg.Interconnect = kv.GetValue(sympiKVs, sy.InterconnectKey)
 
 	// Load the job manager component first
 	jobmgr = jm.Detect()
@@ -211,6 +214,59 @@ func expectedOutput(stdout string, stderr string, appInfo *app.Info, jobInfo *jo
 	return matched
 }
 
+// getLaunchEnv returns the environment variables that were set specifically to launch a job, i.e., that differ from our own environment
+func getLaunchEnv(env []string) []string {
+	curEnv := make(map[string]bool)
+	for _, envVar := range os.Environ() {
+		curEnv[envVar] = true
+	}
+
+	var launchEnv []string
+	for _, envVar := range env {
+		if !curEnv[envVar] {
+			launchEnv = append(launchEnv, envVar)
+		}
+	}
+	return launchEnv
+}
+
+// logShellCommand logs the command to start a shell in the container of a failed job, with the same runtime configuration
+func logShellCommand(hostMPI *mpi.Config, hostBuildEnv *buildenv.Info, containerMPI *mpi.Config, launchCmd *syexec.SyCmd, sysCfg *sys.Config) {
+	var hostImplem *implem.Info
+	if hostMPI != nil {
+		hostImplem = &hostMPI.Implem
+	}
+	opts := container.ExecOptions{
+		Env:     launchCmd.Cmd.Env,
+		WorkDir: launchCmd.Cmd.Dir,
+	}
+	argv, env, err := container.ShellCommand(&containerMPI.Container, opts, hostImplem, hostBuildEnv, sysCfg)
+	if err != nil {
+		log.Printf("unable to get the command to troubleshoot the container: %s", err)
+		return
+	}
+	log.Printf("* To troubleshoot in the same environment, run: %s", container.FormatShellCommand(argv, getLaunchEnv(env)))
+}
+
+// checkRuntimeEnvironment warns about the requirements of a container that the host does not meet, since
+// the job is then likely to fail or hang for environmental reasons
+func checkRuntimeEnvironment(containerMPI *mpi.Config, sysCfg *sys.Config) {
+	req := container.GetRuntimeRequirements(&containerMPI.Container, &containerMPI.Implem, sysCfg)
+	report, err := sys.CheckRuntimeEnvironment(req)
+	if err != nil {
+		log.Printf("unable to check the runtime environment: %s", err)
+		return
+	}
+	for _, check := range report.Failed() {
+		sylog.Warn("%s: %s (%s)", check.Name, check.Details, check.Remediation)
+	}
+
+	err = container.CheckInterconnect(&containerMPI.Container, sysCfg)
+	if err != nil {
+		sylog.Warn("%s", err)
+	}
+}
+
 // Run executes a container with a specific version of MPI on the host
 func Run(appInfo *app.Info, hostMPI *mpi.Config, hostBuildEnv *buildenv.Info, containerMPI *mpi.Config, jobmgr *jm.JM, sysCfg *sys.Config, args []string) (results.Result, syexec.Result) {
 	var newjob job.Job
@@ -224,6 +280,7 @@ func Run(appInfo *app.Info, hostMPI *mpi.Config, hostBuildEnv *buildenv.Info, co
 
 	if containerMPI != nil {
 		newjob.Container = &containerMPI.Container
+		checkRuntimeEnvironment(containerMPI, sysCfg)
 	}
 
 	newjob.App.BinPath = appInfo.BinPath
@@ -264,23 +321,23 @@ func Run(appInfo *app.Info, hostMPI *mpi.Config, hostBuildEnv *buildenv.Info, co
 	if err != nil {
 		// The command simply failed and the Go runtime caught it
 		expRes.Pass = false
-		log.Printf("[ERROR] Command failed - stdout: %s - stderr: %s - err: %s\n", stdout.String(), stderr.String(), err)
+		sylog.Error("Command failed - stdout: %s - stderr: %s - err: %s", stdout.String(), stderr.String(), err)
 	}
 	if submitCmd.Ctx.Err() == context.DeadlineExceeded {
 		// The command timed out
 		expRes.Pass = false
-		log.Printf("[ERROR] Command timed out - stdout: %s - stderr: %s\n", stdout.String(), stderr.String())
+		sylog.Error("Command timed out - stdout: %s - stderr: %s", stdout.String(), stderr.String())
 	}
 	if expRes.Pass {
 		if re.Match(stdout.Bytes()) {
 			// mpirun actually failed, exited with 0 as return code but displayed the usage message (so nothing really ran)
 			expRes.Pass = false
-			log.Printf("[ERROR] mpirun failed and returned help messafe - stdout: %s - stderr: %s\n", stdout.String(), stderr.String())
+			sylog.Error("mpirun failed and returned help messafe - stdout: %s - stderr: %s", stdout.String(), stderr.String())
 		}
 		if !expectedOutput(execRes.Stdout, execRes.Stderr, appInfo, &newjob) {
 			// The output is NOT the expected output
 			expRes.Pass = false
-			log.Printf("[ERROR] Run succeeded but output is not matching expectation - stdout: %s - stderr: %s\n", stdout.String(), stderr.String())
+			sylog.Error("Run succeeded but output is not matching expectation - stdout: %s - stderr: %s", stdout.String(), stderr.String())
 		}
 	}
 
@@ -296,6 +353,9 @@ func Run(appInfo *app.Info, hostMPI *mpi.Config, hostBuildEnv *buildenv.Info, co
 		} else {
 			log.Println("Not an MPI job, not saving error details")
 		}
+		if containerMPI != nil {
+			logShellCommand(hostMPI, hostBuildEnv, containerMPI, &submitCmd, sysCfg)
+		}
 	}
 
 	return expRes, execRes
@@ -8,6 +8,7 @@ package manifest
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,6 +19,35 @@ import (
 	"github.com/gvallee/go_util/pkg/util"
 )
 
+const (
+	// SchemaVersion is the version of the format of the manifests we create
+	SchemaVersion = 2
+
+	// LegacySchemaVersion is the version assigned to manifests created before the introduction of schema versions
+	LegacySchemaVersion = 1
+)
+
+// FileHash is the hash of a file recorded in a manifest
+type FileHash struct {
+	// Path is the path to the file
+	Path string `json:"path"`
+
+	// Hash is the SHA-256 hash of the file
+	Hash string `json:"hash"`
+}
+
+// Manifest is the structured form of a manifest
+type Manifest struct {
+	// SchemaVersion is the version of the format of the manifest
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Files are the hashes of the files recorded in the manifest
+	Files []FileHash `json:"files"`
+
+	// Data are the free-form entries of the manifest, e.g., the command that was executed
+	Data []string `json:"data"`
+}
+
 func getFileHash(path string) string {
 	f, err := os.Open(path)
 	if err != nil {
@@ -48,12 +78,20 @@ func HashFiles(files []string) []string {
 
 // Create a new manifest
 func Create(filepath string, entries []string) error {
+	m := parseEntries(entries)
+	m.SchemaVersion = SchemaVersion
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+
 	f, err := os.Create(filepath)
 	if err != nil {
 		return fmt.Errorf("failed to create %s: %s", filepath, err)
 	}
+	defer f.Close()
 
-	_, err = f.WriteString(strings.Join(entries, "\n"))
+	_, err = f.Write(data)
 	if err != nil {
 		return fmt.Errorf("failed to write to %s: %s", filepath, err)
 	}
@@ -66,34 +104,81 @@ func Create(filepath string, entries []string) error {
 	return nil
 }
 
+// isHash checks whether a string is a SHA-256 hash as generated by HashFiles
+func isHash(str string) bool {
+	if len(str) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(str)
+	return err == nil
+}
+
+// parseEntries creates a manifest from a list of entries using the format of HashFiles for the hashes of files
+func parseEntries(entries []string) *Manifest {
+	m := new(Manifest)
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		tokens := strings.Split(entry, ": ")
+		if len(tokens) == 2 && isHash(tokens[1]) {
+			m.Files = append(m.Files, FileHash{Path: tokens[0], Hash: tokens[1]})
+		} else {
+			m.Data = append(m.Data, entry)
+		}
+	}
+	return m
+}
+
+// Parse parses the content of a manifest. Manifests created before the introduction of schema versions
+// (plain text, one entry per line) are upgraded to the structured form
+func Parse(data []byte) (*Manifest, error) {
+	content := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(content, "{") {
+		m := parseEntries(strings.Split(content, "\n"))
+		m.SchemaVersion = LegacySchemaVersion
+		return m, nil
+	}
+
+	m := new(Manifest)
+	err := json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %s", err)
+	}
+	if m.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("unsupported manifest schema version: %d", m.SchemaVersion)
+	}
+	return m, nil
+}
+
+// Load reads and parses a manifest
+func Load(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	return Parse(data)
+}
+
 // Check parses a given manifest and check that all hash there are in the manifest are the same than current
 // files
 func Check(path string) error {
 	if !util.FileExists(path) {
 		// This is currently not an error, just log the fact there is no manifest
 		log.Printf("%s does not exist, skipping...", path)
+		return nil
 	}
 
-	if util.FileExists(path) {
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			log.Printf("failed to read manifest %s", path)
-			return nil // This is not a fatal error
-		}
+	m, err := Load(path)
+	if err != nil {
+		log.Printf("failed to load manifest %s: %s", path, err)
+		return nil // This is not a fatal error
+	}
 
-		content := string(data)
-		lines := strings.Split(content, "\n")
-		for _, line := range lines {
-			tokens := strings.Split(line, ": ")
-			if len(tokens) == 2 {
-				file := tokens[0]
-				recordedHash := tokens[1]
-				curFileHash := HashFiles([]string{file})
-				if curFileHash[0] != line {
-					actualHash := strings.Split(curFileHash[0], ": ")[1]
-					return fmt.Errorf("hashes differ (record: %s; actual: %s)", recordedHash, actualHash)
-				}
-			}
+	for _, file := range m.Files {
+		actualHash := getFileHash(file.Path)
+		if actualHash != file.Hash {
+			return fmt.Errorf("hashes differ (record: %s; actual: %s)", file.Hash, actualHash)
 		}
 	}
 
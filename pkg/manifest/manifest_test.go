@@ -0,0 +1,75 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadLegacyManifest(t *testing.T) {
+	path := filepath.Join("testdata", "legacy.MANIFEST")
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("failed to load %s: %s", path, err)
+	}
+	if m.SchemaVersion != LegacySchemaVersion {
+		t.Fatalf("invalid schema version: %d", m.SchemaVersion)
+	}
+	if len(m.Files) != 1 || m.Files[0].Path != "testdata/hello.txt" {
+		t.Fatalf("invalid list of files: %+v", m.Files)
+	}
+	if len(m.Data) != 1 || m.Data[0] != "Singularity version: 3.5.2" {
+		t.Fatalf("invalid data: %+v", m.Data)
+	}
+
+	err = Check(path)
+	if err != nil {
+		t.Fatalf("failed to check %s: %s", path, err)
+	}
+}
+
+func TestCreateManifest(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	file := filepath.Join(tempDir, "file.txt")
+	err = ioutil.WriteFile(file, []byte("content\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", file, err)
+	}
+
+	path := filepath.Join(tempDir, "test.MANIFEST")
+	err = Create(path, append([]string{"Command: make install"}, HashFiles([]string{file})...))
+	if err != nil {
+		t.Fatalf("failed to create manifest: %s", err)
+	}
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("failed to load %s: %s", path, err)
+	}
+	if m.SchemaVersion != SchemaVersion || len(m.Files) != 1 || len(m.Data) != 1 {
+		t.Fatalf("invalid manifest: %+v", m)
+	}
+	err = Check(path)
+	if err != nil {
+		t.Fatalf("failed to check %s: %s", path, err)
+	}
+
+	err = ioutil.WriteFile(file, []byte("modified\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to modify %s: %s", file, err)
+	}
+	err = Check(path)
+	if err == nil {
+		t.Fatalf("modified file was not detected")
+	}
+}
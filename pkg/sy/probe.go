@@ -0,0 +1,282 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sympierr"
+	"github.com/sylabs/singularity-mpi/pkg/checker"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// FeatureSIF is the 'sif' command used to inspect the partitions of images
+	FeatureSIF = "sif"
+
+	// FeatureOverlay is the 'overlay create' command used to create persistent overlays
+	FeatureOverlay = "overlay create"
+
+	// FeatureCacheList is the 'cache list' command used to list the content of the cache
+	FeatureCacheList = "cache list"
+
+	// FeatureInspectJSON is the JSON output of the 'inspect' command
+	FeatureInspectJSON = "inspect --json"
+
+	// FeatureInspectDefFile is the option of the 'inspect' command displaying the definition file of images
+	FeatureInspectDefFile = "inspect --deffile"
+
+	// FeatureMksquashfsArgs is the option of the 'build' command passing arguments to mksquashfs
+	FeatureMksquashfsArgs = "build --mksquashfs-args"
+
+	// FeatureEncryption is the option of the 'build' command creating encrypted images
+	FeatureEncryption = "build --encrypt"
+
+	// FeatureBuildArgs is the option of the 'build' command setting build arguments
+	FeatureBuildArgs = "build --build-arg"
+
+	// FeatureBuildBind is the option of the 'build' command binding directories of the host during the build
+	FeatureBuildBind = "build --bind"
+
+	// FeatureFakeroot is the option of the 'build' command building images as an unprivileged user
+	FeatureFakeroot = "build --fakeroot"
+
+	// FeaturePush is the 'push' command used to upload images to a registry
+	FeaturePush = "push"
+
+	// FeatureKeyPassphraseEnv is the environment variable of the 'sign' command providing the passphrase
+	// of the signing key, which avoids the interactive prompt
+	FeatureKeyPassphraseEnv = "sign KEY_PASSPHRASE"
+
+	// apptainerBaseVersion is the version of Singularity Apptainer 1.0 is forked from, used to compare
+	// versions of Apptainer with the first version of Singularity supporting a feature
+	apptainerBaseVersion = "3.9"
+)
+
+// feature describes an optional feature of Singularity
+type feature struct {
+	// cmd is the command providing the feature, e.g., "overlay create"
+	cmd string
+
+	// flag is the option of cmd providing the feature, empty if the command itself is the feature
+	flag string
+
+	// minVersion is the first version of Singularity supporting the feature
+	minVersion string
+
+	// minApptainerVersion is the first version of Apptainer supporting the feature, empty if all versions support it
+	minApptainerVersion string
+
+	// env is the environment variable providing the feature, without the SINGULARITY_ or APPTAINER_ prefix.
+	// Environment variables do not appear in the help of the commands so these features are always deduced
+	// from the version.
+	env string
+}
+
+// supportedBy checks whether a given version of Singularity or Apptainer supports a feature
+func (f feature) supportedBy(version string, apptainer bool) bool {
+	switch {
+	case apptainer && f.minApptainerVersion != "":
+		return checker.CompareVersions(version, f.minApptainerVersion) >= 0
+	case apptainer:
+		return checker.CompareVersions(apptainerBaseVersion, f.minVersion) >= 0
+	default:
+		return checker.CompareVersions(version, f.minVersion) >= 0
+	}
+}
+
+// features is the list of the optional features of Singularity the tool relies on
+var features = map[string]feature{
+	FeatureSIF:              {cmd: "sif", minVersion: "3.5"},
+	FeatureOverlay:          {cmd: "overlay create", minVersion: "3.8"},
+	FeatureCacheList:        {cmd: "cache list", minVersion: "3.1"},
+	FeatureInspectJSON:      {cmd: "inspect", flag: "--json", minVersion: "3.0"},
+	FeatureInspectDefFile:   {cmd: "inspect", flag: "--deffile", minVersion: "3.0"},
+	FeatureMksquashfsArgs:   {cmd: "build", flag: "--mksquashfs-args", minVersion: "3.9"},
+	FeatureEncryption:       {cmd: "build", flag: "--encrypt", minVersion: "3.4"},
+	FeatureBuildArgs:        {cmd: "build", flag: "--build-arg", minVersion: "4.0", minApptainerVersion: "1.2"},
+	FeatureBuildBind:        {cmd: "build", flag: "--bind", minVersion: "3.10", minApptainerVersion: "1.1"},
+	FeatureFakeroot:         {cmd: "build", flag: "--fakeroot", minVersion: "3.3"},
+	FeaturePush:             {cmd: "push", minVersion: "3.0"},
+	FeatureKeyPassphraseEnv: {cmd: "sign", env: "KEY_PASSPHRASE", minVersion: "3.8", minApptainerVersion: "1.1"},
+}
+
+// Capabilities gathers the optional features supported by an installation of Singularity
+type Capabilities struct {
+	// Version is the version of Singularity
+	Version string
+
+	// Apptainer specifies whether the installation is Apptainer instead of Singularity
+	Apptainer bool
+
+	// Probed specifies whether the features were detected from the help of the commands; when false,
+	// they are deduced from the version
+	Probed bool
+
+	// Features maps the name of the optional features to whether they are supported
+	Features map[string]bool
+}
+
+var (
+	// probedCapabilities caches the capabilities of the installations of Singularity that were probed, by path
+	probedCapabilities = make(map[string]*Capabilities)
+
+	// probeLock protects probedCapabilities
+	probeLock sync.Mutex
+)
+
+// runHelp executes 'singularity help' for a given command and returns its output
+func runHelp(bin string, cmd string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*time.Minute)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"help"}, strings.Fields(cmd)...)
+	c := exec.CommandContext(ctx, bin, args...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	return stdout.String() + stderr.String(), err
+}
+
+// isHelpOf checks whether the output of 'singularity help' is the help of a given command. Unknown
+// commands lead to an error or to the help of the top-level command, whose usage line does not name the command.
+func isHelpOf(output string, cmd string) bool {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "Usage:" {
+			continue
+		}
+		for _, usage := range lines[i+1:] {
+			usage = strings.TrimSpace(usage)
+			if usage != "" {
+				return strings.Contains(usage+" ", " "+cmd+" ")
+			}
+		}
+	}
+	return false
+}
+
+// getVersionCapabilities deduces the capabilities of an installation of Singularity from its version
+func getVersionCapabilities(version string, apptainer bool) *Capabilities {
+	c := &Capabilities{Version: version, Apptainer: apptainer, Features: make(map[string]bool)}
+	for name, f := range features {
+		c.Features[name] = f.supportedBy(version, apptainer)
+	}
+	return c
+}
+
+// probeHelp detects the capabilities of an installation of Singularity from the help of its commands
+func probeHelp(bin string, version string, apptainer bool) (*Capabilities, error) {
+	_, err := runHelp(bin, "")
+	if err != nil {
+		return nil, fmt.Errorf("singularity help failed: %s", err)
+	}
+
+	c := &Capabilities{Version: version, Apptainer: apptainer, Probed: true, Features: make(map[string]bool)}
+	helps := make(map[string]string)
+	for name, f := range features {
+		if f.env != "" {
+			c.Features[name] = version != "" && f.supportedBy(version, apptainer)
+			continue
+		}
+		help, ok := helps[f.cmd]
+		if !ok {
+			help, err = runHelp(bin, f.cmd)
+			if err != nil || !isHelpOf(help, f.cmd) {
+				help = ""
+			}
+			helps[f.cmd] = help
+		}
+		c.Features[name] = help != "" && (f.flag == "" || strings.Contains(help, f.flag))
+	}
+	return c, nil
+}
+
+// ProbeSubcommands detects which optional sub-commands and options are supported by the installation of
+// Singularity. The help of the commands is used when available, otherwise the features are deduced from the
+// version. The result is cached so each installation is only probed once.
+func ProbeSubcommands(sysCfg *sys.Config) (*Capabilities, error) {
+	if sysCfg.SingularityBin == "" {
+		return nil, sympierr.ErrSingularityNotInstalled
+	}
+
+	probeLock.Lock()
+	defer probeLock.Unlock()
+
+	if c, ok := probedCapabilities[sysCfg.SingularityBin]; ok {
+		return c, nil
+	}
+
+	versionOutput := GetVersion(sysCfg)
+	version := ParseVersion(versionOutput)
+	apptainer := strings.Contains(strings.ToLower(versionOutput), "apptainer")
+
+	c, err := probeHelp(sysCfg.SingularityBin, version, apptainer)
+	if err != nil {
+		if version == "" {
+			return nil, fmt.Errorf("unable to detect the capabilities of %s: %s", sysCfg.SingularityBin, err)
+		}
+		log.Printf("-> Unable to probe the commands of %s (%s), relying on its version (%s)", sysCfg.SingularityBin, err, version)
+		c = getVersionCapabilities(version, apptainer)
+	}
+
+	probedCapabilities[sysCfg.SingularityBin] = c
+	return c, nil
+}
+
+// Has checks whether a feature is supported
+func (c *Capabilities) Has(name string) bool {
+	return c.Features[name]
+}
+
+// GetEnvVar returns the name of the environment variable providing a feature, e.g., SINGULARITY_KEY_PASSPHRASE,
+// or an empty string if the feature is not provided by an environment variable or is not supported
+func (c *Capabilities) GetEnvVar(name string) string {
+	f, ok := features[name]
+	if !ok || f.env == "" || !c.Has(name) {
+		return ""
+	}
+	if c.Apptainer {
+		return "APPTAINER_" + f.env
+	}
+	return "SINGULARITY_" + f.env
+}
+
+// CheckFeature returns a sympierr.ErrFeatureUnavailable error when a feature is not supported by the
+// installation of Singularity. If the capabilities cannot be detected, the feature is assumed to be supported
+// and the error, if any, reported when the command is executed.
+func CheckFeature(name string, sysCfg *sys.Config) error {
+	f, ok := features[name]
+	if !ok {
+		return fmt.Errorf("unknown feature: %s", name)
+	}
+
+	c, err := ProbeSubcommands(sysCfg)
+	if err != nil {
+		log.Printf("-> Unable to check whether %s is supported: %s", name, err)
+		return nil
+	}
+	if c.Has(name) {
+		return nil
+	}
+
+	minVersion := "Singularity " + f.minVersion
+	if c.Apptainer {
+		minVersion = "Apptainer 1.0"
+		if f.minApptainerVersion != "" {
+			minVersion = "Apptainer " + f.minApptainerVersion
+		}
+	}
+	return &sympierr.ErrFeatureUnavailable{Feature: name, MinVersion: minVersion}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sympierr"
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const rootHelp = "Usage:\n  singularity [global options...] <command>\n\nAvailable Commands:\n  build       Build a Singularity image\n"
+
+// getHelp returns the help of a command as displayed by Singularity
+func getHelp(bin string, cmd string, flags ...string) string {
+	help := "Usage:\n  " + bin + " [global options...] " + cmd + " [options...]\n\nFlags:\n"
+	for _, flag := range flags {
+		help += "      " + flag + "   description\n"
+	}
+	return help
+}
+
+// createFakeSingularity creates a script emulating the version and help commands of Singularity. When
+// unknownExit is true, the help of unknown commands fails, otherwise the top-level help is displayed.
+func createFakeSingularity(t *testing.T, dir string, version string, helps map[string]string, unknownExit bool) string {
+	script := "#!/bin/sh\ncase \"$*\" in\n\"version\")\n\techo '" + version + "'\n\t;;\n"
+	for cmd, help := range helps {
+		script += "\"" + strings.TrimSpace("help "+cmd) + "\")\n\tcat <<'EOF'\n" + help + "EOF\n\t;;\n"
+	}
+	if unknownExit {
+		script += "*)\n\techo 'Error: unknown help topic' >&2\n\texit 1\n\t;;\n"
+	} else {
+		script += "*)\n\tcat <<'EOF'\n" + rootHelp + "EOF\n\t;;\n"
+	}
+	script += "esac\n"
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", dir, err)
+	}
+	bin := filepath.Join(dir, "singularity")
+	err = ioutil.WriteFile(bin, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", bin, err)
+	}
+	return bin
+}
+
+func TestProbeSubcommands(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name           string
+		version        string
+		helps          map[string]string
+		unknownExit    bool
+		expectedProbed bool
+		expected       map[string]bool
+	}{
+		{
+			name:    "singularity 3.1",
+			version: "singularity version 3.1.1-1.el7",
+			helps: map[string]string{
+				"":           rootHelp,
+				"inspect":    getHelp("singularity", "inspect", "--json", "--deffile"),
+				"build":      getHelp("singularity", "build", "--sandbox", "--fakeroot"),
+				"cache list": getHelp("singularity", "cache list", "--type"),
+				"push":       getHelp("singularity", "push"),
+			},
+			expectedProbed: true,
+			expected: map[string]bool{
+				FeatureSIF:            false,
+				FeatureOverlay:        false,
+				FeatureCacheList:      true,
+				FeatureInspectJSON:    true,
+				FeatureInspectDefFile: true,
+				FeatureMksquashfsArgs: false,
+				FeatureEncryption:     false,
+				FeatureBuildArgs:      false,
+				FeaturePush:           true,
+			},
+		},
+		{
+			name:    "singularity 3.5",
+			version: "singularity version 3.5.3",
+			helps: map[string]string{
+				"":           rootHelp,
+				"sif":        getHelp("singularity", "sif"),
+				"inspect":    getHelp("singularity", "inspect", "--json", "--deffile"),
+				"build":      getHelp("singularity", "build", "--sandbox", "--encrypt"),
+				"cache list": getHelp("singularity", "cache list", "--type"),
+				"push":       getHelp("singularity", "push"),
+			},
+			expectedProbed: true,
+			expected: map[string]bool{
+				FeatureSIF:            true,
+				FeatureOverlay:        false,
+				FeatureCacheList:      true,
+				FeatureInspectJSON:    true,
+				FeatureInspectDefFile: true,
+				FeatureMksquashfsArgs: false,
+				FeatureEncryption:     true,
+				FeatureBuildArgs:      false,
+				FeaturePush:           true,
+			},
+		},
+		{
+			name:    "apptainer 1.2",
+			version: "apptainer version 1.2.4",
+			helps: map[string]string{
+				"":               strings.Replace(rootHelp, "singularity", "apptainer", 1),
+				"sif":            getHelp("apptainer", "sif"),
+				"overlay create": getHelp("apptainer", "overlay create", "--size"),
+				"inspect":        getHelp("apptainer", "inspect", "--json", "--deffile"),
+				"build":          getHelp("apptainer", "build", "--encrypt", "--mksquashfs-args", "--build-arg"),
+				"cache list":     getHelp("apptainer", "cache list", "--type"),
+				"push":           getHelp("apptainer", "push"),
+			},
+			unknownExit:    true,
+			expectedProbed: true,
+			expected: map[string]bool{
+				FeatureSIF:            true,
+				FeatureOverlay:        true,
+				FeatureCacheList:      true,
+				FeatureInspectJSON:    true,
+				FeatureInspectDefFile: true,
+				FeatureMksquashfsArgs: true,
+				FeatureEncryption:     true,
+				FeatureBuildArgs:      true,
+				FeaturePush:           true,
+				// Deduced from the version even when the help is available
+				FeatureKeyPassphraseEnv: true,
+			},
+		},
+		{
+			name:        "singularity 3.5 without help",
+			version:     "singularity version 3.5.3",
+			unknownExit: true,
+			expected: map[string]bool{
+				FeatureSIF:              true,
+				FeatureOverlay:          false,
+				FeatureCacheList:        true,
+				FeatureMksquashfsArgs:   false,
+				FeatureEncryption:       true,
+				FeatureBuildArgs:        false,
+				FeatureKeyPassphraseEnv: false,
+			},
+		},
+		{
+			name:        "apptainer 1.1 without help",
+			version:     "apptainer version 1.1.9",
+			unknownExit: true,
+			expected: map[string]bool{
+				FeatureSIF:              true,
+				FeatureOverlay:          true,
+				FeatureMksquashfsArgs:   true,
+				FeatureBuildArgs:        false,
+				FeatureKeyPassphraseEnv: true,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		var sysCfg sys.Config
+		sysCfg.SingularityBin = createFakeSingularity(t, filepath.Join(tempDir, strconv.Itoa(i)), tt.version, tt.helps, tt.unknownExit)
+
+		c, err := ProbeSubcommands(&sysCfg)
+		if err != nil {
+			t.Fatalf("%s: failed to probe sub-commands: %s", tt.name, err)
+		}
+		if c.Probed != tt.expectedProbed {
+			t.Fatalf("%s: probed is %t instead of %t", tt.name, c.Probed, tt.expectedProbed)
+		}
+		for feature, expected := range tt.expected {
+			if c.Has(feature) != expected {
+				t.Fatalf("%s: support of %s is %t instead of %t", tt.name, feature, c.Has(feature), expected)
+			}
+
+			err = CheckFeature(feature, &sysCfg)
+			if expected && err != nil {
+				t.Fatalf("%s: check of %s failed: %s", tt.name, feature, err)
+			}
+			if !expected {
+				unavailable, ok := err.(*sympierr.ErrFeatureUnavailable)
+				if !ok {
+					t.Fatalf("%s: check of %s returned %v instead of a ErrFeatureUnavailable error", tt.name, feature, err)
+				}
+				if unavailable.Feature != feature || unavailable.MinVersion == "" || !strings.Contains(err.Error(), unavailable.MinVersion) {
+					t.Fatalf("%s: invalid error for %s: %s", tt.name, feature, err)
+				}
+			}
+		}
+
+		envVar := c.GetEnvVar(FeatureKeyPassphraseEnv)
+		switch {
+		case !c.Has(FeatureKeyPassphraseEnv) && envVar != "",
+			c.Has(FeatureKeyPassphraseEnv) && c.Apptainer && envVar != "APPTAINER_KEY_PASSPHRASE",
+			c.Has(FeatureKeyPassphraseEnv) && !c.Apptainer && envVar != "SINGULARITY_KEY_PASSPHRASE":
+			t.Fatalf("%s: invalid passphrase environment variable: %q", tt.name, envVar)
+		}
+
+		// Capabilities are only probed once
+		err = os.Remove(sysCfg.SingularityBin)
+		if err != nil {
+			t.Fatalf("failed to remove %s: %s", sysCfg.SingularityBin, err)
+		}
+		cached, err := ProbeSubcommands(&sysCfg)
+		if err != nil || cached != c {
+			t.Fatalf("%s: capabilities were not cached", tt.name)
+		}
+	}
+
+	var sysCfg sys.Config
+	sysCfg.SingularityBin = filepath.Join(tempDir, "missing", "singularity")
+	_, err = ProbeSubcommands(&sysCfg)
+	if err == nil {
+		t.Fatalf("probe of a missing binary succeeded")
+	}
+	err = CheckFeature(FeatureSIF, &sysCfg)
+	if err != nil {
+		t.Fatalf("features are not assumed to be available when they cannot be probed: %s", err)
+	}
+	err = CheckFeature("unknown", &sysCfg)
+	if err == nil {
+		t.Fatalf("check of an unknown feature succeeded")
+	}
+}
@@ -47,6 +47,9 @@ const (
 	// SudoCmdsKey is the key used to specify which Singularity commands need to be executed with sudo
 	SudoCmdsKey = "singularity_sudo_cmds"
 
+	// InterconnectKey is the key used to specify the interconnect of the cluster
+	InterconnectKey = "interconnect"
+
 	sympiConfigFilename = "sympi_singularity.conf"
 )
 
@@ -330,13 +333,18 @@ func GetSIFArchs(imgPath string, sysCfg *sys.Config) ([]string, error) {
 		return nil, fmt.Errorf("image %s does not exists", imgPath)
 	}
 
+	err := CheckFeature(FeatureSIF, sysCfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// Singularity changed the mconfig flags over time so we need to figure out how the prefix is specified
 	ctx, cancel := context.WithTimeout(context.Background(), sys.CmdTimeout*time.Minute)
 	defer cancel()
 	var stdout bytes.Buffer
 	cmd := exec.CommandContext(ctx, sysCfg.SingularityBin, "sif", "list", imgPath)
 	cmd.Stdout = &stdout
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		return nil, fmt.Errorf("singularity sif list command failed: %s", err)
 	}
@@ -367,6 +375,16 @@ func GetVersion(sysCfg *sys.Config) string {
 	return stdout.String()
 }
 
+// ParseVersion extracts the version number from the output of 'singularity version', e.g., 3.5.2-1.el7
+func ParseVersion(output string) string {
+	tokens := strings.Fields(output)
+	if len(tokens) == 0 {
+		return ""
+	}
+	version := tokens[len(tokens)-1]
+	return strings.Split(version, "-")[0]
+}
+
 // CheckIntegrity checks if the installation of Singularity has been compromised
 func CheckIntegrity(sysCfg *sys.Config) error {
 	log.Println("* Checking intergrity of Singularity...")
@@ -0,0 +1,149 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sy
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+const (
+	// BuildModeDirect is the build of images by executing Singularity directly, which requires to be root
+	BuildModeDirect = "direct"
+
+	// BuildModeFakeroot is the build of images by an unprivileged user with the --fakeroot option
+	BuildModeFakeroot = "fakeroot"
+
+	// BuildModeSudo is the build of images by executing Singularity with sudo
+	BuildModeSudo = "sudo"
+
+	// BuildModeRemote is the build of images by a remote build service with the --remote option, which requires
+	// neither root nor fakeroot on the host
+	BuildModeRemote = "remote"
+
+	// subUIDFile is the file mapping users to the subordinate user IDs required by fakeroot
+	subUIDFile = "/etc/subuid"
+
+	// maxUserNamespacesSysctl is the maximum number of user namespaces, 0 when user namespaces are disabled
+	maxUserNamespacesSysctl = "/proc/sys/user/max_user_namespaces"
+)
+
+// BuildProbes are the functions used to check how images can be built, which can be replaced for testing
+type BuildProbes struct {
+	// Getuid returns the user ID of the current user
+	Getuid func() int
+
+	// Username returns the name of the current user
+	Username func() (string, error)
+
+	// ReadFile returns the content of a file, e.g., /etc/subuid
+	ReadFile func(path string) ([]byte, error)
+
+	// SupportsFakeroot checks whether the installation of Singularity supports the --fakeroot option
+	SupportsFakeroot func(sysCfg *sys.Config) bool
+}
+
+// getUsername returns the name of the current user
+func getUsername() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+// supportsFakeroot checks whether the installation of Singularity supports the --fakeroot option
+func supportsFakeroot(sysCfg *sys.Config) bool {
+	return CheckFeature(FeatureFakeroot, sysCfg) == nil
+}
+
+// buildProbes are the probes used by CanBuildUnprivileged
+var buildProbes = BuildProbes{
+	Getuid:           os.Getuid,
+	Username:         getUsername,
+	ReadFile:         ioutil.ReadFile,
+	SupportsFakeroot: supportsFakeroot,
+}
+
+// SetBuildProbes replaces the probes used to check how images can be built and returns the previous ones
+func SetBuildProbes(p BuildProbes) BuildProbes {
+	previous := buildProbes
+	buildProbes = p
+	return previous
+}
+
+// hasSubUIDs checks whether the content of /etc/subuid maps subordinate user IDs to a user, by name or ID
+func hasSubUIDs(content string, username string, uid int) bool {
+	for _, line := range strings.Split(content, "\n") {
+		tokens := strings.Split(strings.TrimSpace(line), ":")
+		if len(tokens) != 3 {
+			continue
+		}
+		if tokens[0] == username || tokens[0] == strconv.Itoa(uid) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanBuildUnprivileged checks whether the current user can build images without sudo, i.e., is root or
+// can use fakeroot, and returns the reason
+func CanBuildUnprivileged(sysCfg *sys.Config) (bool, string) {
+	uid := buildProbes.Getuid()
+	if uid == 0 {
+		return true, "running as root"
+	}
+
+	if !buildProbes.SupportsFakeroot(sysCfg) {
+		return false, "the installation of Singularity does not support --fakeroot"
+	}
+
+	// The sysctl does not exist on kernels without user namespaces limits, they are then enabled
+	d, err := buildProbes.ReadFile(maxUserNamespacesSysctl)
+	if err == nil && strings.TrimSpace(string(d)) == "0" {
+		return false, "user namespaces are disabled (" + maxUserNamespacesSysctl + " is 0)"
+	}
+
+	username, err := buildProbes.Username()
+	if err != nil {
+		return false, "unable to get the current user: " + err.Error()
+	}
+	d, err = buildProbes.ReadFile(subUIDFile)
+	if err != nil {
+		return false, "unable to read " + subUIDFile + ": " + err.Error()
+	}
+	if !hasSubUIDs(string(d), username, uid) {
+		return false, username + " does not have subordinate user IDs in " + subUIDFile + ", which fakeroot requires (see 'singularity config fakeroot --add " + username + "')"
+	}
+
+	return true, "fakeroot is available"
+}
+
+// GetBuildMode returns how images are built (BuildModeDirect, BuildModeFakeroot or BuildModeSudo) and why:
+// the configuration is used when it requests fakeroot or sudo, unless sudo is useless because the current user is
+// root; otherwise, fakeroot is used when available.
+func GetBuildMode(sysCfg *sys.Config) (string, string) {
+	if sysCfg.Nopriv {
+		return BuildModeFakeroot, "fakeroot is requested by the configuration"
+	}
+
+	ok, reason := CanBuildUnprivileged(sysCfg)
+	if ok && buildProbes.Getuid() == 0 {
+		return BuildModeDirect, reason
+	}
+	if IsSudoCmd("build", sysCfg) {
+		return BuildModeSudo, "sudo is requested by the configuration"
+	}
+	if ok {
+		return BuildModeFakeroot, reason
+	}
+	return BuildModeDirect, reason
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sylabs/singularity-mpi/pkg/sys"
+)
+
+// getFakeBuildProbes returns probes emulating a host where the current user has a given ID and the files have a given content
+func getFakeBuildProbes(uid int, fakeroot bool, files map[string]string) BuildProbes {
+	return BuildProbes{
+		Getuid:   func() int { return uid },
+		Username: func() (string, error) { return "alice", nil },
+		ReadFile: func(path string) ([]byte, error) {
+			content, ok := files[path]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", path)
+			}
+			return []byte(content), nil
+		},
+		SupportsFakeroot: func(sysCfg *sys.Config) bool { return fakeroot },
+	}
+}
+
+func TestGetBuildMode(t *testing.T) {
+	defaultProbes := buildProbes
+	defer SetBuildProbes(defaultProbes)
+
+	subuid := "bob:100000:65536\nalice:165536:65536\n"
+	tests := []struct {
+		name         string
+		uid          int
+		fakeroot     bool
+		files        map[string]string
+		sudo         bool
+		nopriv       bool
+		unprivileged bool
+		mode         string
+	}{
+		{name: "root", uid: 0, sudo: true, unprivileged: true, mode: BuildModeDirect},
+		{name: "fakeroot", uid: 1000, fakeroot: true, files: map[string]string{subUIDFile: subuid, maxUserNamespacesSysctl: "15000\n"}, unprivileged: true, mode: BuildModeFakeroot},
+		{name: "subuid by ID", uid: 1000, fakeroot: true, files: map[string]string{subUIDFile: "1000:165536:65536\n"}, unprivileged: true, mode: BuildModeFakeroot},
+		{name: "sudo requested", uid: 1000, fakeroot: true, files: map[string]string{subUIDFile: subuid}, sudo: true, unprivileged: true, mode: BuildModeSudo},
+		{name: "no subuid", uid: 1000, fakeroot: true, files: map[string]string{subUIDFile: "bob:100000:65536\n"}, sudo: true, mode: BuildModeSudo},
+		{name: "no userns", uid: 1000, fakeroot: true, files: map[string]string{subUIDFile: subuid, maxUserNamespacesSysctl: "0\n"}, mode: BuildModeDirect},
+		{name: "old singularity", uid: 1000, files: map[string]string{subUIDFile: subuid}, mode: BuildModeDirect},
+		{name: "nopriv", uid: 1000, nopriv: true, mode: BuildModeFakeroot},
+	}
+	for _, tt := range tests {
+		SetBuildProbes(getFakeBuildProbes(tt.uid, tt.fakeroot, tt.files))
+		var sysCfg sys.Config
+		sysCfg.Nopriv = tt.nopriv
+		if tt.sudo {
+			sysCfg.SudoSyCmds = []string{"build"}
+		}
+
+		ok, reason := CanBuildUnprivileged(&sysCfg)
+		if ok != tt.unprivileged || reason == "" {
+			t.Fatalf("%s: CanBuildUnprivileged returned %t (%s) instead of %t", tt.name, ok, reason, tt.unprivileged)
+		}
+		mode, _ := GetBuildMode(&sysCfg)
+		if mode != tt.mode {
+			t.Fatalf("%s: build mode is %s instead of %s", tt.name, mode, tt.mode)
+		}
+	}
+}
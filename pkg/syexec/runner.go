@@ -0,0 +1,40 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package syexec
+
+// Runner is the interface of the components executing commands
+type Runner interface {
+	// Run executes a command and returns the result of its execution
+	Run(cmd *SyCmd) Result
+}
+
+// DefaultRunner executes commands on the host
+type DefaultRunner struct{}
+
+// Run executes a command on the host
+func (r *DefaultRunner) Run(cmd *SyCmd) Result {
+	return cmd.Run()
+}
+
+// FakeRunner records commands instead of executing them and returns scripted results; it is meant to be used for testing
+type FakeRunner struct {
+	// Results is the list of results to return, in order; an empty result is returned once the list is exhausted
+	Results []Result
+
+	// Cmds is the list of commands that have been run
+	Cmds []SyCmd
+}
+
+// Run records a command and returns the next scripted result
+func (r *FakeRunner) Run(cmd *SyCmd) Result {
+	r.Cmds = append(r.Cmds, *cmd)
+	if len(r.Results) == 0 {
+		return Result{}
+	}
+	res := r.Results[0]
+	r.Results = r.Results[1:]
+	return res
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package syexec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Step is a command recorded in a transcript and the result of its execution
+type Step struct {
+	BinPath string   `json:"bin_path"`
+	CmdArgs []string `json:"cmd_args"`
+	ExecDir string   `json:"exec_dir,omitempty"`
+	Stdout  string   `json:"stdout,omitempty"`
+	Stderr  string   `json:"stderr,omitempty"`
+	Err     string   `json:"err,omitempty"`
+}
+
+// Transcript is the list of commands executed by a runner, in order, with their results
+type Transcript struct {
+	Steps []Step `json:"steps"`
+}
+
+// LoadTranscript reads a transcript
+func LoadTranscript(path string) (*Transcript, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+
+	var t Transcript
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse transcript %s: %s", path, err)
+	}
+	return &t, nil
+}
+
+// Save writes a transcript to a file
+func (t *Transcript) Save(path string) error {
+	data, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to serialize transcript: %s", err)
+	}
+	err = ioutil.WriteFile(path, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// Replace replaces all the occurrences of a string in the commands and outputs of a transcript,
+// e.g., to replace host-specific paths with placeholders
+func (t *Transcript) Replace(old string, new string) {
+	if old == "" {
+		return
+	}
+	for i := range t.Steps {
+		s := &t.Steps[i]
+		s.BinPath = strings.Replace(s.BinPath, old, new, -1)
+		for j := range s.CmdArgs {
+			s.CmdArgs[j] = strings.Replace(s.CmdArgs[j], old, new, -1)
+		}
+		s.ExecDir = strings.Replace(s.ExecDir, old, new, -1)
+		s.Stdout = strings.Replace(s.Stdout, old, new, -1)
+		s.Stderr = strings.Replace(s.Stderr, old, new, -1)
+	}
+}
+
+// Results returns the results of the steps of a transcript, e.g., to replay it with a FakeRunner
+func (t *Transcript) Results() []Result {
+	var results []Result
+	for _, s := range t.Steps {
+		res := Result{Stdout: s.Stdout, Stderr: s.Stderr}
+		if s.Err != "" {
+			res.Err = fmt.Errorf("%s", s.Err)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// Check compares the commands executed by a runner with the commands of a transcript
+func (t *Transcript) Check(cmds []SyCmd) error {
+	for i, s := range t.Steps {
+		if i >= len(cmds) {
+			return fmt.Errorf("command #%d (%s %s) was not executed", i, s.BinPath, strings.Join(s.CmdArgs, " "))
+		}
+		actual := cmds[i].BinPath + " " + strings.Join(cmds[i].CmdArgs, " ")
+		expected := s.BinPath + " " + strings.Join(s.CmdArgs, " ")
+		if actual != expected {
+			return fmt.Errorf("command #%d is %s instead of %s", i, actual, expected)
+		}
+		if cmds[i].ExecDir != s.ExecDir {
+			return fmt.Errorf("command #%d is executed from %s instead of %s", i, cmds[i].ExecDir, s.ExecDir)
+		}
+	}
+	if len(cmds) > len(t.Steps) {
+		return fmt.Errorf("unexpected command #%d: %s %s", len(t.Steps), cmds[len(t.Steps)].BinPath, strings.Join(cmds[len(t.Steps)].CmdArgs, " "))
+	}
+	return nil
+}
+
+// RecordingRunner executes commands with another runner and records them with their results in a transcript
+type RecordingRunner struct {
+	// Runner is the runner actually executing the commands
+	Runner Runner
+
+	// Transcript is the transcript of the commands that have been executed
+	Transcript Transcript
+}
+
+// Run executes a command and records it
+func (r *RecordingRunner) Run(cmd *SyCmd) Result {
+	res := r.Runner.Run(cmd)
+	step := Step{
+		BinPath: cmd.BinPath,
+		CmdArgs: append([]string{}, cmd.CmdArgs...),
+		ExecDir: cmd.ExecDir,
+		Stdout:  res.Stdout,
+		Stderr:  res.Stderr,
+	}
+	if res.Err != nil {
+		step.Err = res.Err.Error()
+	}
+	r.Transcript.Steps = append(r.Transcript.Steps, step)
+	return res
+}
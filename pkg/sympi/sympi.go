@@ -164,7 +164,7 @@ func LoadMPI(id string) error {
 }
 
 func getImagePath(containerDesc string, sysCfg *sys.Config) (string, error) {
-	containerInstallDir := filepath.Join(sys.GetSympiDir(), sys.ContainerInstallDirPrefix+containerDesc)
+	containerInstallDir := sys.GetWorkspacePath(sys.GetSympiDir(), sys.WorkspaceImagesDir, sys.ContainerInstallDirPrefix+containerDesc)
 	imgPath := filepath.Join(containerInstallDir, containerDesc+".sif")
 	if !util.FileExists(imgPath) {
 		return "", fmt.Errorf("%s does not exist", imgPath)
@@ -0,0 +1,260 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// SharedMemDir is the directory where the shared-memory segments of MPI are created
+	SharedMemDir = "/dev/shm"
+
+	// InfinibandDevicesDir is the directory of the Infiniband devices
+	InfinibandDevicesDir = "/dev/infiniband"
+
+	// userNamespacesSysctl is the maximum number of user namespaces, 0 when user namespaces are disabled
+	userNamespacesSysctl = "/proc/sys/user/max_user_namespaces"
+
+	// unprivilegedUserNamespacesSysctl specifies, on Debian-based distros, whether unprivileged users can create user namespaces
+	unprivilegedUserNamespacesSysctl = "/proc/sys/kernel/unprivileged_userns_clone"
+)
+
+var (
+	// nvidiaDevices are the devices created by the NVIDIA driver
+	nvidiaDevices = []string{"/dev/nvidiactl", "/dev/nvidia0"}
+
+	// amdDevices are the devices required by ROCm
+	amdDevices = []string{"/dev/kfd", "/dev/dri"}
+)
+
+// Requirements are the features of the host the execution of a container relies on
+type Requirements struct {
+	// NvidiaDevices specifies whether the NVIDIA GPUs must be available, e.g., for CUDA images
+	NvidiaDevices bool
+
+	// AMDDevices specifies whether the AMD GPUs must be available, e.g., for ROCm images
+	AMDDevices bool
+
+	// InfinibandDevices specifies whether the Infiniband devices must be available, e.g., for UCX images
+	InfinibandDevices bool
+
+	// UserNamespaces specifies whether unprivileged user namespaces must be enabled, e.g., when Singularity runs with -u
+	UserNamespaces bool
+
+	// MinSharedMemSize is the minimum size in bytes of /dev/shm, 0 if shared memory is not a concern
+	MinSharedMemSize int64
+}
+
+// RuntimeCheck is the result of the check of a requirement
+type RuntimeCheck struct {
+	// Name describes the requirement that was checked
+	Name string
+
+	// Passed specifies whether the requirement is met
+	Passed bool
+
+	// Details describes what was found on the host
+	Details string
+
+	// Remediation describes how to meet the requirement, when not met
+	Remediation string
+}
+
+// Report gathers the results of the checks of the runtime environment
+type Report struct {
+	// Checks are the results of each check, in the order they were performed
+	Checks []RuntimeCheck
+}
+
+// RuntimeProbes are the functions used to inspect the host, which can be replaced for testing
+type RuntimeProbes struct {
+	// PathExists checks whether a file or a device exists
+	PathExists func(path string) bool
+
+	// ReadFile returns the content of a file, e.g., a sysctl in /proc/sys
+	ReadFile func(path string) ([]byte, error)
+
+	// FilesystemSize returns the size in bytes of the file system mounted on a directory
+	FilesystemSize func(path string) (int64, error)
+}
+
+// pathExists checks whether a path exists
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// filesystemSize returns the size of a file system
+func filesystemSize(path string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Blocks) * int64(st.Bsize), nil
+}
+
+// runtimeProbes are the probes used by CheckRuntimeEnvironment
+var runtimeProbes = RuntimeProbes{
+	PathExists:     pathExists,
+	ReadFile:       ioutil.ReadFile,
+	FilesystemSize: filesystemSize,
+}
+
+// SetRuntimeProbes replaces the probes used to inspect the host and returns the previous ones
+func SetRuntimeProbes(p RuntimeProbes) RuntimeProbes {
+	previous := runtimeProbes
+	runtimeProbes = p
+	return previous
+}
+
+// checkDevices checks that at least one of the devices exists
+func checkDevices(name string, devices []string, remediation string) RuntimeCheck {
+	check := RuntimeCheck{Name: name, Remediation: remediation}
+	for _, dev := range devices {
+		if runtimeProbes.PathExists(dev) {
+			check.Passed = true
+			check.Details = dev + " is available"
+			return check
+		}
+	}
+	check.Details = "none of " + strings.Join(devices, ", ") + " is available"
+	return check
+}
+
+// readSysctl returns the integer value of a sysctl and whether it is available
+func readSysctl(path string) (int64, bool, error) {
+	if !runtimeProbes.PathExists(path) {
+		return 0, false, nil
+	}
+	d, err := runtimeProbes.ReadFile(path)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(d)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid value in %s: %s", path, err)
+	}
+	return value, true, nil
+}
+
+// checkUserNamespaces checks that unprivileged users can create user namespaces
+func checkUserNamespaces() (RuntimeCheck, error) {
+	check := RuntimeCheck{Name: "unprivileged user namespaces", Passed: true, Details: "user namespaces are enabled"}
+
+	max, ok, err := readSysctl(userNamespacesSysctl)
+	if err != nil {
+		return check, err
+	}
+	if ok && max == 0 {
+		check.Passed = false
+		check.Details = userNamespacesSysctl + " is 0"
+		check.Remediation = "enable user namespaces with 'sysctl user.max_user_namespaces=15000' or run without the nopriv option"
+		return check, nil
+	}
+
+	clone, ok, err := readSysctl(unprivilegedUserNamespacesSysctl)
+	if err != nil {
+		return check, err
+	}
+	if ok && clone == 0 {
+		check.Passed = false
+		check.Details = unprivilegedUserNamespacesSysctl + " is 0"
+		check.Remediation = "enable unprivileged user namespaces with 'sysctl kernel.unprivileged_userns_clone=1' or run without the nopriv option"
+	}
+	return check, nil
+}
+
+// checkSharedMemSize checks that the shared-memory file system is large enough
+func checkSharedMemSize(min int64) (RuntimeCheck, error) {
+	check := RuntimeCheck{Name: "size of " + SharedMemDir}
+	size, err := runtimeProbes.FilesystemSize(SharedMemDir)
+	if err != nil {
+		return check, fmt.Errorf("failed to get the size of %s: %s", SharedMemDir, err)
+	}
+	check.Details = fmt.Sprintf("%s is %d MiB", SharedMemDir, size>>20)
+	check.Passed = size >= min
+	if !check.Passed {
+		check.Remediation = fmt.Sprintf("increase the size of %s to at least %d MiB, e.g., 'mount -o remount,size=%dM %s'", SharedMemDir, min>>20, min>>20, SharedMemDir)
+	}
+	return check, nil
+}
+
+// CheckRuntimeEnvironment checks that the host provides what the execution of a container requires, so
+// environmental issues are reported before starting a job. An error is returned only when a check cannot
+// be performed; failed checks are listed in the report with the remediation.
+func CheckRuntimeEnvironment(requirements Requirements) (Report, error) {
+	var report Report
+
+	if requirements.MinSharedMemSize < 0 {
+		return report, fmt.Errorf("invalid minimum size of %s: %d", SharedMemDir, requirements.MinSharedMemSize)
+	}
+
+	if requirements.NvidiaDevices {
+		report.Checks = append(report.Checks, checkDevices("NVIDIA devices", nvidiaDevices, "load the NVIDIA driver or run on a node with NVIDIA GPUs"))
+	}
+	if requirements.AMDDevices {
+		report.Checks = append(report.Checks, checkDevices("AMD devices", amdDevices, "load the amdgpu driver or run on a node with AMD GPUs"))
+	}
+	if requirements.InfinibandDevices {
+		report.Checks = append(report.Checks, checkDevices("Infiniband devices", []string{InfinibandDevicesDir}, "load the Infiniband drivers (e.g., ib_uverbs) or use an image without UCX/Infiniband support"))
+	}
+	if requirements.UserNamespaces {
+		check, err := checkUserNamespaces()
+		if err != nil {
+			return report, err
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	if requirements.MinSharedMemSize > 0 {
+		check, err := checkSharedMemSize(requirements.MinSharedMemSize)
+		if err != nil {
+			return report, err
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	return report, nil
+}
+
+// Passed checks whether all the requirements are met
+func (r *Report) Passed() bool {
+	return len(r.Failed()) == 0
+}
+
+// Failed returns the checks that did not pass
+func (r *Report) Failed() []RuntimeCheck {
+	var failed []RuntimeCheck
+	for _, check := range r.Checks {
+		if !check.Passed {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+// String returns a human-readable version of the report, one line per check
+func (r *Report) String() string {
+	var lines []string
+	for _, check := range r.Checks {
+		status := "PASS"
+		if !check.Passed {
+			status = "FAIL"
+		}
+		line := "[" + status + "] " + check.Name + ": " + check.Details
+		if !check.Passed && check.Remediation != "" {
+			line += " (" + check.Remediation + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sys
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// getFakeProbes returns probes emulating a host with the given files and /dev/shm size
+func getFakeProbes(files map[string]string, shmSize int64) RuntimeProbes {
+	return RuntimeProbes{
+		PathExists: func(path string) bool {
+			_, ok := files[path]
+			return ok
+		},
+		ReadFile: func(path string) ([]byte, error) {
+			content, ok := files[path]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			return []byte(content), nil
+		},
+		FilesystemSize: func(path string) (int64, error) {
+			if path != SharedMemDir {
+				return 0, fmt.Errorf("unexpected file system: %s", path)
+			}
+			return shmSize, nil
+		},
+	}
+}
+
+func TestCheckRuntimeEnvironment(t *testing.T) {
+	defaultProbes := runtimeProbes
+	defer SetRuntimeProbes(defaultProbes)
+
+	allRequirements := Requirements{
+		NvidiaDevices:     true,
+		AMDDevices:        true,
+		InfinibandDevices: true,
+		UserNamespaces:    true,
+		MinSharedMemSize:  256 << 20,
+	}
+
+	tests := []struct {
+		name         string
+		requirements Requirements
+		files        map[string]string
+		shmSize      int64
+		failed       []string
+	}{
+		{
+			name:         "no requirement",
+			requirements: Requirements{},
+		},
+		{
+			name:         "capable host",
+			requirements: allRequirements,
+			files: map[string]string{
+				"/dev/nvidia0":       "",
+				"/dev/kfd":           "",
+				InfinibandDevicesDir: "",
+				userNamespacesSysctl: "15000\n",
+			},
+			shmSize: 1 << 30,
+		},
+		{
+			name:         "bare host",
+			requirements: allRequirements,
+			files: map[string]string{
+				userNamespacesSysctl: "0\n",
+			},
+			shmSize: 64 << 20,
+			failed:  []string{"NVIDIA devices", "AMD devices", "Infiniband devices", "unprivileged user namespaces", "size of " + SharedMemDir},
+		},
+		{
+			name:         "unprivileged user namespaces disabled",
+			requirements: Requirements{UserNamespaces: true},
+			files: map[string]string{
+				userNamespacesSysctl:             "15000\n",
+				unprivilegedUserNamespacesSysctl: "0\n",
+			},
+			failed: []string{"unprivileged user namespaces"},
+		},
+	}
+
+	for _, tt := range tests {
+		SetRuntimeProbes(getFakeProbes(tt.files, tt.shmSize))
+		report, err := CheckRuntimeEnvironment(tt.requirements)
+		if err != nil {
+			t.Fatalf("%s: failed to check runtime environment: %s", tt.name, err)
+		}
+
+		var failed []string
+		for _, check := range report.Failed() {
+			if check.Remediation == "" {
+				t.Fatalf("%s: no remediation for %s", tt.name, check.Name)
+			}
+			failed = append(failed, check.Name)
+		}
+		if strings.Join(failed, ",") != strings.Join(tt.failed, ",") {
+			t.Fatalf("%s: failed checks are %v instead of %v:\n%s", tt.name, failed, tt.failed, report.String())
+		}
+		if report.Passed() != (len(tt.failed) == 0) {
+			t.Fatalf("%s: report passed is %t", tt.name, report.Passed())
+		}
+	}
+
+	// Checks that cannot be performed are errors
+	SetRuntimeProbes(getFakeProbes(map[string]string{userNamespacesSysctl: "enabled"}, 0))
+	_, err := CheckRuntimeEnvironment(Requirements{UserNamespaces: true})
+	if err == nil {
+		t.Fatalf("invalid sysctl value accepted")
+	}
+	_, err = CheckRuntimeEnvironment(Requirements{MinSharedMemSize: -1})
+	if err == nil {
+		t.Fatalf("invalid shared-memory size accepted")
+	}
+}
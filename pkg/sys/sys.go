@@ -6,11 +6,13 @@
 package sys
 
 import (
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/sylabs/singularity-mpi/internal/pkg/sylog"
 )
 
 const (
@@ -88,6 +90,10 @@ type Config struct {
 	// SingularityBin is the path to the singularity binary
 	SingularityBin string
 
+	// GlobalSingularityFlags are the global flags passed to singularity before the command, e.g., --debug or -c
+	// followed by the path to a configuration file
+	GlobalSingularityFlags []string
+
 	// OutputFile is the path the output file
 	OutputFile string
 
@@ -130,17 +136,48 @@ type Config struct {
 	// IBEnables specifies whether Infiniband is currently enabled
 	IBEnabled bool
 
+	// ExposeIBDevices specifies whether the Infiniband devices (and the knem/xpmem devices when available) need to be bind-mounted in the container at execution time
+	ExposeIBDevices bool
+
 	// SyConfigFile
 	SyConfigFile string
 
 	// Nopriv specifies whether we need to use the '-u' option when running singularity
 	Nopriv bool
 
+	// Interconnect is the interconnect of the cluster (e.g., infiniband), used to warn about images tuned for another interconnect (optional)
+	Interconnect string
+
 	// SudoSyCmds is the list of Singularity commands that need to be executed with sudo
 	SudoSyCmds []string
 
 	// SudoBin is the path to sudo on the host
 	SudoBin string
+
+	// RetryTransient is the number of times a build is automatically retried when it fails because of the network
+	RetryTransient int
+
+	// SignTimeout is the maximum time the signature of an image can take (container.DefaultSignTimeout if not set)
+	SignTimeout time.Duration
+
+	// BuildArtifactsMaxAge is the age after which build directories are considered stale and can be cleaned up
+	BuildArtifactsMaxAge time.Duration
+
+	// PrepareOnly specifies whether we only prepare a build bundle instead of building images
+	PrepareOnly bool
+
+	// MinimalBase specifies whether images are based on a minimal Linux distribution, without compilers, when
+	// nothing needs to be compiled in the image, e.g., with the bind model
+	MinimalBase bool
+
+	// StrictPortability specifies whether the generation of definition files fails when the post section uses
+	// a directory that only exists on the host, e.g., the directory where the sources were downloaded
+	StrictPortability bool
+
+	// RepoSnapshot pins the packages installed in the images to a snapshot of the repositories of the Linux
+	// distribution: either a point in time, e.g., 20240101T000000Z, for the distributions with a known snapshot
+	// service (snapshot.ubuntu.com), or the URL of a snapshot mirror (optional)
+	RepoSnapshot string
 }
 
 // GetSympiDir returns the directory where MPI is installed and container images
@@ -156,13 +193,13 @@ func GetSympiDir() string {
 // ParseDistroID parses the string we use to identify a specific distro into a distribution name and its version
 func ParseDistroID(distro string) (string, string) {
 	if !strings.Contains(distro, ":") {
-		log.Printf("[WARN] %s an invalid distro ID\n", distro)
+		sylog.Warn("%s an invalid distro ID", distro)
 		return "", ""
 	}
 
 	tokens := strings.Split(distro, ":")
 	if len(tokens) != 2 {
-		log.Printf("[WARN] %s an invalid distro ID\n", distro)
+		sylog.Warn("%s an invalid distro ID", distro)
 		return "", ""
 	}
 
@@ -0,0 +1,288 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sys
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// WorkspaceImagesDir is the subdirectory of the workspace where container images are stored
+	WorkspaceImagesDir = "images"
+
+	// WorkspaceDefFilesDir is the subdirectory of the workspace where the definition files used to build images are stored
+	WorkspaceDefFilesDir = "deffiles"
+
+	// WorkspaceIndexFile is the name of the file listing the content of the workspace
+	WorkspaceIndexFile = "index.json"
+
+	// workspaceIndexVersion is the version of the format of the index of the workspace
+	workspaceIndexVersion = 1
+)
+
+// workspaceDirs is the list of the subdirectories of a workspace
+var workspaceDirs = []string{WorkspaceImagesDir, WorkspaceDefFilesDir}
+
+// WorkspaceEntry describes an element stored in a workspace
+type WorkspaceEntry struct {
+	// Dir is the subdirectory of the workspace the entry belongs to
+	Dir string `json:"dir"`
+
+	// Name is the name of the file or directory of the entry
+	Name string `json:"name"`
+
+	// Legacy specifies whether the entry is still stored at the root of the workspace (legacy flat layout)
+	Legacy bool `json:"legacy,omitempty"`
+}
+
+// WorkspaceIndex is the content of the index of a workspace
+type WorkspaceIndex struct {
+	// Version is the version of the format of the index
+	Version int `json:"version"`
+
+	// Entries is the list of the elements stored in the workspace
+	Entries []WorkspaceEntry `json:"entries"`
+}
+
+// WorkspaceUsage is the disk usage of a subdirectory of a workspace
+type WorkspaceUsage struct {
+	// Dir is the subdirectory of the workspace
+	Dir string
+
+	// Size is the disk usage of the subdirectory in bytes, including the legacy entries adopted in place
+	Size int64
+}
+
+// getLegacyEntryDir returns the subdirectory of the workspace where an element stored at the
+// root of a workspace belongs, an empty string if it is not part of the workspace (e.g., MPI
+// installations on the host)
+func getLegacyEntryDir(entry os.FileInfo) string {
+	name := entry.Name()
+	if entry.IsDir() {
+		if strings.HasPrefix(name, ContainerInstallDirPrefix) {
+			return WorkspaceImagesDir
+		}
+		return ""
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".sif"):
+		return WorkspaceImagesDir
+	case strings.HasSuffix(name, ".def"):
+		return WorkspaceDefFilesDir
+	}
+	return ""
+}
+
+// getLegacyEntries returns the elements stored at the root of a workspace that belong to one of its subdirectories
+func getLegacyEntries(root string) ([]WorkspaceEntry, error) {
+	var entries []WorkspaceEntry
+
+	content, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", root, err)
+	}
+	for _, entry := range content {
+		dir := getLegacyEntryDir(entry)
+		if dir != "" {
+			entries = append(entries, WorkspaceEntry{Dir: dir, Name: entry.Name(), Legacy: true})
+		}
+	}
+
+	return entries, nil
+}
+
+// IsLegacyWorkspace checks whether some of the elements of a workspace are still stored at its root (legacy flat layout)
+func IsLegacyWorkspace(root string) (bool, error) {
+	entries, err := getLegacyEntries(root)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+// InitWorkspace creates the layout of a workspace and its index. Elements stored at the root of
+// the workspace by previous versions are adopted in place; Migrate() moves them into the layout.
+func InitWorkspace(root string) error {
+	for _, dir := range workspaceDirs {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", filepath.Join(root, dir), err)
+		}
+	}
+
+	return UpdateWorkspaceIndex(root)
+}
+
+// GetWorkspaceDir returns the path to a subdirectory of a workspace
+func GetWorkspaceDir(root string, dir string) string {
+	return filepath.Join(root, dir)
+}
+
+// GetWorkspacePath returns the path to an element of a workspace. If the element is still stored
+// at the root of the workspace, i.e., has not been migrated yet, the path to the legacy location
+// is returned.
+func GetWorkspacePath(root string, dir string, name string) string {
+	path := filepath.Join(root, dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+
+	legacyPath := filepath.Join(root, name)
+	if info, err := os.Stat(legacyPath); err == nil && getLegacyEntryDir(info) == dir {
+		return legacyPath
+	}
+
+	return path
+}
+
+// UpdateWorkspaceIndex scans a workspace and updates its index accordingly
+func UpdateWorkspaceIndex(root string) error {
+	index := WorkspaceIndex{Version: workspaceIndexVersion}
+
+	for _, dir := range workspaceDirs {
+		content, err := ioutil.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", filepath.Join(root, dir), err)
+		}
+		for _, entry := range content {
+			index.Entries = append(index.Entries, WorkspaceEntry{Dir: dir, Name: entry.Name()})
+		}
+	}
+
+	legacyEntries, err := getLegacyEntries(root)
+	if err != nil {
+		return err
+	}
+	index.Entries = append(index.Entries, legacyEntries...)
+
+	sort.Slice(index.Entries, func(i, j int) bool {
+		if index.Entries[i].Dir != index.Entries[j].Dir {
+			return index.Entries[i].Dir < index.Entries[j].Dir
+		}
+		return index.Entries[i].Name < index.Entries[j].Name
+	})
+
+	data, err := json.MarshalIndent(index, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode the index of %s: %s", root, err)
+	}
+
+	indexFile := filepath.Join(root, WorkspaceIndexFile)
+	err = ioutil.WriteFile(indexFile, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", indexFile, err)
+	}
+
+	return nil
+}
+
+// LoadWorkspaceIndex reads the index of a workspace
+func LoadWorkspaceIndex(root string) (WorkspaceIndex, error) {
+	var index WorkspaceIndex
+
+	indexFile := filepath.Join(root, WorkspaceIndexFile)
+	data, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		return index, fmt.Errorf("failed to read %s: %s", indexFile, err)
+	}
+
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return index, fmt.Errorf("failed to parse %s: %s", indexFile, err)
+	}
+
+	return index, nil
+}
+
+// Migrate moves the elements stored at the root of a workspace (legacy flat layout) into the
+// layout of the workspace. Elements that already exist in the layout, for instance because of
+// a previous partial migration, are left in place.
+func Migrate(root string) error {
+	err := InitWorkspace(root)
+	if err != nil {
+		return err
+	}
+
+	entries, err := getLegacyEntries(root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		src := filepath.Join(root, entry.Name)
+		dst := filepath.Join(root, entry.Dir, entry.Name)
+		if _, err := os.Stat(dst); err == nil {
+			log.Printf("[WARN] %s already exists, leaving %s in place", dst, src)
+			continue
+		}
+
+		log.Printf("-> Moving %s to %s", src, dst)
+		err = os.Rename(src, dst)
+		if err != nil {
+			return fmt.Errorf("failed to move %s to %s: %s", src, dst, err)
+		}
+	}
+
+	return UpdateWorkspaceIndex(root)
+}
+
+// getDiskUsage returns the size of a file or of the content of a directory
+func getDiskUsage(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// WorkspaceInfo returns the disk usage of each subdirectory of a workspace
+func WorkspaceInfo(root string) ([]WorkspaceUsage, error) {
+	var usage []WorkspaceUsage
+
+	legacyEntries, err := getLegacyEntries(root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range workspaceDirs {
+		var size int64
+		path := filepath.Join(root, dir)
+		if _, err := os.Stat(path); err == nil {
+			size, err = getDiskUsage(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the disk usage of %s: %s", path, err)
+			}
+		}
+
+		for _, entry := range legacyEntries {
+			if entry.Dir != dir {
+				continue
+			}
+			legacySize, err := getDiskUsage(filepath.Join(root, entry.Name))
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the disk usage of %s: %s", filepath.Join(root, entry.Name), err)
+			}
+			size += legacySize
+		}
+
+		usage = append(usage, WorkspaceUsage{Dir: dir, Size: size})
+	}
+
+	return usage, nil
+}
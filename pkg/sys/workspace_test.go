@@ -0,0 +1,174 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createWorkspaceFile(t *testing.T, path string, size int) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", filepath.Dir(path), err)
+	}
+	err = ioutil.WriteFile(path, make([]byte, size), 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", path, err)
+	}
+}
+
+func getIndexedEntries(t *testing.T, root string) map[string]WorkspaceEntry {
+	index, err := LoadWorkspaceIndex(root)
+	if err != nil {
+		t.Fatalf("failed to load index: %s", err)
+	}
+	entries := make(map[string]WorkspaceEntry)
+	for _, e := range index.Entries {
+		entries[e.Name] = e
+	}
+	return entries
+}
+
+func TestWorkspace(t *testing.T) {
+	tests := []struct {
+		name           string
+		files          map[string]int
+		expectedLegacy bool
+		expectedUsage  map[string]int64
+		expectedPaths  map[string]string
+	}{
+		{
+			name:          "fresh",
+			expectedUsage: map[string]int64{WorkspaceImagesDir: 0, WorkspaceDefFilesDir: 0},
+			expectedPaths: map[string]string{ContainerInstallDirPrefix + "helloworld": filepath.Join(WorkspaceImagesDir, ContainerInstallDirPrefix+"helloworld")},
+		},
+		{
+			name: "legacy",
+			files: map[string]int{
+				filepath.Join(ContainerInstallDirPrefix+"helloworld", "helloworld.sif"): 10,
+				"helloworld.def": 3,
+				MPIInstallDirPrefix + "openmpi-4.0.2/bin/mpiexec": 5,
+			},
+			expectedLegacy: true,
+			expectedUsage:  map[string]int64{WorkspaceImagesDir: 10, WorkspaceDefFilesDir: 3},
+			expectedPaths:  map[string]string{ContainerInstallDirPrefix + "helloworld": ContainerInstallDirPrefix + "helloworld"},
+		},
+		{
+			name: "partially migrated",
+			files: map[string]int{
+				filepath.Join(WorkspaceImagesDir, ContainerInstallDirPrefix+"netpipe", "netpipe.sif"): 7,
+				filepath.Join(ContainerInstallDirPrefix+"helloworld", "helloworld.sif"):               10,
+			},
+			expectedLegacy: true,
+			expectedUsage:  map[string]int64{WorkspaceImagesDir: 17, WorkspaceDefFilesDir: 0},
+			expectedPaths: map[string]string{
+				ContainerInstallDirPrefix + "helloworld": ContainerInstallDirPrefix + "helloworld",
+				ContainerInstallDirPrefix + "netpipe":    filepath.Join(WorkspaceImagesDir, ContainerInstallDirPrefix+"netpipe"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("failed to create temporary directory: %s", err)
+			}
+			defer os.RemoveAll(root)
+
+			for file, size := range tt.files {
+				createWorkspaceFile(t, filepath.Join(root, file), size)
+			}
+
+			legacy, err := IsLegacyWorkspace(root)
+			if err != nil {
+				t.Fatalf("failed to detect layout: %s", err)
+			}
+			if legacy != tt.expectedLegacy {
+				t.Fatalf("legacy layout detection returned %t instead of %t", legacy, tt.expectedLegacy)
+			}
+
+			err = InitWorkspace(root)
+			if err != nil {
+				t.Fatalf("failed to initialize workspace: %s", err)
+			}
+			for _, dir := range workspaceDirs {
+				if _, err := os.Stat(filepath.Join(root, dir)); err != nil {
+					t.Fatalf("%s was not created: %s", dir, err)
+				}
+			}
+
+			// Legacy entries are adopted in place
+			for name, expected := range tt.expectedPaths {
+				path := GetWorkspacePath(root, WorkspaceImagesDir, name)
+				if path != filepath.Join(root, expected) {
+					t.Fatalf("path of %s is %s instead of %s", name, path, filepath.Join(root, expected))
+				}
+			}
+			entries := getIndexedEntries(t, root)
+			if _, ok := entries[MPIInstallDirPrefix+"openmpi-4.0.2"]; ok {
+				t.Fatalf("MPI installation was added to the index")
+			}
+			if e, ok := entries[ContainerInstallDirPrefix+"helloworld"]; tt.expectedLegacy && (!ok || !e.Legacy) {
+				t.Fatalf("legacy image was not adopted: %v", entries)
+			}
+
+			usage, err := WorkspaceInfo(root)
+			if err != nil {
+				t.Fatalf("failed to get disk usage: %s", err)
+			}
+			for _, u := range usage {
+				if expected, ok := tt.expectedUsage[u.Dir]; ok && u.Size != expected {
+					t.Fatalf("disk usage of %s is %d instead of %d", u.Dir, u.Size, expected)
+				}
+			}
+
+			err = Migrate(root)
+			if err != nil {
+				t.Fatalf("failed to migrate workspace: %s", err)
+			}
+			legacy, err = IsLegacyWorkspace(root)
+			if err != nil {
+				t.Fatalf("failed to detect layout: %s", err)
+			}
+			if legacy {
+				t.Fatalf("workspace still has a legacy layout after migration")
+			}
+			for name := range tt.expectedPaths {
+				path := GetWorkspacePath(root, WorkspaceImagesDir, name)
+				if path != filepath.Join(root, WorkspaceImagesDir, name) {
+					t.Fatalf("path of %s is %s after migration", name, path)
+				}
+			}
+			for name, e := range getIndexedEntries(t, root) {
+				if e.Legacy {
+					t.Fatalf("%s is still a legacy entry after migration", name)
+				}
+			}
+			for file := range tt.files {
+				if filepath.Dir(filepath.Dir(file)) != MPIInstallDirPrefix+"openmpi-4.0.2" {
+					continue
+				}
+				if _, err := os.Stat(filepath.Join(root, file)); err != nil {
+					t.Fatalf("MPI installation was moved: %s", err)
+				}
+			}
+
+			usage, err = WorkspaceInfo(root)
+			if err != nil {
+				t.Fatalf("failed to get disk usage: %s", err)
+			}
+			for _, u := range usage {
+				if expected, ok := tt.expectedUsage[u.Dir]; ok && u.Size != expected {
+					t.Fatalf("disk usage of %s is %d instead of %d after migration", u.Dir, u.Size, expected)
+				}
+			}
+		})
+	}
+}